@@ -2,6 +2,7 @@ package config
 
 import (
 	"encoding/json"
+	"net"
 	"os"
 	"path"
 	"time"
@@ -22,6 +23,73 @@ type DaemonConfig struct {
 type MetadataServiceConfig struct {
 	Protocol string `json omitempty`
 	Address  string `json omitempty`
+	// PEM files for TLS, used if Protocol is https. The server certificate
+	// must be signed by CACert, and ClientCert/ClientKey authenticate the
+	// daemon to the server. Rotated files are picked up without a restart.
+	CACert     string `json:"ca_cert,omitempty"`
+	ClientCert string `json:"client_cert,omitempty"`
+	ClientKey  string `json:"client_key,omitempty"`
+	ServerName string `json:"server_name,omitempty"`
+	// version of the wire protocol, 1 or 2. Negotiated with the server if 0.
+	ProtocolVersion int `json:"protocol_version,omitempty"`
+	// IMDSv2 session tokens for the instance IPs: IMDS_V1, IMDS_OPTIONAL to
+	// fall back to v1 if the server has no tokens, or IMDS_REQUIRED. Tokens
+	// last ImdsTokenTTL seconds.
+	Imds         string        `json:"imds,omitempty"`
+	ImdsTokenTTL time.Duration `json:"imds_token_ttl,omitempty"`
+	// requests are signed with the key in SigningKey if set, either a PEM
+	// ed25519 private key or an HMAC secret. The key id defaults to the host
+	// name.
+	SigningKey   string `json:"signing_key,omitempty"`
+	SigningKeyId string `json:"signing_key_id,omitempty"`
+	// seconds a metadata call may take
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// mutations of all containers are buffered and sent in one batch when
+	// BatchSize of them are collected, or every BatchInterval milliseconds.
+	// Buffering is disabled if BatchSize is 0.
+	BatchSize     int           `json:"batch_size,omitempty"`
+	BatchInterval time.Duration `json:"batch_interval,omitempty"`
+	// idempotent calls finding the server unavailable are retried Retries
+	// times, the first time after RetryDelay milliseconds, doubled every
+	// time up to RetryMaxDelay. After BreakerThreshold failures in a row no
+	// call is made for BreakerTimeout seconds. Both are off if 0.
+	Retries          int           `json:"retries,omitempty"`
+	RetryDelay       time.Duration `json:"retry_delay,omitempty"`
+	RetryMaxDelay    time.Duration `json:"retry_max_delay,omitempty"`
+	BreakerThreshold int           `json:"breaker_threshold,omitempty"`
+	BreakerTimeout   time.Duration `json:"breaker_timeout,omitempty"`
+	// calls per second to the server, with bursts of up to the burst size.
+	// Reads and mutations have separate budgets, unlimited if the rate is 0.
+	ReadRate      float64 `json:"read_rate,omitempty"`
+	ReadBurst     int     `json:"read_burst,omitempty"`
+	MutationRate  float64 `json:"mutation_rate,omitempty"`
+	MutationBurst int     `json:"mutation_burst,omitempty"`
+	// every metadata call is appended to RecordFile as a line of JSON, to
+	// be replayed later with statement.ReplayApi. Off if empty.
+	RecordFile string `json:"record_file,omitempty"`
+}
+
+// where the identity of the instance comes from: INSTANCE_OPENSTACK for the
+// metadata service, a public cloud's instance metadata, INSTANCE_STATIC for
+// the IPs and ns configured here, or INSTANCE_AUTO to detect the cloud.
+// Address overrides where the cloud serves its instance metadata. Global
+// IPv6 addresses are taken from the interface of the local IP if the
+// provider has none.
+type InstanceConfig struct {
+	Provider string   `json:"provider,omitempty"`
+	Address  string   `json:"address,omitempty"`
+	LocalIp  string   `json:"local_ip,omitempty"`
+	PublicIp string   `json:"public_ip,omitempty"`
+	Ipv6     []string `json:"ipv6,omitempty"`
+	Ns       string   `json:"ns,omitempty"`
+}
+
+// a pool of static ports from Min to Max, Max excluded. Containers not
+// asking for a size get PortPerContainer ports, the global one if not set.
+type PortPoolConfig struct {
+	Min              int `json:"min"`
+	Max              int `json:"max"`
+	PortPerContainer int `json:"port_per_container,omitempty"`
 }
 
 type TapconConfig struct {
@@ -32,16 +100,100 @@ type TapconConfig struct {
 	PortPerContainer int    `json:"port_per_container,omitempty"`
 	LogLevel         int    `json:"log_level,omitempty"`
 	LogPath          string `json:"log_path,omitempty"`
+	// pools containers pick by name with a label, besides DEFAULT_PORT_POOL
+	// of StaticPortBase to StaticPortMax
+	PortPools map[string]PortPoolConfig `json:"port_pools,omitempty"`
+	// what to do with principals of images removed from docker, either
+	// STALE_IMAGE_DELETE or STALE_IMAGE_RETIRE
+	StaleImagePolicy string `json:"stale_image_policy,omitempty"`
+	// docker storage driver, detected from docker's layout if not set
+	StorageDriver string `json:"storage_driver,omitempty"`
+	// docker API socket, and the drivers of the networks getting a
+	// namespace, all but bridge, host and null if empty
+	DockerSocket   string   `json:"docker_socket,omitempty"`
+	NetworkDrivers []string `json:"network_drivers,omitempty"`
+	// identity of the instance the daemon runs on
+	Instance InstanceConfig `json:"instance,omitempty"`
+	// firewall the container rules go to, SANDBOX_IPTABLES or
+	// SANDBOX_NFTABLES, detected from the host if SANDBOX_AUTO or not set
+	Sandbox string `json:"sandbox,omitempty"`
+	// containers reach this address only once their principal is
+	// reconciled, DEFAULT_METADATA_GUARD if not set. METADATA_GUARD_OFF lets
+	// every container reach it.
+	MetadataGuard string `json:"metadata_guard,omitempty"`
 }
 
 const (
 	DEFAULT_STATIC_PORT_BASE  = 15000
 	DEFAULT_NUM_PER_CONTAINER = 100
 	DEFAULT_STATIC_PORT_MAX   = 35000
+	DEFAULT_PORT_POOL         = "default"
+
+	DEFAULT_BATCH_INTERVAL   = 100
+	DEFAULT_METADATA_TIMEOUT = 10
+
+	METADATA_HTTP  = "http"
+	METADATA_HTTPS = "https"
+
+	IMDS_V1                = "v1"
+	IMDS_OPTIONAL          = "optional"
+	IMDS_REQUIRED          = "required"
+	DEFAULT_IMDS_TOKEN_TTL = 21600
+
+	INSTANCE_AUTO      = "auto"
+	INSTANCE_OPENSTACK = "openstack"
+	INSTANCE_AWS       = "aws"
+	INSTANCE_GCP       = "gcp"
+	INSTANCE_AZURE     = "azure"
+	INSTANCE_STATIC    = "static"
+
+	DEFAULT_RETRY_DELAY     = 100
+	DEFAULT_RETRY_MAX_DELAY = 5000
+	DEFAULT_BREAKER_TIMEOUT = 30
+
+	STALE_IMAGE_DELETE         = "delete"
+	STALE_IMAGE_RETIRE         = "retire"
+	DEFAULT_STALE_IMAGE_POLICY = STALE_IMAGE_DELETE
+
+	SANDBOX_AUTO     = "auto"
+	SANDBOX_IPTABLES = "iptables"
+	SANDBOX_NFTABLES = "nftables"
+
+	DEFAULT_METADATA_GUARD = "169.254.169.254"
+	METADATA_GUARD_OFF     = "off"
 )
 
 var Config *TapconConfig
 
+// validatePortPools fills the sizes of the pools and checks no two of them
+// share a port.
+func validatePortPools() {
+	pools := map[string]PortPoolConfig{DEFAULT_PORT_POOL: {
+		Min: Config.StaticPortBase,
+		Max: Config.StaticPortMax,
+	}}
+	for name, pool := range Config.PortPools {
+		if name == DEFAULT_PORT_POOL {
+			log.Fatalf("port pool %s is the static port base and max", name)
+		}
+		if pool.Min <= 0 || pool.Max <= pool.Min || pool.Max > 65536 {
+			log.Fatalf("invalid port pool %s %d-%d", name, pool.Min, pool.Max)
+		}
+		if pool.PortPerContainer == 0 {
+			pool.PortPerContainer = Config.PortPerContainer
+			Config.PortPools[name] = pool
+		}
+		pools[name] = pool
+	}
+	for name, pool := range pools {
+		for other, o := range pools {
+			if name < other && pool.Min < o.Max && o.Min < pool.Max {
+				log.Fatalf("port pools %s and %s overlap", name, other)
+			}
+		}
+	}
+}
+
 func InitConf(config_path string) {
 	conf_file := path.Join(config_path, CONFIG_FILE)
 	f, err := os.Open(conf_file)
@@ -63,6 +215,73 @@ func InitConf(config_path string) {
 	if Config.PortPerContainer == 0 {
 		Config.PortPerContainer = DEFAULT_NUM_PER_CONTAINER
 	}
+	validatePortPools()
+	if Config.Metadata.Protocol == "" {
+		Config.Metadata.Protocol = METADATA_HTTP
+	} else if Config.Metadata.Protocol != METADATA_HTTP &&
+		Config.Metadata.Protocol != METADATA_HTTPS {
+		log.Fatalf("unknown metadata protocol %s", Config.Metadata.Protocol)
+	}
+	if v := Config.Metadata.ProtocolVersion; v < 0 || v > 2 {
+		log.Fatalf("unknown metadata protocol version %d", v)
+	}
+	if Config.Metadata.Imds == "" {
+		Config.Metadata.Imds = IMDS_OPTIONAL
+	} else if Config.Metadata.Imds != IMDS_V1 &&
+		Config.Metadata.Imds != IMDS_OPTIONAL &&
+		Config.Metadata.Imds != IMDS_REQUIRED {
+		log.Fatalf("unknown imds mode %s", Config.Metadata.Imds)
+	}
+	if Config.Metadata.ImdsTokenTTL == 0 {
+		Config.Metadata.ImdsTokenTTL = DEFAULT_IMDS_TOKEN_TTL
+	}
+	switch Config.Instance.Provider {
+	case "":
+		Config.Instance.Provider = INSTANCE_OPENSTACK
+	case INSTANCE_AUTO, INSTANCE_OPENSTACK, INSTANCE_AWS, INSTANCE_GCP,
+		INSTANCE_AZURE:
+	case INSTANCE_STATIC:
+		if Config.Instance.LocalIp == "" {
+			log.Fatalf("static instance provider without local ip")
+		}
+	default:
+		log.Fatalf("unknown instance provider %s", Config.Instance.Provider)
+	}
+	if Config.Metadata.Timeout == 0 {
+		Config.Metadata.Timeout = DEFAULT_METADATA_TIMEOUT
+	}
+	if Config.Metadata.BatchInterval == 0 {
+		Config.Metadata.BatchInterval = DEFAULT_BATCH_INTERVAL
+	}
+	if Config.Metadata.RetryDelay == 0 {
+		Config.Metadata.RetryDelay = DEFAULT_RETRY_DELAY
+	}
+	if Config.Metadata.RetryMaxDelay == 0 {
+		Config.Metadata.RetryMaxDelay = DEFAULT_RETRY_MAX_DELAY
+	}
+	if Config.Metadata.BreakerTimeout == 0 {
+		Config.Metadata.BreakerTimeout = DEFAULT_BREAKER_TIMEOUT
+	}
+	if Config.StaleImagePolicy == "" {
+		Config.StaleImagePolicy = DEFAULT_STALE_IMAGE_POLICY
+	} else if Config.StaleImagePolicy != STALE_IMAGE_DELETE &&
+		Config.StaleImagePolicy != STALE_IMAGE_RETIRE {
+		log.Fatalf("unknown stale image policy %s", Config.StaleImagePolicy)
+	}
+	switch Config.Sandbox {
+	case "":
+		Config.Sandbox = SANDBOX_AUTO
+	case SANDBOX_AUTO, SANDBOX_IPTABLES, SANDBOX_NFTABLES:
+	default:
+		log.Fatalf("unknown sandbox %s", Config.Sandbox)
+	}
+	if Config.MetadataGuard == "" {
+		Config.MetadataGuard = DEFAULT_METADATA_GUARD
+	} else if Config.MetadataGuard != METADATA_GUARD_OFF &&
+		net.ParseIP(Config.MetadataGuard).To4() == nil {
+		log.Fatalf("metadata guard %s is not an IPv4 address",
+			Config.MetadataGuard)
+	}
 	if Config.LogLevel == 0 {
 		log.SetLevel(log.DebugLevel)
 	} else if Config.LogLevel == 1 {
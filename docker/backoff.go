@@ -0,0 +1,139 @@
+package docker
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	tapcon_config "github.com/jerryz920/tapcon-monitor/config"
+	metadata "github.com/jerryz920/tapcon-monitor/statement"
+)
+
+const (
+	MIN_SERVER_BACKOFF = 1 * time.Second
+	MAX_SERVER_BACKOFF = 64 * time.Second
+)
+
+// serverBackoff pauses reconciliation while the metadata server is
+// unavailable. The zero value is ready to use and not backing off.
+type serverBackoff struct {
+	lock  sync.Mutex
+	delay time.Duration
+	until time.Time
+}
+
+// Failed starts backing off, or doubles the pause if already backing off.
+func (b *serverBackoff) Failed() time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.delay == 0 {
+		b.delay = MIN_SERVER_BACKOFF
+	} else if b.delay < MAX_SERVER_BACKOFF {
+		b.delay *= 2
+		if b.delay > MAX_SERVER_BACKOFF {
+			b.delay = MAX_SERVER_BACKOFF
+		}
+	}
+	b.until = time.Now().Add(b.delay)
+	return b.delay
+}
+
+// PauseFor backs off for the duration, regardless of failures counted.
+func (b *serverBackoff) PauseFor(d time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if until := time.Now().Add(d); until.After(b.until) {
+		b.until = until
+	}
+}
+
+func (b *serverBackoff) Succeeded() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.delay = 0
+	b.until = time.Time{}
+}
+
+// Remaining is how long to wait before talking to the server again.
+func (b *serverBackoff) Remaining() time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if wait := time.Until(b.until); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// setupRetry wraps the metadata api with retries and a circuit breaker if
+// configured. Reconciliation pauses while the breaker is open.
+func (m *Monitor) setupRetry(conf tapcon_config.MetadataServiceConfig) {
+	if conf.Retries == 0 && conf.BreakerThreshold == 0 {
+		return
+	}
+	timeout := conf.BreakerTimeout * time.Second
+	m.breaker = metadata.NewRetryApi(m.ctx, m.MetadataApi,
+		metadata.RetryConfig{
+			Retries:          conf.Retries,
+			BaseDelay:        conf.RetryDelay * time.Millisecond,
+			MaxDelay:         conf.RetryMaxDelay * time.Millisecond,
+			BreakerThreshold: conf.BreakerThreshold,
+			BreakerTimeout:   timeout,
+		})
+	m.breaker.OnStateChange(func(state metadata.BreakerState) {
+		m.breakerChanged(state, timeout)
+	})
+	m.MetadataApi = m.breaker
+}
+
+func (m *Monitor) breakerChanged(state metadata.BreakerState,
+	timeout time.Duration) {
+	switch state {
+	case metadata.BreakerOpen:
+		log.Warnf("metadata api breaker open, pausing reconciliation for %v",
+			timeout)
+		m.backoff.PauseFor(timeout)
+	case metadata.BreakerClosed:
+		log.Infof("metadata api breaker closed, resuming reconciliation")
+		m.backoff.Succeeded()
+	}
+}
+
+// BreakerState is the state of the metadata api circuit breaker, always
+// closed if there is no breaker.
+func (m *Monitor) BreakerState() metadata.BreakerState {
+	if m.breaker == nil {
+		return metadata.BreakerClosed
+	}
+	return m.breaker.State()
+}
+
+// retryLater asks the keeper of the container to reconcile again after the
+// wait. Only one retry is pending for a container at any time.
+func (m *Monitor) retryLater(c *MemContainer, wait time.Duration) {
+	if !atomic.CompareAndSwapInt32(&c.retryPending, 0, 1) {
+		return
+	}
+	time.AfterFunc(wait, func() {
+		atomic.StoreInt32(&c.retryPending, 0)
+		c.EventChan <- NEED_UPDATE
+	})
+}
+
+// checkServer updates the backoff with the result of talking to the server,
+// and schedules a retry of the container if the server is unavailable.
+func (m *Monitor) checkServer(c *MemContainer, err error) {
+	switch {
+	case err == nil:
+		m.backoff.Succeeded()
+	case errorHasKind(err, metadata.ErrUnavailable):
+		wait := m.backoff.Failed()
+		log.Warnf("metadata server unavailable, retry %s in %v: %v", c.Id,
+			wait, err)
+		m.retryLater(c, wait)
+	case errorHasKind(err, metadata.ErrUnauthorized):
+		log.Errorf("not authorized to reconcile %s: %v", c.Id, err)
+	default:
+		log.Errorf("reconciling %s: %v", c.Id, err)
+	}
+}
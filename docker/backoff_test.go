@@ -0,0 +1,49 @@
+package docker
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	metadata "github.com/jerryz920/tapcon-monitor/statement"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerBackoff(t *testing.T) {
+	b := &serverBackoff{}
+	assert.Equal(t, time.Duration(0), b.Remaining(), "not backing off")
+	assert.Equal(t, MIN_SERVER_BACKOFF, b.Failed(), "first pause")
+	assert.Equal(t, 2*MIN_SERVER_BACKOFF, b.Failed(), "doubled")
+	assert.True(t, b.Remaining() > MIN_SERVER_BACKOFF, "backing off")
+	for i := 0; i < 10; i++ {
+		b.Failed()
+	}
+	assert.Equal(t, MAX_SERVER_BACKOFF, b.Failed(), "limited")
+	b.Succeeded()
+	assert.Equal(t, time.Duration(0), b.Remaining(), "reset")
+}
+
+func TestCheckServer(t *testing.T) {
+	m := &Monitor{}
+	c := NewMemContainer("c1", "/tmp/c1", "localns")
+	unavailable := &ReconcileError{Errors: []error{errors.New("other"),
+		&metadata.ApiError{Kind: metadata.ErrUnavailable}}}
+
+	m.checkServer(c, errors.New("other"))
+	assert.Equal(t, time.Duration(0), m.backoff.Remaining(), "not backing off")
+	m.checkServer(c, unavailable)
+	assert.True(t, m.backoff.Remaining() > 0, "backing off")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&c.retryPending), "retry scheduled")
+	m.checkServer(c, nil)
+	assert.Equal(t, time.Duration(0), m.backoff.Remaining(), "recovered")
+}
+
+func TestBreakerPausesReconciliation(t *testing.T) {
+	m := &Monitor{}
+	assert.Equal(t, metadata.BreakerClosed, m.BreakerState(), "no breaker")
+	m.breakerChanged(metadata.BreakerOpen, time.Minute)
+	assert.True(t, m.backoff.Remaining() > 30*time.Second, "paused")
+	m.breakerChanged(metadata.BreakerClosed, time.Minute)
+	assert.Equal(t, time.Duration(0), m.backoff.Remaining(), "resumed")
+}
@@ -18,6 +18,7 @@ type ReconcileCache interface {
 
 type reconcileCache struct {
 	api         metadata.MetadataAPI
+	batcher     metadata.Batcher
 	c           *MemContainer
 	serverState *metadata.Principal
 }
@@ -26,7 +27,12 @@ func (r *reconcileCache) Refresh() error {
 	cid := tapconContainerId(r.c)
 	p, err := r.api.ShowPrincipal(cid)
 	if err != nil {
-		if r.serverState != nil {
+		if metadata.IsNotFound(err) && r.serverState != nil {
+			/// dropped by the server, e.g. restarted without persistence.
+			// Forget the cache so the next Create makes it again.
+			log.Warnf("principal %s lost at server side, to recreate", cid)
+			r.serverState = nil
+		} else if r.serverState != nil {
 			log.Errorf("cache exists, but at server side: %s", err)
 		} else {
 			log.Debugf("unsynced principal in show: %s", err)
@@ -37,112 +43,153 @@ func (r *reconcileCache) Refresh() error {
 	return nil
 }
 
-func (r *reconcileCache) ReconcileFactStatement() error {
-	/// defensive
-	if r.serverState == nil {
-		return fmt.Errorf("must have valid server state to call this\n")
+type factItem metadata.EndorsedStatement
+
+func (f factItem) Key() string {
+	return f.Fact
+}
+
+func factStatements(items []reconcileItem) []metadata.Statement {
+	result := make([]metadata.Statement, 0, len(items))
+	for _, item := range items {
+		result = append(result, metadata.Statement(item.(factItem).Fact))
 	}
-	cid := tapconContainerId(r.c)
+	return result
+}
 
-	/// check statements
+func (r *reconcileCache) factPlan(state *metadata.Principal) *reconcilePlan {
+	cid := tapconContainerId(r.c)
 	facts := r.c.ContainerFacts()
-	toPost := make([]metadata.Statement, 0, len(facts))
-	for _, fclient := range facts {
-		found := false
-		for _, fserver := range r.serverState.Statements {
-			if string(fclient) == fserver.Fact {
-				log.Debugf("statement %s existed", fclient)
-				break
-			}
-		}
-		if !found {
-			toPost = append(toPost, fclient)
-			break
-		}
+	client := make([]reconcileItem, 0, len(facts))
+	for _, f := range facts {
+		// We don't care about endorser here
+		client = append(client, factItem{Endorser: "", Fact: string(f)})
 	}
-	if len(toPost) > 0 {
-		for _, f := range toPost {
-			// We don't care about endorser here
-			s := metadata.EndorsedStatement{Endorser: "", Fact: string(f)}
-			r.serverState.Statements = append(r.serverState.Statements, s)
-		}
-		return r.api.PostProofForChild(cid, toPost)
+	server := make([]reconcileItem, 0, len(state.Statements))
+	for _, s := range state.Statements {
+		server = append(server, factItem(s))
 	}
-	return nil
+
+	return planItems(client, server, reconcileOps{
+		add: func(items []reconcileItem) metadata.Mutation {
+			return metadata.PostProofForChildMutation(cid, factStatements(items))
+		},
+		remove: func(items []reconcileItem) metadata.Mutation {
+			return metadata.RemoveProofForChildMutation(cid, factStatements(items))
+		},
+		commit: func(items []reconcileItem) {
+			state.Statements = make([]metadata.EndorsedStatement, 0, len(items))
+			for _, item := range items {
+				state.Statements = append(state.Statements,
+					metadata.EndorsedStatement(item.(factItem)))
+			}
+		},
+		batch: true,
+	})
 }
 
-func (r *reconcileCache) ReconcileImageLink() error {
+func (r *reconcileCache) ReconcileFactStatement() error {
+	/// defensive
 	if r.serverState == nil {
 		return fmt.Errorf("must have valid server state to call this\n")
 	}
+	return reconcilePlans(r.batcher, r.factPlan(r.serverState))
+}
+
+type linkItem string
+
+func (l linkItem) Key() string {
+	return string(l)
+}
+
+func linkNames(items []reconcileItem) []string {
+	result := make([]string, 0, len(items))
+	for _, item := range items {
+		result = append(result, string(item.(linkItem)))
+	}
+	return result
+}
+
+func (r *reconcileCache) imageLinkPlan(state *metadata.Principal) *reconcilePlan {
 	cid := tapconContainerId(r.c)
-	link := tapconContainerImageId(r.c)
-	for _, slink := range r.serverState.Links {
-		if slink == link {
-			log.Debugf("image %s existed", slink)
-			return nil
-		}
+	client := []reconcileItem{linkItem(tapconContainerImageId(r.c))}
+	server := make([]reconcileItem, 0, len(state.Links))
+	for _, slink := range state.Links {
+		server = append(server, linkItem(slink))
 	}
-	r.serverState.Links = append(r.serverState.Links, link)
-	return r.api.LinkProofForChild(cid, []string{link})
+
+	return planItems(client, server, reconcileOps{
+		add: func(items []reconcileItem) metadata.Mutation {
+			return metadata.LinkProofForChildMutation(cid, linkNames(items))
+		},
+		remove: func(items []reconcileItem) metadata.Mutation {
+			return metadata.UnlinkProofForChildMutation(cid, linkNames(items))
+		},
+		commit: func(items []reconcileItem) {
+			state.Links = linkNames(items)
+		},
+		batch: true,
+	})
 }
 
-func (r *reconcileCache) ReconcileIpAlias() error {
+func (r *reconcileCache) ReconcileImageLink() error {
 	if r.serverState == nil {
 		return fmt.Errorf("must have valid server state to call this\n")
 	}
+	return reconcilePlans(r.batcher, r.imageLinkPlan(r.serverState))
+}
+
+type ipAliasItem metadata.IpAlias
+
+func (a ipAliasItem) Key() string {
+	return a.NsName + "/" + canonicalIp(a.Ip)
+}
+
+func (r *reconcileCache) ipAliasPlan(state *metadata.Principal) *reconcilePlan {
 	cid := tapconContainerId(r.c)
 
-	latestIpAliases := make([]metadata.IpAlias, 0, len(r.c.Ips))
+	client := make([]reconcileItem, 0, len(r.c.Ips))
 	for _, cip := range r.c.Ips {
-		found := false
-		for _, sip := range r.serverState.Aliases.Ips {
-			if cip == sip.Ip {
-				found = true
-				break
-			}
-		}
 		nsName, err := r.c.GetNsName(cip)
 		if err != nil {
 			// this is a workaround: the network address allocated is
 			// tenant network address, so it's using the instance local NS
 			// name
-
 			continue
 		}
-		alias := metadata.IpAlias{NsName: nsName, Ip: cip}
-		if !found {
-			err := r.api.CreateIPAlias(cid, nsName, net.ParseIP(cip))
-			if err != nil {
-				/// dont update this in server cache then
-				log.Errorf("fail to create IP alias %s, %s", nsName, cip)
-				continue
-			}
-		}
-		latestIpAliases = append(latestIpAliases, alias)
+		client = append(client, ipAliasItem{NsName: nsName, Ip: cip})
+	}
+	server := make([]reconcileItem, 0, len(state.Aliases.Ips))
+	for _, sip := range state.Aliases.Ips {
+		server = append(server, ipAliasItem(sip))
 	}
 
-	for _, sip := range r.serverState.Aliases.Ips {
-		found := false
-		for _, cip := range r.c.Ips {
-			if cip == sip.Ip {
-				found = true
-				break
-			}
-		}
-		if !found {
-			err := r.api.DeleteIPAlias(cid, sip.NsName, net.ParseIP(sip.Ip))
-			if err != nil {
-				/// dont update this in server cache then
-				log.Errorf("fail to delete IP alias %s, %s", sip.NsName, sip.Ip)
-				/// still include this in server cache, as there is error deleting
-				latestIpAliases = append(latestIpAliases, sip)
-				continue
+	return planItems(client, server, reconcileOps{
+		add: func(items []reconcileItem) metadata.Mutation {
+			alias := items[0].(ipAliasItem)
+			return metadata.CreateIPAliasMutation(cid, alias.NsName,
+				net.ParseIP(alias.Ip))
+		},
+		remove: func(items []reconcileItem) metadata.Mutation {
+			alias := items[0].(ipAliasItem)
+			return metadata.DeleteIPAliasMutation(cid, alias.NsName,
+				net.ParseIP(alias.Ip))
+		},
+		commit: func(items []reconcileItem) {
+			state.Aliases.Ips = make([]metadata.IpAlias, 0, len(items))
+			for _, item := range items {
+				state.Aliases.Ips = append(state.Aliases.Ips,
+					metadata.IpAlias(item.(ipAliasItem)))
 			}
-		}
+		},
+	})
+}
+
+func (r *reconcileCache) ReconcileIpAlias() error {
+	if r.serverState == nil {
+		return fmt.Errorf("must have valid server state to call this\n")
 	}
-	r.serverState.Aliases.Ips = latestIpAliases
-	return nil
+	return reconcilePlans(r.batcher, r.ipAliasPlan(r.serverState))
 }
 
 func PortAliasIn(target []PortAlias, ns, ip, protocol string, min, max int) bool {
@@ -155,144 +202,154 @@ func PortAliasIn(target []PortAlias, ns, ip, protocol string, min, max int) bool
 	return false
 }
 
-func PortsAliasDiff(cports []PortAlias, p *metadata.Principal) (
-	[]PortAlias, []PortAlias, []PortAlias) {
-
-	clientOnly := make([]PortAlias, 0, len(cports))
-	/// They won't differ much so just use len(cports)
-	serverOnly := make([]PortAlias, 0, len(cports))
-	mutualPorts := make([]PortAlias, 0, len(cports))
+func portAliasItems(ports []PortAlias) []reconcileItem {
+	result := make([]reconcileItem, 0, len(ports))
+	for _, p := range ports {
+		result = append(result, p)
+	}
+	return result
+}
 
-	for _, cport := range cports {
-		_, j := p.FindPortAlias(cport.nsName, cport.ip, cport.protocol,
-			cport.min, cport.max)
-		if j != -1 {
-			mutualPorts = append(mutualPorts, cport)
-		} else {
-			clientOnly = append(clientOnly, cport)
-		}
+func itemPortAliases(items []reconcileItem) []PortAlias {
+	result := make([]PortAlias, 0, len(items))
+	for _, item := range items {
+		result = append(result, item.(PortAlias))
 	}
+	return result
+}
 
+// flatten the port aliases of a principal
+func principalPortAliases(p *metadata.Principal) []PortAlias {
+	result := make([]PortAlias, 0, 2*len(p.Aliases.Ports))
 	for _, sports := range p.Aliases.Ports {
-		for _, tcpPort := range sports.Ports.Tcp {
-			if !PortAliasIn(cports, sports.NsName, sports.Ip, "tcp", tcpPort[0],
-				tcpPort[1]) {
-				serverOnly = append(serverOnly, PortAlias{
-					min:      tcpPort[0],
-					max:      tcpPort[1],
-					protocol: "tcp",
-					nsName:   sports.NsName,
-					ip:       sports.Ip,
-				})
-			}
-		}
-		for _, udpPort := range sports.Ports.Udp {
-			if !PortAliasIn(cports, sports.NsName, sports.Ip, "udp", udpPort[0],
-				udpPort[1]) {
-				serverOnly = append(serverOnly, PortAlias{
-					min:      udpPort[0],
-					max:      udpPort[1],
-					protocol: "udp",
+		for _, proto := range PORT_PROTOCOLS {
+			for _, port := range *sports.Ports.Protocol(proto) {
+				result = append(result, PortAlias{
+					min:      port[0],
+					max:      port[1],
+					protocol: proto,
 					nsName:   sports.NsName,
 					ip:       sports.Ip,
 				})
 			}
 		}
 	}
-	return clientOnly, serverOnly, mutualPorts
+	return result
+}
+
+func PortsAliasDiff(cports []PortAlias, p *metadata.Principal) (
+	[]PortAlias, []PortAlias, []PortAlias) {
 
+	diff := diffItems(portAliasItems(cports),
+		portAliasItems(principalPortAliases(p)))
+	return itemPortAliases(diff.Add), itemPortAliases(diff.Remove),
+		itemPortAliases(diff.Keep)
 }
 
-func (r *reconcileCache) ReconcilePortAlias() error {
-	if r.serverState == nil {
-		return fmt.Errorf("must have valid server state to call this\n")
-	}
+func (r *reconcileCache) portAliasPlan(state *metadata.Principal) *reconcilePlan {
 	cid := tapconContainerId(r.c)
 	// PortAlias in this package is just a simple representation of properties
 	// PortAlias from metadata package is the actual form of alias on the metadata
 	// server
-	ports := r.c.ContainerPorts()
-	clientOnlyPorts, serverOnlyPorts, mutualPorts := PortsAliasDiff(
-		ports, r.serverState)
-	log.Debugf("----reconciling server port state----")
-	log.Debugf("client ports: %v", clientOnlyPorts)
-	log.Debugf("server ports: %v", serverOnlyPorts)
-	log.Debugf("mutual ports: %v", mutualPorts)
-	log.Debugf("-------------------------------------")
-
-	for _, port := range clientOnlyPorts {
-		ip := net.ParseIP(port.ip)
-		if ip == nil {
+	ports := make([]PortAlias, 0)
+	for _, port := range r.c.ContainerPorts() {
+		if net.ParseIP(port.ip) == nil {
+			log.Errorf("invalid port alias ip %s", port.ip)
 			continue
 		}
-		if err := r.api.CreatePortAlias(cid, port.nsName, ip, port.protocol,
-			port.min, port.max); err != nil {
-			continue
-		}
-		mutualPorts = append(mutualPorts, port)
+		ports = append(ports, port)
 	}
+	log.Debugf("----reconciling server port state----")
+	log.Debugf("client ports: %v", ports)
+	log.Debugf("-------------------------------------")
 
-	for _, port := range serverOnlyPorts {
-		/// remove server ports so they are actually consistent with local state
-		ip := net.ParseIP(port.ip)
-		if ip == nil {
-			mutualPorts = append(mutualPorts, port)
-			continue
-		}
-		if err := r.api.DeletePortAlias(cid, port.nsName, ip, port.protocol,
-			port.min, port.max); err != nil {
-			// failure in deleting the alias, so still keep them in cache state.
-			mutualPorts = append(mutualPorts, port)
-			continue
-		}
-	}
-	r.serverState.Aliases.Ports = make([]metadata.PortAlias, 0, len(mutualPorts))
+	return planItems(portAliasItems(ports),
+		portAliasItems(principalPortAliases(state)), reconcileOps{
+			add: func(items []reconcileItem) metadata.Mutation {
+				port := items[0].(PortAlias)
+				return metadata.CreatePortAliasMutation(cid, port.nsName,
+					net.ParseIP(port.ip), port.protocol, port.min, port.max)
+			},
+			remove: func(items []reconcileItem) metadata.Mutation {
+				/// remove server ports so they are actually consistent with local state
+				port := items[0].(PortAlias)
+				return metadata.DeletePortAliasMutation(cid, port.nsName,
+					net.ParseIP(port.ip), port.protocol, port.min, port.max)
+			},
+			commit: func(items []reconcileItem) {
+				state.Aliases.Ports = make([]metadata.PortAlias, 0, len(items))
+				for _, port := range itemPortAliases(items) {
+					state.AddPortAlias(port.nsName, port.ip, port.protocol,
+						port.min, port.max)
+				}
+			},
+		})
+}
 
-	for _, port := range mutualPorts {
-		r.serverState.AddPortAlias(port.nsName, port.ip, port.protocol,
-			port.min, port.max)
+func (r *reconcileCache) ReconcilePortAlias() error {
+	if r.serverState == nil {
+		return fmt.Errorf("must have valid server state to call this\n")
 	}
+	return reconcilePlans(r.batcher, r.portAliasPlan(r.serverState))
+}
 
-	return nil
+type principalItem string
+
+func (p principalItem) Key() string {
+	return string(p)
 }
 
-/// Create principal if necessary
+/// Create principal if necessary. All the changes of the container are sent
+// in one batch, creating the principal first if there is no server state.
 func (r *reconcileCache) Create() error {
 
 	cid := tapconContainerId(r.c)
-	if r.serverState == nil {
-		err := r.api.CreatePrincipal(cid)
-		if err != nil {
-			return err
-		}
-		r.serverState = metadata.NewPrincipal()
+	state := r.serverState
+	created := state != nil
+	plans := make([]*reconcilePlan, 0, 5)
+	var principal *reconcilePlan
+	if state == nil {
+		state = metadata.NewPrincipal()
+		principal = planItems([]reconcileItem{principalItem(cid)},
+			[]reconcileItem{}, reconcileOps{
+				add: func(items []reconcileItem) metadata.Mutation {
+					return metadata.CreatePrincipalMutation(cid)
+				},
+				commit: func(items []reconcileItem) {
+					created = len(items) > 0
+				},
+				batch: true,
+			})
+		plans = append(plans, principal)
 	}
 
-	/// just a workaround
-
-	if err := r.ReconcileFactStatement(); err != nil {
-		log.Errorf("error in posting facts: %v", err)
-	}
-
-	if err := r.ReconcileImageLink(); err != nil {
-		log.Errorf("error in linking image: %v", err)
+	plans = append(plans, r.factPlan(state), r.imageLinkPlan(state),
+		r.ipAliasPlan(state), r.portAliasPlan(state))
+	err := reconcilePlans(r.batcher, plans...)
+	if principal != nil && len(principal.Existed) > 0 {
+		/// made before we could see it, e.g. by an earlier run of the
+		// monitor. Take the server state and reconcile against it instead.
+		log.Infof("principal %s exists at server side, adopting it", cid)
+		if err := r.Refresh(); err != nil {
+			return err
+		}
+		return r.Create()
 	}
-
-	if err := r.ReconcileIpAlias(); err != nil {
-		log.Errorf("error in reconcile IP aliases: %v", err)
+	if !created {
+		return err
 	}
-
-	if err := r.ReconcilePortAlias(); err != nil {
-		log.Errorf("error in reconciling Port aliases: %v", err)
+	r.serverState = state
+	if err != nil {
+		log.Errorf("error in reconciling principal %s: %v", cid, err)
 	}
-	return nil
+	return err
 }
 
 func (r *reconcileCache) Remove() error {
 	cid := tapconContainerId(r.c)
 	if r.serverState != nil {
 		err := r.api.DeletePrincipal(cid)
-		if err != nil {
+		if err != nil && !metadata.IsNotFound(err) {
 			return err
 		}
 		r.serverState = nil
@@ -311,8 +368,16 @@ func (r *reconcileCache) Valid() bool {
 }
 
 func NewReconcileCache(api metadata.MetadataAPI, c *MemContainer) ReconcileCache {
+	return NewBatchedReconcileCache(api, api, c)
+}
+
+// NewBatchedReconcileCache sends the mutations through batcher, which may be
+// shared by many containers, e.g. a metadata.BatchBuffer.
+func NewBatchedReconcileCache(api metadata.MetadataAPI, batcher metadata.Batcher,
+	c *MemContainer) ReconcileCache {
 	return &reconcileCache{
 		api:         api,
+		batcher:     batcher,
 		c:           c,
 		serverState: nil,
 	}
@@ -322,6 +387,7 @@ func NewReconcileCache(api metadata.MetadataAPI, c *MemContainer) ReconcileCache
 func newReconcileCache(api metadata.MetadataAPI, c *MemContainer) *reconcileCache {
 	return &reconcileCache{
 		api:         api,
+		batcher:     api,
 		c:           c,
 		serverState: nil,
 	}
@@ -1,6 +1,7 @@
 package docker
 
 import (
+	"bytes"
 	"fmt"
 	"reflect"
 	"testing"
@@ -358,3 +359,80 @@ func TestNewContainer(t *testing.T) {
 	log.Debugf("test new\n")
 	cacheTestNew(t)
 }
+
+func TestStaleFactAndLinkWithdrawn(t *testing.T) {
+	c := newStubContainer("regular", "image-2", "192.168.0.1",
+		"172.16.0.1", "localns", "10.0.0.1", "overlay",
+		1000, 2000, 7077, 8088)
+	cache := newReconcileCache(metadata.NewStubApi(t), c)
+	cacheTestDefault(cache, t)
+
+	state := cache.State()
+	assert.Equal(t, []string{"image-2"}, state.Links, "stale link withdrawn")
+	assert.Len(t, state.Statements, 1, "stale fact withdrawn")
+	assert.Equal(t, "containerFact(\"regular\", \"image-2\")",
+		state.Statements[0].Fact, "new fact posted")
+}
+
+func newUnknownReconcileCache(t *testing.T) *reconcileCache {
+	c := newStubContainer("newctn", "image-test", "192.168.0.1",
+		"172.16.0.1", "localns", "10.0.0.1", "overlay",
+		1000, 2000, 7077, 8088)
+	return newReconcileCache(metadata.NewStubApi(t), c)
+}
+
+func TestCreateAdoptsExistingPrincipal(t *testing.T) {
+	earlier := newUnknownReconcileCache(t)
+	cacheTestDefault(earlier, t)
+	// no refresh, the principal made by an earlier run is unknown
+	cache := newReconcileCache(earlier.api, earlier.c)
+	if err := cache.Create(); err != nil {
+		t.Fatalf("error in reconciling the state: %v\n", err)
+	}
+	serverState, err := cache.api.ShowPrincipal(cache.c.Id)
+	if err != nil {
+		t.Fatalf("error in showing principal: %v\n", err)
+	}
+	AssertPrincipalEqual(t, cache.State(), serverState)
+}
+
+func TestPrincipalLostAtServer(t *testing.T) {
+	cache := newUnknownReconcileCache(t)
+	cacheTestDefault(cache, t)
+	cid := tapconContainerId(cache.c)
+
+	cache.api.DeletePrincipal(cid)
+	err := cache.Refresh()
+	assert.True(t, metadata.IsNotFound(err), "principal not found")
+	assert.False(t, cache.Valid(), "cache dropped")
+	cacheTestDefault(cache, t)
+
+	cache.api.DeletePrincipal(cid)
+	assert.Nil(t, cache.Remove(), "removing a lost principal")
+	assert.False(t, cache.Valid(), "cache dropped")
+}
+
+// a session recorded from one build replays against another, the mutations
+// made are compared
+func TestReplayReconcileSession(t *testing.T) {
+	var recording bytes.Buffer
+	recorded := newUnknownReconcileCache(t)
+	recorder := metadata.NewRecordingApi(recorded.api, &recording)
+	recorded.api, recorded.batcher = recorder, recorder
+	cacheTestDefault(recorded, t)
+	assert.Nil(t, recorded.Remove(), "removing")
+
+	calls, err := metadata.LoadRecording(&recording)
+	assert.Nil(t, err, "loading the recording")
+	replay := metadata.NewReplayApi(calls)
+	cache := newReconcileCache(replay, recorded.c)
+	cacheTestDefault(cache, t)
+	assert.Nil(t, cache.Remove(), "removing")
+
+	assert.Equal(t, 0, replay.Unmatched(), "calls not recorded")
+	want, err := metadata.Mutations(calls)
+	assert.Nil(t, err, "recorded mutations")
+	got, err := metadata.Mutations(replay.Calls())
+	assert.Nil(t, err, "replayed mutations")
+	assert.ElementsMatch(t, want, got, "same mutations")
+}
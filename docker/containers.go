@@ -2,9 +2,11 @@ package docker
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -12,6 +14,7 @@ import (
 	log "github.com/Sirupsen/logrus"
 	docker_type "github.com/docker/docker/api/types/container"
 	docker "github.com/docker/docker/container"
+	docker_network "github.com/docker/docker/daemon/network"
 	config "github.com/jerryz920/tapcon-monitor/config"
 	metadata "github.com/jerryz920/tapcon-monitor/statement"
 )
@@ -20,8 +23,10 @@ const (
 	CONTAINER_CONFIG_FILE = "config.v2.json"
 	CONTAINER_HOST_CONFIG = "hostconfig.json"
 	LOCALHOST_V4          = "127.0.0.1"
+	LOCALHOST_V6          = "::1"
 	DEFAULT_NS            = "default"
 	WILDCARD_IP           = "0.0.0.0"
+	WILDCARD_IPV6         = "::"
 
 	/// Container events
 	NEED_UPDATE    = 1
@@ -38,7 +43,7 @@ type MemContainer struct {
 	Id               string
 	Root             string // /var/lib/docker/containers/<id>/
 	Mutex            *sync.Mutex
-	Ips              []string /// detect the IPv4 addresses of this container
+	Ips              []string /// detect the IPv4 and IPv6 addresses of this container
 	PrincipalCreated bool
 	FactCreated      bool
 	ImageLinked      bool
@@ -52,7 +57,9 @@ type MemContainer struct {
 	RefreshDuration  time.Duration
 	VmIps            []instanceIp
 	EventChan        chan int
-	listIp           func(string) []string
+	listIp           func(string) ([]string, error)
+	staticPortIps    []string // the static ports are mapped to, nil if none
+	retryPending     int32 // set while a retry is scheduled, see retryLater
 }
 
 func NewMemContainer(id, root, localNs string) *MemContainer {
@@ -170,7 +177,14 @@ func (c *MemContainer) Load() bool {
 			return true
 		}
 		log.Debugf("checking sandbox key: %s", osNsName)
-		ips := c.listIp(osNsName)
+		ips, err := c.listIp(osNsName)
+		if err != nil {
+			/// keep the IPs known, the aliases are not withdrawn for that.
+			// Revert to old timestamp so next time we try to list again
+			log.Errorf("listing IPs of container %s: %v", c.Id, err)
+			c.LastUpdate = oldTimestamp
+			return true
+		}
 		if len(ips) == 0 && !baseContainer.Config.NetworkDisabled {
 			log.Errorf("There must be non-empty ip list for container")
 			/// for this case the container is still loaded, but just not running
@@ -209,10 +223,25 @@ func IsUserOverlayNetwork(name string) bool {
 	return mode.IsUserDefined()
 }
 
+// sameIp compares addresses, IPv6 ones are written in several ways.
+func sameIp(a, b string) bool {
+	if a == b {
+		return a != ""
+	}
+	ipa, ipb := net.ParseIP(a), net.ParseIP(b)
+	return ipa != nil && ipa.Equal(ipb)
+}
+
+// networkHasIp tells if ip is one of the network's addresses, either family.
+func networkHasIp(network *docker_network.EndpointSettings, ip string) bool {
+	return sameIp(network.IPAddress, ip) ||
+		sameIp(network.GlobalIPv6Address, ip)
+}
+
 func (c *MemContainer) GetNsName(ip string) (string, error) {
 
 	for name, network := range c.Config.NetworkSettings.Networks {
-		if network.IPAddress == ip {
+		if networkHasIp(network, ip) {
 			if IsUserOverlayNetwork(name) {
 				return network.NetworkID, nil
 			} else if IsBridgeNetwork(name) {
@@ -224,7 +253,7 @@ func (c *MemContainer) GetNsName(ip string) (string, error) {
 		// Then the user defined network, the network is "hidden" but it
 		// is there, and it will be the IP we are looking for.
 		for _, nip := range c.Ips {
-			if ip == nip {
+			if sameIp(ip, nip) {
 				return c.LocalNs, nil
 			}
 		}
@@ -237,6 +266,34 @@ func (c *MemContainer) GetNsName(ip string) (string, error) {
 	return "", fmt.Errorf("Can't find NS name for IP %s", ip)
 }
 
+// GetSubnet gives the subnet, in CIDR form, of the network the container
+// holds the IP in. Hidden networks have no prefix length to go by.
+func (c *MemContainer) GetSubnet(ip string) (string, error) {
+	for _, network := range c.Config.NetworkSettings.Networks {
+		prefix := 0
+		switch {
+		case sameIp(network.IPAddress, ip):
+			prefix = network.IPPrefixLen
+		case sameIp(network.GlobalIPv6Address, ip):
+			prefix = network.GlobalIPv6PrefixLen
+		default:
+			continue
+		}
+		addr := net.ParseIP(ip)
+		bits := 8 * net.IPv6len
+		if v4 := addr.To4(); v4 != nil {
+			addr, bits = v4, 8*net.IPv4len
+		}
+		if prefix <= 0 || prefix > bits {
+			break
+		}
+		mask := net.CIDRMask(prefix, bits)
+		subnet := net.IPNet{IP: addr.Mask(mask), Mask: mask}
+		return subnet.String(), nil
+	}
+	return "", fmt.Errorf("Can't find subnet for IP %s", ip)
+}
+
 /// This function needs more elaboration: bridge, gw_bridge, and many other things
 func IsConnectedToHostNetwork(name string) bool {
 	return name == "bridge"
@@ -244,7 +301,7 @@ func IsConnectedToHostNetwork(name string) bool {
 
 func (c *MemContainer) IsContainerIp(ip string) bool {
 	for name, network := range c.Config.NetworkSettings.Networks {
-		if network.IPAddress == ip && IsBridgeNetwork(name) {
+		if networkHasIp(network, ip) && IsBridgeNetwork(name) {
 			return true
 		}
 	}
@@ -252,7 +309,7 @@ func (c *MemContainer) IsContainerIp(ip string) bool {
 		// Then the user defined network, the network is "hidden" but it
 		// is there, and it will be the IP we are looking for.
 		for _, nip := range c.Ips {
-			if ip == nip {
+			if sameIp(ip, nip) {
 				return true
 			}
 		}
@@ -283,31 +340,87 @@ func (c *MemContainer) ContainerFacts() []metadata.Statement {
 		metadata.Statement(fmt.Sprintf("containerFact(\"%s\", \"%s\")", cid, iid))}
 }
 
+// PORT_PROTOCOLS are the protocols port aliases are posted for.
+var PORT_PROTOCOLS = [...]string{"tcp", "udp", "sctp"}
+
+// bindingIps gives the instance addresses a port published on hostIp is
+// reached on: all of them if not set, those of its family if unspecified,
+// the one it names otherwise. None for loopback ones.
+func (c *MemContainer) bindingIps(hostIp string) []instanceIp {
+	if hostIp == "" {
+		return c.VmIps
+	}
+	bind := net.ParseIP(hostIp)
+	if bind == nil {
+		log.Errorf("parsing port binding address %v", hostIp)
+		return nil
+	}
+	result := []instanceIp{}
+	for _, vmip := range c.VmIps {
+		ip := net.ParseIP(vmip.ip)
+		if ip == nil {
+			continue
+		}
+		if bind.IsUnspecified() && (bind.To4() == nil) == (ip.To4() == nil) ||
+			bind.Equal(ip) {
+			result = append(result, vmip)
+		}
+	}
+	return result
+}
+
+// collapsePorts turns ports into the fewest ranges covering them.
+func collapsePorts(ports []int) []PortRange {
+	sort.Ints(ports)
+	result := []PortRange{}
+	for _, p := range ports {
+		if n := len(result); n > 0 && p <= result[n-1].max+1 {
+			if p > result[n-1].max {
+				result[n-1].max = p
+			}
+			continue
+		}
+		result = append(result, PortRange{min: p, max: p})
+	}
+	return result
+}
+
 /// Ports for public network usage
 func (c *MemContainer) ContainerPorts() []PortAlias {
-	ports := make([]PortAlias, 0, len(c.Config.NetworkSettings.Ports)+1)
-	/// Fixme: here we should actually return the port binding for the host
-	for _, bindings := range c.Config.NetworkSettings.Ports {
+	/// the ports published on each instance address and protocol
+	published := make(map[string][]int)
+	aliases := make(map[string]PortAlias)
+	for port, bindings := range c.Config.NetworkSettings.Ports {
 		for _, binding := range bindings {
 			p64, err := strconv.ParseInt(binding.HostPort, 10, 0)
 			if err != nil {
 				log.Errorf("parsing port alias %v", binding.HostPort)
 				continue
 			}
-			p := int(p64)
-			for _, proto := range [2]string{"tcp", "udp"} {
-				for _, vmip := range c.VmIps {
-					ports = append(ports, PortAlias{
-						min:      p,
-						max:      p,
-						ip:       vmip.ip,
-						protocol: proto,
-						nsName:   vmip.ns,
-					})
-				}
+			for _, vmip := range c.bindingIps(binding.HostIP) {
+				alias := PortAlias{ip: vmip.ip, protocol: port.Proto(),
+					nsName: vmip.ns}
+				aliases[alias.Key()] = alias
+				published[alias.Key()] = append(published[alias.Key()],
+					int(p64))
 			}
 		}
 	}
+	keys := make([]string, 0, len(aliases))
+	for key := range aliases {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	ports := make([]PortAlias, 0, len(keys)+2*len(c.VmIps))
+	for _, key := range keys {
+		for _, r := range collapsePorts(published[key]) {
+			alias := aliases[key]
+			alias.min, alias.max = r.min, r.max
+			ports = append(ports, alias)
+		}
+	}
+	/// static ports are masqueraded for tcp and udp only
 	if c.StaticPortMin != 0 {
 		for _, proto := range [2]string{"tcp", "udp"} {
 			for _, vmip := range c.VmIps {
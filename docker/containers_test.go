@@ -1,6 +1,7 @@
 package docker
 
 import (
+	"net"
 	"os"
 	"path/filepath"
 	"testing"
@@ -73,3 +74,106 @@ func TestMemContainerLoad(t *testing.T) {
 	}
 	assert.True(t, c.Load(), "load changed container")
 }
+
+func TestMemContainerDualStack(t *testing.T) {
+	id := "6f1d4a2b9c8e7f60a5b4c3d2e1f0a9b8c7d6e5f4a3b2c1d0e9f8a7b6c5d4e3f2"
+	path, err := filepath.Abs("../tests/backups/")
+	if err != nil {
+		t.Fatalf("error in container root conversion: %v\n", err)
+	}
+	c := NewMemContainer(tapconStringId(id), filepath.Join(path, id), "vm-ns")
+	c.listIp = func(ns string) ([]string, error) {
+		return containerIps([]NsAddr{
+			{"lo", net.ParseIP("127.0.0.1"), 8},
+			{"lo", net.ParseIP("::1"), 128},
+			{"eth0", net.ParseIP("172.17.0.3"), 16},
+			{"eth0", net.ParseIP("2001:db8:1::242:ac11:3"), 64},
+			{"eth0", net.ParseIP("fe80::42:acff:fe11:3"), 64},
+		}), nil
+	}
+	assert.True(t, c.Load(), "c contains valid state")
+	assert.Equal(t, []string{"172.17.0.3", "2001:db8:1::242:ac11:3"}, c.Ips)
+
+	for _, ip := range []string{"172.17.0.3", "2001:db8:1::242:ac11:3",
+		"2001:db8:1:0:0:242:ac11:3"} {
+		ns, err := c.GetNsName(ip)
+		assert.Nil(t, err, "ns of %s", ip)
+		assert.Equal(t, "vm-ns", ns, "bridge address in the local ns")
+		assert.True(t, c.IsContainerIp(ip), "container ip %s", ip)
+	}
+	_, err = c.GetNsName("fe80::42:acff:fe11:3")
+	assert.NotNil(t, err, "link local address has no ns")
+
+	subnet, err := c.GetSubnet("172.17.0.3")
+	assert.Nil(t, err, "subnet of the bridge address")
+	assert.Equal(t, "172.17.0.0/16", subnet)
+	subnet, err = c.GetSubnet("2001:db8:1:0:0:242:ac11:3")
+	assert.Nil(t, err, "subnet of the global address")
+	assert.Equal(t, "2001:db8:1::/64", subnet)
+	_, err = c.GetSubnet("fe80::42:acff:fe11:3")
+	assert.NotNil(t, err, "link local address has no subnet")
+
+	c.VmIps = []instanceIp{
+		{ns: "vm-ns", ip: "10.0.0.4"},
+		{ns: ipv6Ns(net.ParseIP("fd00:1::4"), "vm-ns"), ip: "fd00:1::4"},
+		{ns: ipv6Ns(net.ParseIP("2001:db8::4"), "vm-ns"), ip: "2001:db8::4"},
+	}
+	ports := c.ContainerPorts()
+	assert.Contains(t, ports, PortAlias{min: 8080, max: 8080, protocol: "tcp",
+		ip: "fd00:1::4", nsName: "vm-ns"}, "unique local in the local ns")
+	assert.Contains(t, ports, PortAlias{min: 8080, max: 8080, protocol: "tcp",
+		ip: "2001:db8::4", nsName: DEFAULT_NS}, "global address public")
+	assert.Equal(t, 3, len(ports), "published tcp on every instance address")
+}
+
+func TestMemContainerPublishedPorts(t *testing.T) {
+	/// published with -p 127.0.0.1:8080:80/udp, -p 0.0.0.0:5353:53/tcp and
+	// /udp, -p 9000-9002:9000-9002, -p [::]:8443:443, and
+	// -p 10.0.0.4:3868:3868/sctp
+	id := "9c3e5a7b1d2f4e6a8b0c2d4e6f8a0b1c3d5e7f9a1b3c5d7e9f0a2b4c6d8e0f1a"
+	path, err := filepath.Abs("../tests/backups/")
+	if err != nil {
+		t.Fatalf("error in container root conversion: %v\n", err)
+	}
+	c := NewMemContainer(tapconStringId(id), filepath.Join(path, id), "vm-ns")
+	c.listIp = func(ns string) ([]string, error) {
+		return []string{"172.17.0.3"}, nil
+	}
+	assert.True(t, c.Load(), "c contains valid state")
+	c.VmIps = []instanceIp{
+		{ns: DEFAULT_NS, ip: "192.168.0.1"},
+		{ns: "vm-ns", ip: "10.0.0.4"},
+		{ns: DEFAULT_NS, ip: "2001:db8::4"},
+	}
+
+	assert.Equal(t, []PortAlias{
+		{min: 5353, max: 5353, protocol: "tcp", ip: "192.168.0.1",
+			nsName: DEFAULT_NS},
+		{min: 9000, max: 9002, protocol: "tcp", ip: "192.168.0.1",
+			nsName: DEFAULT_NS},
+		{min: 5353, max: 5353, protocol: "udp", ip: "192.168.0.1",
+			nsName: DEFAULT_NS},
+		{min: 8443, max: 8443, protocol: "tcp", ip: "2001:db8::4",
+			nsName: DEFAULT_NS},
+		{min: 9000, max: 9002, protocol: "tcp", ip: "2001:db8::4",
+			nsName: DEFAULT_NS},
+		{min: 3868, max: 3868, protocol: "sctp", ip: "10.0.0.4",
+			nsName: "vm-ns"},
+		{min: 5353, max: 5353, protocol: "tcp", ip: "10.0.0.4",
+			nsName: "vm-ns"},
+		{min: 9000, max: 9002, protocol: "tcp", ip: "10.0.0.4",
+			nsName: "vm-ns"},
+		{min: 5353, max: 5353, protocol: "udp", ip: "10.0.0.4",
+			nsName: "vm-ns"},
+	}, c.ContainerPorts(), "only where bound, ranges collapsed")
+
+	c.AssignStaticPorts(20000, 20009)
+	assert.Contains(t, c.ContainerPorts(), PortAlias{min: 20000, max: 20009,
+		protocol: "udp", ip: "10.0.0.4", nsName: "vm-ns"}, "static ports")
+}
+
+func TestCollapsePorts(t *testing.T) {
+	assert.Equal(t, []PortRange{{80, 80}, {8080, 8082}, {9000, 9000}},
+		collapsePorts([]int{8081, 9000, 80, 8080, 8082, 8081}))
+	assert.Empty(t, collapsePorts(nil))
+}
@@ -32,7 +32,7 @@ func (s *fakeSandbox) RemoveContainerChain(id string) error {
 }
 
 func (s *fakeSandbox) SetupStaticPortMapping(id string, containerIp string,
-	portMin int, portMax int) error {
+	subnet string, portMin int, portMax int) error {
 
 	chainName := s.ContainerChainName(id)
 	for _, proto := range [2]string{"tcp", "udp"} {
@@ -50,3 +50,23 @@ func (s *fakeSandbox) ClearStaticPortMapping(id string) error {
 	fmt.Printf("cmd %v\n", cmd.Args)
 	return nil
 }
+
+func (s *fakeSandbox) SweepContainerChains(keep []string) error {
+	fmt.Printf("sweep chains but %v\n", keep)
+	return nil
+}
+
+func (s *fakeSandbox) SetupMetadataGuard() error {
+	fmt.Printf("guard metadata server\n")
+	return nil
+}
+
+func (s *fakeSandbox) AllowMetadataAccess(id string, ips []string) error {
+	fmt.Printf("allow %s metadata access from %v\n", id, ips)
+	return nil
+}
+
+func (s *fakeSandbox) RevokeMetadataAccess(id string) error {
+	fmt.Printf("revoke %s metadata access\n", id)
+	return nil
+}
@@ -15,12 +15,27 @@ import (
 )
 
 const (
-	IMAGE_PATH         = "image/aufs"
+	IMAGE_ROOT         = "image"
 	IMAGE_CONTENT_PATH = "imagedb/content/sha256/"
 	IMAGE_REPO_FILE    = "repositories.json"
 	REPO_NAME          = "Repositories"
+
+	DOCKER_DAEMON_CONFIG   = "/etc/docker/daemon.json"
+	DEFAULT_STORAGE_DRIVER = "overlay2"
 )
 
+// Storage drivers whose image metadata lives in image/<driver>. The layout
+// under that directory is the same for all of them.
+var StorageDrivers = []string{
+	"overlay2",
+	"overlay",
+	"aufs",
+	"btrfs",
+	"zfs",
+	"devicemapper",
+	"vfs",
+}
+
 /// names are ugly, rename things later
 type MemImage struct {
 	Config        *docker_image.Image
@@ -128,6 +143,67 @@ func GetAllImageIds(r *Repo) []string {
 	return result
 }
 
+func IsStorageDriver(name string) bool {
+	for _, d := range StorageDrivers {
+		if d == name {
+			return true
+		}
+	}
+	return false
+}
+
+func ImagePath(containerRoot, driver string) string {
+	return path.Join(containerRoot, IMAGE_ROOT, driver)
+}
+
+// storage driver set in docker daemon config, if any
+func daemonConfigStorageDriver(configFile string) string {
+	f, err := os.Open(configFile)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	conf := struct {
+		StorageDriver string `json:"storage-driver"`
+	}{}
+	if err := json.NewDecoder(f).Decode(&conf); err != nil {
+		log.Warnf("can not decode docker daemon config %s: %v", configFile, err)
+		return ""
+	}
+	return conf.StorageDriver
+}
+
+// DetectStorageDriver finds the storage driver whose image metadata docker is
+// using. The driver set in docker's daemon config is preferred. Otherwise the
+// driver directories are probed, and if docker has switched driver before,
+// the one with the latest repositories.json wins.
+func DetectStorageDriver(containerRoot, daemonConfig string) (string, error) {
+	if driver := daemonConfigStorageDriver(daemonConfig); driver != "" {
+		if IsStorageDriver(driver) {
+			return driver, nil
+		}
+		log.Warnf("unsupported storage driver in docker config: %s", driver)
+	}
+
+	found := ""
+	var latest time.Time
+	for _, driver := range StorageDrivers {
+		stat, err := os.Stat(imageRepoFile(ImagePath(containerRoot, driver)))
+		if err != nil {
+			continue
+		}
+		if found == "" || latest.Before(stat.ModTime()) {
+			found = driver
+			latest = stat.ModTime()
+		}
+	}
+	if found == "" {
+		return "", fmt.Errorf("no image metadata found under %s",
+			path.Join(containerRoot, IMAGE_ROOT))
+	}
+	return found, nil
+}
+
 func imageRepoFile(root string) string {
 	return path.Join(root, IMAGE_REPO_FILE)
 }
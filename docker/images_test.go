@@ -1,10 +1,17 @@
 package docker
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"sort"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/jerryz920/tapcon-monitor/config"
+	metadata "github.com/jerryz920/tapcon-monitor/statement"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -42,3 +49,157 @@ func TestGetAllImages(t *testing.T) {
 	sort.Strings(expected)
 	assert.Equal(t, images, expected, "pre-set images")
 }
+
+type imageRecordingApi struct {
+	*metadata.EmptyStubApi
+	deleted []string
+	posted  map[string][]metadata.Statement
+}
+
+func (api *imageRecordingApi) DeletePrincipal(name string) error {
+	api.deleted = append(api.deleted, name)
+	return nil
+}
+
+func (api *imageRecordingApi) PostProof(target string, statements []metadata.Statement) error {
+	api.posted[target] = append(api.posted[target], statements...)
+	return nil
+}
+
+func newImageTestMonitor(t *testing.T, policy string) (*Monitor, *imageRecordingApi) {
+	root, err := filepath.Abs("../tests/image/aufs")
+	if err != nil {
+		t.Fatal("can not obtain abs path to test image repo")
+	}
+	api := &imageRecordingApi{
+		EmptyStubApi: &metadata.EmptyStubApi{},
+		posted:       make(map[string][]metadata.Statement),
+	}
+	m := &Monitor{
+		MetadataApi:       api,
+		ImageMetadataPath: root,
+		ImageLockCounter:  &sync.Mutex{},
+		ContainerLock:     &sync.Mutex{},
+		Containers:        make(map[string]*MemContainer),
+		Images:            make(map[string]*MemImage),
+		staleImagePolicy:  policy,
+	}
+	return m, api
+}
+
+func TestScanImageRemoval(t *testing.T) {
+	m, api := newImageTestMonitor(t, config.STALE_IMAGE_DELETE)
+	gone := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	m.Images[gone] = NewMemImage(m.ImageMetadataPath, gone)
+
+	assert.Nil(t, m.ScanImageUpdate(), "scanning image repo")
+	assert.Len(t, m.Images, 7, "removed image dropped")
+	assert.Equal(t, []string{tapconStringId(gone)}, api.deleted,
+		"removed image principal deleted")
+
+	assert.Nil(t, m.ScanImageUpdate(), "scanning image repo again")
+	assert.Len(t, api.deleted, 1, "no more principal deleted")
+}
+
+func TestScanImageRetire(t *testing.T) {
+	m, api := newImageTestMonitor(t, config.STALE_IMAGE_RETIRE)
+	gone := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	m.Images[gone] = NewMemImage(m.ImageMetadataPath, gone)
+
+	assert.Nil(t, m.ScanImageUpdate(), "scanning image repo")
+	assert.NotContains(t, m.Images, gone, "removed image dropped")
+	assert.Len(t, api.deleted, 0, "retired image principal kept")
+	assert.Equal(t, []metadata.Statement{
+		metadata.Statement(fmt.Sprintf("imageRetired(\"%s\")", tapconStringId(gone))),
+	}, api.posted[tapconStringId(gone)], "retired fact posted")
+}
+
+func TestScanImageInUse(t *testing.T) {
+	m, api := newImageTestMonitor(t, config.STALE_IMAGE_DELETE)
+	gone := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	m.Images[gone] = NewMemImage(m.ImageMetadataPath, gone)
+	c := newStubContainer("c1", "sha256:"+gone, "192.168.0.1",
+		"172.16.0.1", "localns", "10.0.0.1", "overlay", 0, 0)
+	m.Containers["c1"] = c
+
+	assert.Nil(t, m.ScanImageUpdate(), "scanning image repo")
+	assert.Contains(t, m.Images, gone, "image in use kept")
+	assert.Len(t, api.deleted, 0, "image in use not withdrawn")
+
+	delete(m.Containers, "c1")
+	assert.Nil(t, m.ScanImageUpdate(), "scanning image repo")
+	assert.NotContains(t, m.Images, gone, "unused image dropped")
+	assert.Len(t, api.deleted, 1, "unused image withdrawn")
+}
+
+func TestStorageDriverLayouts(t *testing.T) {
+	expected := map[string]int{
+		"aufs":         11,
+		"overlay2":     3,
+		"btrfs":        2,
+		"zfs":          2,
+		"devicemapper": 2,
+		"vfs":          1,
+	}
+	for driver, n := range expected {
+		root, err := filepath.Abs(ImagePath("../tests", driver))
+		if err != nil {
+			t.Fatal("can not obtain abs path to test image repo")
+		}
+		repo, err := LoadImageRepos(root)
+		if err != nil {
+			t.Fatalf("loading %s image repo: %v", driver, err)
+		}
+		images := GetAllImageIds(repo)
+		assert.Len(t, images, n, "%s image count", driver)
+		for _, id := range images {
+			_, err := LoadImage(root, id)
+			assert.Nil(t, err, "%s image %s", driver, id)
+		}
+	}
+}
+
+func makeImageLayout(t *testing.T, root, driver string, mtime time.Time) {
+	p := ImagePath(root, driver)
+	if err := os.MkdirAll(p, 0755); err != nil {
+		t.Fatalf("creating image dir: %v", err)
+	}
+	repoFile := imageRepoFile(p)
+	if err := ioutil.WriteFile(repoFile, []byte(`{"Repositories":{}}`), 0644); err != nil {
+		t.Fatalf("writing repo file: %v", err)
+	}
+	if err := os.Chtimes(repoFile, mtime, mtime); err != nil {
+		t.Fatalf("setting repo file time: %v", err)
+	}
+}
+
+func TestDetectStorageDriver(t *testing.T) {
+	root, err := ioutil.TempDir("", "tapcon-driver")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	daemonConfig := filepath.Join(root, "daemon.json")
+
+	_, err = DetectStorageDriver(root, daemonConfig)
+	assert.NotNil(t, err, "no image metadata")
+
+	now := time.Now()
+	makeImageLayout(t, root, "aufs", now.Add(-time.Hour))
+	driver, err := DetectStorageDriver(root, daemonConfig)
+	assert.Nil(t, err, "detecting aufs")
+	assert.Equal(t, "aufs", driver, "only aufs")
+
+	makeImageLayout(t, root, "overlay2", now)
+	driver, err = DetectStorageDriver(root, daemonConfig)
+	assert.Nil(t, err, "detecting overlay2")
+	assert.Equal(t, "overlay2", driver, "latest repositories.json wins")
+
+	content := []byte(`{"storage-driver": "aufs"}`)
+	if err := ioutil.WriteFile(daemonConfig, content, 0644); err != nil {
+		t.Fatalf("writing daemon config: %v", err)
+	}
+	driver, err = DetectStorageDriver(root, daemonConfig)
+	assert.Nil(t, err, "detecting from daemon config")
+	assert.Equal(t, "aufs", driver, "daemon config wins")
+}
@@ -0,0 +1,336 @@
+package docker
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// CommandRunner runs a command and gives its combined output, with an error
+// if it fails.
+type CommandRunner interface {
+	Run(name string, args ...string) ([]byte, error)
+}
+
+type execRunner struct{}
+
+func (execRunner) Run(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+const (
+	CONTAINER_CHAIN_PREFIX = "ctn-"
+	NAT_POSTROUTING        = "POSTROUTING"
+	FILTER_FORWARD         = "FORWARD"
+	METADATA_CHAIN         = "TAPCON-METADATA"
+)
+
+// iptablesSandbox keeps a nat chain per container, jumped to from
+// POSTROUTING, where the traffic of the container is masqueraded to its
+// static ports. Forwarded traffic to the metadata server goes through
+// METADATA_CHAIN in the filter table, accepted from the allowed containers
+// and dropped otherwise. Each step checks before changing anything, so
+// setting up twice or tearing down what is gone already is fine.
+type iptablesSandbox struct {
+	run CommandRunner
+	/// no guard if empty
+	metadataAddr string
+}
+
+// NewIptablesSandbox runs iptables with run, the real one if nil. Forwarded
+// traffic to metadataAddr is dropped unless allowed, if it is set.
+func NewIptablesSandbox(run CommandRunner, metadataAddr string) Sandbox {
+	if run == nil {
+		run = execRunner{}
+	}
+	return &iptablesSandbox{run: run, metadataAddr: metadataAddr}
+}
+
+// xtables runs iptables on table. It waits for the xtables lock, as docker
+// changes the tables as well.
+func (s *iptablesSandbox) xtables(table string, args ...string) ([]byte,
+	error) {
+	args = append([]string{"-w", "-t", table}, args...)
+	out, err := s.run.Run("iptables", args...)
+	if err != nil {
+		return nil, fmt.Errorf("iptables %s: %v: %s", strings.Join(args, " "),
+			err, bytes.TrimSpace(out))
+	}
+	return out, nil
+}
+
+// output runs iptables on the nat table.
+func (s *iptablesSandbox) output(args ...string) ([]byte, error) {
+	return s.xtables("nat", args...)
+}
+
+func (s *iptablesSandbox) iptables(args ...string) error {
+	_, err := s.output(args...)
+	return err
+}
+
+// exists runs a check, iptables fails if the chain or rule is not there.
+func (s *iptablesSandbox) exists(args ...string) bool {
+	return s.iptables(args...) == nil
+}
+
+func (s *iptablesSandbox) chainExists(chain string) bool {
+	return s.exists("-S", chain)
+}
+
+func (s *iptablesSandbox) ContainerChainName(id string) string {
+	return CONTAINER_CHAIN_PREFIX + id
+}
+
+func (s *iptablesSandbox) SetupContainerChain(id string) error {
+	chain := s.ContainerChainName(id)
+	if !s.chainExists(chain) {
+		if err := s.iptables("-N", chain); err != nil {
+			return err
+		}
+	}
+	if !s.exists("-C", NAT_POSTROUTING, "-j", chain) {
+		return s.iptables("-I", NAT_POSTROUTING, "-j", chain)
+	}
+	return nil
+}
+
+func (s *iptablesSandbox) RemoveContainerChain(id string) error {
+	chain := s.ContainerChainName(id)
+	/// a jump inserted more than once goes as a whole
+	for s.exists("-C", NAT_POSTROUTING, "-j", chain) {
+		if err := s.iptables("-D", NAT_POSTROUTING, "-j", chain); err != nil {
+			return err
+		}
+	}
+	if !s.chainExists(chain) {
+		return nil
+	}
+	if err := s.iptables("-F", chain); err != nil {
+		return err
+	}
+	return s.iptables("-X", chain)
+}
+
+// staticPortRule masquerades the traffic of the ip leaving its subnet, the
+// one to its neighbours on the bridge keeps its source ports.
+func staticPortRule(chain, protocol, ip, subnet string,
+	portMin, portMax int) []string {
+	return []string{chain, "-s", ip, "!", "-d", subnet, "-p", protocol,
+		"-j", "MASQUERADE", "--to-ports", fmt.Sprintf("%d-%d", portMin, portMax)}
+}
+
+func (s *iptablesSandbox) SetupStaticPortMapping(id string, containerIp string,
+	subnet string, portMin int, portMax int) error {
+	ip := net.ParseIP(containerIp)
+	if ip == nil {
+		return fmt.Errorf("invalid container ip %q", containerIp)
+	}
+	_, network, err := net.ParseCIDR(subnet)
+	if err != nil || !network.Contains(ip) {
+		return fmt.Errorf("invalid container subnet %q for %s", subnet,
+			containerIp)
+	}
+	if ip.To4() == nil {
+		/// IPv6 containers are routed rather than masqueraded
+		log.Debugf("no static port mapping for %s on %s", id, containerIp)
+		return nil
+	}
+	if err := s.SetupContainerChain(id); err != nil {
+		return err
+	}
+	chain := s.ContainerChainName(id)
+	for _, proto := range [2]string{"tcp", "udp"} {
+		rule := staticPortRule(chain, proto, containerIp, network.String(),
+			portMin, portMax)
+		if s.exists(append([]string{"-C"}, rule...)...) {
+			continue
+		}
+		if err := s.iptables(append([]string{"-A"}, rule...)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *iptablesSandbox) ClearStaticPortMapping(id string) error {
+	chain := s.ContainerChainName(id)
+	if !s.chainExists(chain) {
+		return nil
+	}
+	return s.iptables("-F", chain)
+}
+
+// SweepContainerChains removes the container chains left by previous runs,
+// but those of the containers in keep.
+func (s *iptablesSandbox) SweepContainerChains(keep []string) error {
+	out, err := s.output("-S")
+	if err != nil {
+		return err
+	}
+	kept := make(map[string]bool, len(keep))
+	for _, id := range keep {
+		kept[s.ContainerChainName(id)] = true
+	}
+	var result error
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != "-N" || kept[fields[1]] ||
+			!strings.HasPrefix(fields[1], CONTAINER_CHAIN_PREFIX) {
+			continue
+		}
+		log.Infof("removing orphaned chain %s", fields[1])
+		id := strings.TrimPrefix(fields[1], CONTAINER_CHAIN_PREFIX)
+		if err := s.RemoveContainerChain(id); err != nil {
+			log.Errorf("removing orphaned chain %s: %v", fields[1], err)
+			result = err
+		}
+	}
+	if s.metadataAddr == "" || !s.filterExists("-S", METADATA_CHAIN) {
+		return result
+	}
+	rules, err := s.metadataRules()
+	if err != nil {
+		return err
+	}
+	for chain, chainRules := range rules {
+		if kept[chain] {
+			continue
+		}
+		log.Infof("removing orphaned metadata access of %s", chain)
+		for _, rule := range chainRules {
+			if err := s.filter(append([]string{"-D"}, rule...)...); err != nil {
+				log.Errorf("removing orphaned metadata access of %s: %v",
+					chain, err)
+				result = err
+			}
+		}
+	}
+	return result
+}
+
+func (s *iptablesSandbox) filter(args ...string) error {
+	_, err := s.xtables("filter", args...)
+	return err
+}
+
+func (s *iptablesSandbox) filterExists(args ...string) bool {
+	return s.filter(args...) == nil
+}
+
+func (s *iptablesSandbox) SetupMetadataGuard() error {
+	if s.metadataAddr == "" {
+		return nil
+	}
+	if !s.filterExists("-S", METADATA_CHAIN) {
+		if err := s.filter("-N", METADATA_CHAIN); err != nil {
+			return err
+		}
+	}
+	/// the accepting rules are inserted before it
+	if !s.filterExists("-C", METADATA_CHAIN, "-j", "DROP") {
+		if err := s.filter("-A", METADATA_CHAIN, "-j", "DROP"); err != nil {
+			return err
+		}
+	}
+	jump := []string{FILTER_FORWARD, "-d", s.metadataAddr, "-j",
+		METADATA_CHAIN}
+	if !s.filterExists(append([]string{"-C"}, jump...)...) {
+		return s.filter(append([]string{"-I"}, jump...)...)
+	}
+	return nil
+}
+
+// metadataRules lists the rules accepting the traffic of containers to the
+// metadata server, by the chain name of the container in their comment.
+func (s *iptablesSandbox) metadataRules() (map[string][][]string, error) {
+	out, err := s.xtables("filter", "-S", METADATA_CHAIN)
+	if err != nil {
+		return nil, err
+	}
+	rules := make(map[string][][]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "-A" {
+			continue
+		}
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] == "--comment" {
+				chain := strings.Trim(fields[i+1], `"`)
+				rules[chain] = append(rules[chain], fields[1:])
+				break
+			}
+		}
+	}
+	return rules, nil
+}
+
+func metadataRuleSource(rule []string) string {
+	for i := 0; i+1 < len(rule); i++ {
+		if rule[i] == "-s" {
+			return strings.TrimSuffix(rule[i+1], "/32")
+		}
+	}
+	return ""
+}
+
+func (s *iptablesSandbox) AllowMetadataAccess(id string, ips []string) error {
+	if s.metadataAddr == "" {
+		return nil
+	}
+	rules, err := s.metadataRules()
+	if err != nil {
+		return err
+	}
+	chain := s.ContainerChainName(id)
+	/// the guard is on IPv4 only
+	wanted := make([]string, 0, len(ips))
+	missing := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() != nil {
+			wanted = append(wanted, parsed.String())
+			missing[parsed.String()] = true
+		}
+	}
+	for _, rule := range rules[chain] {
+		source := metadataRuleSource(rule)
+		if missing[source] {
+			missing[source] = false
+			continue
+		}
+		if err := s.filter(append([]string{"-D"}, rule...)...); err != nil {
+			return err
+		}
+	}
+	for _, ip := range wanted {
+		if !missing[ip] {
+			continue
+		}
+		missing[ip] = false
+		if err := s.filter("-I", METADATA_CHAIN, "-s", ip, "-m", "comment",
+			"--comment", chain, "-j", "ACCEPT"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *iptablesSandbox) RevokeMetadataAccess(id string) error {
+	if s.metadataAddr == "" {
+		return nil
+	}
+	rules, err := s.metadataRules()
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules[s.ContainerChainName(id)] {
+		if err := s.filter(append([]string{"-D"}, rule...)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+package docker
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// natTable records the iptables commands run and keeps the table they make,
+// the nat one unless named otherwise, failing the way iptables does on
+// missing chains and rules.
+type natTable struct {
+	name   string
+	calls  []string
+	chains map[string][]string // chain to its rules, in order
+	order  []string
+}
+
+func newTable(name string, chains ...string) *natTable {
+	t := &natTable{name: name, chains: make(map[string][]string)}
+	for _, chain := range chains {
+		t.chains[chain] = []string{}
+		t.order = append(t.order, chain)
+	}
+	return t
+}
+
+func newNatTable(chains ...string) *natTable {
+	return newTable("nat", append([]string{NAT_POSTROUTING}, chains...)...)
+}
+
+func newFilterTable(chains ...string) *natTable {
+	return newTable("filter", append([]string{FILTER_FORWARD}, chains...)...)
+}
+
+// xtables runs each iptables command on the table it names.
+type xtables map[string]*natTable
+
+func (x xtables) Run(name string, args ...string) ([]byte, error) {
+	if len(args) < 3 || x[args[2]] == nil {
+		return nil, fmt.Errorf("unexpected command %s %v", name, args)
+	}
+	return x[args[2]].Run(name, args...)
+}
+
+// changes lists the calls changing the table, the checks left out.
+func (t *natTable) changes() []string {
+	result := []string{}
+	for _, call := range t.calls {
+		if !strings.Contains(call, " -C ") && !strings.Contains(call, " -S") {
+			result = append(result, call)
+		}
+	}
+	return result
+}
+
+func (t *natTable) Run(name string, args ...string) ([]byte, error) {
+	t.calls = append(t.calls, name+" "+strings.Join(args, " "))
+	if name != "iptables" || len(args) < 4 ||
+		strings.Join(args[:3], " ") != "-w -t "+t.name {
+		return nil, fmt.Errorf("unexpected command %s %v", name, args)
+	}
+	op, args := args[3], args[4:]
+	chain, rule := "", ""
+	if len(args) > 0 {
+		chain, rule = args[0], strings.Join(args[1:], " ")
+	}
+	rules, exists := t.chains[chain]
+	missing := errors.New("exit status 1")
+	switch op {
+	case "-S":
+		if chain == "" {
+			out := ""
+			for _, c := range t.order {
+				out += "-N " + c + "\n"
+				for _, r := range t.chains[c] {
+					out += "-A " + c + " " + r + "\n"
+				}
+			}
+			return []byte(out), nil
+		}
+		if !exists {
+			return []byte("No chain/target/match by that name."), missing
+		}
+		out := "-N " + chain + "\n"
+		for _, r := range rules {
+			out += "-A " + chain + " " + r + "\n"
+		}
+		return []byte(out), nil
+	case "-N":
+		if exists {
+			return []byte("Chain already exists."), missing
+		}
+		t.chains[chain] = []string{}
+		t.order = append(t.order, chain)
+		return nil, nil
+	case "-X":
+		if !exists || len(rules) > 0 {
+			return []byte("Directory not empty."), missing
+		}
+		delete(t.chains, chain)
+		for i, c := range t.order {
+			if c == chain {
+				t.order = append(t.order[:i], t.order[i+1:]...)
+				break
+			}
+		}
+		return nil, nil
+	}
+	if !exists {
+		return []byte("No chain/target/match by that name."), missing
+	}
+	found := -1
+	for i, r := range rules {
+		if r == rule {
+			found = i
+			break
+		}
+	}
+	switch op {
+	case "-F":
+		t.chains[chain] = []string{}
+	case "-A":
+		t.chains[chain] = append(rules, rule)
+	case "-I":
+		t.chains[chain] = append([]string{rule}, rules...)
+	case "-C", "-D":
+		if found < 0 {
+			return []byte("Bad rule (does a matching rule exist in that " +
+				"chain?)."), missing
+		}
+		if op == "-D" {
+			t.chains[chain] = append(rules[:found], rules[found+1:]...)
+		}
+	default:
+		return nil, fmt.Errorf("unexpected iptables %s", op)
+	}
+	return nil, nil
+}
+
+func TestIptablesSandbox(t *testing.T) {
+	table := newNatTable("DOCKER")
+	s := NewIptablesSandbox(table, "")
+
+	require.Nil(t, s.SetupStaticPortMapping("c1", "172.17.0.3",
+		"172.17.0.0/16", 20000, 20009), "mapped")
+	require.Nil(t, s.SetupStaticPortMapping("c1", "172.17.0.3",
+		"172.17.0.0/16", 20000, 20009), "mapped twice")
+	require.Nil(t, s.SetupStaticPortMapping("c1", "2001:db8:1::3",
+		"2001:db8:1::/64", 20000, 20009), "ipv6 skipped")
+	assert.Equal(t, []string{
+		"iptables -w -t nat -N ctn-c1",
+		"iptables -w -t nat -I POSTROUTING -j ctn-c1",
+		"iptables -w -t nat -A ctn-c1 -s 172.17.0.3 ! -d 172.17.0.0/16 " +
+			"-p tcp -j MASQUERADE --to-ports 20000-20009",
+		"iptables -w -t nat -A ctn-c1 -s 172.17.0.3 ! -d 172.17.0.0/16 " +
+			"-p udp -j MASQUERADE --to-ports 20000-20009",
+	}, table.changes(), "checked before changed")
+	assert.Equal(t, []string{"-j ctn-c1"}, table.chains[NAT_POSTROUTING])
+
+	table.calls = nil
+	require.Nil(t, s.ClearStaticPortMapping("c1"), "cleared")
+	assert.Empty(t, table.chains["ctn-c1"], "rules gone")
+	require.Nil(t, s.ClearStaticPortMapping("c2"), "no chain to clear")
+	require.Nil(t, s.RemoveContainerChain("c1"), "removed")
+	require.Nil(t, s.RemoveContainerChain("c1"), "removed twice")
+	assert.Equal(t, []string{
+		"iptables -w -t nat -F ctn-c1",
+		"iptables -w -t nat -D POSTROUTING -j ctn-c1",
+		"iptables -w -t nat -F ctn-c1",
+		"iptables -w -t nat -X ctn-c1",
+	}, table.changes(), "flushed before deleted")
+	assert.Empty(t, table.chains[NAT_POSTROUTING], "jump gone")
+	assert.Equal(t, []string{NAT_POSTROUTING, "DOCKER"}, table.order)
+
+	assert.NotNil(t, s.SetupStaticPortMapping("c1", "not-an-ip",
+		"172.17.0.0/16", 1, 2), "invalid ip")
+	assert.NotNil(t, s.SetupStaticPortMapping("c1", "172.17.0.3",
+		"172.18.0.0/16", 1, 2), "ip outside the subnet")
+}
+
+func TestIptablesSandboxExistingRules(t *testing.T) {
+	/// left by a daemon stopped half way
+	table := newNatTable("ctn-c1")
+	table.chains[NAT_POSTROUTING] = []string{"-j ctn-c1", "-j ctn-c1"}
+	table.chains["ctn-c1"] = []string{"-s 172.17.0.3 ! -d 172.17.0.0/16 " +
+		"-p tcp -j MASQUERADE --to-ports 20000-20009"}
+	s := NewIptablesSandbox(table, "")
+
+	require.Nil(t, s.SetupStaticPortMapping("c1", "172.17.0.3",
+		"172.17.0.0/16", 20000, 20009), "mapped")
+	assert.Equal(t, []string{
+		"iptables -w -t nat -A ctn-c1 -s 172.17.0.3 ! -d 172.17.0.0/16 " +
+			"-p udp -j MASQUERADE --to-ports 20000-20009",
+	}, table.changes(), "existing chain, jump and rule kept")
+
+	require.Nil(t, s.RemoveContainerChain("c1"), "removed")
+	assert.Empty(t, table.chains[NAT_POSTROUTING], "every jump removed")
+	_, exists := table.chains["ctn-c1"]
+	assert.False(t, exists, "chain removed")
+}
+
+func TestSweepContainerChains(t *testing.T) {
+	table := newNatTable("DOCKER", "ctn-c1", "ctn-c2", "ctn-c3")
+	table.chains[NAT_POSTROUTING] = []string{"-j ctn-c1", "-j ctn-c2"}
+	table.chains["ctn-c2"] = []string{
+		"-s 172.17.0.4 -p tcp -j MASQUERADE --to-ports 20010-20019"}
+	s := NewIptablesSandbox(table, "")
+
+	require.Nil(t, s.SweepContainerChains([]string{"c1"}), "swept")
+	assert.Equal(t, []string{NAT_POSTROUTING, "DOCKER", "ctn-c1"}, table.order,
+		"chains of gone containers removed, others left")
+	assert.Equal(t, []string{"-j ctn-c1"}, table.chains[NAT_POSTROUTING])
+
+	failing := &failingRunner{}
+	assert.NotNil(t, NewIptablesSandbox(failing, "").SweepContainerChains(nil),
+		"no iptables")
+}
+
+type failingRunner struct{}
+
+func (failingRunner) Run(name string, args ...string) ([]byte, error) {
+	return []byte(name + ": not found"), errors.New("exec failed")
+}
+
+func TestIptablesMetadataGuard(t *testing.T) {
+	filter := newFilterTable("DOCKER-USER")
+	s := NewIptablesSandbox(xtables{"nat": newNatTable(), "filter": filter},
+		"169.254.169.254")
+
+	require.Nil(t, s.SetupMetadataGuard(), "guarded")
+	require.Nil(t, s.SetupMetadataGuard(), "guarded twice")
+	assert.Equal(t, []string{
+		"iptables -w -t filter -N TAPCON-METADATA",
+		"iptables -w -t filter -A TAPCON-METADATA -j DROP",
+		"iptables -w -t filter -I FORWARD -d 169.254.169.254 -j " +
+			"TAPCON-METADATA",
+	}, filter.changes(), "checked before changed")
+
+	require.Nil(t, s.AllowMetadataAccess("c1", []string{"172.17.0.3",
+		"10.1.0.2", "2001:db8:1::3"}), "allowed")
+	require.Nil(t, s.AllowMetadataAccess("c2", []string{"172.17.0.4"}),
+		"allowed")
+	assert.Equal(t, []string{
+		"-s 172.17.0.4 -m comment --comment ctn-c2 -j ACCEPT",
+		"-s 10.1.0.2 -m comment --comment ctn-c1 -j ACCEPT",
+		"-s 172.17.0.3 -m comment --comment ctn-c1 -j ACCEPT",
+		"-j DROP",
+	}, filter.chains[METADATA_CHAIN], "accepted before dropped")
+
+	filter.calls = nil
+	require.Nil(t, s.AllowMetadataAccess("c1", []string{"172.17.0.3"}),
+		"allowed from fewer ips")
+	assert.Equal(t, []string{
+		"iptables -w -t filter -D TAPCON-METADATA -s 10.1.0.2 -m comment " +
+			"--comment ctn-c1 -j ACCEPT",
+	}, filter.changes(), "only the ip gone removed")
+
+	require.Nil(t, s.RevokeMetadataAccess("c1"), "revoked")
+	require.Nil(t, s.RevokeMetadataAccess("c1"), "revoked twice")
+	assert.Equal(t, []string{
+		"-s 172.17.0.4 -m comment --comment ctn-c2 -j ACCEPT",
+		"-j DROP",
+	}, filter.chains[METADATA_CHAIN])
+
+	require.Nil(t, s.SweepContainerChains([]string{"c1"}), "swept")
+	assert.Equal(t, []string{"-j DROP"}, filter.chains[METADATA_CHAIN],
+		"access of gone containers removed")
+
+	unguarded := NewIptablesSandbox(failingRunner{}, "")
+	assert.Nil(t, unguarded.SetupMetadataGuard(), "no guard")
+	assert.Nil(t, unguarded.AllowMetadataAccess("c1", []string{"172.17.0.3"}),
+		"no guard")
+}
@@ -0,0 +1,58 @@
+package docker
+
+import (
+	"fmt"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// setupMetadataGuard cuts the containers from the metadata server until
+// their principals are reconciled.
+func (m *Monitor) setupMetadataGuard() {
+	if err := m.SandboxBuilder.SetupMetadataGuard(); err != nil {
+		log.Errorf("guarding the metadata server: %v", err)
+	}
+}
+
+// allowMetadataAccess lets a container with its principal reconciled reach
+// the metadata server from all its IPs, as any of them may be routed there.
+func (m *Monitor) allowMetadataAccess(c *MemContainer) {
+	ips := append([]string{}, c.Ips...)
+	if err := m.SandboxBuilder.AllowMetadataAccess(tapconContainerId(c),
+		ips); err != nil {
+		/// allowed again on the next update
+		log.Errorf("allowing %s to the metadata server: %v", c.Id, err)
+		return
+	}
+	m.metadataAccessLock.Lock()
+	defer m.metadataAccessLock.Unlock()
+	if m.metadataAccess == nil {
+		m.metadataAccess = make(map[string][]string)
+	}
+	m.metadataAccess[c.Id] = ips
+}
+
+func (m *Monitor) revokeMetadataAccess(c *MemContainer) {
+	if err := m.SandboxBuilder.RevokeMetadataAccess(
+		tapconContainerId(c)); err != nil {
+		log.Errorf("revoking %s from the metadata server: %v", c.Id, err)
+		return
+	}
+	m.metadataAccessLock.Lock()
+	defer m.metadataAccessLock.Unlock()
+	delete(m.metadataAccess, c.Id)
+}
+
+// MetadataAccessReport lists the containers allowed to the metadata server,
+// each with the IPs it is allowed from.
+func (m *Monitor) MetadataAccessReport() []string {
+	m.metadataAccessLock.Lock()
+	defer m.metadataAccessLock.Unlock()
+	result := make([]string, 0, len(m.metadataAccess))
+	for id, ips := range m.metadataAccess {
+		result = append(result, fmt.Sprintf("%s %v", id, ips))
+	}
+	sort.Strings(result)
+	return result
+}
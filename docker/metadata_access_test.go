@@ -0,0 +1,27 @@
+package docker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetadataAccessReport(t *testing.T) {
+	m := &Monitor{SandboxBuilder: &fakeSandbox{}}
+	assert.Empty(t, m.MetadataAccessReport(), "none allowed")
+
+	c1 := newStubContainer("c1", "image-1", "192.168.0.1", "10.0.0.1",
+		"local-ns", "10.1.0.2", "overlay-1", 0, 0)
+	c2 := newStubContainer("c2", "image-1", "192.168.0.1", "10.0.0.1",
+		"local-ns", "10.1.0.3", "overlay-1", 0, 0)
+	m.allowMetadataAccess(c2)
+	m.allowMetadataAccess(c1)
+	assert.Equal(t, []string{"c1 [10.1.0.2 128.128.128.128]",
+		"c2 [10.1.0.3 128.128.128.128]"}, m.MetadataAccessReport(),
+		"sorted by container")
+
+	m.revokeMetadataAccess(c1)
+	m.revokeMetadataAccess(c1)
+	assert.Equal(t, []string{"c2 [10.1.0.3 128.128.128.128]"},
+		m.MetadataAccessReport(), "revoked")
+}
@@ -1,7 +1,7 @@
 package docker
 
 import (
-	"fmt"
+	"context"
 	"io/ioutil"
 	"net"
 	"os"
@@ -48,37 +48,49 @@ type ServerContainerState struct {
 type Monitor struct {
 	Watcher *fsnotify.Watcher
 
-	MetadataApi            metadata_api.MetadataAPI
-	CommandChan            chan int /// Should be a "command" in future
-	ContainerUpdateChan    chan *MemContainer
-	SandboxBuilder         Sandbox
-	NetworkWorkerLock      *sync.Mutex
-	Networks               []string /// current networks
-	NetworkWorkerQueue     []NetworkDelayFunc
-	ContainerMetadataPath  string
-	ImageMetadataPath      string
-	ImageLockCounter       *sync.Mutex
-	ContainerLock          *sync.Mutex
-	Containers             map[string]*MemContainer
-	Images                 map[string]*MemImage
-	Repo                   *Repo
-	LastUpdate             time.Time
-	timeout                time.Duration
-	cache                  ReconcileCache
-	reconcileTimeout       time.Duration
-	postMortemHandler      func(string)
-	staticPortMin          int
-	staticPortMax          int
-	staticPortPerContainer int
-	publicIp               net.IP
-	localIp                net.IP
-	localNs                string
-	debug                  bool
+	MetadataApi           metadata_api.MetadataAPI
+	Batcher               metadata_api.Batcher
+	breaker               *metadata_api.RetryApi /// nil if not configured
+	ctx                   context.Context        /// cancelled on shutdown
+	cancel                context.CancelFunc
+	limiter               *metadata_api.RateLimitedApi
+	instance              metadata_api.InstanceInfoProvider
+	CommandChan           chan int /// Should be a "command" in future
+	ContainerUpdateChan   chan *MemContainer
+	SandboxBuilder        Sandbox
+	NetworkWorkerLock     *sync.Mutex
+	Networks              []string /// current networks
+	networkInventory      NetworkInventory
+	networkInfo           map[string]NetworkInfo              /// as last listed
+	networkFacts          map[string][]metadata_api.Statement /// as posted
+	NetworkWorkerQueue    []NetworkDelayFunc
+	ContainerMetadataPath string
+	ImageMetadataPath     string
+	ImageLockCounter      *sync.Mutex
+	ContainerLock         *sync.Mutex
+	Containers            map[string]*MemContainer
+	Images                map[string]*MemImage
+	Repo                  *Repo
+	LastUpdate            time.Time
+	timeout               time.Duration
+	cache                 ReconcileCache
+	reconcileTimeout      time.Duration
+	postMortemHandler     func(string)
+	portPools             map[string]*portPool
+	staticPortLock        sync.Mutex
+	reservedStaticPorts   map[string]PortRange /// slots of unloaded containers
+	metadataAccessLock    sync.Mutex
+	metadataAccess        map[string][]string /// allowed ips by container
+	staleImagePolicy      string
+	backoff               serverBackoff
+	publicIp              net.IP
+	localIp               net.IP
+	ipv6                  []net.IP /// global, both local and public
+	localNs               string
+	debug                 bool
 
 	// port management for default network, no need to manage ports for
 	// overlay network
-	availableStaticPorts []int32
-
 	tcpPorts map[string][]PortRange
 	udpPorts map[string][]PortRange
 }
@@ -95,43 +107,82 @@ func NewMonitor(containerRoot string, api metadata_api.MetadataAPI,
 		log.Fatalf("can not obtain absolute directory: %v\n", err)
 	}
 	containerPath := filepath.Join(containerRoot, "containers")
-	imagePath := filepath.Join(containerRoot, IMAGE_PATH)
+	imagePath := ImagePath(containerRoot, storageDriver(containerRoot))
 	watcher.Add(imagePath)
 	watcher.Add(containerPath)
 
+	ctx, cancel := context.WithCancel(context.Background())
 	m := &Monitor{
-		Watcher:                watcher,
-		MetadataApi:            api,
-		CommandChan:            make(chan int),
-		ContainerUpdateChan:    make(chan *MemContainer, 10),
-		SandboxBuilder:         sbox,
-		ContainerMetadataPath:  containerPath,
-		ContainerLock:          &sync.Mutex{},
-		ImageMetadataPath:      imagePath,
-		ImageLockCounter:       &sync.Mutex{},
-		Containers:             make(map[string]*MemContainer),
-		Images:                 make(map[string]*MemImage),
-		Networks:               make([]string, 0),
-		NetworkWorkerQueue:     make([]NetworkDelayFunc, 0),
-		NetworkWorkerLock:      &sync.Mutex{},
-		LastUpdate:             time.Now(),
-		timeout:                tapcon_config.Config.Daemon.Timeout * time.Second,
-		debug:                  debug,
-		staticPortMin:          tapcon_config.Config.StaticPortBase,
-		staticPortMax:          tapcon_config.Config.StaticPortMax,
-		staticPortPerContainer: tapcon_config.Config.PortPerContainer,
+		Watcher:               watcher,
+		MetadataApi:           api,
+		CommandChan:           make(chan int),
+		ContainerUpdateChan:   make(chan *MemContainer, 10),
+		SandboxBuilder:        sbox,
+		ContainerMetadataPath: containerPath,
+		ContainerLock:         &sync.Mutex{},
+		ImageMetadataPath:     imagePath,
+		ImageLockCounter:      &sync.Mutex{},
+		Containers:            make(map[string]*MemContainer),
+		Images:                make(map[string]*MemImage),
+		Networks:              make([]string, 0),
+		NetworkWorkerQueue:    make([]NetworkDelayFunc, 0),
+		NetworkWorkerLock:     &sync.Mutex{},
+		LastUpdate:            time.Now(),
+		timeout:               tapcon_config.Config.Daemon.Timeout * time.Second,
+		debug:                 debug,
+		portPools:             newPortPools(tapcon_config.Config),
+		staleImagePolicy:      tapcon_config.Config.StaleImagePolicy,
+		ctx:                   ctx,
+		cancel:                cancel,
 	}
 	if api == nil {
-		m.MetadataApi = metadata_api.NewOpenstackMetadataAPI("")
+		ctxApi, err := newMetadataClient(tapcon_config.Config.Metadata)
+		if err != nil {
+			cancel()
+			watcher.Close()
+			return nil, err
+		}
+		/// a hung server must not block the keepers forever
+		m.MetadataApi = metadata_api.NoContext(ctxApi, ctx,
+			tapcon_config.Config.Metadata.Timeout*time.Second)
+	}
+	/// each retry attempt is rate limited as well
+	m.setupRateLimit(tapcon_config.Config.Metadata)
+	m.setupRetry(tapcon_config.Config.Metadata)
+	if err := m.setupRecording(tapcon_config.Config.Metadata); err != nil {
+		cancel()
+		watcher.Close()
+		return nil, err
+	}
+	if err := m.setupInstanceProvider(tapcon_config.Config); err != nil {
+		cancel()
+		watcher.Close()
+		return nil, err
+	}
+	m.Batcher = m.MetadataApi
+	if batchSize := tapcon_config.Config.Metadata.BatchSize; batchSize > 0 {
+		m.Batcher = metadata_api.NewBatchBuffer(m.MetadataApi, batchSize,
+			tapcon_config.Config.Metadata.BatchInterval*time.Millisecond)
 	}
 	if sbox == nil {
-		m.SandboxBuilder = &sandbox{}
+		guard := tapcon_config.Config.MetadataGuard
+		if guard == tapcon_config.METADATA_GUARD_OFF {
+			guard = ""
+		}
+		builder, err := NewSandbox(tapcon_config.Config.Sandbox, guard, nil)
+		if err != nil {
+			cancel()
+			watcher.Close()
+			return nil, err
+		}
+		m.SandboxBuilder = builder
 	}
+	m.networkInventory = NewDockerNetworkInventory(
+		tapcon_config.Config.DockerSocket)
 
-	m.availableStaticPorts = make([]int32, (m.staticPortMax-m.staticPortMin)/
-		m.staticPortPerContainer)
-	m.resetAllStaticPortSlot()
 	m.setupInstanceIpInfo()
+	m.sweepContainerChains()
+	m.setupMetadataGuard()
 	// Force a scan to avoid missing events
 	m.Scan()
 
@@ -142,6 +193,24 @@ func NewMonitor(containerRoot string, api metadata_api.MetadataAPI,
 	return m, nil
 }
 
+func storageDriver(containerRoot string) string {
+	driver := tapcon_config.Config.StorageDriver
+	if driver != "" {
+		if !IsStorageDriver(driver) {
+			log.Warnf("unknown storage driver %s, assuming default layout", driver)
+		}
+		return driver
+	}
+	driver, err := DetectStorageDriver(containerRoot, DOCKER_DAEMON_CONFIG)
+	if err != nil {
+		log.Warnf("can not detect storage driver, using %s: %v",
+			DEFAULT_STORAGE_DRIVER, err)
+		return DEFAULT_STORAGE_DRIVER
+	}
+	log.Infof("storage driver: %s", driver)
+	return driver
+}
+
 func (m *Monitor) scanImageUpdate() error {
 
 	r, err := LoadImageRepos(m.ImageMetadataPath)
@@ -152,7 +221,9 @@ func (m *Monitor) scanImageUpdate() error {
 	m.Repo = r
 	/// FIXME: may need to handle images not valid, but still in repositories.json
 	images := GetAllImageIds(m.Repo)
+	current := make(map[string]bool, len(images))
 	for _, id := range images {
+		current[id] = true
 		image, ok := m.Images[id]
 		if !ok {
 			image = NewMemImage(m.ImageMetadataPath, id)
@@ -171,10 +242,50 @@ func (m *Monitor) scanImageUpdate() error {
 		}
 		m.Images[id] = image
 	}
+	m.removeStaleImages(current)
 
 	return nil
 }
 
+// images linked by known containers, keyed by tapcon image id
+func (m *Monitor) imagesInUse() map[string]bool {
+	m.ContainerLock.Lock()
+	defer m.ContainerLock.Unlock()
+	inUse := make(map[string]bool)
+	for _, c := range m.Containers {
+		if c.Config == nil {
+			continue
+		}
+		inUse[tapconContainerImageId(c)] = true
+	}
+	return inUse
+}
+
+func (m *Monitor) removeStaleImages(current map[string]bool) {
+	var inUse map[string]bool
+	for id, image := range m.Images {
+		if current[id] {
+			continue
+		}
+		if inUse == nil {
+			inUse = m.imagesInUse()
+		}
+		// Force removed image can still be used by containers, whose link
+		// proofs point to the image principal. Keep it until they are gone.
+		if inUse[tapconImageId(image)] {
+			log.Debugf("image %s removed but still in use", id)
+			continue
+		}
+		log.Infof("removing image entry: %s", id)
+		if err := m.WithdrawImageProof(image); err != nil {
+			// keep the entry so next scan retries
+			log.Errorf("can't withdraw proof for %s: %v", id, err)
+			continue
+		}
+		delete(m.Images, id)
+	}
+}
+
 func (m *Monitor) ScanImageUpdate() error {
 	m.ImageLockCounter.Lock()
 	defer m.ImageLockCounter.Unlock()
@@ -208,48 +319,70 @@ func (m *Monitor) Keeper(c *MemContainer) {
 		select {
 		case e := <-c.EventChan:
 			if e == CONTAINER_DEAD {
+				m.releaseStaticPorts(c)
+				m.revokeMetadataAccess(c)
+				if err := m.SandboxBuilder.RemoveContainerChain(
+					tapconContainerId(c)); err != nil {
+					log.Errorf("removing chain of %s: %v", c.Id, err)
+				}
 				break
 			}
-			c.Refresh()
-			//if err := c.Refresh(); err != nil {
-			//	// this may happen that a container has been deleted
-			//	log.Printf("refresh error: %v", err)
-			//}
+			if wait := m.backoff.Remaining(); wait > 0 {
+				log.Debugf("metadata server backing off, retry %s in %v",
+					c.Id, wait)
+				m.retryLater(c, wait)
+				continue
+			}
+			/// a principal not found is recreated below, but there is no point
+			// to go on if the server can not be reached
+			if err := c.Refresh(); metadata_api.IsUnavailable(err) {
+				m.checkServer(c, err)
+				continue
+			}
+			var err error
 			if c.Load() {
-				//if c.StaticPortMin == 0 {
-				//	prange, err := m.allocateStaticPortSlot()
-				//	m.SandboxBuilder.ClearStaticPortMapping(cid)
-				//	if err != nil {
-				//		log.Warnf("unable to allocate static ports, retry later")
-				//		continue
-				//	}
-				//	c.StaticPortMin = prange.min
-				//	c.StaticPortMax = prange.max
-				//	for _, ip := range c.Ips {
-				//		if c.IsContainerIp(ip) {
-				//			m.SandboxBuilder.SetupStaticPortMapping(cid, ip,
-				//				prange.min, prange.max)
-				//		}
-				//	}
-				//}
+				if c.Running() {
+					if err := m.assignStaticPorts(c); err != nil {
+						log.Warnf("no static ports for %s yet: %v", c.Id, err)
+					}
+				}
 				/// no matter refresh success or fail, we will resync the
 				// server cache (maybe empty) and client side status
 
 				//set repo string
 				/// Hotcloud2017Workaround
 				log.Debugf("container %s loaded, reconciling", c.Id)
-				c.Cache.Create()
+				if err = c.Cache.Create(); err == nil {
+					m.allowMetadataAccess(c)
+				}
 			} else {
 				log.Debugf("container %s removed, reconciling", c.Id)
-				c.Cache.Remove()
-				//m.SandboxBuilder.ClearStaticPortMapping(cid)
-				//m.deallocateStaticPortByContainer(c)
+				m.releaseStaticPorts(c)
+				m.revokeMetadataAccess(c)
+				err = c.Cache.Remove()
 			}
+			m.checkServer(c, err)
+		}
+	}
+}
+
+// sweepContainerChains removes the sandbox chains of the containers gone
+// while the daemon was not running.
+func (m *Monitor) sweepContainerChains() {
+	files, err := ioutil.ReadDir(m.ContainerMetadataPath)
+	if err != nil {
+		log.Errorf("listing containers to sweep chains: %v", err)
+		return
+	}
+	keep := make([]string, 0, len(files))
+	for _, f := range files {
+		if f.IsDir() {
+			keep = append(keep, tapconStringId(f.Name()))
 		}
 	}
-	//m.SandboxBuilder.RemoveContainerChain(cid)
-	/// withdraw restriction on container
-	//m.deallocateStaticPortByContainer(c)
+	if err := m.SandboxBuilder.SweepContainerChains(keep); err != nil {
+		log.Errorf("sweeping orphaned chains: %v", err)
+	}
 }
 
 func (m *Monitor) containerEntriesReload() {
@@ -280,6 +413,14 @@ func (m *Monitor) containerEntriesReload() {
 			c.EventChan <- NEED_UPDATE
 		} else {
 			root := filepath.Join(m.ContainerMetadataPath, f.Name())
+			if p, ok := serverState[cid]; ok {
+				if published, err := loadPublishedHostPorts(f.Name(),
+					root); err != nil {
+					log.Warnf("no static ports reserved for %s: %v", cid, err)
+				} else {
+					m.reserveStaticPorts(cid, &p, published)
+				}
+			}
 			m.allocateNewMemContainer(cid, root)
 		}
 	}
@@ -328,7 +469,7 @@ func (m *Monitor) allocateNewMemContainer(id, root string) {
 	if m.debug {
 		c.listIp = StubListIP
 	}
-	c.Cache = NewReconcileCache(m.MetadataApi, c)
+	c.Cache = NewBatchedReconcileCache(m.MetadataApi, m.Batcher, c)
 	c.VmIps = []instanceIp{
 		instanceIp{
 			ns: m.localNs,
@@ -339,6 +480,12 @@ func (m *Monitor) allocateNewMemContainer(id, root string) {
 			ip: m.publicIp.String(),
 		},
 	}
+	for _, ip := range m.ipv6 {
+		c.VmIps = append(c.VmIps, instanceIp{
+			ns: ipv6Ns(ip, m.localNs),
+			ip: ip.String(),
+		})
+	}
 
 	log.Infof("loading container entry: %s", id)
 
@@ -415,7 +562,11 @@ func (m *Monitor) handleFsEvent(e fsnotify.Event) error {
 }
 
 func (m *Monitor) ScanNetworkUpdate() {
-	toAdd, toDelete := m.NetworkChanges()
+	toAdd, toDelete, err := m.NetworkChanges()
+	if err != nil {
+		log.Errorf("network inventory unknown, namespaces kept: %v", err)
+		return
+	}
 	if len(toAdd) > 0 || len(toDelete) > 0 {
 		log.Debugf("adding network: %v, deleting %v", toAdd, toDelete)
 
@@ -429,6 +580,7 @@ func (m *Monitor) ScanNetworkUpdate() {
 		}
 
 		for _, n := range toDelete {
+			m.withdrawNetworkFacts(n)
 			if err := m.MetadataApi.LeaveNs(n); err != nil {
 				log.Errorf("failing to leave ns %s", n)
 			}
@@ -437,6 +589,7 @@ func (m *Monitor) ScanNetworkUpdate() {
 			}
 		}
 	}
+	m.updateNetworkFacts()
 }
 
 func (m *Monitor) Scan() {
@@ -464,8 +617,110 @@ func (m *Monitor) WorkAndWait(sigchan chan os.Signal) {
 			//m.Reconcile()
 		case <-sigchan:
 			m.Dump()
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// Shutdown sends the buffered mutations, then stops WorkAndWait and cancels
+// the metadata calls in flight, the ones waiting for rate limit tokens too.
+// Mutations batched from then on fail.
+func (m *Monitor) Shutdown() {
+	if buffer, ok := m.Batcher.(*metadata_api.BatchBuffer); ok {
+		buffer.Close()
+	}
+	m.cancel()
+}
+
+func newMetadataClient(
+	conf tapcon_config.MetadataServiceConfig) (metadata_api.ContextMetadataAPI,
+	error) {
+	api := metadata_api.NewOpenstackContextAPI(conf.Address)
+	if conf.Protocol == tapcon_config.METADATA_HTTPS {
+		var err error
+		api, err = metadata_api.NewOpenstackTLSContextAPI(conf.Address,
+			metadata_api.TLSConfig{
+				CACert:     conf.CACert,
+				ClientCert: conf.ClientCert,
+				ClientKey:  conf.ClientKey,
+				ServerName: conf.ServerName,
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+	api.SetProtocolVersion(conf.ProtocolVersion)
+	api.SetImds(conf.Imds, conf.ImdsTokenTTL*time.Second)
+	if conf.SigningKey != "" {
+		keyId := conf.SigningKeyId
+		if keyId == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				return nil, err
+			}
+			keyId = hostname
+		}
+		signer, err := metadata_api.LoadRequestSigner(keyId, conf.SigningKey)
+		if err != nil {
+			return nil, err
 		}
+		api.SetSigner(signer)
 	}
+	return api, nil
+}
+
+// setupRateLimit puts the metadata api on read and mutation budgets, if any
+// is configured.
+func (m *Monitor) setupRateLimit(conf tapcon_config.MetadataServiceConfig) {
+	if conf.ReadRate <= 0 && conf.MutationRate <= 0 {
+		return
+	}
+	m.limiter = metadata_api.NewRateLimitedApi(m.ctx, m.MetadataApi,
+		metadata_api.NewTokenBucket(conf.ReadRate, conf.ReadBurst),
+		metadata_api.NewTokenBucket(conf.MutationRate, conf.MutationBurst))
+	m.MetadataApi = m.limiter
+}
+
+// setupRecording records the calls made to the metadata api, as the
+// reconciliation sees them, i.e. after retries.
+func (m *Monitor) setupRecording(conf tapcon_config.MetadataServiceConfig) error {
+	if conf.RecordFile == "" {
+		return nil
+	}
+	f, err := os.OpenFile(conf.RecordFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0600)
+	if err != nil {
+		return err
+	}
+	log.Infof("recording metadata api calls to %s", conf.RecordFile)
+	m.MetadataApi = metadata_api.NewRecordingApi(m.MetadataApi, f)
+	return nil
+}
+
+// setupInstanceProvider picks where the identity of the instance comes from.
+// The metadata service is asked through the same retries as other calls, and
+// each cloud asked has the metadata timeout to answer.
+func (m *Monitor) setupInstanceProvider(conf *tapcon_config.TapconConfig) error {
+	instance := conf.Instance
+	if instance.Provider == tapcon_config.INSTANCE_STATIC {
+		provider, err := metadata_api.NewStaticInstanceProvider(
+			instance.LocalIp, instance.PublicIp, instance.Ipv6, instance.Ns)
+		if err != nil {
+			return err
+		}
+		m.instance = provider
+		return nil
+	}
+	provider, err := metadata_api.NewInstanceProvider(instance.Provider,
+		instance.Address, conf.Metadata.Imds,
+		conf.Metadata.Timeout*time.Second,
+		metadata_api.WithContext(m.MetadataApi))
+	if err != nil {
+		return err
+	}
+	m.instance = provider
+	return nil
 }
 
 func (m *Monitor) Dump() {
@@ -473,21 +728,19 @@ func (m *Monitor) Dump() {
 	log.Infof("container path %s", m.ContainerMetadataPath)
 	log.Infof("image path %s", m.ImageMetadataPath)
 	log.Infof("timeout %v", m.timeout)
-	log.Infof("static %d %d %d", m.staticPortMin, m.staticPortMax,
-		m.staticPortPerContainer)
+	log.Infof("metadata api breaker %s", m.BreakerState())
+	if m.limiter != nil {
+		metrics := m.limiter.Metrics()
+		log.Infof("metadata reads %d, throttled %d for %v",
+			metrics.Reads.Calls, metrics.Reads.Throttled, metrics.Reads.Waited)
+		log.Infof("metadata mutations %d, throttled %d for %v",
+			metrics.Mutations.Calls, metrics.Mutations.Throttled,
+			metrics.Mutations.Waited)
+	}
 	log.Infof("ipinfo: %s %s %s", m.publicIp.String(), m.localIp.String(),
 		m.localNs)
-	result := make([]string, 0, len(m.availableStaticPorts))
-	for i, p := range m.availableStaticPorts {
-		// This may have memory ordering issue as we didn't use barrier. But
-		// it doesn't matter
-		if p != 0 {
-			pmin := m.staticPortMin + i*m.staticPortPerContainer
-			pmax := pmin + m.staticPortPerContainer - 1
-			result = append(result, fmt.Sprintf("%d-%d", pmin, pmax))
-		}
-	}
-	log.Infof("allocated ports: %v", result)
+	m.dumpPortPools()
+	log.Infof("metadata access: %v", m.MetadataAccessReport())
 	m.ContainerLock.Lock()
 	log.Infof("-------Containers---------")
 
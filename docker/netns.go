@@ -0,0 +1,35 @@
+package docker
+
+import (
+	"fmt"
+	"net"
+)
+
+/// Addresses of the network namespaces, read over netlink from inside them.
+// Docker binds the ns to its own place so ip-route tools can not use it.
+
+// NsAddr is an address of an interface in a network namespace.
+type NsAddr struct {
+	Iface     string
+	IP        net.IP
+	PrefixLen int
+}
+
+func (a NsAddr) String() string {
+	return fmt.Sprintf("%s %s/%d", a.Iface, a.IP, a.PrefixLen)
+}
+
+// containerIps keeps the addresses reachable from outside, i.e. neither
+// loopback nor link local, with IPv6 ones written the canonical way.
+func containerIps(addrs []NsAddr) []string {
+	result := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		/// every IPv6 interface has a link local address, lo has ::1, none
+		// of them reachable from outside
+		if addr.IP.IsLoopback() || addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		result = append(result, addr.IP.String())
+	}
+	return result
+}
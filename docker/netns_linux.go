@@ -0,0 +1,184 @@
+//go:build linux
+// +build linux
+
+package docker
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// InNetns runs fn in the network namespace at path, e.g. the SandboxKey of a
+// container. fn runs on a thread of its own, locked for the time being, as
+// the other goroutines must not end up in the namespace.
+func InNetns(path string, fn func() error) error {
+	target, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening netns %s: %v", path, err)
+	}
+	defer target.Close()
+
+	result := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		origin, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net",
+			unix.Gettid()))
+		if err != nil {
+			runtime.UnlockOSThread()
+			result <- fmt.Errorf("opening current netns: %v", err)
+			return
+		}
+		defer origin.Close()
+		if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+			runtime.UnlockOSThread()
+			result <- fmt.Errorf("entering netns %s: %v", path, err)
+			return
+		}
+		fnErr := fn()
+		if err := unix.Setns(int(origin.Fd()), unix.CLONE_NEWNET); err != nil {
+			/// the thread stays locked and goes away with the goroutine
+			log.Errorf("leaving netns %s: %v", path, err)
+		} else {
+			runtime.UnlockOSThread()
+		}
+		result <- fnErr
+	}()
+	return <-result
+}
+
+// ListNsAddrs lists the addresses of all interfaces in the network
+// namespace at path.
+func ListNsAddrs(path string) ([]NsAddr, error) {
+	var addrs []NsAddr
+	err := InNetns(path, func() error {
+		var err error
+		addrs, err = netlinkAddrs()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addrs, nil
+}
+
+// ListNsIps lists the addresses of a container reachable from outside, i.e.
+// neither loopback nor link local, with IPv6 ones written the canonical way.
+func ListNsIps(ns string) ([]string, error) {
+	addrs, err := ListNsAddrs(ns)
+	if err != nil {
+		return nil, err
+	}
+	return containerIps(addrs), nil
+}
+
+// netlinkDump sends a dump request of the type in the current netns and
+// gives the messages answered.
+func netlinkDump(typ int) ([]syscall.NetlinkMessage, error) {
+	tab, err := syscall.NetlinkRIB(typ, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, os.NewSyscallError("netlinkrib", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(tab)
+	if err != nil {
+		return nil, os.NewSyscallError("parsenetlinkmessage", err)
+	}
+	result := make([]syscall.NetlinkMessage, 0, len(msgs))
+	for _, m := range msgs {
+		switch m.Header.Type {
+		case syscall.NLMSG_DONE:
+			return result, nil
+		case syscall.NLMSG_ERROR:
+			return nil, fmt.Errorf("netlink dump %d failed", typ)
+		}
+		result = append(result, m)
+	}
+	return result, nil
+}
+
+// netlinkLinks maps the interface indexes to names.
+func netlinkLinks() (map[int32]string, error) {
+	msgs, err := netlinkDump(syscall.RTM_GETLINK)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[int32]string, len(msgs))
+	for i := range msgs {
+		m := &msgs[i]
+		if m.Header.Type != syscall.RTM_NEWLINK ||
+			len(m.Data) < syscall.SizeofIfInfomsg {
+			continue
+		}
+		info := (*syscall.IfInfomsg)(unsafe.Pointer(&m.Data[0]))
+		attrs, err := syscall.ParseNetlinkRouteAttr(m)
+		if err != nil {
+			return nil, os.NewSyscallError("parsenetlinkrouteattr", err)
+		}
+		for _, a := range attrs {
+			if a.Attr.Type == syscall.IFLA_IFNAME {
+				names[info.Index] = strings.TrimRight(string(a.Value), "\x00")
+			}
+		}
+	}
+	return names, nil
+}
+
+func netlinkAddrs() ([]NsAddr, error) {
+	names, err := netlinkLinks()
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := netlinkDump(syscall.RTM_GETADDR)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]NsAddr, 0, len(msgs))
+	for i := range msgs {
+		m := &msgs[i]
+		if m.Header.Type != syscall.RTM_NEWADDR ||
+			len(m.Data) < syscall.SizeofIfAddrmsg {
+			continue
+		}
+		info := (*syscall.IfAddrmsg)(unsafe.Pointer(&m.Data[0]))
+		attrs, err := syscall.ParseNetlinkRouteAttr(m)
+		if err != nil {
+			return nil, os.NewSyscallError("parsenetlinkrouteattr", err)
+		}
+		/// IFA_ADDRESS is the peer on point to point links, IFA_LOCAL ours
+		var local, address net.IP
+		for _, a := range attrs {
+			switch a.Attr.Type {
+			case syscall.IFA_LOCAL:
+				local = append(net.IP(nil), a.Value...)
+			case syscall.IFA_ADDRESS:
+				address = append(net.IP(nil), a.Value...)
+			}
+		}
+		ip := local
+		if ip == nil {
+			ip = address
+		}
+		if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+			log.Warnf("netlink address of family %d skipped: %v", info.Family,
+				ip)
+			continue
+		}
+		name, ok := names[int32(info.Index)]
+		if !ok {
+			name = fmt.Sprintf("if%d", info.Index)
+		}
+		addrs = append(addrs, NsAddr{
+			Iface:     name,
+			IP:        ip,
+			PrefixLen: int(info.Prefixlen),
+		})
+	}
+	return addrs, nil
+}
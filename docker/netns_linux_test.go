@@ -0,0 +1,85 @@
+//go:build linux
+// +build linux
+
+package docker
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startNetns starts a process in new user and network namespaces with a
+// veth interface, as a container would have. Tests are skipped where
+// unprivileged namespaces are not available.
+func startNetns(t *testing.T) (string, func()) {
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("no ip command to configure the namespace")
+	}
+	cmd := exec.Command("sh", "-c", "ip link set lo up && "+
+		"ip link add eth0 type veth peer name peer0 && "+
+		"ip link set peer0 up && ip link set eth0 up && "+
+		"ip addr add 172.17.0.3/16 dev eth0 && "+
+		"ip -6 addr add 2001:db8:1::242:ac11:3/64 dev eth0 nodad && "+
+		"echo ready && exec sleep 60")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET,
+		UidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+	}
+	out, err := cmd.StdoutPipe()
+	require.Nil(t, err, "stdout pipe")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("no unprivileged user and network namespaces: %v", err)
+	}
+	done := func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+	line, err := bufio.NewReader(out).ReadString('\n')
+	if err != nil || line != "ready\n" {
+		done()
+		t.Skipf("configuring the namespace: %v", err)
+	}
+	return fmt.Sprintf("/proc/%d/ns/net", cmd.Process.Pid), done
+}
+
+func TestListNsAddrs(t *testing.T) {
+	ns, done := startNetns(t)
+	defer done()
+
+	addrs, err := ListNsAddrs(ns)
+	if err != nil {
+		t.Skipf("entering the namespace: %v", err)
+	}
+	strs := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		strs = append(strs, addr.String())
+	}
+	assert.Contains(t, strs, "lo 127.0.0.1/8")
+	assert.Contains(t, strs, "eth0 172.17.0.3/16")
+	assert.Contains(t, strs, "eth0 2001:db8:1::242:ac11:3/64")
+
+	ips, err := ListNsIps(ns)
+	require.Nil(t, err, "listing ips")
+	assert.Equal(t, []string{"172.17.0.3", "2001:db8:1::242:ac11:3"}, ips,
+		"loopback and link local skipped")
+
+	/// the caller is back in its own namespace
+	host, err := ListNsIps(fmt.Sprintf("/proc/%d/ns/net", os.Getpid()))
+	require.Nil(t, err, "listing own ips")
+	assert.NotContains(t, host, "2001:db8:1::242:ac11:3")
+}
+
+func TestListNsIpsMissing(t *testing.T) {
+	_, err := ListNsIps("/var/run/docker/netns/does-not-exist")
+	assert.NotNil(t, err, "error instead of an empty list")
+}
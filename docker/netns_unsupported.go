@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package docker
+
+import (
+	"fmt"
+)
+
+func InNetns(path string, fn func() error) error {
+	return fmt.Errorf("network namespaces are only on linux")
+}
+
+func ListNsAddrs(path string) ([]NsAddr, error) {
+	return nil, fmt.Errorf("network namespaces are only on linux")
+}
+
+func ListNsIps(ns string) ([]string, error) {
+	return nil, fmt.Errorf("network namespaces are only on linux")
+}
@@ -1,11 +1,17 @@
 package docker
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net"
-	"os/exec"
+	"net/http"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+	tapcon_config "github.com/jerryz920/tapcon-monitor/config"
 )
 
 type NetworkEvent struct {
@@ -15,24 +21,135 @@ type NetworkEvent struct {
 
 type NetworkDelayFunc func(NetworkEvent) error
 
-func getOverlayNetworks() []string {
-	cmd := exec.Command("docker", "network", "ls", "--no-trunc", "-q", "-f", "driver=overlay")
-	out, err := cmd.Output()
+// NetworkInfo is a docker network, as the docker API lists it.
+type NetworkInfo struct {
+	Id         string            `json:"Id"`
+	Name       string            `json:"Name"`
+	Driver     string            `json:"Driver"`
+	Scope      string            `json:"Scope"`
+	IPAM       NetworkIPAM       `json:"IPAM"`
+	Internal   bool              `json:"Internal"`
+	Attachable bool              `json:"Attachable"`
+	Labels     map[string]string `json:"Labels"`
+}
+
+type NetworkIPAM struct {
+	Config []NetworkIPAMConfig `json:"Config"`
+}
+
+type NetworkIPAMConfig struct {
+	Subnet  string `json:"Subnet"`
+	Gateway string `json:"Gateway"`
+}
+
+// NetworkInventory lists the docker networks. An error means the networks
+// are unknown, not that there are none.
+type NetworkInventory interface {
+	Networks(ctx context.Context) ([]NetworkInfo, error)
+}
+
+const (
+	DOCKER_SOCKET      = "/var/run/docker.sock"
+	DOCKER_API_TIMEOUT = 10 * time.Second
+)
+
+// networks local to the instance, the containers on them are reached
+// through the instance IPs
+var localNetworkDrivers = map[string]bool{
+	"bridge": true,
+	"host":   true,
+	"null":   true,
+}
+
+// dockerApiInventory asks the docker daemon through its API socket.
+type dockerApiInventory struct {
+	client *http.Client
+}
+
+func NewDockerNetworkInventory(socket string) NetworkInventory {
+	if socket == "" {
+		socket = DOCKER_SOCKET
+	}
+	return &dockerApiInventory{
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn,
+					error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+func (d *dockerApiInventory) Networks(ctx context.Context) ([]NetworkInfo,
+	error) {
+	req, err := http.NewRequest(http.MethodGet, "http://docker/networks", nil)
 	if err != nil {
-		log.Errorf("error in capturing network output: %v", err)
-		return []string{}
+		return nil, err
+	}
+	resp, err := d.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("listing docker networks: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("listing docker networks: %s: %s", resp.Status,
+			strings.TrimSpace(string(msg)))
+	}
+	var networks []NetworkInfo
+	if err := json.NewDecoder(resp.Body).Decode(&networks); err != nil {
+		return nil, fmt.Errorf("decoding docker networks: %v", err)
+	}
+	return networks, nil
+}
+
+// namespaceNetworks picks the networks getting a namespace of their own:
+// those of the drivers if any, overlay, macvlan, ipvlan and plugin ones
+// otherwise.
+func namespaceNetworks(networks []NetworkInfo, drivers []string) []string {
+	result := make([]string, 0, len(networks))
+	for _, n := range networks {
+		if n.Id == "" {
+			continue
+		}
+		if len(drivers) > 0 {
+			for _, d := range drivers {
+				if n.Driver == d {
+					result = append(result, n.Id)
+					break
+				}
+			}
+		} else if !localNetworkDrivers[n.Driver] {
+			result = append(result, n.Id)
+		}
 	}
-	trimmed := strings.Trim(string(out), "\n")
-	return strings.Split(trimmed, "\n")
+	return result
 }
 
-func (m *Monitor) NetworkChanges() ([]string, []string) {
+// NetworkChanges compares the docker networks with the known ones. If they
+// can not be listed nothing changes.
+func (m *Monitor) NetworkChanges() ([]string, []string, error) {
 
 	// check the delayed queue, this is actually pretty slow work so
 	// we may do something to it
+	ctx, cancel := context.WithTimeout(m.ctx, DOCKER_API_TIMEOUT)
+	defer cancel()
+	listed, err := m.networkInventory.Networks(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	newNetworks := namespaceNetworks(listed,
+		tapcon_config.Config.NetworkDrivers)
+
 	m.NetworkWorkerLock.Lock()
+	m.networkInfo = make(map[string]NetworkInfo, len(newNetworks))
+	for _, n := range listed {
+		m.networkInfo[n.Id] = n
+	}
 	oldNetworks := m.Networks
-	newNetworks := getOverlayNetworks()
 	toDelete := []string{}
 	toAdd := []string{}
 
@@ -63,31 +180,73 @@ func (m *Monitor) NetworkChanges() ([]string, []string) {
 	}
 	m.Networks = newNetworks
 	m.NetworkWorkerLock.Unlock()
-	return toAdd, toDelete
+	return toAdd, toDelete, nil
 }
 
 func (m *Monitor) setupInstanceIpInfo() {
-	pubIp, err := m.MetadataApi.MyPublicIp()
+	/// the provider limits each of the clouds it asks
+	info, err := m.instance.InstanceInfo(m.ctx)
 	if err != nil {
-		log.Fatalf("can not obtain public IP info: %s", err)
+		log.Fatalf("can not obtain instance info from %s: %s",
+			m.instance.Name(), err)
 	}
-	m.publicIp = net.ParseIP(pubIp)
+	m.localIp = info.LocalIp
+	m.publicIp = info.PublicIp
 	if m.publicIp == nil {
-		log.Fatalf("invalid IP: %s", pubIp)
+		/// reachable only on the local IP, the public ports are the same
+		log.Warnf("instance has no public IP, using local IP %s", m.localIp)
+		m.publicIp = m.localIp
 	}
-	localIp, err := m.MetadataApi.MyLocalIp()
+	m.localNs = info.Ns
+	m.ipv6 = info.Ipv6
+	if len(m.ipv6) == 0 {
+		m.ipv6 = hostIpv6(m.localIp)
+	}
+	log.Infof("instance from %s: local IP %s, public IP %s, IPv6 %v, ns %s",
+		m.instance.Name(), m.localIp, m.publicIp, m.ipv6, m.localNs)
+}
+
+// hostIpv6 finds the global IPv6 addresses of the interface with the local
+// IP, for clouds not telling them.
+func hostIpv6(localIp net.IP) []net.IP {
+	ifaces, err := net.Interfaces()
 	if err != nil {
-		log.Fatalf("can not obtain local IP info: %s", err)
+		log.Errorf("listing interfaces for IPv6: %v", err)
+		return nil
 	}
-	m.localIp = net.ParseIP(localIp)
-	if m.localIp == nil {
-		log.Fatalf("invalid IP: %s", localIp)
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			log.Errorf("listing addresses of %s: %v", iface.Name, err)
+			continue
+		}
+		found := false
+		ipv6 := make([]net.IP, 0, len(addrs))
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ipnet.IP.Equal(localIp) {
+				found = true
+			} else if ipnet.IP.To4() == nil && ipnet.IP.IsGlobalUnicast() {
+				ipv6 = append(ipv6, ipnet.IP)
+			}
+		}
+		if found {
+			return ipv6
+		}
 	}
-	localNs, err := m.MetadataApi.MyNs()
-	if err != nil {
-		log.Fatalf("can not obtain local Ns info: %s", err)
+	return nil
+}
+
+// ipv6Ns is the namespace of an instance IPv6 address: unique local ones
+// (fc00::/7) are in the local ns, the others are public.
+func ipv6Ns(ip net.IP, localNs string) string {
+	if ip16 := ip.To16(); ip16 != nil && ip16[0]&0xfe == 0xfc {
+		return localNs
 	}
-	m.localNs = localNs
+	return DEFAULT_NS
 }
 
 func (m *Monitor) setupPortMapping(cid string, pmin int, pmax int) error {
@@ -0,0 +1,237 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	metadata "github.com/jerryz920/tapcon-monitor/statement"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const dockerNetworks = `[
+ {"Name": "bridge", "Id": "n-bridge", "Scope": "local", "Driver": "bridge",
+  "IPAM": {"Driver": "default", "Config": [{"Subnet": "172.17.0.0/16",
+   "Gateway": "172.17.0.1"}]}, "Internal": false, "Attachable": false,
+  "Labels": {}},
+ {"Name": "host", "Id": "n-host", "Scope": "local", "Driver": "host"},
+ {"Name": "none", "Id": "n-none", "Scope": "local", "Driver": "null"},
+ {"Name": "mybridge", "Id": "n-mybridge", "Scope": "local", "Driver": "bridge"},
+ {"Name": "ingress", "Id": "n-overlay", "Scope": "swarm", "Driver": "overlay"},
+ {"Name": "lan", "Id": "n-macvlan", "Scope": "local", "Driver": "macvlan"},
+ {"Name": "l2", "Id": "n-ipvlan", "Scope": "local", "Driver": "ipvlan"},
+ {"Name": "weave", "Id": "n-weave", "Scope": "global",
+  "Driver": "weaveworks/net-plugin:latest"}
+]`
+
+// dockerSocket serves the docker API on a unix socket.
+func dockerSocket(t *testing.T, handler http.HandlerFunc) (string, func()) {
+	dir, err := ioutil.TempDir("", "docker-api")
+	require.Nil(t, err, "temp dir")
+	socket := filepath.Join(dir, "docker.sock")
+	l, err := net.Listen("unix", socket)
+	require.Nil(t, err, "listening")
+	server := httptest.NewUnstartedServer(handler)
+	server.Listener = l
+	server.Start()
+	return socket, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestDockerNetworkInventory(t *testing.T) {
+	socket, done := dockerSocket(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/networks" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(dockerNetworks))
+	})
+	defer done()
+
+	networks, err := NewDockerNetworkInventory(socket).Networks(
+		context.Background())
+	require.Nil(t, err, "listing")
+	assert.Equal(t, 8, len(networks))
+	assert.Equal(t, []NetworkIPAMConfig{{"172.17.0.0/16", "172.17.0.1"}},
+		networks[0].IPAM.Config, "ipam")
+	assert.Equal(t, []string{"n-overlay", "n-macvlan", "n-ipvlan", "n-weave"},
+		namespaceNetworks(networks, nil), "all but local drivers")
+	assert.Equal(t, []string{"n-overlay"},
+		namespaceNetworks(networks, []string{"overlay"}), "configured drivers")
+
+	_, err = NewDockerNetworkInventory(filepath.Join(filepath.Dir(socket),
+		"missing.sock")).Networks(context.Background())
+	assert.NotNil(t, err, "no docker daemon")
+
+	socket, done = dockerSocket(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer done()
+	_, err = NewDockerNetworkInventory(socket).Networks(context.Background())
+	assert.NotNil(t, err, "failing docker daemon")
+}
+
+type staticInventory struct {
+	networks []NetworkInfo
+	err      error
+}
+
+func (s *staticInventory) Networks(ctx context.Context) ([]NetworkInfo,
+	error) {
+	return s.networks, s.err
+}
+
+func TestNetworkChangesListingFails(t *testing.T) {
+	inventory := &staticInventory{networks: []NetworkInfo{
+		{Id: "n1", Driver: "overlay"}, {Id: "n2", Driver: "macvlan"}}}
+	m := &Monitor{
+		ctx:               context.Background(),
+		NetworkWorkerLock: &sync.Mutex{},
+		Networks:          []string{},
+		networkInventory:  inventory,
+	}
+	toAdd, toDelete, err := m.NetworkChanges()
+	require.Nil(t, err, "listed")
+	assert.Equal(t, []string{"n1", "n2"}, toAdd)
+	assert.Empty(t, toDelete)
+
+	inventory.networks, inventory.err = nil, errors.New("docker is down")
+	toAdd, toDelete, err = m.NetworkChanges()
+	assert.NotNil(t, err, "listing failed")
+	assert.Empty(t, toDelete, "no network gone")
+	assert.Equal(t, []string{"n1", "n2"}, m.Networks, "networks kept")
+
+	inventory.networks, inventory.err = []NetworkInfo{
+		{Id: "n2", Driver: "macvlan"}, {Id: "n3", Driver: "ipvlan"}}, nil
+	toAdd, toDelete, err = m.NetworkChanges()
+	require.Nil(t, err, "listed")
+	assert.Equal(t, []string{"n3"}, toAdd)
+	assert.Equal(t, []string{"n1"}, toDelete)
+}
+
+func TestNetworkFacts(t *testing.T) {
+	overlay := NetworkInfo{Id: "n1", Name: "front", Driver: "overlay",
+		Scope: "swarm", Attachable: true,
+		IPAM: NetworkIPAM{Config: []NetworkIPAMConfig{
+			{Subnet: "10.0.1.0/24", Gateway: "10.0.1.1"}}},
+		Labels: map[string]string{"tier": "web", "app": "shop"}}
+	assert.Equal(t, []metadata.Statement{
+		`networkFact("n1", "name", "front")`,
+		`networkFact("n1", "driver", "overlay")`,
+		`networkFact("n1", "scope", "swarm")`,
+		`networkFact("n1", "internal", "false")`,
+		`networkFact("n1", "attachable", "true")`,
+		`networkFact("n1", "subnet", "10.0.1.0/24")`,
+		`networkFact("n1", "gateway", "10.0.1.1")`,
+		`networkLabel("n1", "app", "shop")`,
+		`networkLabel("n1", "tier", "web")`,
+	}, NetworkFacts(overlay), "labels by key")
+
+	fake := metadata.NewFakeServer()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	inventory := &staticInventory{networks: []NetworkInfo{overlay}}
+	m := &Monitor{
+		ctx:               ctx,
+		MetadataApi:       metadata.NoContext(fake, ctx, time.Second),
+		NetworkWorkerLock: &sync.Mutex{},
+		Networks:          []string{},
+		networkInventory:  inventory,
+	}
+	m.ScanNetworkUpdate()
+	assert.Equal(t, map[string]bool{"n1": true}, fake.Namespaces(), "joined")
+	facts := func() []metadata.Statement {
+		result := []metadata.Statement{}
+		for _, f := range fake.NsFacts("n1") {
+			result = append(result, metadata.Statement(f))
+		}
+		return result
+	}
+	assert.Equal(t, NetworkFacts(overlay), facts(), "posted")
+
+	m.ScanNetworkUpdate()
+	assert.Equal(t, NetworkFacts(overlay), facts(), "unchanged, not posted")
+
+	changed := overlay
+	changed.IPAM.Config = []NetworkIPAMConfig{
+		{Subnet: "10.0.2.0/24", Gateway: "10.0.2.1"}}
+	changed.Labels = map[string]string{"tier": "web"}
+	inventory.networks = []NetworkInfo{changed}
+	m.ScanNetworkUpdate()
+	assert.ElementsMatch(t, NetworkFacts(changed), facts(), "updated")
+
+	inventory.networks = nil
+	m.ScanNetworkUpdate()
+	assert.Empty(t, fake.Namespaces(), "deleted")
+	assert.Empty(t, fake.NsFacts("n1"), "facts removed")
+	assert.Empty(t, m.networkFacts, "nothing posted")
+}
+
+// failingNsProofs fails the removal of namespace facts when asked to.
+type failingNsProofs struct {
+	metadata.MetadataAPI
+	fail bool
+}
+
+func (f *failingNsProofs) RemoveNsProof(ns string,
+	statements []metadata.Statement) error {
+	if f.fail {
+		return errors.New("server unreachable")
+	}
+	return f.MetadataAPI.RemoveNsProof(ns, statements)
+}
+
+func TestNetworkFactsRestart(t *testing.T) {
+	old := NetworkInfo{Id: "n1", Name: "front", Driver: "overlay",
+		Scope: "swarm", Labels: map[string]string{"tier": "web"}}
+	fake := metadata.NewFakeServer()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	/// posted by the previous run, and a fact of someone else
+	require.Nil(t, fake.CreateNs(ctx, "n1"))
+	require.Nil(t, fake.PostNsProof(ctx, "n1", append(NetworkFacts(old),
+		`zone("n1", "east")`)))
+
+	changed := old
+	changed.Labels = map[string]string{"tier": "db"}
+	inventory := &staticInventory{networks: []NetworkInfo{changed}}
+	api := &failingNsProofs{
+		MetadataAPI: metadata.NoContext(fake, ctx, time.Second)}
+	m := &Monitor{
+		ctx:               ctx,
+		MetadataApi:       api,
+		NetworkWorkerLock: &sync.Mutex{},
+		Networks:          []string{},
+		networkInventory:  inventory,
+	}
+	m.ScanNetworkUpdate()
+	expected := []string{`zone("n1", "east")`}
+	for _, f := range NetworkFacts(changed) {
+		expected = append(expected, string(f))
+	}
+	assert.ElementsMatch(t, expected, fake.NsFacts("n1"),
+		"changed while down, replaced")
+
+	/// withdrawn on the next scan if it fails
+	inventory.networks = nil
+	api.fail = true
+	m.ScanNetworkUpdate()
+	assert.Contains(t, m.networkFacts, "n1", "kept to retry")
+	require.Nil(t, fake.CreateNs(ctx, "n1"), "namespace back")
+	require.Nil(t, fake.PostNsProof(ctx, "n1", NetworkFacts(changed)))
+	api.fail = false
+	m.ScanNetworkUpdate()
+	assert.Empty(t, fake.NsFacts("n1"), "facts removed")
+	assert.Empty(t, m.networkFacts, "nothing posted")
+}
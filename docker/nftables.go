@@ -0,0 +1,341 @@
+package docker
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	tapcon_config "github.com/jerryz920/tapcon-monitor/config"
+)
+
+// InputRunner is a CommandRunner able to feed the command, nft reads its
+// transactions from the input.
+type InputRunner interface {
+	CommandRunner
+	RunInput(input string, name string, args ...string) ([]byte, error)
+}
+
+func (execRunner) RunInput(input string, name string,
+	args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = strings.NewReader(input)
+	return cmd.CombinedOutput()
+}
+
+const (
+	NFT_TABLE = "tapcon"
+	/// right before the srcnat of docker, 100
+	NFT_NAT_PRIORITY = 99
+	/// before the forward filter of docker, 0
+	NFT_FILTER_PRIORITY = -1
+)
+
+type nftMapping struct {
+	ip      string
+	subnet  string // the traffic to it is left alone
+	portMin int
+	portMax int
+}
+
+// nftContainer is what the tapcon table has for a container: its chain with
+// the static port mappings, and the IPs allowed to the metadata server.
+type nftContainer struct {
+	mappings    []nftMapping
+	metadataIps []string
+}
+
+type nftState map[string]*nftContainer
+
+func (st nftState) clone() nftState {
+	result := make(nftState, len(st))
+	for id, c := range st {
+		result[id] = &nftContainer{
+			mappings:    append([]nftMapping{}, c.mappings...),
+			metadataIps: append([]string{}, c.metadataIps...),
+		}
+	}
+	return result
+}
+
+// nftablesSandbox owns the tapcon table, with a chain per container jumped
+// to from its own nat hook. The whole table is written again on each change
+// in one transaction, so a change is applied entirely or not at all, and
+// chains left by previous runs go with the first one.
+type nftablesSandbox struct {
+	run InputRunner
+	/// only allowed containers reach it, no guard if empty
+	metadataAddr string
+	lock         *sync.Mutex
+	containers   nftState
+}
+
+// NewNftablesSandbox runs nft with run, the real one if nil. Forwarded
+// traffic to metadataAddr is dropped unless allowed, if it is set.
+func NewNftablesSandbox(run InputRunner, metadataAddr string) Sandbox {
+	if run == nil {
+		run = execRunner{}
+	}
+	return &nftablesSandbox{
+		run:          run,
+		metadataAddr: metadataAddr,
+		lock:         &sync.Mutex{},
+		containers:   make(nftState),
+	}
+}
+
+// nftRuleset gives the transaction replacing the tapcon table with the one
+// of the containers. Adding the table first makes deleting it safe when
+// there is none yet.
+func nftRuleset(containers nftState, metadataAddr string) string {
+	ids := make([]string, 0, len(containers))
+	for id := range containers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "table ip %s\n", NFT_TABLE)
+	fmt.Fprintf(&b, "delete table ip %s\n", NFT_TABLE)
+	fmt.Fprintf(&b, "table ip %s {\n", NFT_TABLE)
+	for _, id := range ids {
+		fmt.Fprintf(&b, "\tchain %s%s {\n", CONTAINER_CHAIN_PREFIX, id)
+		for _, m := range containers[id].mappings {
+			for _, proto := range [2]string{"tcp", "udp"} {
+				fmt.Fprintf(&b, "\t\tip saddr %s ip daddr != %s meta l4proto %s "+
+					"masquerade to :%d-%d\n", m.ip, m.subnet, proto, m.portMin,
+					m.portMax)
+			}
+		}
+		b.WriteString("\t}\n")
+	}
+	fmt.Fprintf(&b, "\tchain postrouting {\n\t\ttype nat hook postrouting "+
+		"priority %d; policy accept;\n", NFT_NAT_PRIORITY)
+	for _, id := range ids {
+		fmt.Fprintf(&b, "\t\tjump %s%s\n", CONTAINER_CHAIN_PREFIX, id)
+	}
+	b.WriteString("\t}\n")
+	if metadataAddr != "" {
+		/// containers may share an IP, nft rejects duplicate elements
+		seen := make(map[string]bool)
+		allowed := []string{}
+		for _, id := range ids {
+			for _, ip := range containers[id].metadataIps {
+				if !seen[ip] {
+					seen[ip] = true
+					allowed = append(allowed, ip)
+				}
+			}
+		}
+		sort.Strings(allowed)
+		b.WriteString("\tset metadata_allowed {\n\t\ttype ipv4_addr\n")
+		if len(allowed) > 0 {
+			fmt.Fprintf(&b, "\t\telements = { %s }\n",
+				strings.Join(allowed, ", "))
+		}
+		b.WriteString("\t}\n")
+		fmt.Fprintf(&b, "\tchain metadata {\n\t\ttype filter hook forward "+
+			"priority %d; policy accept;\n", NFT_FILTER_PRIORITY)
+		fmt.Fprintf(&b, "\t\tip daddr %s ip saddr @metadata_allowed accept\n",
+			metadataAddr)
+		fmt.Fprintf(&b, "\t\tip daddr %s drop\n", metadataAddr)
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// update applies the containers changed by fn, kept as they were if nft
+// fails. fn tells whether anything changed.
+func (s *nftablesSandbox) update(fn func(containers nftState) bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	containers := s.containers.clone()
+	if !fn(containers) {
+		return nil
+	}
+	if err := s.apply(containers); err != nil {
+		return err
+	}
+	s.containers = containers
+	return nil
+}
+
+func (s *nftablesSandbox) apply(containers nftState) error {
+	out, err := s.run.RunInput(nftRuleset(containers, s.metadataAddr), "nft",
+		"-f", "-")
+	if err != nil {
+		return fmt.Errorf("nft -f -: %v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func (s *nftablesSandbox) ContainerChainName(id string) string {
+	return CONTAINER_CHAIN_PREFIX + id
+}
+
+func (s *nftablesSandbox) SetupContainerChain(id string) error {
+	return s.update(func(containers nftState) bool {
+		if _, ok := containers[id]; ok {
+			return false
+		}
+		containers[id] = &nftContainer{}
+		return true
+	})
+}
+
+func (s *nftablesSandbox) RemoveContainerChain(id string) error {
+	return s.update(func(containers nftState) bool {
+		if _, ok := containers[id]; !ok {
+			return false
+		}
+		delete(containers, id)
+		return true
+	})
+}
+
+func (s *nftablesSandbox) SetupStaticPortMapping(id string, containerIp string,
+	subnet string, portMin int, portMax int) error {
+	ip := net.ParseIP(containerIp)
+	if ip == nil {
+		return fmt.Errorf("invalid container ip %q", containerIp)
+	}
+	if ip.To4() == nil {
+		/// IPv6 containers are routed rather than masqueraded
+		log.Debugf("no static port mapping for %s on %s", id, containerIp)
+		return nil
+	}
+	_, network, err := net.ParseCIDR(subnet)
+	if err != nil || !network.Contains(ip) {
+		return fmt.Errorf("invalid container subnet %q for %s", subnet,
+			containerIp)
+	}
+	mapping := nftMapping{ip: ip.String(), subnet: network.String(),
+		portMin: portMin, portMax: portMax}
+	return s.update(func(containers nftState) bool {
+		c, ok := containers[id]
+		if !ok {
+			c = &nftContainer{}
+			containers[id] = c
+		}
+		for _, m := range c.mappings {
+			if m == mapping {
+				return !ok
+			}
+		}
+		c.mappings = append(c.mappings, mapping)
+		return true
+	})
+}
+
+func (s *nftablesSandbox) ClearStaticPortMapping(id string) error {
+	return s.update(func(containers nftState) bool {
+		c, ok := containers[id]
+		if !ok || len(c.mappings) == 0 {
+			return false
+		}
+		c.mappings = nil
+		return true
+	})
+}
+
+// SetupMetadataGuard writes the table with the guard before any container
+// is allowed.
+func (s *nftablesSandbox) SetupMetadataGuard() error {
+	if s.metadataAddr == "" {
+		return nil
+	}
+	return s.update(func(containers nftState) bool {
+		return true
+	})
+}
+
+// AllowMetadataAccess lets the IPv4 addresses of a container reach the
+// metadata server.
+func (s *nftablesSandbox) AllowMetadataAccess(id string, ips []string) error {
+	allowed := []string{}
+	for _, ip := range ips {
+		if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() != nil {
+			allowed = append(allowed, parsed.String())
+		}
+	}
+	sort.Strings(allowed)
+	return s.update(func(containers nftState) bool {
+		c, ok := containers[id]
+		if !ok {
+			c = &nftContainer{}
+			containers[id] = c
+		}
+		if ok && strings.Join(c.metadataIps, ",") ==
+			strings.Join(allowed, ",") {
+			return false
+		}
+		c.metadataIps = allowed
+		return true
+	})
+}
+
+func (s *nftablesSandbox) RevokeMetadataAccess(id string) error {
+	return s.update(func(containers nftState) bool {
+		c, ok := containers[id]
+		if !ok || len(c.metadataIps) == 0 {
+			return false
+		}
+		c.metadataIps = nil
+		return true
+	})
+}
+
+// SweepContainerChains writes the table again without the containers not
+// kept. The first transaction of a run removes the chains of the previous
+// ones anyway.
+func (s *nftablesSandbox) SweepContainerChains(keep []string) error {
+	kept := make(map[string]bool, len(keep))
+	for _, id := range keep {
+		kept[id] = true
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	containers := s.containers.clone()
+	for id := range containers {
+		if !kept[id] {
+			delete(containers, id)
+		}
+	}
+	if err := s.apply(containers); err != nil {
+		return err
+	}
+	s.containers = containers
+	return nil
+}
+
+// NewSandbox gives the sandbox of kind, one of the config SANDBOX_*, guarding
+// metadataAddr if set. With SANDBOX_AUTO iptables is kept wherever it still
+// works, nft is used on the hosts without it.
+func NewSandbox(kind string, metadataAddr string, run InputRunner) (Sandbox,
+	error) {
+	if run == nil {
+		run = execRunner{}
+	}
+	switch kind {
+	case tapcon_config.SANDBOX_IPTABLES:
+		return NewIptablesSandbox(run, metadataAddr), nil
+	case tapcon_config.SANDBOX_NFTABLES:
+		return NewNftablesSandbox(run, metadataAddr), nil
+	case tapcon_config.SANDBOX_AUTO, "":
+	default:
+		return nil, fmt.Errorf("unknown sandbox %s", kind)
+	}
+	if _, err := run.Run("iptables", "-w", "-t", "nat", "-S"); err == nil {
+		return NewIptablesSandbox(run, metadataAddr), nil
+	}
+	if _, err := run.Run("nft", "list", "tables"); err == nil {
+		log.Infof("no usable iptables, using nftables")
+		return NewNftablesSandbox(run, metadataAddr), nil
+	}
+	return nil, fmt.Errorf("neither iptables nor nft usable")
+}
@@ -0,0 +1,195 @@
+package docker
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	tapcon_config "github.com/jerryz920/tapcon-monitor/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// nftRunner records the transactions given to nft, failing them when asked
+// to. Other commands fail unless listed as working.
+type nftRunner struct {
+	inputs  []string
+	fail    bool
+	working map[string]bool
+}
+
+func (r *nftRunner) Run(name string, args ...string) ([]byte, error) {
+	if r.working[name] {
+		return nil, nil
+	}
+	return []byte(name + ": not found"), errors.New("exec failed")
+}
+
+func (r *nftRunner) RunInput(input string, name string,
+	args ...string) ([]byte, error) {
+	if name != "nft" || strings.Join(args, " ") != "-f -" {
+		return nil, errors.New("unexpected command " + name)
+	}
+	if r.fail {
+		return []byte("Error: syntax error"), errors.New("exit status 1")
+	}
+	r.inputs = append(r.inputs, input)
+	return nil, nil
+}
+
+func (r *nftRunner) last() string {
+	if len(r.inputs) == 0 {
+		return ""
+	}
+	return r.inputs[len(r.inputs)-1]
+}
+
+func TestNftRuleset(t *testing.T) {
+	assert.Equal(t, "table ip tapcon\n"+
+		"delete table ip tapcon\n"+
+		"table ip tapcon {\n"+
+		"\tchain postrouting {\n"+
+		"\t\ttype nat hook postrouting priority 99; policy accept;\n"+
+		"\t}\n"+
+		"}\n", nftRuleset(nftState{}, ""), "empty table")
+
+	containers := nftState{
+		"c2": &nftContainer{metadataIps: []string{"172.17.0.4"}},
+		"c1": &nftContainer{
+			mappings: []nftMapping{
+				{"172.17.0.3", "172.17.0.0/16", 20000, 20009}},
+			metadataIps: []string{"172.17.0.3", "172.18.0.2"},
+		},
+	}
+	assert.Equal(t, "table ip tapcon\n"+
+		"delete table ip tapcon\n"+
+		"table ip tapcon {\n"+
+		"\tchain ctn-c1 {\n"+
+		"\t\tip saddr 172.17.0.3 ip daddr != 172.17.0.0/16 meta l4proto tcp "+
+		"masquerade to :20000-20009\n"+
+		"\t\tip saddr 172.17.0.3 ip daddr != 172.17.0.0/16 meta l4proto udp "+
+		"masquerade to :20000-20009\n"+
+		"\t}\n"+
+		"\tchain ctn-c2 {\n"+
+		"\t}\n"+
+		"\tchain postrouting {\n"+
+		"\t\ttype nat hook postrouting priority 99; policy accept;\n"+
+		"\t\tjump ctn-c1\n"+
+		"\t\tjump ctn-c2\n"+
+		"\t}\n"+
+		"\tset metadata_allowed {\n"+
+		"\t\ttype ipv4_addr\n"+
+		"\t\telements = { 172.17.0.3, 172.17.0.4, 172.18.0.2 }\n"+
+		"\t}\n"+
+		"\tchain metadata {\n"+
+		"\t\ttype filter hook forward priority -1; policy accept;\n"+
+		"\t\tip daddr 169.254.169.254 ip saddr @metadata_allowed accept\n"+
+		"\t\tip daddr 169.254.169.254 drop\n"+
+		"\t}\n"+
+		"}\n", nftRuleset(containers, "169.254.169.254"), "sorted by container")
+
+	assert.NotContains(t, nftRuleset(nftState{}, "169.254.169.254"),
+		"elements", "no elements in an empty set")
+
+	/// e.g. containers sharing the network namespace of another
+	shared := nftState{
+		"c1": &nftContainer{metadataIps: []string{"172.17.0.3"}},
+		"c2": &nftContainer{metadataIps: []string{"172.17.0.10",
+			"172.17.0.3"}},
+	}
+	assert.Contains(t, nftRuleset(shared, "169.254.169.254"),
+		"\t\telements = { 172.17.0.10, 172.17.0.3 }\n", "each ip once")
+}
+
+func TestNftablesSandbox(t *testing.T) {
+	run := &nftRunner{}
+	s := NewNftablesSandbox(run, "169.254.169.254").(*nftablesSandbox)
+
+	require.Nil(t, s.SetupStaticPortMapping("c1", "172.17.0.3",
+		"172.17.0.0/16", 20000, 20009), "mapped")
+	require.Nil(t, s.SetupStaticPortMapping("c1", "172.17.0.3",
+		"172.17.0.0/16", 20000, 20009), "mapped twice")
+	require.Nil(t, s.SetupStaticPortMapping("c1", "2001:db8:1::3",
+		"2001:db8:1::/64", 20000, 20009), "ipv6 skipped")
+	require.Nil(t, s.SetupContainerChain("c1"), "chain there already")
+	assert.Len(t, run.inputs, 1, "one transaction per change")
+	assert.Contains(t, run.last(), "jump ctn-c1")
+	assert.Contains(t, run.last(), "ip daddr != 172.17.0.0/16",
+		"bridge traffic left alone")
+
+	require.Nil(t, s.AllowMetadataAccess("c1", []string{"172.17.0.3",
+		"2001:db8:1::3"}), "allowed")
+	require.Nil(t, s.AllowMetadataAccess("c1", []string{"172.17.0.3"}),
+		"allowed twice")
+	assert.Len(t, run.inputs, 2)
+	assert.Contains(t, run.last(), "elements = { 172.17.0.3 }")
+
+	run.fail = true
+	assert.NotNil(t, s.RemoveContainerChain("c1"), "nft failed")
+	assert.Contains(t, s.containers, "c1", "kept when not applied")
+	run.fail = false
+
+	require.Nil(t, s.RevokeMetadataAccess("c1"), "revoked")
+	require.Nil(t, s.ClearStaticPortMapping("c1"), "cleared")
+	require.Nil(t, s.ClearStaticPortMapping("c2"), "nothing to clear")
+	assert.Len(t, run.inputs, 4)
+	assert.Contains(t, run.last(), "chain ctn-c1 {\n\t}\n")
+	assert.NotContains(t, run.last(), "elements")
+
+	require.Nil(t, s.RemoveContainerChain("c1"), "removed")
+	require.Nil(t, s.RemoveContainerChain("c1"), "removed twice")
+	assert.Len(t, run.inputs, 5)
+	assert.NotContains(t, run.last(), "ctn-c1")
+
+	assert.NotNil(t, s.SetupStaticPortMapping("c1", "not-an-ip",
+		"172.17.0.0/16", 1, 2), "invalid ip")
+	assert.NotNil(t, s.SetupStaticPortMapping("c1", "172.17.0.3",
+		"172.18.0.0/16", 1, 2), "ip outside the subnet")
+}
+
+func TestNftablesSweep(t *testing.T) {
+	run := &nftRunner{}
+	s := NewNftablesSandbox(run, "")
+	require.Nil(t, s.SetupContainerChain("c1"))
+	require.Nil(t, s.SetupContainerChain("c2"))
+
+	require.Nil(t, s.SweepContainerChains([]string{"c1", "c3"}), "swept")
+	assert.Contains(t, run.last(), "chain ctn-c1")
+	assert.NotContains(t, run.last(), "ctn-c2", "gone container removed")
+	assert.NotContains(t, run.last(), "ctn-c3", "unknown container not added")
+	assert.NotContains(t, run.last(), "metadata", "no guard")
+
+	run.fail = true
+	assert.NotNil(t, s.SweepContainerChains(nil), "nft failed")
+	require.Nil(t, s.SetupMetadataGuard(), "no guard to set up")
+
+	guarded := &nftRunner{}
+	require.Nil(t, NewNftablesSandbox(guarded,
+		"169.254.169.254").SetupMetadataGuard(), "guarded")
+	assert.Contains(t, guarded.last(), "ip daddr 169.254.169.254 drop",
+		"guarded before any container")
+}
+
+func TestNewSandbox(t *testing.T) {
+	both := &nftRunner{working: map[string]bool{"iptables": true, "nft": true}}
+	s, err := NewSandbox(tapcon_config.SANDBOX_AUTO, "", both)
+	require.Nil(t, err)
+	assert.IsType(t, &iptablesSandbox{}, s, "iptables kept where it works")
+
+	nftOnly := &nftRunner{working: map[string]bool{"nft": true}}
+	s, err = NewSandbox(tapcon_config.SANDBOX_AUTO, "", nftOnly)
+	require.Nil(t, err)
+	assert.IsType(t, &nftablesSandbox{}, s, "nft without iptables")
+
+	s, err = NewSandbox(tapcon_config.SANDBOX_NFTABLES, "", both)
+	require.Nil(t, err)
+	assert.IsType(t, &nftablesSandbox{}, s, "configured")
+	s, err = NewSandbox(tapcon_config.SANDBOX_IPTABLES, "", nftOnly)
+	require.Nil(t, err)
+	assert.IsType(t, &iptablesSandbox{}, s, "configured, not detected")
+
+	_, err = NewSandbox(tapcon_config.SANDBOX_AUTO, "", &nftRunner{})
+	assert.NotNil(t, err, "no firewall")
+	_, err = NewSandbox("ebtables", "", both)
+	assert.NotNil(t, err, "unknown sandbox")
+}
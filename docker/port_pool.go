@@ -0,0 +1,120 @@
+package docker
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+type portAllocation struct {
+	PortRange
+	owner string
+}
+
+// portPool gives out ranges of its ports from min to max, max excluded, of
+// any size. A range goes to the smallest gap it fits in, the lowest one
+// first, so that large gaps are kept for large requests.
+type portPool struct {
+	name        string
+	min         int
+	max         int
+	defaultSize int
+	lock        *sync.Mutex
+	used        []portAllocation /// sorted by min
+}
+
+func newPortPool(name string, min, max, defaultSize int) *portPool {
+	return &portPool{
+		name:        name,
+		min:         min,
+		max:         max,
+		defaultSize: defaultSize,
+		lock:        &sync.Mutex{},
+		used:        []portAllocation{},
+	}
+}
+
+func (p *portPool) contains(r PortRange) bool {
+	return r.min >= p.min && r.max < p.max && r.min <= r.max
+}
+
+func (p *portPool) insert(a portAllocation) {
+	i := sort.Search(len(p.used), func(i int) bool {
+		return p.used[i].min > a.min
+	})
+	p.used = append(p.used, portAllocation{})
+	copy(p.used[i+1:], p.used[i:])
+	p.used[i] = a
+}
+
+func (p *portPool) allocate(size int, owner string) (PortRange, error) {
+	if size <= 0 || size > p.max-p.min {
+		return PortRange{}, fmt.Errorf("%d ports do not fit pool %s %d-%d",
+			size, p.name, p.min, p.max-1)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	best, bestGap := 0, 0
+	start := p.min
+	for i := 0; i <= len(p.used); i++ {
+		end := p.max
+		if i < len(p.used) {
+			end = p.used[i].min
+		}
+		if gap := end - start; gap >= size && (bestGap == 0 || gap < bestGap) {
+			best, bestGap = start, gap
+		}
+		if i < len(p.used) {
+			start = p.used[i].max + 1
+		}
+	}
+	if bestGap == 0 {
+		return PortRange{}, fmt.Errorf("no %d free ports in pool %s", size,
+			p.name)
+	}
+	r := PortRange{min: best, max: best + size - 1}
+	p.insert(portAllocation{PortRange: r, owner: owner})
+	return r, nil
+}
+
+// claim takes exactly the range, false if it is not in the pool or any of
+// its ports is taken.
+func (p *portPool) claim(r PortRange, owner string) bool {
+	if !p.contains(r) {
+		return false
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, a := range p.used {
+		if a.min <= r.max && r.min <= a.max {
+			return false
+		}
+	}
+	p.insert(portAllocation{PortRange: r, owner: owner})
+	return true
+}
+
+func (p *portPool) release(r PortRange) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i, a := range p.used {
+		if a.PortRange == r {
+			p.used = append(p.used[:i], p.used[i+1:]...)
+			return
+		}
+	}
+}
+
+func (p *portPool) allocations() []portAllocation {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]portAllocation{}, p.used...)
+}
+
+func (p *portPool) free() int {
+	free := p.max - p.min
+	for _, a := range p.allocations() {
+		free -= a.max - a.min + 1
+	}
+	return free
+}
@@ -0,0 +1,65 @@
+package docker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortPool(t *testing.T) {
+	p := newPortPool("test", 1000, 1100, 10)
+	a, err := p.allocate(30, "a")
+	require.Nil(t, err, "allocated")
+	assert.Equal(t, PortRange{1000, 1029}, a)
+	b, err := p.allocate(20, "b")
+	require.Nil(t, err, "allocated")
+	assert.Equal(t, PortRange{1030, 1049}, b, "packed")
+	c, err := p.allocate(10, "c")
+	require.Nil(t, err, "allocated")
+	assert.Equal(t, PortRange{1050, 1059}, c)
+
+	/// gaps of 30 at 1000 and of 50 at 1050
+	p.release(a)
+	p.release(c)
+	assert.Equal(t, 80, p.free(), "taken back")
+	d, err := p.allocate(25, "d")
+	require.Nil(t, err, "allocated")
+	assert.Equal(t, PortRange{1000, 1024}, d, "smallest gap fitting")
+	e, err := p.allocate(40, "e")
+	require.Nil(t, err, "large request still fits")
+	assert.Equal(t, PortRange{1050, 1089}, e)
+	f, err := p.allocate(5, "f")
+	require.Nil(t, err, "allocated")
+	assert.Equal(t, PortRange{1025, 1029}, f, "gap filled")
+
+	_, err = p.allocate(11, "g")
+	assert.NotNil(t, err, "no gap large enough")
+	_, err = p.allocate(0, "g")
+	assert.NotNil(t, err, "nothing to allocate")
+	g, err := p.allocate(10, "g")
+	require.Nil(t, err, "last gap")
+	assert.Equal(t, PortRange{1090, 1099}, g)
+	assert.Equal(t, 0, p.free(), "full")
+
+	assert.False(t, p.claim(PortRange{1040, 1044}, "h"), "taken")
+	p.release(b)
+	assert.True(t, p.claim(PortRange{1040, 1044}, "h"), "claimed")
+	assert.False(t, p.claim(PortRange{1095, 1100}, "i"), "out of the pool")
+	assert.Equal(t, []string{"d", "f", "h", "e", "g"}, owners(p))
+
+	/// gaps of the same size, the lowest is taken
+	q := newPortPool("test", 1000, 1030, 10)
+	require.True(t, q.claim(PortRange{1010, 1019}, "a"), "claimed")
+	r, err := q.allocate(10, "b")
+	require.Nil(t, err, "allocated")
+	assert.Equal(t, PortRange{1000, 1009}, r)
+}
+
+func owners(p *portPool) []string {
+	result := []string{}
+	for _, a := range p.allocations() {
+		result = append(result, a.owner)
+	}
+	return result
+}
@@ -2,9 +2,13 @@ package docker
 
 import (
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
 
+	tapcon_config "github.com/jerryz920/tapcon-monitor/config"
 	metadata "github.com/jerryz920/tapcon-monitor/statement"
 )
 
@@ -17,6 +21,19 @@ func (m *Monitor) PostImageProof(image *MemImage) error {
 	return m.MetadataApi.PostProof(id, []metadata.Statement{imageFact})
 }
 
+// WithdrawImageProof is called once an image is removed from docker. The image
+// principal is either deleted or kept with a retired fact, depending on the
+// configured stale image policy.
+func (m *Monitor) WithdrawImageProof(image *MemImage) error {
+	id := tapconImageId(image)
+	if m.staleImagePolicy == tapcon_config.STALE_IMAGE_RETIRE {
+		retiredFact := metadata.Statement(
+			fmt.Sprintf("imageRetired(\"%s\")", id))
+		return m.MetadataApi.PostProof(id, []metadata.Statement{retiredFact})
+	}
+	return m.MetadataApi.DeletePrincipal(id)
+}
+
 func (m *Monitor) PostContainerFact(c *MemContainer) error {
 	facts := c.ContainerFacts()
 	cid := tapconContainerId(c)
@@ -32,3 +49,150 @@ func (m *Monitor) LinkContainerImage(c *MemContainer) error {
 	iid := tapconContainerImageId(c)
 	return m.MetadataApi.LinkProofForChild(cid, []string{iid})
 }
+
+// NetworkFacts describes a docker network, in an order that only changes
+// with the network: the settings, the subnets as IPAM lists them, then the
+// labels by key.
+func NetworkFacts(n NetworkInfo) []metadata.Statement {
+	fact := func(key, value string) metadata.Statement {
+		return metadata.Statement(fmt.Sprintf("networkFact(%q, %q, %q)",
+			n.Id, key, value))
+	}
+	facts := []metadata.Statement{
+		fact("name", n.Name),
+		fact("driver", n.Driver),
+		fact("scope", n.Scope),
+		fact("internal", strconv.FormatBool(n.Internal)),
+		fact("attachable", strconv.FormatBool(n.Attachable)),
+	}
+	for _, c := range n.IPAM.Config {
+		if c.Subnet != "" {
+			facts = append(facts, fact("subnet", c.Subnet))
+		}
+		if c.Gateway != "" {
+			facts = append(facts, fact("gateway", c.Gateway))
+		}
+	}
+	keys := make([]string, 0, len(n.Labels))
+	for k := range n.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		facts = append(facts, metadata.Statement(fmt.Sprintf(
+			"networkLabel(%q, %q, %q)", n.Id, k, n.Labels[k])))
+	}
+	return facts
+}
+
+// statementsMinus gives the statements of a not in b.
+func statementsMinus(a, b []metadata.Statement) []metadata.Statement {
+	in := make(map[metadata.Statement]bool, len(b))
+	for _, s := range b {
+		in[s] = true
+	}
+	result := []metadata.Statement{}
+	for _, s := range a {
+		if !in[s] {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// postedNetworkFacts gives the facts of a network its namespace has on the
+// server, as a previous run may have left facts no longer true. A namespace
+// not there has none.
+func (m *Monitor) postedNetworkFacts(id string) ([]metadata.Statement, error) {
+	statements, err := m.MetadataApi.ListNsProofs(id)
+	if metadata.IsNotFound(err) {
+		return []metadata.Statement{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	prefixes := []string{fmt.Sprintf("networkFact(%q, ", id),
+		fmt.Sprintf("networkLabel(%q, ", id)}
+	posted := []metadata.Statement{}
+	for _, s := range statements {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(s.Fact, prefix) {
+				posted = append(posted, metadata.Statement(s.Fact))
+				break
+			}
+		}
+	}
+	return posted, nil
+}
+
+// updateNetworkFacts posts the facts of the tracked networks to their
+// namespaces. Facts no longer true are removed first, what the namespaces
+// have is read from the server the first time. Failures, including the
+// withdrawals of the networks gone, are retried on the next scan.
+func (m *Monitor) updateNetworkFacts() {
+	m.NetworkWorkerLock.Lock()
+	defer m.NetworkWorkerLock.Unlock()
+	if m.networkFacts == nil {
+		m.networkFacts = make(map[string][]metadata.Statement)
+	}
+	tracked := make(map[string]bool, len(m.Networks))
+	for _, id := range m.Networks {
+		tracked[id] = true
+		info, ok := m.networkInfo[id]
+		if !ok {
+			continue
+		}
+		posted, ok := m.networkFacts[id]
+		if !ok {
+			var err error
+			if posted, err = m.postedNetworkFacts(id); err != nil {
+				log.Errorf("reading facts of network %s: %v", id, err)
+				continue
+			}
+			m.networkFacts[id] = posted
+		}
+		facts := NetworkFacts(info)
+		if stale := statementsMinus(posted, facts); len(stale) > 0 {
+			if err := m.MetadataApi.RemoveNsProof(id, stale); err != nil {
+				/// read again, some may be gone already
+				log.Errorf("removing stale facts of network %s: %v", id, err)
+				delete(m.networkFacts, id)
+				continue
+			}
+			posted = statementsMinus(posted, stale)
+			m.networkFacts[id] = posted
+		}
+		if fresh := statementsMinus(facts, posted); len(fresh) > 0 {
+			if err := m.MetadataApi.PostNsProof(id, fresh); err != nil {
+				log.Errorf("posting facts of network %s: %v", id, err)
+				continue
+			}
+		}
+		m.networkFacts[id] = facts
+	}
+	for id := range m.networkFacts {
+		if !tracked[id] {
+			m.removeNetworkFacts(id)
+		}
+	}
+}
+
+// removeNetworkFacts removes the facts posted of a network, kept to be
+// removed again if that fails. The facts of a namespace gone went with it.
+func (m *Monitor) removeNetworkFacts(id string) {
+	if posted := m.networkFacts[id]; len(posted) > 0 {
+		err := m.MetadataApi.RemoveNsProof(id, posted)
+		if err != nil && !metadata.IsNotFound(err) {
+			log.Errorf("removing facts of network %s: %v", id, err)
+			return
+		}
+	}
+	delete(m.networkFacts, id)
+}
+
+// withdrawNetworkFacts removes the facts of a deleted network, before its
+// namespace goes.
+func (m *Monitor) withdrawNetworkFacts(id string) {
+	m.NetworkWorkerLock.Lock()
+	defer m.NetworkWorkerLock.Unlock()
+	m.removeNetworkFacts(id)
+}
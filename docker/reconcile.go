@@ -0,0 +1,223 @@
+package docker
+
+import (
+	"fmt"
+	"strings"
+
+	metadata "github.com/jerryz920/tapcon-monitor/statement"
+)
+
+/// set reconciliation between the local view and the metadata server
+
+// reconcileItem is an element of a collection kept in sync with the metadata
+// server. Items with the same key are considered the same.
+type reconcileItem interface {
+	Key() string
+}
+
+type reconcileDiff struct {
+	Add    []reconcileItem
+	Remove []reconcileItem
+	Keep   []reconcileItem
+}
+
+// diffItems splits the client and server collections into items only the
+// client has (to add), items only the server has (to remove), and items both
+// have (to keep). Kept items are taken from the server side, and duplicated
+// keys are counted once.
+func diffItems(client, server []reconcileItem) reconcileDiff {
+	diff := reconcileDiff{
+		Add:    make([]reconcileItem, 0, len(client)),
+		Remove: make([]reconcileItem, 0, len(server)),
+		Keep:   make([]reconcileItem, 0, len(server)),
+	}
+	clientKeys := make(map[string]bool, len(client))
+	for _, item := range client {
+		clientKeys[item.Key()] = true
+	}
+	serverKeys := make(map[string]bool, len(server))
+	for _, item := range server {
+		key := item.Key()
+		if serverKeys[key] {
+			continue
+		}
+		serverKeys[key] = true
+		if clientKeys[key] {
+			diff.Keep = append(diff.Keep, item)
+		} else {
+			diff.Remove = append(diff.Remove, item)
+		}
+	}
+	added := make(map[string]bool, len(client))
+	for _, item := range client {
+		key := item.Key()
+		if serverKeys[key] || added[key] {
+			continue
+		}
+		added[key] = true
+		diff.Add = append(diff.Add, item)
+	}
+	return diff
+}
+
+// reconcileOps describes how to change a collection on the metadata server.
+// add and remove build the mutations applying the changes. In batch mode they
+// are called once with all the items, and the single mutation returned covers
+// all of them. Otherwise they are called once for every item. commit updates
+// the cached server state with what the server holds after the changes.
+type reconcileOps struct {
+	add    func([]reconcileItem) metadata.Mutation
+	remove func([]reconcileItem) metadata.Mutation
+	commit func([]reconcileItem)
+	batch  bool
+}
+
+// reconcilePlan holds the mutations to bring one collection in sync, so that
+// the plans of several collections can be sent together.
+type reconcilePlan struct {
+	ops       reconcileOps
+	diff      reconcileDiff
+	adds      [][]reconcileItem // items covered by each add mutation
+	removes   [][]reconcileItem // items covered by each remove mutation
+	Mutations []metadata.Mutation
+	// items the server already had when adding them, filled by Commit
+	Existed []reconcileItem
+}
+
+func (p *reconcilePlan) group(items []reconcileItem) [][]reconcileItem {
+	if len(items) == 0 {
+		return [][]reconcileItem{}
+	}
+	if p.ops.batch {
+		return [][]reconcileItem{items}
+	}
+	groups := make([][]reconcileItem, 0, len(items))
+	for _, item := range items {
+		groups = append(groups, []reconcileItem{item})
+	}
+	return groups
+}
+
+func planItems(client, server []reconcileItem, ops reconcileOps) *reconcilePlan {
+	p := &reconcilePlan{ops: ops, diff: diffItems(client, server)}
+	p.adds = p.group(p.diff.Add)
+	p.removes = p.group(p.diff.Remove)
+	p.Mutations = make([]metadata.Mutation, 0, len(p.adds)+len(p.removes))
+	for _, items := range p.adds {
+		p.Mutations = append(p.Mutations, ops.add(items))
+	}
+	for _, items := range p.removes {
+		p.Mutations = append(p.Mutations, ops.remove(items))
+	}
+	return p
+}
+
+// Commit takes the results of the planned mutations, in order, and commits
+// what the server holds afterwards: the kept items, the items added, and the
+// items failed to be removed. A single item the server already has counts as
+// added, and one it doesn't have as removed, our view was just stale. Other
+// failures are returned together as a *ReconcileError.
+func (p *reconcilePlan) Commit(results []error) error {
+	errs := &ReconcileError{}
+	result := make([]reconcileItem, 0, len(p.diff.Keep)+len(p.diff.Add))
+	result = append(result, p.diff.Keep...)
+	for i, items := range p.adds {
+		if err := results[i]; err != nil {
+			if len(items) != 1 || !metadata.IsAlreadyExists(err) {
+				errs.Add(err)
+				continue
+			}
+			p.Existed = append(p.Existed, items...)
+		}
+		result = append(result, items...)
+	}
+	for i, items := range p.removes {
+		err := results[len(p.adds)+i]
+		if err != nil && (len(items) != 1 || !metadata.IsNotFound(err)) {
+			errs.Add(err)
+			result = append(result, items...)
+		}
+	}
+	p.ops.commit(result)
+	return errs.Err()
+}
+
+// reconcilePlans sends the mutations of all the plans in one batch and
+// commits each of them. Failures don't stop the rest of the changes.
+func reconcilePlans(batcher metadata.Batcher, plans ...*reconcilePlan) error {
+	mutations := make([]metadata.Mutation, 0)
+	for _, p := range plans {
+		mutations = append(mutations, p.Mutations...)
+	}
+	results := []error{}
+	if len(mutations) > 0 {
+		results = batcher.Batch(mutations)
+	}
+	if len(results) != len(mutations) {
+		err := fmt.Errorf("batch returns %d results for %d mutations",
+			len(results), len(mutations))
+		results = make([]error, len(mutations))
+		for i := range results {
+			results[i] = err
+		}
+	}
+
+	errs := &ReconcileError{}
+	offset := 0
+	for _, p := range plans {
+		n := len(p.Mutations)
+		errs.Add(p.Commit(results[offset : offset+n]))
+		offset += n
+	}
+	return errs.Err()
+}
+
+// ReconcileError collects the failures of a reconciliation.
+type ReconcileError struct {
+	Errors []error
+}
+
+func (e *ReconcileError) Add(err error) {
+	if err == nil {
+		return
+	}
+	if nested, ok := err.(*ReconcileError); ok {
+		e.Errors = append(e.Errors, nested.Errors...)
+		return
+	}
+	e.Errors = append(e.Errors, err)
+}
+
+// Err returns nil if nothing failed, so the result can be returned directly.
+func (e *ReconcileError) Err() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
+
+// HasKind tells if any of the failures is a metadata API error of the kind.
+func (e *ReconcileError) HasKind(kind metadata.ErrorKind) bool {
+	for _, err := range e.Errors {
+		if metadata.ErrorKindOf(err) == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// errorHasKind is HasKind for errors that may or may not be a *ReconcileError.
+func errorHasKind(err error, kind metadata.ErrorKind) bool {
+	if rerr, ok := err.(*ReconcileError); ok {
+		return rerr.HasKind(kind)
+	}
+	return metadata.ErrorKindOf(err) == kind
+}
+
+func (e *ReconcileError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
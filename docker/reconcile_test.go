@@ -0,0 +1,211 @@
+package docker
+
+import (
+	"fmt"
+	"testing"
+
+	metadata "github.com/jerryz920/tapcon-monitor/statement"
+	"github.com/stretchr/testify/assert"
+)
+
+type testItem struct {
+	key  string
+	side string
+}
+
+func (i testItem) Key() string {
+	return i.key
+}
+
+func clientItems(keys ...string) []reconcileItem {
+	result := make([]reconcileItem, 0, len(keys))
+	for _, k := range keys {
+		result = append(result, testItem{k, "client"})
+	}
+	return result
+}
+
+func serverItems(keys ...string) []reconcileItem {
+	result := make([]reconcileItem, 0, len(keys))
+	for _, k := range keys {
+		result = append(result, testItem{k, "server"})
+	}
+	return result
+}
+
+func itemKeys(items []reconcileItem) []string {
+	result := make([]string, 0, len(items))
+	for _, item := range items {
+		result = append(result, item.Key())
+	}
+	return result
+}
+
+func TestDiffItems(t *testing.T) {
+	cases := []struct {
+		name   string
+		client []reconcileItem
+		server []reconcileItem
+		add    []string
+		remove []string
+		keep   []string
+	}{
+		{"empty", clientItems(), serverItems(),
+			[]string{}, []string{}, []string{}},
+		{"client only", clientItems("a", "b"), serverItems(),
+			[]string{"a", "b"}, []string{}, []string{}},
+		{"server only", clientItems(), serverItems("a", "b"),
+			[]string{}, []string{"a", "b"}, []string{}},
+		{"same", clientItems("a", "b"), serverItems("b", "a"),
+			[]string{}, []string{}, []string{"b", "a"}},
+		{"mixed", clientItems("a", "b", "c"), serverItems("b", "d"),
+			[]string{"a", "c"}, []string{"d"}, []string{"b"}},
+		{"duplicated", clientItems("a", "a", "b"), serverItems("b", "b", "c", "c"),
+			[]string{"a"}, []string{"c"}, []string{"b"}},
+	}
+
+	for _, c := range cases {
+		diff := diffItems(c.client, c.server)
+		assert.Equal(t, c.add, itemKeys(diff.Add), "%s: add", c.name)
+		assert.Equal(t, c.remove, itemKeys(diff.Remove), "%s: remove", c.name)
+		assert.Equal(t, c.keep, itemKeys(diff.Keep), "%s: keep", c.name)
+		for _, item := range diff.Keep {
+			assert.Equal(t, "server", item.(testItem).side,
+				"%s: kept item from server", c.name)
+		}
+	}
+}
+
+// records applied items and fails on the given keys
+type testBatcher struct {
+	added   []string
+	removed []string
+	fail    map[string]bool
+	errs    map[string]error
+	batches int
+}
+
+func (b *testBatcher) Batch(mutations []metadata.Mutation) []error {
+	b.batches++
+	results := make([]error, len(mutations))
+	for i, m := range mutations {
+		for _, key := range m.Dependencies {
+			if b.fail[key] {
+				results[i] = fmt.Errorf("failing %s", key)
+			} else if err, ok := b.errs[key]; ok {
+				results[i] = err
+			}
+		}
+		if results[i] != nil {
+			continue
+		}
+		if m.Op == "add" {
+			b.added = append(b.added, m.Dependencies...)
+		} else {
+			b.removed = append(b.removed, m.Dependencies...)
+		}
+	}
+	return results
+}
+
+func testOps(batch bool, result *[]string) reconcileOps {
+	return reconcileOps{
+		add: func(items []reconcileItem) metadata.Mutation {
+			return metadata.Mutation{Op: "add", Dependencies: itemKeys(items)}
+		},
+		remove: func(items []reconcileItem) metadata.Mutation {
+			return metadata.Mutation{Op: "remove", Dependencies: itemKeys(items)}
+		},
+		commit: func(items []reconcileItem) {
+			*result = itemKeys(items)
+		},
+		batch: batch,
+	}
+}
+
+func TestReconcileItems(t *testing.T) {
+	cases := []struct {
+		name    string
+		client  []reconcileItem
+		server  []reconcileItem
+		fail    []string
+		batch   bool
+		added   []string
+		removed []string
+		result  []string
+		nerrs   int
+	}{
+		{"in sync", clientItems("a"), serverItems("a"), nil, false,
+			nil, nil, []string{"a"}, 0},
+		{"all succeed", clientItems("a", "b"), serverItems("b", "c"), nil, false,
+			[]string{"a"}, []string{"c"}, []string{"b", "a"}, 0},
+		{"add fails", clientItems("a", "b", "c"), serverItems(), []string{"b"}, false,
+			[]string{"a", "c"}, nil, []string{"a", "c"}, 1},
+		{"remove fails", clientItems(), serverItems("a", "b", "c"), []string{"a", "c"}, false,
+			nil, []string{"b"}, []string{"a", "c"}, 2},
+		{"batch succeeds", clientItems("a", "b"), serverItems("c", "d"), nil, true,
+			[]string{"a", "b"}, []string{"c", "d"}, []string{"a", "b"}, 0},
+		{"batch add fails", clientItems("a", "b"), serverItems("c"), []string{"a"}, true,
+			nil, []string{"c"}, []string{}, 1},
+		{"batch remove fails", clientItems("a"), serverItems("c", "d"), []string{"d"}, true,
+			[]string{"a"}, nil, []string{"a", "c", "d"}, 1},
+	}
+
+	for _, c := range cases {
+		b := &testBatcher{fail: make(map[string]bool)}
+		for _, k := range c.fail {
+			b.fail[k] = true
+		}
+		var result []string
+		plan := planItems(c.client, c.server, testOps(c.batch, &result))
+		err := reconcilePlans(b, plan)
+		assert.Equal(t, c.added, b.added, "%s: added", c.name)
+		assert.Equal(t, c.removed, b.removed, "%s: removed", c.name)
+		assert.Equal(t, c.result, result, "%s: result", c.name)
+		if c.nerrs == 0 {
+			assert.Nil(t, err, "%s: error", c.name)
+		} else if assert.IsType(t, &ReconcileError{}, err, "%s: error", c.name) {
+			assert.Len(t, err.(*ReconcileError).Errors, c.nerrs, "%s: errors", c.name)
+		}
+	}
+}
+
+func TestReconcilePlansInOneBatch(t *testing.T) {
+	b := &testBatcher{fail: map[string]bool{"b": true}}
+	var r1, r2, r3 []string
+	err := reconcilePlans(b,
+		planItems(clientItems("a", "b"), serverItems("c"), testOps(false, &r1)),
+		planItems(clientItems(), serverItems(), testOps(true, &r2)),
+		planItems(clientItems("d"), serverItems("e"), testOps(true, &r3)))
+
+	assert.Equal(t, 1, b.batches, "all mutations in one batch")
+	assert.Equal(t, []string{"a"}, r1, "first plan result")
+	assert.Equal(t, []string{}, r2, "empty plan result")
+	assert.Equal(t, []string{"d"}, r3, "last plan result")
+	assert.Equal(t, []string{"a", "d"}, b.added, "added")
+	assert.Equal(t, []string{"c", "e"}, b.removed, "removed")
+	if assert.IsType(t, &ReconcileError{}, err, "aggregated error") {
+		assert.Len(t, err.(*ReconcileError).Errors, 1, "one failure")
+	}
+}
+
+func TestReconcileStaleView(t *testing.T) {
+	exists := &metadata.ApiError{Kind: metadata.ErrAlreadyExists}
+	notFound := &metadata.ApiError{Kind: metadata.ErrNotFound}
+	b := &testBatcher{errs: map[string]error{"a": exists, "c": notFound}}
+	var result []string
+	plan := planItems(clientItems("a", "b"), serverItems("c", "d"),
+		testOps(false, &result))
+	err := reconcilePlans(b, plan)
+	assert.Nil(t, err, "stale view is not an error")
+	assert.Equal(t, []string{"a", "b"}, result, "existing item kept, missing dropped")
+	assert.Equal(t, []string{"a"}, itemKeys(plan.Existed), "existed items")
+
+	b = &testBatcher{errs: map[string]error{"a": exists}}
+	result = nil
+	plan = planItems(clientItems("a", "b"), serverItems(), testOps(true, &result))
+	err = reconcilePlans(b, plan)
+	assert.True(t, errorHasKind(err, metadata.ErrAlreadyExists),
+		"batched items may only partly exist")
+	assert.Empty(t, result, "nothing added")
+}
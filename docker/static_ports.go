@@ -2,45 +2,368 @@ package docker
 
 import (
 	"fmt"
-	"sync/atomic"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	docker "github.com/docker/docker/container"
+	tapcon_config "github.com/jerryz920/tapcon-monitor/config"
+	metadata "github.com/jerryz920/tapcon-monitor/statement"
+)
+
+const (
+	// STATIC_PORT_LABEL pins the static ports of a container, as
+	// "<min>-<max>".
+	STATIC_PORT_LABEL = "tapcon.static_ports"
+	// STATIC_PORT_SIZE_LABEL asks for a number of static ports, none if 0,
+	// and STATIC_PORT_POOL_LABEL for the pool they come from.
+	STATIC_PORT_SIZE_LABEL = "tapcon.ports"
+	STATIC_PORT_POOL_LABEL = "tapcon.port-pool"
 )
 
-func (m *Monitor) staticPortSlotAllocated(i int) bool {
-	return atomic.LoadInt32(&m.availableStaticPorts[i]) == 0
+// newPortPools makes the configured pools, the default one left out if it
+// has no port.
+func newPortPools(conf *tapcon_config.TapconConfig) map[string]*portPool {
+	pools := make(map[string]*portPool, len(conf.PortPools)+1)
+	if conf.StaticPortMax > conf.StaticPortBase {
+		pools[tapcon_config.DEFAULT_PORT_POOL] = newPortPool(
+			tapcon_config.DEFAULT_PORT_POOL, conf.StaticPortBase,
+			conf.StaticPortMax, conf.PortPerContainer)
+	}
+	for name, pool := range conf.PortPools {
+		pools[name] = newPortPool(name, pool.Min, pool.Max,
+			pool.PortPerContainer)
+	}
+	return pools
 }
 
-func (m *Monitor) deallocateStaticPort(i int) {
-	atomic.StoreInt32(&m.availableStaticPorts[i], 0)
+// staticPortPool gives the pool of the range, nil if it is in none.
+func (m *Monitor) staticPortPool(r PortRange) *portPool {
+	for _, pool := range m.portPools {
+		if pool.contains(r) {
+			return pool
+		}
+	}
+	return nil
+}
+
+// claimStaticPorts takes the range for owner, false if it is in no pool or
+// any of its ports is taken already.
+func (m *Monitor) claimStaticPorts(r PortRange, owner string) bool {
+	pool := m.staticPortPool(r)
+	return pool != nil && pool.claim(r, owner)
+}
+
+func (m *Monitor) deallocateStaticPortRange(r PortRange) {
+	if pool := m.staticPortPool(r); pool != nil {
+		pool.release(r)
+	}
 }
 
 func (m *Monitor) deallocateStaticPortByContainer(c *MemContainer) {
 	if c.StaticPortMin != 0 {
-		index := c.StaticPortMin / m.staticPortPerContainer
-		m.deallocateStaticPort(index)
+		m.deallocateStaticPortRange(PortRange{min: c.StaticPortMin,
+			max: c.StaticPortMax})
 		c.StaticPortMin = 0
 		c.StaticPortMax = 0
 	}
 }
 
-func (m *Monitor) nStaticPortSlot() int {
-	return (m.staticPortMax - m.staticPortMin) / m.staticPortPerContainer
+func containerLabels(c *MemContainer) map[string]string {
+	if c.Config == nil || c.Config.Config == nil {
+		return nil
+	}
+	return c.Config.Config.Labels
+}
+
+// staticPortRequest gives the pool and the number of static ports a
+// container asks for with its labels, the size of the default pool unless
+// told otherwise.
+func (m *Monitor) staticPortRequest(c *MemContainer) (*portPool, int, error) {
+	labels := containerLabels(c)
+	name := tapcon_config.DEFAULT_PORT_POOL
+	if label, ok := labels[STATIC_PORT_POOL_LABEL]; ok {
+		name = strings.TrimSpace(label)
+	}
+	pool, ok := m.portPools[name]
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown port pool %q", name)
+	}
+	size := pool.defaultSize
+	if label, ok := labels[STATIC_PORT_SIZE_LABEL]; ok {
+		n, err := strconv.Atoi(strings.TrimSpace(label))
+		if err != nil || n < 0 {
+			return nil, 0, fmt.Errorf("invalid label %s=%q",
+				STATIC_PORT_SIZE_LABEL, label)
+		}
+		size = n
+	}
+	return pool, size, nil
+}
+
+func fitsRequest(r PortRange, pool *portPool, size int) bool {
+	return pool.contains(r) && r.max-r.min+1 == size
+}
+
+func parsePortRange(s string) (PortRange, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), "-", 2)
+	if len(parts) != 2 {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	min, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	max, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return PortRange{min: min, max: max}, nil
+}
+
+// publishedHostPorts lists the host ports a container publishes, posted as
+// port aliases just like static ports and maybe within a pool.
+func publishedHostPorts(config *docker.Container) map[int]bool {
+	published := make(map[int]bool)
+	if config == nil || config.NetworkSettings == nil {
+		return published
+	}
+	for _, bindings := range config.NetworkSettings.Ports {
+		for _, binding := range bindings {
+			if port, err := strconv.Atoi(binding.HostPort); err == nil {
+				published[port] = true
+			}
+		}
+	}
+	return published
+}
+
+// loadPublishedHostPorts reads the host ports a container publishes from its
+// config on disk, before the container is loaded.
+func loadPublishedHostPorts(id, root string) (map[int]bool, error) {
+	config := docker.NewBaseContainer(id, root)
+	if err := config.FromDisk(); err != nil {
+		return nil, err
+	}
+	return publishedHostPorts(config), nil
+}
+
+func publishesAny(published map[int]bool, r PortRange) bool {
+	for port := r.min; port <= r.max; port++ {
+		if published[port] {
+			return true
+		}
+	}
+	return false
+}
+
+// principalStaticPorts lists the port aliases of a principal that may be its
+// static ports: within a pool, posted for both tcp and udp like static ports
+// are, and with none of the published host ports.
+func (m *Monitor) principalStaticPorts(p *metadata.Principal,
+	published map[int]bool) []PortRange {
+	ranges := []PortRange{}
+	if p == nil {
+		return ranges
+	}
+	found := make(map[PortRange]bool)
+	for _, alias := range p.Aliases.Ports {
+		udp := make(map[[2]int]bool, len(alias.Ports.Udp))
+		for _, r := range alias.Ports.Udp {
+			udp[r] = true
+		}
+		for _, r := range alias.Ports.Tcp {
+			prange := PortRange{min: r[0], max: r[1]}
+			if !udp[r] || found[prange] || m.staticPortPool(prange) == nil ||
+				publishesAny(published, prange) {
+				continue
+			}
+			found[prange] = true
+			ranges = append(ranges, prange)
+		}
+	}
+	return ranges
+}
+
+// reserveStaticPorts claims the ports a container had on the server before
+// the daemon restarted, so that no other container takes them before the
+// container is loaded. Nothing is reserved unless a single range may be its
+// static ports.
+func (m *Monitor) reserveStaticPorts(cid string, p *metadata.Principal,
+	published map[int]bool) {
+	ranges := m.principalStaticPorts(p, published)
+	if len(ranges) != 1 {
+		if len(ranges) > 1 {
+			log.Warnf("container %s static ports unclear among %v", cid,
+				ranges)
+		}
+		return
+	}
+	if !m.claimStaticPorts(ranges[0], cid) {
+		return
+	}
+	m.staticPortLock.Lock()
+	defer m.staticPortLock.Unlock()
+	if m.reservedStaticPorts == nil {
+		m.reservedStaticPorts = make(map[string]PortRange)
+	}
+	m.reservedStaticPorts[cid] = ranges[0]
+}
+
+// takeReservedStaticPorts gives the ports reserved for a container, if any.
+func (m *Monitor) takeReservedStaticPorts(cid string) (PortRange, bool) {
+	m.staticPortLock.Lock()
+	defer m.staticPortLock.Unlock()
+	r, ok := m.reservedStaticPorts[cid]
+	delete(m.reservedStaticPorts, cid)
+	return r, ok
+}
+
+// knownStaticPorts lists the ranges a container may have had before the
+// daemon restarted: the one pinned by its label first, then the port
+// aliases of its principal of the size it asks for in its pool.
+func (m *Monitor) knownStaticPorts(c *MemContainer, pool *portPool,
+	size int) []PortRange {
+	ranges := []PortRange{}
+	if label, ok := containerLabels(c)[STATIC_PORT_LABEL]; ok {
+		if r, err := parsePortRange(label); err != nil {
+			log.Warnf("container %s label %s: %v", c.Id, STATIC_PORT_LABEL,
+				err)
+		} else {
+			ranges = append(ranges, r)
+		}
+	}
+	if c.Cache != nil && size > 0 {
+		for _, r := range m.principalStaticPorts(c.Cache.State(),
+			publishedHostPorts(c.Config)) {
+			if fitsRequest(r, pool, size) {
+				ranges = append(ranges, r)
+			}
+		}
+	}
+	return ranges
+}
+
+// chooseStaticPorts picks the static ports of a container: the ones
+// reserved for it, the ones it had if still free, or free ones of the size
+// and pool it asks for. The range is empty if it asks for none.
+func (m *Monitor) chooseStaticPorts(c *MemContainer) (PortRange, error) {
+	cid := tapconContainerId(c)
+	reserved, ok := m.takeReservedStaticPorts(cid)
+	pool, size, err := m.staticPortRequest(c)
+	if err != nil {
+		if ok {
+			m.deallocateStaticPortRange(reserved)
+		}
+		return PortRange{}, err
+	}
+	for _, r := range m.knownStaticPorts(c, pool, size) {
+		if ok && r == reserved {
+			return r, nil
+		}
+		if m.claimStaticPorts(r, cid) {
+			if ok {
+				m.deallocateStaticPortRange(reserved)
+			}
+			return r, nil
+		}
+		log.Warnf("container %s static ports %d-%d not available", c.Id,
+			r.min, r.max)
+	}
+	if ok {
+		if fitsRequest(reserved, pool, size) {
+			return reserved, nil
+		}
+		m.deallocateStaticPortRange(reserved)
+	}
+	if size == 0 {
+		return PortRange{}, nil
+	}
+	return pool.allocate(size, cid)
+}
+
+// assignStaticPorts gives a running container its static ports and maps
+// them to the container IPs, again whenever they change.
+func (m *Monitor) assignStaticPorts(c *MemContainer) error {
+	if len(m.portPools) == 0 {
+		return nil
+	}
+	if c.StaticPortMin == 0 {
+		prange, err := m.chooseStaticPorts(c)
+		if err != nil {
+			return err
+		}
+		if prange.min == 0 {
+			return nil
+		}
+		log.Infof("container %s static ports %d-%d", c.Id, prange.min,
+			prange.max)
+		c.AssignStaticPorts(prange.min, prange.max)
+		c.staticPortIps = nil
+	}
+
+	ips := make([]string, 0, len(c.Ips))
+	for _, ip := range c.Ips {
+		if c.IsContainerIp(ip) {
+			ips = append(ips, ip)
+		}
+	}
+	if c.staticPortIps != nil && reflect.DeepEqual(ips, c.staticPortIps) {
+		return nil
+	}
+	cid := tapconContainerId(c)
+	m.SandboxBuilder.ClearStaticPortMapping(cid)
+	for _, ip := range ips {
+		/// traffic staying on the container network keeps its ports
+		subnet, err := c.GetSubnet(ip)
+		if err == nil {
+			err = m.SandboxBuilder.SetupStaticPortMapping(cid, ip, subnet,
+				c.StaticPortMin, c.StaticPortMax)
+		}
+		if err != nil {
+			/// mapped again on the next update
+			log.Errorf("mapping static ports of %s to %s: %v", c.Id, ip, err)
+			c.staticPortIps = nil
+			return nil
+		}
+	}
+	c.staticPortIps = ips
+	return nil
 }
 
-func (m *Monitor) resetAllStaticPortSlot() {
-	maxSlot := m.nStaticPortSlot()
-	for i := 0; i < maxSlot; i++ {
-		atomic.StoreInt32(&m.availableStaticPorts[i], 0)
+// releaseStaticPorts frees the ports of a container stopped or removed, or
+// the ones reserved for it if it never ran since.
+func (m *Monitor) releaseStaticPorts(c *MemContainer) {
+	if r, ok := m.takeReservedStaticPorts(tapconContainerId(c)); ok {
+		m.deallocateStaticPortRange(r)
+	}
+	if c.StaticPortMin == 0 {
+		return
 	}
+	if err := m.SandboxBuilder.ClearStaticPortMapping(
+		tapconContainerId(c)); err != nil {
+		log.Errorf("clearing static ports of %s: %v", c.Id, err)
+	}
+	c.staticPortIps = nil
+	m.deallocateStaticPortByContainer(c)
 }
 
-func (m *Monitor) allocateStaticPortSlot() (PortRange, error) {
-	maxSlot := m.nStaticPortSlot()
-	for i := 0; i < maxSlot; i++ {
-		if atomic.CompareAndSwapInt32(&m.availableStaticPorts[i], 0, 1) {
-			min := m.staticPortMin + i*m.staticPortPerContainer
-			max := m.staticPortMin + (i+1)*m.staticPortPerContainer - 1
-			return PortRange{min: min, max: max}, nil
+func (m *Monitor) dumpPortPools() {
+	names := make([]string, 0, len(m.portPools))
+	for name := range m.portPools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		pool := m.portPools[name]
+		allocated := []string{}
+		for _, a := range pool.allocations() {
+			allocated = append(allocated, fmt.Sprintf("%d-%d %s", a.min, a.max,
+				a.owner))
 		}
+		log.Infof("port pool %s %d-%d, %d per container, %d free: %v", name,
+			pool.min, pool.max-1, pool.defaultSize, pool.free(), allocated)
 	}
-	return PortRange{0, 0}, fmt.Errorf("can not find available slot")
 }
@@ -0,0 +1,196 @@
+package docker
+
+import (
+	"testing"
+
+	container_types "github.com/docker/docker/api/types/container"
+	tapcon_config "github.com/jerryz920/tapcon-monitor/config"
+	metadata "github.com/jerryz920/tapcon-monitor/statement"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newStaticPortMonitor(min, max, per int) *Monitor {
+	return &Monitor{
+		portPools: newPortPools(&tapcon_config.TapconConfig{
+			StaticPortBase:   min,
+			StaticPortMax:    max,
+			PortPerContainer: per,
+		}),
+		SandboxBuilder: &fakeSandbox{},
+	}
+}
+
+func TestStaticPortClaims(t *testing.T) {
+	m := newStaticPortMonitor(20000, 20030, 10)
+	assert.True(t, m.claimStaticPorts(PortRange{20010, 20019}, "c1"),
+		"claimed")
+	assert.False(t, m.claimStaticPorts(PortRange{20005, 20014}, "c2"),
+		"overlapping")
+	assert.False(t, m.claimStaticPorts(PortRange{20025, 20034}, "c2"),
+		"out of range")
+
+	c := &MemContainer{}
+	c.AssignStaticPorts(20010, 20019)
+	m.deallocateStaticPortByContainer(c)
+	assert.Equal(t, 0, c.StaticPortMin, "released")
+	assert.True(t, m.claimStaticPorts(PortRange{20005, 20014}, "c2"),
+		"freed")
+}
+
+func TestStaticPortLifecycle(t *testing.T) {
+	m := newStaticPortMonitor(20000, 20030, 10)
+	c := newStubContainer("c1", "image-1", "192.168.0.1", "10.0.0.1",
+		"local-ns", "10.1.0.2", "overlay-1", 0, 0)
+	c.Config.Config = &container_types.Config{}
+
+	require.Nil(t, m.assignStaticPorts(c), "assigned")
+	assert.Equal(t, 20000, c.StaticPortMin)
+	assert.Equal(t, 20009, c.StaticPortMax)
+	assert.Contains(t, c.ContainerPorts(), PortAlias{min: 20000, max: 20009,
+		ip: "10.0.0.1", protocol: "tcp", nsName: "local-ns"}, "posted")
+	require.Nil(t, m.assignStaticPorts(c), "assigned again")
+	assert.Equal(t, 20000, c.StaticPortMin, "kept while running")
+
+	m.releaseStaticPorts(c)
+	assert.Equal(t, 0, c.StaticPortMin, "released on stop")
+	assert.True(t, m.claimStaticPorts(PortRange{20000, 20009}, "c2"),
+		"slot freed")
+	m.deallocateStaticPortRange(PortRange{20000, 20009})
+
+	/// pinned by the label
+	c.Config.Config.Labels = map[string]string{
+		STATIC_PORT_LABEL: "20020-20029"}
+	require.Nil(t, m.assignStaticPorts(c), "assigned")
+	assert.Equal(t, 20020, c.StaticPortMin, "label honoured")
+	m.releaseStaticPorts(c)
+}
+
+func TestStaticPortRecovery(t *testing.T) {
+	m := newStaticPortMonitor(20000, 20030, 10)
+	p := metadata.NewPrincipal()
+	for _, proto := range []string{"tcp", "udp"} {
+		require.Nil(t, p.AddPortAlias("local-ns", "10.0.0.1", proto, 20010,
+			20019), "alias")
+	}
+	m.reserveStaticPorts("c1", p, nil)
+
+	/// another container loaded first does not take the slot
+	other := newStubContainer("c2", "image-1", "192.168.0.1", "10.0.0.1",
+		"local-ns", "10.1.0.3", "overlay-1", 0, 0)
+	require.Nil(t, m.assignStaticPorts(other), "assigned")
+	assert.Equal(t, 20000, other.StaticPortMin)
+	c := newStubContainer("c1", "image-1", "192.168.0.1", "10.0.0.1",
+		"local-ns", "10.1.0.2", "overlay-1", 0, 0)
+	require.Nil(t, m.assignStaticPorts(c), "assigned")
+	assert.Equal(t, 20010, c.StaticPortMin, "recovered")
+
+	/// removed before it was loaded
+	m.reserveStaticPorts("c3", p, nil)
+	assert.Empty(t, m.reservedStaticPorts, "slot in use")
+	m.releaseStaticPorts(c)
+	m.reserveStaticPorts("c3", p, nil)
+	m.releaseStaticPorts(&MemContainer{Id: "c3"})
+	assert.True(t, m.claimStaticPorts(PortRange{20010, 20019}, "c4"),
+		"reservation freed")
+}
+
+func TestStaticPortRecoveryPublished(t *testing.T) {
+	m := newStaticPortMonitor(20000, 20030, 10)
+	/// -p 20000:80 as well as static ports, both posted for tcp
+	p := metadata.NewPrincipal()
+	require.Nil(t, p.AddPortAlias("local-ns", "10.0.0.1", "tcp", 20000,
+		20000), "published alias")
+	for _, proto := range []string{"tcp", "udp"} {
+		require.Nil(t, p.AddPortAlias("local-ns", "10.0.0.1", proto, 20010,
+			20019), "static alias")
+	}
+	published := map[int]bool{20000: true}
+	assert.Equal(t, []PortRange{{20010, 20019}},
+		m.principalStaticPorts(p, published), "published port left out")
+
+	m.reserveStaticPorts("c1", p, published)
+	assert.Equal(t, map[string]PortRange{"c1": {20010, 20019}},
+		m.reservedStaticPorts, "static ports reserved")
+	assert.True(t, m.claimStaticPorts(PortRange{20000, 20009}, "c2"),
+		"published port not reserved")
+	m.deallocateStaticPortRange(PortRange{20000, 20009})
+
+	/// after the restart the container gets its static ports back
+	c := newStubContainer("c1", "image-1", "192.168.0.1", "10.0.0.1",
+		"local-ns", "10.1.0.2", "overlay-1", 0, 0, 20000)
+	require.Nil(t, m.assignStaticPorts(c), "assigned")
+	assert.Equal(t, 20010, c.StaticPortMin, "recovered")
+	assert.Equal(t, 20019, c.StaticPortMax)
+
+	/// a principal with the published port only has no static ports
+	tcpOnly := metadata.NewPrincipal()
+	require.Nil(t, tcpOnly.AddPortAlias("local-ns", "10.0.0.1", "tcp", 20020,
+		20029), "tcp alias")
+	m.reserveStaticPorts("c3", tcpOnly, nil)
+	assert.NotContains(t, m.reservedStaticPorts, "c3", "tcp only")
+
+	/// nor does one with two candidates
+	two := metadata.NewPrincipal()
+	for _, r := range [][2]int{{20020, 20024}, {20025, 20029}} {
+		for _, proto := range []string{"tcp", "udp"} {
+			require.Nil(t, two.AddPortAlias("local-ns", "10.0.0.1", proto,
+				r[0], r[1]), "alias")
+		}
+	}
+	m.reserveStaticPorts("c4", two, nil)
+	assert.NotContains(t, m.reservedStaticPorts, "c4", "unclear")
+}
+
+func TestStaticPortLabels(t *testing.T) {
+	m := &Monitor{
+		portPools: newPortPools(&tapcon_config.TapconConfig{
+			StaticPortBase:   20000,
+			StaticPortMax:    20100,
+			PortPerContainer: 10,
+			PortPools: map[string]tapcon_config.PortPoolConfig{
+				"high": {Min: 40000, Max: 42000, PortPerContainer: 100},
+			},
+		}),
+		SandboxBuilder: &fakeSandbox{},
+	}
+	labelled := func(id string, labels map[string]string) *MemContainer {
+		c := newStubContainer(id, "image-1", "192.168.0.1", "10.0.0.1",
+			"local-ns", "10.1.0.2", "overlay-1", 0, 0)
+		c.Config.Config = &container_types.Config{Labels: labels}
+		return c
+	}
+
+	big := labelled("c1", map[string]string{STATIC_PORT_SIZE_LABEL: "1000",
+		STATIC_PORT_POOL_LABEL: "high"})
+	require.Nil(t, m.assignStaticPorts(big), "assigned")
+	assert.Equal(t, 40000, big.StaticPortMin)
+	assert.Equal(t, 40999, big.StaticPortMax, "size asked for")
+	assert.Contains(t, big.ContainerPorts(), PortAlias{min: 40000,
+		max: 40999, ip: "10.0.0.1", protocol: "udp", nsName: "local-ns"},
+		"posted")
+
+	pooled := labelled("c2", map[string]string{STATIC_PORT_POOL_LABEL: "high"})
+	require.Nil(t, m.assignStaticPorts(pooled), "assigned")
+	assert.Equal(t, []int{41000, 41099}, []int{pooled.StaticPortMin,
+		pooled.StaticPortMax}, "size of the pool")
+
+	none := labelled("c3", map[string]string{STATIC_PORT_SIZE_LABEL: "0"})
+	require.Nil(t, m.assignStaticPorts(none), "no ports asked for")
+	assert.Equal(t, 0, none.StaticPortMin)
+	for _, alias := range none.ContainerPorts() {
+		assert.NotEqual(t, 20000, alias.min, "no static alias")
+	}
+
+	assert.NotNil(t, m.assignStaticPorts(labelled("c4", map[string]string{
+		STATIC_PORT_POOL_LABEL: "low"})), "unknown pool")
+	assert.NotNil(t, m.assignStaticPorts(labelled("c5", map[string]string{
+		STATIC_PORT_SIZE_LABEL: "-1"})), "invalid size")
+	assert.NotNil(t, m.assignStaticPorts(labelled("c6", map[string]string{
+		STATIC_PORT_SIZE_LABEL: "1000", STATIC_PORT_POOL_LABEL: "high"})),
+		"pool full")
+
+	m.releaseStaticPorts(big)
+	assert.Equal(t, []portAllocation{{PortRange{41000, 41099}, "c2"}},
+		m.portPools["high"].allocations(), "released")
+}
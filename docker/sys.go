@@ -1,13 +1,5 @@
 package docker
 
-import (
-	"fmt"
-	"os/exec"
-	"strings"
-
-	log "github.com/Sirupsen/logrus"
-)
-
 /// metadata and port management for tapcon monitor
 
 func (m *Monitor) ProvisionContainer(id string, c *MemContainer) error {
@@ -49,118 +41,21 @@ Tapcon metadata management:
     operation scan will skip it
 */
 
-// call our ipshow tool to display network namespace IPs. Docker bind the ns name
-// to different places so ip-route tools can not make use of that.
-func parseIps(data string) []string {
-	data = strings.Trim(data, "\n")
-	splitted := strings.Split(data, "\n")
-	/// each line is <eth> <ip> format
-	result := make([]string, 0, len(splitted))
-	for i, ipline := range splitted {
-		info := strings.Split(ipline, " ")
-		if len(info) < 2 {
-			log.Errorf("error reading in IPs: %s [%s]", splitted[i], ipline)
-			return []string{}
-		}
-		result = append(result, info[1])
-	}
-	return result
-}
-
-func ListNsIps(ns string) []string {
-
-	cmd := exec.Command("ipshow", ns)
-	data, err := cmd.Output()
-	if err != nil {
-		log.Errorf("error in listing Ns %s Ips: %s", ns, err.Error())
-		return []string{}
-	}
-	return parseIps(string(data))
-}
-
 /// Each chain contains the mapping of static ports assigned to it
 
 type Sandbox interface {
 	ContainerChainName(id string) string
 	SetupContainerChain(id string) error
 	RemoveContainerChain(id string) error
-	SetupStaticPortMapping(id string, containerIp string,
+	/// masquerade the ip to the ports, on the way out of its subnet only
+	SetupStaticPortMapping(id string, containerIp string, subnet string,
 		portMin int, portMax int) error
 	ClearStaticPortMapping(id string) error
-}
-
-type sandbox struct{}
-
-func (s *sandbox) ContainerChainName(id string) string {
-	return fmt.Sprintf("ctn-%s", id)
-}
-
-func (s *sandbox) SetupContainerChain(id string) error {
-
-	//	chainName := s.ContainerChainName(id)
-	//	cmd := exec.Command("iptables", "-t", "nat", "-N", chainName)
-	//
-	//	if out, err := cmd.CombinedOutput(); err != nil {
-	//		log.Errorf("error creating chain: %s", string(out))
-	//		return err
-	//	}
-	//
-	//	cmd = exec.Command("iptables", "-t", "nat", "-I", "POSTROUTING", "-j", chainName)
-	//	if out, err := cmd.CombinedOutput(); err != nil {
-	//		log.Errorf("error inserting chain: %s", string(out))
-	//		// we ignore the error here...
-	//		exec.Command("iptables", "-t", "nat", "-X", chainName).Run()
-	//		return err
-	//	}
-	return nil
-}
-
-func (s *sandbox) RemoveContainerChain(id string) error {
-	//	chainName := s.ContainerChainName(id)
-	//	cmd := exec.Command("iptables", "-t", "nat", "-D", "POSTROUTING", "-j", chainName)
-	//	if out, err := cmd.CombinedOutput(); err != nil {
-	//		log.Errorf("error clearing jumping to static mapping chain: %s", string(out))
-	//		return err
-	//	}
-	//
-	//	cmd = exec.Command("iptables", "-t", "nat", "-F", chainName)
-	//	if out, err := cmd.CombinedOutput(); err != nil {
-	//		log.Errorf("error clearing static mapping chain: %s", string(out))
-	//		return err
-	//	}
-	//
-	//	cmd = exec.Command("iptables", "-t", "nat", "-X", chainName)
-	//	if out, err := cmd.CombinedOutput(); err != nil {
-	//		log.Errorf("error deleting static mapping chain: %s", string(out))
-	//		return err
-	//	}
-	return nil
-}
-
-func (s *sandbox) SetupStaticPortMapping(id string, containerIp string,
-	portMin int, portMax int) error {
-
-	//	chainName := s.ContainerChainName(id)
-	//	for _, proto := range [2]string{"tcp", "udp"} {
-	//		cmd := exec.Command("iptables", "-t", "nat", "-A", chainName,
-	//			"-p", proto, "-d", containerIp,
-	//			"-j", "MASQUERADE", "--to-ports", fmt.Sprintf("%d-%d", portMin, portMax))
-	//		if out, err := cmd.CombinedOutput(); err != nil {
-	//			log.Errorf("error inserting static mapping rule: %s", string(out))
-	//			// clear the chain
-	//			exec.Command("iptables", "-t", "nat", "-F", chainName).Run()
-	//			return err
-	//		}
-	//	}
-	return nil
-}
-
-func (s *sandbox) ClearStaticPortMapping(id string) error {
-	chainName := s.ContainerChainName(id)
-	cmd := exec.Command("iptables", "-t", "nat", "-F", chainName)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		log.Errorf("error clearing static mapping chain: %s", string(out))
-		return err
-	}
-	return nil
+	/// remove the chains left by previous runs, but those of the ids
+	SweepContainerChains(keep []string) error
+	/// drop the traffic of containers to the metadata server, but the allowed
+	SetupMetadataGuard() error
+	/// let the ips of the container reach it, the ones allowed before go
+	AllowMetadataAccess(id string, ips []string) error
+	RevokeMetadataAccess(id string) error
 }
@@ -38,6 +38,6 @@ func initTestConfig() {
 	config.InitConf("../tests/")
 }
 
-func StubListIP(ns string) []string {
-	return []string{"192.168.1.1"}
+func StubListIP(ns string) ([]string, error) {
+	return []string{"192.168.1.1"}, nil
 }
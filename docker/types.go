@@ -1,5 +1,10 @@
 package docker
 
+import (
+	"fmt"
+	"net"
+)
+
 type PortRange struct {
 	min int
 	max int
@@ -12,3 +17,17 @@ type PortAlias struct {
 	ip       string
 	nsName   string
 }
+
+func (p PortAlias) Key() string {
+	return fmt.Sprintf("%s/%s/%s/%d-%d", p.nsName, canonicalIp(p.ip), p.protocol,
+		p.min, p.max)
+}
+
+// canonicalIp writes an address the way Go does, so IPv6 addresses spelled
+// differently by the server still match.
+func canonicalIp(s string) string {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.String()
+	}
+	return s
+}
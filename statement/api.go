@@ -2,6 +2,8 @@ package statement
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -11,6 +13,8 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 )
@@ -38,7 +42,16 @@ type MetadataAPI interface {
 	PostProofForChild(target string, statements []Statement) error
 	LinkProof(target string, dependencies []string) error
 	LinkProofForChild(target string, dependencies []string) error
+	RemoveProofForChild(target string, statements []Statement) error
+	UnlinkProofForChild(target string, dependencies []string) error
 	SelfCertify(statements []Statement) error
+	/// facts about a namespace, e.g. the network behind it
+	PostNsProof(ns string, statements []Statement) error
+	RemoveNsProof(ns string, statements []Statement) error
+	ListNsProofs(ns string) ([]EndorsedStatement, error)
+
+	/// apply many mutations in one call, with one result per mutation
+	Batch(mutations []Mutation) []error
 
 	/// traditional metadata api
 	MyLocalIp() (string, error)
@@ -50,26 +63,33 @@ const (
 	APIPath      = "openstack/latest/container_api"
 	AwsAPIPath   = "latest/meta-data"
 	/// API endpoints
-	kUploadVmImage     = "/upload_tapcon_image"
-	kViewNs            = "/query_iaas_ns"
-	kViewPrincipalName = "/view_principal_name"
-	kPostProof         = "/post_proofs"
-	kPostProofForChild = "/post_proofs_for_child"
-	kLinkProof         = "/link_proofs"
-	kLinkProofForChild = "/link_proofs_for_child"
-	kSelfCertify       = "/self_certify"
-	kCreatePrincipal   = "/create_principal"
-	kDeletePrincipal   = "/delete_principal"
-	kListPrincipals    = "/list_principals"
-	kShowPrincipal     = "/show_principal"
-	kCreateNs          = "/create_ns"
-	kDeleteNs          = "/delete_ns"
-	kJoinNs            = "/join_ns"
-	kLeaveNs           = "/leave_ns"
-	kCreateIPAlias     = "/create_ip_alias"
-	kDeleteIPAlias     = "/delete_ip_alias"
-	kCreatePortAlias   = "/create_port_alias"
-	kDeletePortAlias   = "/delete_port_alias"
+	kUploadVmImage       = "/upload_tapcon_image"
+	kViewNs              = "/query_iaas_ns"
+	kViewPrincipalName   = "/view_principal_name"
+	kPostProof           = "/post_proofs"
+	kPostProofForChild   = "/post_proofs_for_child"
+	kLinkProof           = "/link_proofs"
+	kLinkProofForChild   = "/link_proofs_for_child"
+	kRemoveProofForChild = "/remove_proofs_for_child"
+	kUnlinkProofForChild = "/unlink_proofs_for_child"
+	kSelfCertify         = "/self_certify"
+	kPostNsProof         = "/post_ns_proofs"
+	kRemoveNsProof       = "/remove_ns_proofs"
+	kListNsProofs        = "/list_ns_proofs"
+	kCreatePrincipal     = "/create_principal"
+	kDeletePrincipal     = "/delete_principal"
+	kListPrincipals      = "/list_principals"
+	kShowPrincipal       = "/show_principal"
+	kCreateNs            = "/create_ns"
+	kDeleteNs            = "/delete_ns"
+	kJoinNs              = "/join_ns"
+	kLeaveNs             = "/leave_ns"
+	kCreateIPAlias       = "/create_ip_alias"
+	kDeleteIPAlias       = "/delete_ip_alias"
+	kCreatePortAlias     = "/create_port_alias"
+	kDeletePortAlias     = "/delete_port_alias"
+	kBatch               = "/batch"
+	kCapabilities        = "/capabilities"
 	// traditional AWS api:
 	kViewLocalIP  = "/local-ipv4"
 	kViewPublicIP = "/public-ipv4"
@@ -96,39 +116,82 @@ const (
 type Api struct {
 	client     *http.Client
 	serverAddr string
+	scheme     string
+	// certificates reloaded on rotation, nil without TLS
+	certs      *certReloader
+	clientLock *sync.Mutex
+	signer     *RequestSigner // nil to send requests unsigned
+	version    int            // of the wire protocol, ProtocolAuto to negotiate
+	imds       *imdsSession
+	// features advertised by the server, nil until fetched
+	capabilities map[string]bool
+	capLock      *sync.Mutex
+	capProbing   bool          // one caller asks, the others go without
+	capNext      time.Time     // not asked again before, after a failure
+	capDelay     time.Duration // to wait after the next failure
 }
 
 // For whatever result the server is returning 200 at the moment. Though
-// a "false" in body is returned for failure, and "true" for success
+// a "false" in body is returned for failure, and "true" for success. Newer
+// servers also answer with an error status, both end up in an *ApiError.
 func ok(resp *http.Response) error {
 	data, err := ioutil.ReadAll(resp.Body)
 	defer resp.Body.Close()
 	if err != nil {
 		log.Errorf("reading metadata server result: %v", err)
-		return err
+		return unavailable(err)
 	}
 	res := string(data)
 	res = strings.ToLower(res)
 	// make it debug
-	if res == "true" {
+	if resp.StatusCode == http.StatusOK && res == "true" {
+		return nil
+	}
+	return NewApiError(resp.StatusCode, res)
+}
+
+// statusError returns the error of a response with a failure status, the body
+// is consumed in that case.
+func statusError(resp *http.Response) error {
+	if resp.StatusCode == http.StatusOK {
 		return nil
 	}
-	return fmt.Errorf("metadata server returns error string: %s", res)
+	data, _ := ioutil.ReadAll(resp.Body)
+	return NewApiError(resp.StatusCode, string(data))
+}
+
+// readBody reads the whole body, ContentLength is only a hint and may be -1.
+func readBody(resp *http.Response) (*bytes.Buffer, error) {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	if resp.ContentLength > 0 {
+		buf.Grow(int(resp.ContentLength))
+	}
+	if _, err := buf.ReadFrom(resp.Body); err != nil {
+		log.Debugf("error reading content of resp body: %v", err)
+		return buf, unavailable(err)
+	}
+	return buf, nil
 }
 
 func strResp(resp *http.Response) (string, error) {
-	data, err := ioutil.ReadAll(resp.Body)
 	defer resp.Body.Close()
+	if err := statusError(resp); err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		log.Errorf("reading metadata server result: %v", err)
-		return "", err
+		return "", unavailable(err)
 	}
 	return string(data), nil
 }
 
 func jsonResp(resp *http.Response) ([]string, error) {
-	decoder := json.NewDecoder(resp.Body)
 	defer resp.Body.Close()
+	if err := statusError(resp); err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(resp.Body)
 	result := make([]string, 0)
 	if err := decoder.Decode(&result); err != nil {
 		return nil, err
@@ -138,13 +201,12 @@ func jsonResp(resp *http.Response) ([]string, error) {
 
 func principalResp(resp *http.Response) (*Principal, error) {
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("error showing principal: %d", resp.StatusCode)
+	if err := statusError(resp); err != nil {
+		return nil, err
 	}
-	buf := make([]byte, 0, resp.ContentLength)
-	debugBuf := bytes.NewBuffer(buf)
-	if _, err := debugBuf.ReadFrom(resp.Body); err != nil {
-		log.Debugf("error reading content of resp body: %v", err)
+	debugBuf, err := readBody(resp)
+	if err != nil {
+		return nil, err
 	}
 	if debugBuf.Len() != 0 {
 		log.Debugf("buffer for principal: ----\n%s\n---", debugBuf.String())
@@ -159,13 +221,12 @@ func principalResp(resp *http.Response) (*Principal, error) {
 
 func principalMap(resp *http.Response) (map[string]Principal, error) {
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("status error in listing principals")
+	if err := statusError(resp); err != nil {
+		return nil, err
 	}
-	buf := make([]byte, 0, resp.ContentLength)
-	debugBuf := bytes.NewBuffer(buf)
-	if _, err := debugBuf.ReadFrom(resp.Body); err != nil {
-		log.Debugf("content of resp body: %s", debugBuf.String())
+	debugBuf, err := readBody(resp)
+	if err != nil {
+		return nil, err
 	}
 	if debugBuf.Len() != 0 {
 		log.Debugf("buffer for principal map: ----\n%s\n----", debugBuf.String())
@@ -178,19 +239,37 @@ func principalMap(resp *http.Response) (map[string]Principal, error) {
 	return result, nil
 }
 
+// NewOpenstackMetadataAPI gives every call DefaultTimeout to finish. Use
+// NewOpenstackContextAPI to pass deadlines and cancel calls.
 func NewOpenstackMetadataAPI(addr string) MetadataAPI {
+	return NoContext(NewOpenstackContextAPI(addr), context.Background(),
+		DefaultTimeout)
+}
+
+func NewOpenstackContextAPI(addr string) *Api {
+	return newApi(addr, "http", nil)
+}
+
+func newApi(addr, scheme string, tlsConfig *tls.Config) *Api {
 	if addr == "" {
 		addr = MetadataHost
 	}
-	api := &Api{serverAddr: addr}
+	return &Api{
+		serverAddr: addr,
+		scheme:     scheme,
+		client:     newHttpClient(tlsConfig),
+		clientLock: &sync.Mutex{},
+		capLock:    &sync.Mutex{},
+		imds:       newImdsSession(ImdsOptional, DefaultImdsTokenTTL),
+	}
+}
 
+func newHttpClient(tlsConfig *tls.Config) *http.Client {
 	tr := &http.Transport{
-		// if we need TLS in future
-		//TLSClientConfig: &tls.Config{RootCAs: pool},
+		TLSClientConfig:    tlsConfig,
 		DisableCompression: true,
 	}
-	api.client = &http.Client{Transport: tr}
-	return api
+	return &http.Client{Transport: tr}
 }
 
 type Base64FileReader struct {
@@ -274,16 +353,16 @@ func pack(names ...string) []urlQuery {
 	return result
 }
 
-func (api *Api) DoPost(apiname string, reader io.Reader, queries []urlQuery) (*http.Response, error) {
+func (api *Api) DoPost(ctx context.Context, apiname string, reader io.Reader, queries []urlQuery) (*http.Response, error) {
 
-	// FIXME: Most of the parameters are passed through "post", but actually using URL query.
-	// It's bad practice, but we have to modify the server for all these changes. Not worth
-	// it given the time budget at the moment.
-	req, err := http.NewRequest(http.MethodPost, api.GetAPI("http", apiname), reader)
+	// Version 1 passes the parameters of a "post" in the URL query. Servers
+	// speaking version 2 get JSON bodies instead, see DoV2.
+	req, err := http.NewRequest(http.MethodPost, api.GetAPI(api.scheme, apiname), reader)
 	if err != nil {
 		log.Errorf("constructing request: %v", err)
 		return nil, err
 	}
+	req = req.WithContext(ctx)
 	if len(queries) > 0 {
 		query := req.URL.Query()
 		for _, q := range queries {
@@ -292,15 +371,16 @@ func (api *Api) DoPost(apiname string, reader io.Reader, queries []urlQuery) (*h
 		req.URL.RawQuery = query.Encode()
 	}
 	log.Debugf("meta api: %s", req.URL.String())
-	return api.client.Do(req)
+	return api.do(req)
 }
 
-func (api *Api) DoGet(apiname string, queries []urlQuery) (*http.Response, error) {
-	req, err := http.NewRequest(http.MethodGet, api.GetAPI("http", apiname), nil)
+func (api *Api) DoGet(ctx context.Context, apiname string, queries []urlQuery) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, api.GetAPI(api.scheme, apiname), nil)
 	if err != nil {
 		log.Errorf("constructing request: %v", err)
 		return nil, err
 	}
+	req = req.WithContext(ctx)
 	if len(queries) > 0 {
 		query := req.URL.Query()
 		for _, q := range queries {
@@ -309,26 +389,50 @@ func (api *Api) DoGet(apiname string, queries []urlQuery) (*http.Response, error
 		req.URL.RawQuery = query.Encode()
 	}
 	log.Debugf("meta api: %s", req.URL.String())
-	return api.client.Do(req)
+	return api.do(req)
 }
 
-func (api *Api) DoAwsGet(apiname string, queries []urlQuery) (*http.Response, error) {
-	req, err := http.NewRequest(http.MethodGet, api.GetAwsAPI("http", apiname), nil)
-	if err != nil {
-		log.Errorf("constructing request: %v", err)
-		return nil, err
-	}
-	if len(queries) > 0 {
-		query := req.URL.Query()
-		for _, q := range queries {
-			query.Add(q.name, q.value)
+// DoAwsGet sends the IMDSv2 session token if there is one, see SetImds.
+func (api *Api) DoAwsGet(ctx context.Context, apiname string, queries []urlQuery) (*http.Response, error) {
+	return api.doImds(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, api.GetAwsAPI(api.scheme, apiname), nil)
+		if err != nil {
+			log.Errorf("constructing request: %v", err)
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		if len(queries) > 0 {
+			query := req.URL.Query()
+			for _, q := range queries {
+				query.Add(q.name, q.value)
+			}
+			req.URL.RawQuery = query.Encode()
+		}
+		return req, nil
+	})
+}
+
+// SetSigner signs all the requests made after with the signer.
+func (api *Api) SetSigner(signer *RequestSigner) {
+	api.signer = signer
+}
+
+// do sends the request, a server that can not be reached is unavailable.
+func (api *Api) do(req *http.Request) (*http.Response, error) {
+	if api.signer != nil {
+		if err := api.signer.Sign(req); err != nil {
+			log.Errorf("signing request: %v", err)
+			return nil, err
 		}
-		req.URL.RawQuery = query.Encode()
 	}
-	return api.client.Do(req)
+	resp, err := api.httpClient().Do(req)
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	return resp, nil
 }
 
-func (api *Api) UploadVmImage(name, location, gitrepo, gitrev, format string, encoded bool) error {
+func (api *Api) UploadVmImage(ctx context.Context, name, location, gitrepo, gitrev, format string, encoded bool) error {
 
 	/// read the data first and convert it to
 	var (
@@ -350,7 +454,7 @@ func (api *Api) UploadVmImage(name, location, gitrepo, gitrev, format string, en
 	defer encoder.Close()
 
 	/// upload image and wait for response
-	resp, err := api.DoPost(kUploadVmImage, encoder,
+	resp, err := api.DoPost(ctx, kUploadVmImage, encoder,
 		pack(qImageGitRepo, gitrepo,
 			qImageGitRev, gitrev,
 			qImageName, name,
@@ -362,8 +466,15 @@ func (api *Api) UploadVmImage(name, location, gitrepo, gitrev, format string, en
 	return ok(resp)
 }
 
-func (api *Api) MyId() (string, error) {
-	resp, err := api.DoGet(kViewPrincipalName, pack())
+func (api *Api) MyId(ctx context.Context) (string, error) {
+	if api.v2(ctx) {
+		self, err := api.selfV2(ctx)
+		if err != nil {
+			return "", err
+		}
+		return self.Principal, nil
+	}
+	resp, err := api.DoGet(ctx, kViewPrincipalName, pack())
 	if err != nil {
 		log.Errorf("view principal ID: %v", err)
 		return "", err
@@ -371,8 +482,15 @@ func (api *Api) MyId() (string, error) {
 	return strResp(resp)
 }
 
-func (api *Api) MyNs() (string, error) {
-	resp, err := api.DoGet(kViewNs, pack())
+func (api *Api) MyNs(ctx context.Context) (string, error) {
+	if api.v2(ctx) {
+		self, err := api.selfV2(ctx)
+		if err != nil {
+			return "", err
+		}
+		return self.NsName, nil
+	}
+	resp, err := api.DoGet(ctx, kViewNs, pack())
 	if err != nil {
 		log.Errorf("view NS ID: %v", err)
 		return "", err
@@ -380,8 +498,11 @@ func (api *Api) MyNs() (string, error) {
 	return strResp(resp)
 }
 
-func (api *Api) CreatePrincipal(name string) error {
-	resp, err := api.DoPost(kCreatePrincipal, nil, pack(qPrincipalName, name))
+func (api *Api) CreatePrincipal(ctx context.Context, name string) error {
+	if api.v2(ctx) {
+		return api.mutateV2(ctx, http.MethodPut, principalPath(name, ""), nil)
+	}
+	resp, err := api.DoPost(ctx, kCreatePrincipal, nil, pack(qPrincipalName, name))
 	if err != nil {
 		log.Errorf("creating principal: %v", err)
 		return err
@@ -389,8 +510,15 @@ func (api *Api) CreatePrincipal(name string) error {
 	return ok(resp)
 }
 
-func (api *Api) ListPrincipals() (map[string]Principal, error) {
-	resp, err := api.DoGet(kListPrincipals, pack())
+func (api *Api) ListPrincipals(ctx context.Context) (map[string]Principal, error) {
+	if api.v2(ctx) {
+		result := make(map[string]Principal)
+		if err := api.getV2(ctx, kV2Principals, &result); err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+	resp, err := api.DoGet(ctx, kListPrincipals, pack())
 	if err != nil {
 		log.Errorf("listing principals: %v", err)
 		return nil, err
@@ -398,8 +526,15 @@ func (api *Api) ListPrincipals() (map[string]Principal, error) {
 	return principalMap(resp)
 }
 
-func (api *Api) ShowPrincipal(target string) (*Principal, error) {
-	resp, err := api.DoGet(kShowPrincipal, pack(qTarget, target))
+func (api *Api) ShowPrincipal(ctx context.Context, target string) (*Principal, error) {
+	if api.v2(ctx) {
+		result := Principal{}
+		if err := api.getV2(ctx, principalPath(target, ""), &result); err != nil {
+			return nil, err
+		}
+		return &result, nil
+	}
+	resp, err := api.DoGet(ctx, kShowPrincipal, pack(qTarget, target))
 	if err != nil {
 		log.Errorf("show principal: %v", err)
 		return nil, err
@@ -408,8 +543,11 @@ func (api *Api) ShowPrincipal(target string) (*Principal, error) {
 
 }
 
-func (api *Api) DeletePrincipal(name string) error {
-	resp, err := api.DoPost(kDeletePrincipal, nil, pack(qPrincipalName, name))
+func (api *Api) DeletePrincipal(ctx context.Context, name string) error {
+	if api.v2(ctx) {
+		return api.mutateV2(ctx, http.MethodDelete, principalPath(name, ""), nil)
+	}
+	resp, err := api.DoPost(ctx, kDeletePrincipal, nil, pack(qPrincipalName, name))
 	if err != nil {
 		log.Errorf("deleting principal: %v", err)
 		return err
@@ -417,8 +555,11 @@ func (api *Api) DeletePrincipal(name string) error {
 	return ok(resp)
 }
 
-func (api *Api) CreateNs(ns string) error {
-	resp, err := api.DoPost(kCreateNs, nil, pack(qNsName, ns))
+func (api *Api) CreateNs(ctx context.Context, ns string) error {
+	if api.v2(ctx) {
+		return api.mutateV2(ctx, http.MethodPut, namespacePath(ns, ""), nil)
+	}
+	resp, err := api.DoPost(ctx, kCreateNs, nil, pack(qNsName, ns))
 	if err != nil {
 		log.Errorf("creating ns: %v", err)
 		return err
@@ -426,8 +567,11 @@ func (api *Api) CreateNs(ns string) error {
 	return ok(resp)
 }
 
-func (api *Api) JoinNs(ns string) error {
-	resp, err := api.DoPost(kJoinNs, nil, pack(qNsName, ns))
+func (api *Api) JoinNs(ctx context.Context, ns string) error {
+	if api.v2(ctx) {
+		return api.mutateV2(ctx, http.MethodPut, namespacePath(ns, v2Membership), nil)
+	}
+	resp, err := api.DoPost(ctx, kJoinNs, nil, pack(qNsName, ns))
 	if err != nil {
 		log.Errorf("joining ns: %v", err)
 		return err
@@ -435,8 +579,11 @@ func (api *Api) JoinNs(ns string) error {
 	return ok(resp)
 }
 
-func (api *Api) LeaveNs(ns string) error {
-	resp, err := api.DoPost(kLeaveNs, nil, pack(qNsName, ns))
+func (api *Api) LeaveNs(ctx context.Context, ns string) error {
+	if api.v2(ctx) {
+		return api.mutateV2(ctx, http.MethodDelete, namespacePath(ns, v2Membership), nil)
+	}
+	resp, err := api.DoPost(ctx, kLeaveNs, nil, pack(qNsName, ns))
 	if err != nil {
 		log.Errorf("leaving ns: %v", err)
 		return err
@@ -444,8 +591,11 @@ func (api *Api) LeaveNs(ns string) error {
 	return ok(resp)
 }
 
-func (api *Api) DeleteNs(ns string) error {
-	resp, err := api.DoPost(kDeleteNs, nil, pack(qNsName, ns))
+func (api *Api) DeleteNs(ctx context.Context, ns string) error {
+	if api.v2(ctx) {
+		return api.mutateV2(ctx, http.MethodDelete, namespacePath(ns, ""), nil)
+	}
+	resp, err := api.DoPost(ctx, kDeleteNs, nil, pack(qNsName, ns))
 	if err != nil {
 		log.Errorf("deleting ns: %v", err)
 		return err
@@ -453,8 +603,12 @@ func (api *Api) DeleteNs(ns string) error {
 	return ok(resp)
 }
 
-func (api *Api) CreateIPAlias(name string, ns string, ip net.IP) error {
-	resp, err := api.DoPost(kCreateIPAlias, nil, pack(qNsName, ns,
+func (api *Api) CreateIPAlias(ctx context.Context, name string, ns string, ip net.IP) error {
+	if api.v2(ctx) {
+		return api.mutateV2(ctx, http.MethodPut, principalPath(name,
+			v2IpAliases), ipAliasV2(ns, ip))
+	}
+	resp, err := api.DoPost(ctx, kCreateIPAlias, nil, pack(qNsName, ns,
 		qPrincipalName, name, qIpAlias, ip.String()))
 	if err != nil {
 		log.Errorf("creating Ip alias: %v", err)
@@ -463,8 +617,12 @@ func (api *Api) CreateIPAlias(name string, ns string, ip net.IP) error {
 	return ok(resp)
 }
 
-func (api *Api) DeleteIPAlias(name string, ns string, ip net.IP) error {
-	resp, err := api.DoPost(kDeleteIPAlias, nil, pack(qNsName, ns,
+func (api *Api) DeleteIPAlias(ctx context.Context, name string, ns string, ip net.IP) error {
+	if api.v2(ctx) {
+		return api.mutateV2(ctx, http.MethodDelete, principalPath(name,
+			v2IpAliases), ipAliasV2(ns, ip))
+	}
+	resp, err := api.DoPost(ctx, kDeleteIPAlias, nil, pack(qNsName, ns,
 		qPrincipalName, name, qIpAlias, ip.String()))
 	if err != nil {
 		log.Errorf("deleting Ip alias: %v", err)
@@ -473,9 +631,13 @@ func (api *Api) DeleteIPAlias(name string, ns string, ip net.IP) error {
 	return ok(resp)
 }
 
-func (api *Api) CreatePortAlias(name string, ns string, ip net.IP, protocol string,
+func (api *Api) CreatePortAlias(ctx context.Context, name string, ns string, ip net.IP, protocol string,
 	portMin, portMax int) error {
-	resp, err := api.DoPost(kCreatePortAlias, nil, pack(qNsName, ns,
+	if api.v2(ctx) {
+		return api.mutateV2(ctx, http.MethodPut, principalPath(name,
+			v2PortAliases), portAliasV2(ns, ip, protocol, portMin, portMax))
+	}
+	resp, err := api.DoPost(ctx, kCreatePortAlias, nil, pack(qNsName, ns,
 		qPrincipalName, name, qIpAlias, ip.String(), qProtocol, protocol,
 		qPortMin, fmt.Sprintf("%d", portMin), qPortMax, fmt.Sprintf("%d", portMax)))
 	if err != nil {
@@ -485,9 +647,13 @@ func (api *Api) CreatePortAlias(name string, ns string, ip net.IP, protocol stri
 	return ok(resp)
 }
 
-func (api *Api) DeletePortAlias(name string, ns string, ip net.IP, protocol string,
+func (api *Api) DeletePortAlias(ctx context.Context, name string, ns string, ip net.IP, protocol string,
 	portMin, portMax int) error {
-	resp, err := api.DoPost(kDeletePortAlias, nil, pack(qNsName, ns,
+	if api.v2(ctx) {
+		return api.mutateV2(ctx, http.MethodDelete, principalPath(name,
+			v2PortAliases), portAliasV2(ns, ip, protocol, portMin, portMax))
+	}
+	resp, err := api.DoPost(ctx, kDeletePortAlias, nil, pack(qNsName, ns,
 		qPrincipalName, name, qIpAlias, ip.String(), qProtocol, protocol,
 		qPortMin, fmt.Sprintf("%d", portMin), qPortMax, fmt.Sprintf("%d", portMax)))
 	if err != nil {
@@ -497,16 +663,24 @@ func (api *Api) DeletePortAlias(name string, ns string, ip net.IP, protocol stri
 	return ok(resp)
 }
 
-func (api *Api) postProof(target string, statements []Statement, apiname string) error {
+// encodeStatements gives the base64 encoded JSON of the statements, as the
+// version 1 endpoints take them.
+func encodeStatements(statements []Statement) (string, error) {
 	buf := bytes.NewBuffer(make([]byte, 0))
 	encoder := json.NewEncoder(buf)
 	if err := encoder.Encode(statements); err != nil {
 		log.Errorf("encoding statements: %v", err)
-		return err
+		return "", err
 	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
 
-	b64Statements := base64.StdEncoding.EncodeToString(buf.Bytes())
-	resp, err := api.DoPost(apiname, nil, pack(qTarget, target,
+func (api *Api) postProof(ctx context.Context, target string, statements []Statement, apiname string) error {
+	b64Statements, err := encodeStatements(statements)
+	if err != nil {
+		return err
+	}
+	resp, err := api.DoPost(ctx, apiname, nil, pack(qTarget, target,
 		qStatements, b64Statements))
 	if err != nil {
 		log.Errorf("posting proofs: %v", err)
@@ -515,15 +689,23 @@ func (api *Api) postProof(target string, statements []Statement, apiname string)
 	return ok(resp)
 }
 
-func (api *Api) PostProof(target string, statements []Statement) error {
-	return api.postProof(target, statements, kPostProof)
+func (api *Api) PostProof(ctx context.Context, target string, statements []Statement) error {
+	if api.v2(ctx) {
+		return api.mutateV2(ctx, http.MethodPost, principalPath(target,
+			v2Proofs), &v2Proof{Statements: statements})
+	}
+	return api.postProof(ctx, target, statements, kPostProof)
 }
 
-func (api *Api) PostProofForChild(target string, statements []Statement) error {
-	return api.postProof(target, statements, kPostProofForChild)
+func (api *Api) PostProofForChild(ctx context.Context, target string, statements []Statement) error {
+	if api.v2(ctx) {
+		return api.mutateV2(ctx, http.MethodPost, principalPath(target,
+			v2ChildProofs), &v2Proof{Statements: statements})
+	}
+	return api.postProof(ctx, target, statements, kPostProofForChild)
 }
 
-func (api *Api) linkProof(target string, dependencies []string, apiname string) error {
+func (api *Api) linkProof(ctx context.Context, target string, dependencies []string, apiname string) error {
 	buf := bytes.NewBuffer(make([]byte, 0))
 	encoder := json.NewEncoder(buf)
 	if err := encoder.Encode(dependencies); err != nil {
@@ -532,7 +714,7 @@ func (api *Api) linkProof(target string, dependencies []string, apiname string)
 	}
 
 	b64Dependencies := base64.StdEncoding.EncodeToString(buf.Bytes())
-	resp, err := api.DoPost(apiname, nil, pack(qTarget, target,
+	resp, err := api.DoPost(ctx, apiname, nil, pack(qTarget, target,
 		qDependencies, b64Dependencies))
 	if err != nil {
 		log.Errorf("linking proofs: %v", err)
@@ -541,15 +723,43 @@ func (api *Api) linkProof(target string, dependencies []string, apiname string)
 	return ok(resp)
 }
 
-func (api *Api) LinkProof(target string, dependencies []string) error {
-	return api.linkProof(target, dependencies, kLinkProof)
+func (api *Api) LinkProof(ctx context.Context, target string, dependencies []string) error {
+	if api.v2(ctx) {
+		return api.mutateV2(ctx, http.MethodPost, principalPath(target,
+			v2Links), &v2Proof{Dependencies: dependencies})
+	}
+	return api.linkProof(ctx, target, dependencies, kLinkProof)
 }
 
-func (api *Api) LinkProofForChild(target string, dependencies []string) error {
-	return api.linkProof(target, dependencies, kLinkProofForChild)
+func (api *Api) LinkProofForChild(ctx context.Context, target string, dependencies []string) error {
+	if api.v2(ctx) {
+		return api.mutateV2(ctx, http.MethodPost, principalPath(target,
+			v2ChildLinks), &v2Proof{Dependencies: dependencies})
+	}
+	return api.linkProof(ctx, target, dependencies, kLinkProofForChild)
 }
 
-func (api *Api) SelfCertify(statements []Statement) error {
+func (api *Api) RemoveProofForChild(ctx context.Context, target string, statements []Statement) error {
+	if api.v2(ctx) {
+		return api.mutateV2(ctx, http.MethodDelete, principalPath(target,
+			v2ChildProofs), &v2Proof{Statements: statements})
+	}
+	return api.postProof(ctx, target, statements, kRemoveProofForChild)
+}
+
+func (api *Api) UnlinkProofForChild(ctx context.Context, target string, dependencies []string) error {
+	if api.v2(ctx) {
+		return api.mutateV2(ctx, http.MethodDelete, principalPath(target,
+			v2ChildLinks), &v2Proof{Dependencies: dependencies})
+	}
+	return api.linkProof(ctx, target, dependencies, kUnlinkProofForChild)
+}
+
+func (api *Api) SelfCertify(ctx context.Context, statements []Statement) error {
+	if api.v2(ctx) {
+		return api.mutateV2(ctx, http.MethodPost, kV2Self+"/"+v2Proofs,
+			&v2Proof{Statements: statements})
+	}
 	buf := bytes.NewBuffer(make([]byte, 0))
 	encoder := json.NewEncoder(buf)
 	if err := encoder.Encode(statements); err != nil {
@@ -558,7 +768,7 @@ func (api *Api) SelfCertify(statements []Statement) error {
 	}
 
 	b64Statements := base64.StdEncoding.EncodeToString(buf.Bytes())
-	resp, err := api.DoPost(kSelfCertify, nil, pack(qStatements, b64Statements))
+	resp, err := api.DoPost(ctx, kSelfCertify, nil, pack(qStatements, b64Statements))
 	if err != nil {
 		log.Errorf("posting proofs: %v", err)
 		return err
@@ -566,8 +776,64 @@ func (api *Api) SelfCertify(statements []Statement) error {
 	return ok(resp)
 }
 
-func (api *Api) MyLocalIp() (string, error) {
-	resp, err := api.DoAwsGet(kViewLocalIP, pack())
+func (api *Api) postNsProof(ctx context.Context, ns string, statements []Statement, apiname string) error {
+	b64Statements, err := encodeStatements(statements)
+	if err != nil {
+		return err
+	}
+	resp, err := api.DoPost(ctx, apiname, nil, pack(qNsName, ns,
+		qStatements, b64Statements))
+	if err != nil {
+		log.Errorf("posting namespace proofs: %v", err)
+		return err
+	}
+	return ok(resp)
+}
+
+func (api *Api) PostNsProof(ctx context.Context, ns string, statements []Statement) error {
+	if api.v2(ctx) {
+		return api.mutateV2(ctx, http.MethodPost, namespacePath(ns, v2Proofs),
+			&v2Proof{Statements: statements})
+	}
+	return api.postNsProof(ctx, ns, statements, kPostNsProof)
+}
+
+func (api *Api) RemoveNsProof(ctx context.Context, ns string, statements []Statement) error {
+	if api.v2(ctx) {
+		return api.mutateV2(ctx, http.MethodDelete, namespacePath(ns,
+			v2Proofs), &v2Proof{Statements: statements})
+	}
+	return api.postNsProof(ctx, ns, statements, kRemoveNsProof)
+}
+
+// ListNsProofs gives the statements posted about a namespace, by anyone.
+func (api *Api) ListNsProofs(ctx context.Context, ns string) (
+	[]EndorsedStatement, error) {
+	result := []EndorsedStatement{}
+	if api.v2(ctx) {
+		if err := api.getV2(ctx, namespacePath(ns, v2Proofs),
+			&result); err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+	resp, err := api.DoGet(ctx, kListNsProofs, pack(qNsName, ns))
+	if err != nil {
+		log.Errorf("listing namespace proofs: %v", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := statusError(resp); err != nil {
+		return nil, err
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (api *Api) MyLocalIp(ctx context.Context) (string, error) {
+	resp, err := api.DoAwsGet(ctx, kViewLocalIP, pack())
 	if err != nil {
 		log.Errorf("view local IP: %v", err)
 		return "", err
@@ -575,11 +841,121 @@ func (api *Api) MyLocalIp() (string, error) {
 	return strResp(resp)
 }
 
-func (api *Api) MyPublicIp() (string, error) {
-	resp, err := api.DoAwsGet(kViewPublicIP, pack())
+func (api *Api) MyPublicIp(ctx context.Context) (string, error) {
+	resp, err := api.DoAwsGet(ctx, kViewPublicIP, pack())
 	if err != nil {
 		log.Errorf("view public IP: %v", err)
 		return "", err
 	}
 	return strResp(resp)
 }
+
+// fetchCapabilities asks the server what it supports. Old servers without
+// kCapabilities answer 404 and support nothing, any other failure leaves the
+// answer unknown.
+func (api *Api) fetchCapabilities(ctx context.Context) (map[string]bool,
+	error) {
+	resp, err := api.DoGet(ctx, kCapabilities, pack())
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		log.Infof("metadata server advertises no capability")
+		return map[string]bool{}, nil
+	}
+	caps, err := jsonResp(resp)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]bool, len(caps))
+	for _, c := range caps {
+		result[c] = true
+	}
+	return result, nil
+}
+
+// Supports tells if the server advertises a capability. Only a definite
+// answer is cached. After a failure the capability is taken as missing and
+// the server asked again once a backoff delay has passed, so an outage does
+// not cost a query per call. Callers do not wait for each other's query.
+func (api *Api) Supports(ctx context.Context, capability string) bool {
+	api.capLock.Lock()
+	caps := api.capabilities
+	probe := caps == nil && !api.capProbing && !time.Now().Before(api.capNext)
+	if probe {
+		api.capProbing = true
+	}
+	api.capLock.Unlock()
+	if caps != nil {
+		return caps[capability]
+	}
+	if !probe {
+		return false
+	}
+	caps, err := api.fetchCapabilities(ctx)
+	api.capLock.Lock()
+	defer api.capLock.Unlock()
+	api.capProbing = false
+	if err != nil {
+		if api.capDelay == 0 {
+			api.capDelay = CapProbeMinDelay
+		}
+		api.capNext = time.Now().Add(api.capDelay)
+		log.Errorf("querying capabilities, asking again in %v: %v",
+			api.capDelay, err)
+		if api.capDelay *= 2; api.capDelay > CapProbeMaxDelay {
+			api.capDelay = CapProbeMaxDelay
+		}
+		return false
+	}
+	api.capabilities = caps
+	api.capDelay = 0
+	return caps[capability]
+}
+
+func (api *Api) Batch(ctx context.Context, mutations []Mutation) []error {
+	if len(mutations) == 0 {
+		return []error{}
+	}
+	probeCtx, cancel := callContext(ctx)
+	batched := api.Supports(probeCtx, CapBatch)
+	cancel()
+	if !batched {
+		return ApplyMutationsContext(ctx, api, mutations)
+	}
+	ctx, cancel = batchContext(ctx, len(mutations))
+	defer cancel()
+
+	buf := bytes.NewBuffer(make([]byte, 0))
+	encoder := json.NewEncoder(buf)
+	if err := encoder.Encode(mutations); err != nil {
+		log.Errorf("encoding mutations: %v", err)
+		return batchFailed(len(mutations), err)
+	}
+	resp, err := api.DoPost(ctx, kBatch, buf, pack())
+	if err != nil {
+		log.Errorf("posting batch: %v", err)
+		return batchFailed(len(mutations), err)
+	}
+	defer resp.Body.Close()
+	if err := statusError(resp); err != nil {
+		return batchFailed(len(mutations), err)
+	}
+	results := make([]MutationResult, 0, len(mutations))
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return batchFailed(len(mutations), err)
+	}
+	if len(results) != len(mutations) {
+		return batchFailed(len(mutations), fmt.Errorf(
+			"batch returns %d results for %d mutations", len(results),
+			len(mutations)))
+	}
+	errs := make([]error, len(results))
+	for i, r := range results {
+		if !r.Ok {
+			errs[i] = NewApiError(r.Status, r.Error)
+		}
+	}
+	return errs
+}
@@ -218,16 +218,18 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	// it's just a simple test. No need to do that so far.
 
 	dispatcher_table := map[string]Handler{
-		kUploadVmImage:     HandleUploadVmImage,
-		kViewPrincipalName: HandleViewPrincipalName,
-		kViewNs:            HandleNsName,
-		kViewLocalIP:       HandleViewLocalIP,
-		kViewPublicIP:      HandleViewPublicIP,
-		kPostProof:         HandlePostProof,
-		kLinkProof:         HandleLinkProof,
-		kSelfCertify:       HandleSelfCertify,
-		kListPrincipals:    HandleListPrincipals,
-		kShowPrincipal:     HandleShowPrincipal,
+		kUploadVmImage:       HandleUploadVmImage,
+		kViewPrincipalName:   HandleViewPrincipalName,
+		kViewNs:              HandleNsName,
+		kViewLocalIP:         HandleViewLocalIP,
+		kViewPublicIP:        HandleViewPublicIP,
+		kPostProof:           HandlePostProof,
+		kLinkProof:           HandleLinkProof,
+		kRemoveProofForChild: HandlePostProof,
+		kUnlinkProofForChild: HandleLinkProof,
+		kSelfCertify:         HandleSelfCertify,
+		kListPrincipals:      HandleListPrincipals,
+		kShowPrincipal:       HandleShowPrincipal,
 		kCreatePrincipal: checkFieldsFunc(
 			map[string]string{"principal": "target"},
 		),
@@ -456,6 +458,20 @@ func TestLinkProof(t *testing.T) {
 	}
 }
 
+func TestRemoveProofForChild(t *testing.T) {
+	err := api.RemoveProofForChild("target", []Statement{"stmt1", "stmt2", "stmt3"})
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+}
+
+func TestUnlinkProofForChild(t *testing.T) {
+	err := api.UnlinkProofForChild("target", []string{"dep1", "dep2", "dep3"})
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+}
+
 func TestGetLocalIP(t *testing.T) {
 	s, err := api.MyLocalIp()
 	if err != nil {
@@ -481,9 +497,7 @@ func TestSelfCertify(t *testing.T) {
 
 func TestShowPrincipal(t *testing.T) {
 	s, err := api.ShowPrincipal("nonexist")
-	if err != nil {
-		t.Fatalf("error show principal: %v", err)
-	}
+	assert.True(t, IsNotFound(err), "non exist principal")
 	assert.Nil(t, s, "non exist principal")
 
 	s, err = api.ShowPrincipal("test")
@@ -0,0 +1,336 @@
+package statement
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+/// Batched mutations of the metadata service
+
+const (
+	// capability advertised by servers accepting kBatch
+	CapBatch = "batch"
+)
+
+// A Mutation is one state changing call of MetadataAPI. Op is the name of the
+// API endpoint, the other fields are its parameters.
+type Mutation struct {
+	Op           string      `json:"op"`
+	Principal    string      `json:"principal,omitempty"`
+	NsName       string      `json:"ns_name,omitempty"`
+	Ip           string      `json:"ip,omitempty"`
+	Protocol     string      `json:"protocol,omitempty"`
+	PortMin      int         `json:"port_min,omitempty"`
+	PortMax      int         `json:"port_max,omitempty"`
+	Target       string      `json:"target,omitempty"`
+	Statements   []Statement `json:"statements,omitempty"`
+	Dependencies []string    `json:"dependencies,omitempty"`
+}
+
+// MutationResult is the server's answer to one mutation in a batch. Status is
+// the HTTP status the individual call would have returned, if the server
+// tells.
+type MutationResult struct {
+	Ok     bool   `json:"ok"`
+	Error  string `json:"error,omitempty"`
+	Status int    `json:"status,omitempty"`
+}
+
+// Batcher applies a list of mutations, returning one result per mutation.
+type Batcher interface {
+	Batch(mutations []Mutation) []error
+}
+
+func opName(apiname string) string {
+	return strings.TrimPrefix(apiname, "/")
+}
+
+func CreatePrincipalMutation(name string) Mutation {
+	return Mutation{Op: opName(kCreatePrincipal), Principal: name}
+}
+
+func DeletePrincipalMutation(name string) Mutation {
+	return Mutation{Op: opName(kDeletePrincipal), Principal: name}
+}
+
+func CreateNsMutation(ns string) Mutation {
+	return Mutation{Op: opName(kCreateNs), NsName: ns}
+}
+
+func JoinNsMutation(ns string) Mutation {
+	return Mutation{Op: opName(kJoinNs), NsName: ns}
+}
+
+func LeaveNsMutation(ns string) Mutation {
+	return Mutation{Op: opName(kLeaveNs), NsName: ns}
+}
+
+func DeleteNsMutation(ns string) Mutation {
+	return Mutation{Op: opName(kDeleteNs), NsName: ns}
+}
+
+func CreateIPAliasMutation(name, ns string, ip net.IP) Mutation {
+	return Mutation{Op: opName(kCreateIPAlias), Principal: name, NsName: ns,
+		Ip: ip.String()}
+}
+
+func DeleteIPAliasMutation(name, ns string, ip net.IP) Mutation {
+	return Mutation{Op: opName(kDeleteIPAlias), Principal: name, NsName: ns,
+		Ip: ip.String()}
+}
+
+func CreatePortAliasMutation(name, ns string, ip net.IP, protocol string,
+	portMin, portMax int) Mutation {
+	return Mutation{Op: opName(kCreatePortAlias), Principal: name, NsName: ns,
+		Ip: ip.String(), Protocol: protocol, PortMin: portMin, PortMax: portMax}
+}
+
+func DeletePortAliasMutation(name, ns string, ip net.IP, protocol string,
+	portMin, portMax int) Mutation {
+	return Mutation{Op: opName(kDeletePortAlias), Principal: name, NsName: ns,
+		Ip: ip.String(), Protocol: protocol, PortMin: portMin, PortMax: portMax}
+}
+
+func PostProofMutation(target string, statements []Statement) Mutation {
+	return Mutation{Op: opName(kPostProof), Target: target, Statements: statements}
+}
+
+func PostProofForChildMutation(target string, statements []Statement) Mutation {
+	return Mutation{Op: opName(kPostProofForChild), Target: target,
+		Statements: statements}
+}
+
+func RemoveProofForChildMutation(target string, statements []Statement) Mutation {
+	return Mutation{Op: opName(kRemoveProofForChild), Target: target,
+		Statements: statements}
+}
+
+func PostNsProofMutation(ns string, statements []Statement) Mutation {
+	return Mutation{Op: opName(kPostNsProof), NsName: ns, Statements: statements}
+}
+
+func RemoveNsProofMutation(ns string, statements []Statement) Mutation {
+	return Mutation{Op: opName(kRemoveNsProof), NsName: ns,
+		Statements: statements}
+}
+
+func LinkProofMutation(target string, dependencies []string) Mutation {
+	return Mutation{Op: opName(kLinkProof), Target: target,
+		Dependencies: dependencies}
+}
+
+func LinkProofForChildMutation(target string, dependencies []string) Mutation {
+	return Mutation{Op: opName(kLinkProofForChild), Target: target,
+		Dependencies: dependencies}
+}
+
+func UnlinkProofForChildMutation(target string, dependencies []string) Mutation {
+	return Mutation{Op: opName(kUnlinkProofForChild), Target: target,
+		Dependencies: dependencies}
+}
+
+// ApplyMutation makes the individual API call of a mutation.
+func ApplyMutation(api MetadataAPI, m Mutation) error {
+	return ApplyMutationContext(context.Background(), WithContext(api), m)
+}
+
+// ApplyMutations is the fallback of Batch, one API call per mutation.
+func ApplyMutations(api MetadataAPI, mutations []Mutation) []error {
+	return ApplyMutationsContext(context.Background(), WithContext(api),
+		mutations)
+}
+
+func ApplyMutationContext(ctx context.Context, api ContextMetadataAPI,
+	m Mutation) error {
+	ip := net.ParseIP(m.Ip)
+	switch "/" + m.Op {
+	case kCreatePrincipal:
+		return api.CreatePrincipal(ctx, m.Principal)
+	case kDeletePrincipal:
+		return api.DeletePrincipal(ctx, m.Principal)
+	case kCreateNs:
+		return api.CreateNs(ctx, m.NsName)
+	case kJoinNs:
+		return api.JoinNs(ctx, m.NsName)
+	case kLeaveNs:
+		return api.LeaveNs(ctx, m.NsName)
+	case kDeleteNs:
+		return api.DeleteNs(ctx, m.NsName)
+	case kCreateIPAlias:
+		return api.CreateIPAlias(ctx, m.Principal, m.NsName, ip)
+	case kDeleteIPAlias:
+		return api.DeleteIPAlias(ctx, m.Principal, m.NsName, ip)
+	case kCreatePortAlias:
+		return api.CreatePortAlias(ctx, m.Principal, m.NsName, ip, m.Protocol,
+			m.PortMin, m.PortMax)
+	case kDeletePortAlias:
+		return api.DeletePortAlias(ctx, m.Principal, m.NsName, ip, m.Protocol,
+			m.PortMin, m.PortMax)
+	case kPostProof:
+		return api.PostProof(ctx, m.Target, m.Statements)
+	case kPostProofForChild:
+		return api.PostProofForChild(ctx, m.Target, m.Statements)
+	case kRemoveProofForChild:
+		return api.RemoveProofForChild(ctx, m.Target, m.Statements)
+	case kPostNsProof:
+		return api.PostNsProof(ctx, m.NsName, m.Statements)
+	case kRemoveNsProof:
+		return api.RemoveNsProof(ctx, m.NsName, m.Statements)
+	case kLinkProof:
+		return api.LinkProof(ctx, m.Target, m.Dependencies)
+	case kLinkProofForChild:
+		return api.LinkProofForChild(ctx, m.Target, m.Dependencies)
+	case kUnlinkProofForChild:
+		return api.UnlinkProofForChild(ctx, m.Target, m.Dependencies)
+	}
+	return fmt.Errorf("unknown mutation %s", m.Op)
+}
+
+// ApplyMutationsContext applies the mutations one by one, each within the
+// timeout per call of ctx if it has one.
+func ApplyMutationsContext(ctx context.Context, api ContextMetadataAPI,
+	mutations []Mutation) []error {
+	results := make([]error, len(mutations))
+	for i, m := range mutations {
+		callCtx, cancel := callContext(ctx)
+		results[i] = ApplyMutationContext(callCtx, api, m)
+		cancel()
+	}
+	return results
+}
+
+// the same error for every mutation, when the whole batch fails
+func batchFailed(n int, err error) []error {
+	results := make([]error, n)
+	for i := range results {
+		results[i] = err
+	}
+	return results
+}
+
+type pendingMutation struct {
+	m      Mutation
+	result chan error
+}
+
+// BatchBuffer collects mutations from many callers, for example the keepers of
+// different containers, and sends them in one batch when maxSize mutations are
+// buffered or the flush interval expires. Callers block until their own
+// mutations are done. Once closed, mutations fail without being sent.
+type BatchBuffer struct {
+	batcher  Batcher
+	maxSize  int
+	interval time.Duration
+	lock     *sync.Mutex
+	pending  []pendingMutation
+	closed   bool
+	done     chan bool
+}
+
+func NewBatchBuffer(batcher Batcher, maxSize int,
+	interval time.Duration) *BatchBuffer {
+	b := &BatchBuffer{
+		batcher:  batcher,
+		maxSize:  maxSize,
+		interval: interval,
+		lock:     &sync.Mutex{},
+		pending:  make([]pendingMutation, 0, maxSize),
+		done:     make(chan bool),
+	}
+	go b.flusher()
+	return b
+}
+
+func (b *BatchBuffer) flusher() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.Flush()
+		case <-b.done:
+			return
+		}
+	}
+}
+
+func (b *BatchBuffer) take() []pendingMutation {
+	pending := b.pending
+	b.pending = make([]pendingMutation, 0, b.maxSize)
+	return pending
+}
+
+func (b *BatchBuffer) send(pending []pendingMutation) {
+	if len(pending) == 0 {
+		return
+	}
+	mutations := make([]Mutation, 0, len(pending))
+	for _, p := range pending {
+		mutations = append(mutations, p.m)
+	}
+	log.Debugf("flushing %d buffered mutations", len(mutations))
+	results := b.batcher.Batch(mutations)
+	if len(results) != len(mutations) {
+		results = batchFailed(len(mutations), fmt.Errorf(
+			"batch returns %d results for %d mutations", len(results),
+			len(mutations)))
+	}
+	for i, p := range pending {
+		p.result <- results[i]
+	}
+}
+
+// Batch buffers the mutations and waits for their results.
+func (b *BatchBuffer) Batch(mutations []Mutation) []error {
+	waiting := make([]chan error, 0, len(mutations))
+	var full []pendingMutation
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return batchFailed(len(mutations), newError(ErrUnavailable,
+			"batch buffer closed"))
+	}
+	for _, m := range mutations {
+		p := pendingMutation{m: m, result: make(chan error, 1)}
+		b.pending = append(b.pending, p)
+		waiting = append(waiting, p.result)
+	}
+	if len(b.pending) >= b.maxSize {
+		full = b.take()
+	}
+	b.lock.Unlock()
+	b.send(full)
+
+	results := make([]error, 0, len(waiting))
+	for _, w := range waiting {
+		results = append(results, <-w)
+	}
+	return results
+}
+
+// Flush sends the buffered mutations right away.
+func (b *BatchBuffer) Flush() {
+	b.lock.Lock()
+	pending := b.take()
+	b.lock.Unlock()
+	b.send(pending)
+}
+
+// Close stops the periodic flush, and flushes what is left.
+func (b *BatchBuffer) Close() {
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return
+	}
+	b.closed = true
+	b.lock.Unlock()
+	close(b.done)
+	b.Flush()
+}
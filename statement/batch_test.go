@@ -0,0 +1,266 @@
+package statement
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type countingBatcher struct {
+	lock    *sync.Mutex
+	batches [][]Mutation
+}
+
+func (b *countingBatcher) Batch(mutations []Mutation) []error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.batches = append(b.batches, mutations)
+	results := make([]error, len(mutations))
+	for i, m := range mutations {
+		if m.Principal == "bad" {
+			results[i] = fmt.Errorf("bad principal")
+		}
+	}
+	return results
+}
+
+func (b *countingBatcher) nbatches() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.batches)
+}
+
+func TestBatchBufferFlushBySize(t *testing.T) {
+	b := &countingBatcher{lock: &sync.Mutex{}}
+	buffer := NewBatchBuffer(b, 4, time.Hour)
+	defer buffer.Close()
+
+	var wg sync.WaitGroup
+	results := make([][]error, 2)
+	for i, name := range []string{"good", "bad"} {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			results[i] = buffer.Batch([]Mutation{
+				CreatePrincipalMutation(name),
+				CreateNsMutation("ns1"),
+			})
+		}(i, name)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, b.nbatches(), "one batch for both callers")
+	assert.Len(t, b.batches[0], 4, "all mutations in the batch")
+	assert.Nil(t, results[0][0], "good principal")
+	assert.Nil(t, results[0][1], "good ns")
+	assert.NotNil(t, results[1][0], "bad principal")
+	assert.Nil(t, results[1][1], "ns of bad principal")
+}
+
+func TestBatchBufferFlushByTime(t *testing.T) {
+	b := &countingBatcher{lock: &sync.Mutex{}}
+	buffer := NewBatchBuffer(b, 100, 10*time.Millisecond)
+	defer buffer.Close()
+
+	results := buffer.Batch([]Mutation{CreatePrincipalMutation("good")})
+	assert.Equal(t, []error{nil}, results, "flushed by timer")
+	assert.Equal(t, 1, b.nbatches(), "one batch")
+}
+
+func TestBatchBufferClosed(t *testing.T) {
+	b := &countingBatcher{lock: &sync.Mutex{}}
+	buffer := NewBatchBuffer(b, 100, time.Hour)
+	buffer.Close()
+	buffer.Close()
+
+	results := buffer.Batch([]Mutation{CreatePrincipalMutation("good"),
+		CreateNsMutation("ns1")})
+	assert.Len(t, results, 2, "one result per mutation")
+	assert.True(t, IsUnavailable(results[0]), "failed once closed")
+	assert.True(t, IsUnavailable(results[1]), "failed once closed")
+	assert.Equal(t, 0, b.nbatches(), "nothing sent")
+}
+
+func batchServer(t *testing.T, capabilities []string,
+	calls *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			apiname := getApiName(r.URL.Path)
+			*calls = append(*calls, apiname)
+			switch apiname {
+			case kCapabilities:
+				if capabilities == nil {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				json.NewEncoder(w).Encode(capabilities)
+			case kBatch:
+				var mutations []Mutation
+				if err := json.NewDecoder(r.Body).Decode(&mutations); err != nil {
+					t.Errorf("decoding batch: %v", err)
+				}
+				results := make([]MutationResult, 0, len(mutations))
+				for _, m := range mutations {
+					if m.Principal == "bad" {
+						results = append(results, MutationResult{Ok: false, Error: "bad"})
+					} else {
+						results = append(results, MutationResult{Ok: true})
+					}
+				}
+				json.NewEncoder(w).Encode(results)
+			default:
+				if r.URL.Query().Get(qPrincipalName) == "bad" {
+					fmt.Fprintf(w, "false")
+				} else {
+					fmt.Fprintf(w, "true")
+				}
+			}
+		}))
+}
+
+func testMutations() []Mutation {
+	ip := net.ParseIP("192.168.0.1")
+	return []Mutation{
+		CreatePrincipalMutation("p1"),
+		CreateIPAliasMutation("bad", "ns1", ip),
+		CreatePortAliasMutation("p1", "ns1", ip, "tcp", 1000, 2000),
+	}
+}
+
+func TestApiBatch(t *testing.T) {
+	calls := []string{}
+	server := batchServer(t, []string{CapBatch}, &calls)
+	defer server.Close()
+	batchApi := NewOpenstackMetadataAPI(strings.TrimPrefix(server.URL, "http://"))
+
+	results := batchApi.Batch(testMutations())
+	assert.Len(t, results, 3, "one result per mutation")
+	assert.Nil(t, results[0], "principal created")
+	assert.NotNil(t, results[1], "bad ip alias")
+	assert.Nil(t, results[2], "port alias created")
+	assert.Equal(t, []string{kCapabilities, kBatch}, calls, "one batch request")
+
+	batchApi.Batch(testMutations())
+	assert.Equal(t, []string{kCapabilities, kBatch, kBatch}, calls,
+		"capabilities cached")
+}
+
+func TestApiBatchFallback(t *testing.T) {
+	calls := []string{}
+	server := batchServer(t, nil, &calls)
+	defer server.Close()
+	batchApi := NewOpenstackMetadataAPI(strings.TrimPrefix(server.URL, "http://"))
+
+	results := batchApi.Batch(testMutations())
+	assert.Len(t, results, 3, "one result per mutation")
+	assert.Nil(t, results[0], "principal created")
+	assert.NotNil(t, results[1], "bad ip alias")
+	assert.Nil(t, results[2], "port alias created")
+	assert.Equal(t, []string{kCapabilities, kCreatePrincipal, kCreateIPAlias,
+		kCreatePortAlias}, calls, "individual calls")
+}
+
+func TestApiCapabilitiesUnavailable(t *testing.T) {
+	calls := []string{}
+	batch := batchServer(t, []string{CapBatch}, &calls)
+	defer batch.Close()
+	down := true
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if down {
+				calls = append(calls, getApiName(r.URL.Path))
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			batch.Config.Handler.ServeHTTP(w, r)
+		}))
+	defer server.Close()
+	api := NewOpenstackContextAPI(strings.TrimPrefix(server.URL, "http://"))
+
+	assert.False(t, api.Supports(context.Background(), CapBatch),
+		"unknown while unavailable")
+	assert.False(t, api.Supports(context.Background(), CapBatch),
+		"not asked again right away")
+	down = false
+	api.capNext = time.Now()
+	assert.True(t, api.Supports(context.Background(), CapBatch),
+		"asked again after the delay")
+	assert.True(t, api.Supports(context.Background(), CapBatch), "cached")
+	assert.Equal(t, []string{kCapabilities, kCapabilities}, calls)
+}
+
+func TestApiCapabilitiesBackoff(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+	defer server.Close()
+	api := NewOpenstackContextAPI(strings.TrimPrefix(server.URL, "http://"))
+
+	for i, delay := range []time.Duration{time.Second, 2 * time.Second,
+		4 * time.Second} {
+		assert.False(t, api.v2(context.Background()), "version 1 meanwhile")
+		assert.False(t, api.v2(context.Background()), "version 1 meanwhile")
+		assert.Equal(t, i+1, calls, "asked once per delay")
+		assert.WithinDuration(t, time.Now().Add(delay), api.capNext,
+			time.Second/2, "delay doubled")
+		api.capNext = time.Now()
+	}
+
+	api.capDelay = CapProbeMaxDelay
+	api.v2(context.Background())
+	assert.Equal(t, CapProbeMaxDelay, api.capDelay, "delay capped")
+}
+
+// slowServer answers as the handler after the delay.
+func slowServer(delay time.Duration, handler http.Handler) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(delay)
+			handler.ServeHTTP(w, r)
+		}))
+}
+
+func TestApiBatchDeadlines(t *testing.T) {
+	calls := []string{}
+	fallback := batchServer(t, nil, &calls)
+	defer fallback.Close()
+	server := slowServer(20*time.Millisecond, fallback.Config.Handler)
+	defer server.Close()
+	api := NoContext(NewOpenstackContextAPI(strings.TrimPrefix(server.URL,
+		"http://")), context.Background(), 100*time.Millisecond)
+
+	/// 20 calls of 20ms, 4 times the timeout
+	mutations := []Mutation{}
+	for i := 0; i < 20; i++ {
+		mutations = append(mutations, CreatePrincipalMutation(
+			fmt.Sprintf("p%d", i)))
+	}
+	results := api.Batch(mutations)
+	assert.Equal(t, make([]error, len(mutations)), results,
+		"each mutation within its own deadline")
+	assert.Len(t, calls, len(mutations)+1, "one by one")
+
+	batchCalls := []string{}
+	batched := batchServer(t, []string{CapBatch}, &batchCalls)
+	defer batched.Close()
+	slowBatch := slowServer(150*time.Millisecond, batched.Config.Handler)
+	defer slowBatch.Close()
+	api = NoContext(NewOpenstackContextAPI(strings.TrimPrefix(slowBatch.URL,
+		"http://")), context.Background(), 200*time.Millisecond)
+	results = api.Batch(append(mutations, mutations...))
+	assert.Equal(t, make([]error, 2*len(mutations)), results,
+		"capabilities and batch within the deadline of 4 calls")
+	assert.Equal(t, []string{kCapabilities, kBatch}, batchCalls)
+}
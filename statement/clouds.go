@@ -0,0 +1,296 @@
+package statement
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+/// Instance metadata of the public clouds
+
+const (
+	// where the clouds serve the instance metadata
+	CloudMetadataHost = "169.254.169.254"
+	GCPMetadataHost   = "metadata.google.internal"
+
+	awsIdentityPath = "latest/dynamic/instance-identity/document"
+	gcpPath         = "computeMetadata/v1/"
+	gcpFlavor       = "Metadata-Flavor"
+	azurePath       = "metadata/instance"
+	azureVersion    = "2021-02-01"
+)
+
+// awsProvider reads the EC2 instance metadata, with IMDSv2 tokens as set by
+// imds. Ns is the account of the instance.
+type awsProvider struct {
+	api *Api
+}
+
+func NewAWSInstanceProvider(addr, imds string) InstanceInfoProvider {
+	if addr == "" {
+		addr = CloudMetadataHost
+	}
+	api := newApi(addr, "http", nil)
+	api.SetImds(imds, DefaultImdsTokenTTL)
+	return &awsProvider{api}
+}
+
+func (p *awsProvider) Name() string {
+	return ProviderAWS
+}
+
+// get reads a path under "latest".
+func (p *awsProvider) get(ctx context.Context, path string) (string, error) {
+	url := fmt.Sprintf("%s://%s/%s", p.api.scheme, p.api.serverAddr, path)
+	resp, err := p.api.doImds(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		return req.WithContext(ctx), nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return strResp(resp)
+}
+
+func (p *awsProvider) InstanceInfo(ctx context.Context) (*InstanceInfo,
+	error) {
+	/// only EC2 has the identity document, OpenStack has the rest as well
+	doc, err := p.get(ctx, awsIdentityPath)
+	if err != nil {
+		return nil, err
+	}
+	var identity struct {
+		AccountId string `json:"accountId"`
+		PrivateIp string `json:"privateIp"`
+	}
+	if err := json.Unmarshal([]byte(doc), &identity); err != nil {
+		return nil, badRequest("invalid instance identity document: %v", err)
+	}
+	info := &InstanceInfo{Ns: identity.AccountId}
+	if info.LocalIp, err = parseIp("local ip", identity.PrivateIp); err != nil {
+		return nil, err
+	}
+	public, err := p.get(ctx, AwsAPIPath+kViewPublicIP)
+	if err == nil {
+		info.PublicIp, err = parseIp("public ip", public)
+	}
+	if err != nil && !IsNotFound(err) {
+		return nil, err
+	}
+	ipv6, err := p.get(ctx, AwsAPIPath+"/ipv6")
+	if err == nil {
+		info.Ipv6, err = parseIpv6(ipv6)
+	}
+	if err != nil && !IsNotFound(err) {
+		return nil, err
+	}
+	return info, nil
+}
+
+// gcpProvider reads the GCE metadata server, which answers only requests
+// with the Metadata-Flavor header and tells it is Google's the same way. Ns
+// is the project.
+type gcpProvider struct {
+	addr   string
+	client *http.Client
+}
+
+func NewGCPInstanceProvider(addr string) InstanceInfoProvider {
+	if addr == "" {
+		addr = GCPMetadataHost
+	}
+	return &gcpProvider{addr: addr, client: newHttpClient(nil)}
+}
+
+func (p *gcpProvider) Name() string {
+	return ProviderGCP
+}
+
+func (p *gcpProvider) get(ctx context.Context, path string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet,
+		fmt.Sprintf("http://%s/%s%s", p.addr, gcpPath, path), nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set(gcpFlavor, "Google")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", unavailable(err)
+	}
+	if resp.Header.Get(gcpFlavor) != "Google" {
+		resp.Body.Close()
+		return "", newError(ErrNotFound, "%s is not a GCE metadata server",
+			p.addr)
+	}
+	return strResp(resp)
+}
+
+func (p *gcpProvider) InstanceInfo(ctx context.Context) (*InstanceInfo,
+	error) {
+	local, err := p.get(ctx, "instance/network-interfaces/0/ip")
+	if err != nil {
+		return nil, err
+	}
+	info := &InstanceInfo{}
+	if info.LocalIp, err = parseIp("local ip", local); err != nil {
+		return nil, err
+	}
+	public, err := p.get(ctx,
+		"instance/network-interfaces/0/access-configs/0/external-ip")
+	if err == nil && public != "" {
+		info.PublicIp, err = parseIp("public ip", public)
+	}
+	if err != nil && !IsNotFound(err) {
+		return nil, err
+	}
+	/// internal and external IPv6 ranges are exclusive of each other
+	for _, path := range []string{"instance/network-interfaces/0/ipv6s",
+		"instance/network-interfaces/0/ipv6-access-configs/0/external-ipv6",
+	} {
+		ipv6, err := p.get(ctx, path)
+		if IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		ips, err := parseIpv6(ipv6)
+		if err != nil {
+			return nil, err
+		}
+		info.Ipv6 = append(info.Ipv6, ips...)
+	}
+	if info.Ns, err = p.get(ctx, "project/project-id"); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// azureProvider reads the Azure instance metadata service, which wants the
+// Metadata header and an api-version. Ns is the subscription.
+type azureProvider struct {
+	addr   string
+	client *http.Client
+}
+
+func NewAzureInstanceProvider(addr string) InstanceInfoProvider {
+	if addr == "" {
+		addr = CloudMetadataHost
+	}
+	return &azureProvider{addr: addr, client: newHttpClient(nil)}
+}
+
+func (p *azureProvider) Name() string {
+	return ProviderAzure
+}
+
+type azureAddresses struct {
+	IpAddress []struct {
+		PrivateIpAddress string `json:"privateIpAddress"`
+		PublicIpAddress  string `json:"publicIpAddress"`
+	} `json:"ipAddress"`
+}
+
+type azureInstance struct {
+	Compute struct {
+		SubscriptionId string `json:"subscriptionId"`
+	} `json:"compute"`
+	Network struct {
+		Interface []struct {
+			Ipv4 azureAddresses `json:"ipv4"`
+			Ipv6 azureAddresses `json:"ipv6"`
+		} `json:"interface"`
+	} `json:"network"`
+}
+
+func (p *azureProvider) InstanceInfo(ctx context.Context) (*InstanceInfo,
+	error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf(
+		"http://%s/%s?api-version=%s", p.addr, azurePath, azureVersion), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Metadata", "true")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	defer resp.Body.Close()
+	if err := statusError(resp); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	var instance azureInstance
+	if err := json.Unmarshal(data, &instance); err != nil {
+		return nil, badRequest("invalid azure instance metadata: %v", err)
+	}
+	interfaces := instance.Network.Interface
+	if len(interfaces) == 0 || len(interfaces[0].Ipv4.IpAddress) == 0 {
+		return nil, notFound("azure instance without ipv4 address")
+	}
+	addr := interfaces[0].Ipv4.IpAddress[0]
+	info := &InstanceInfo{Ns: instance.Compute.SubscriptionId}
+	if info.LocalIp, err = parseIp("local ip", addr.PrivateIpAddress); err != nil {
+		return nil, err
+	}
+	if addr.PublicIpAddress != "" {
+		if info.PublicIp, err = parseIp("public ip",
+			addr.PublicIpAddress); err != nil {
+			return nil, err
+		}
+	}
+	for _, addr := range interfaces[0].Ipv6.IpAddress {
+		ips, err := parseIpv6(addr.PrivateIpAddress)
+		if err != nil {
+			return nil, err
+		}
+		info.Ipv6 = append(info.Ipv6, ips...)
+	}
+	return info, nil
+}
+
+// NewInstanceProvider gives the provider of the name, addr overrides where
+// the cloud serves its metadata. The auto provider tries the clouds that can
+// be told apart first, and the metadata service last. Each call to a cloud,
+// and each probe while detecting one, has timeout to finish.
+func NewInstanceProvider(name, addr, imds string, timeout time.Duration,
+	api ContextMetadataAPI) (InstanceInfoProvider, error) {
+	switch strings.ToLower(name) {
+	case "", ProviderOpenstack:
+		return NewTimeoutInstanceProvider(NewMetadataInstanceProvider(api),
+			timeout), nil
+	case ProviderAWS:
+		return NewTimeoutInstanceProvider(NewAWSInstanceProvider(addr, imds),
+			timeout), nil
+	case ProviderGCP:
+		return NewTimeoutInstanceProvider(NewGCPInstanceProvider(addr),
+			timeout), nil
+	case ProviderAzure:
+		return NewTimeoutInstanceProvider(NewAzureInstanceProvider(addr),
+			timeout), nil
+	case ProviderAuto:
+		if addr != "" {
+			log.Warnf("instance metadata address %s ignored for detection",
+				addr)
+		}
+		return NewAutoInstanceProvider(timeout,
+			NewGCPInstanceProvider(""),
+			NewAzureInstanceProvider(""),
+			NewAWSInstanceProvider("", imds),
+			NewMetadataInstanceProvider(api)), nil
+	}
+	return nil, fmt.Errorf("unknown instance metadata provider %s", name)
+}
@@ -0,0 +1,526 @@
+package statement
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+/// Context aware metadata API
+
+const (
+	// deadline of the calls made through NewOpenstackMetadataAPI
+	DefaultTimeout = 10 * time.Second
+	// a batch has the deadline of one call per so many mutations
+	BatchMutationsPerCall = 10
+)
+
+type callTimeoutKey struct{}
+
+// WithCallTimeout has the calls a batch is made of, sent one by one or
+// together, each get timeout rather than the batch sharing one deadline.
+func WithCallTimeout(ctx context.Context,
+	timeout time.Duration) context.Context {
+	return context.WithValue(ctx, callTimeoutKey{}, timeout)
+}
+
+// callContext gives the context of one call of a batch, with the timeout
+// per call if there is one.
+func callContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if timeout, ok := ctx.Value(callTimeoutKey{}).(time.Duration); ok &&
+		timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// batchContext gives the context of a batch sent in one call, its deadline
+// growing with the number of mutations.
+func batchContext(ctx context.Context,
+	n int) (context.Context, context.CancelFunc) {
+	if timeout, ok := ctx.Value(callTimeoutKey{}).(time.Duration); ok &&
+		timeout > 0 {
+		calls := (n + BatchMutationsPerCall - 1) / BatchMutationsPerCall
+		if calls < 1 {
+			calls = 1
+		}
+		return context.WithTimeout(ctx, time.Duration(calls)*timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// ContextMetadataAPI is MetadataAPI with a context for every call. Calls give
+// up with an ErrUnavailable error once the context is done.
+type ContextMetadataAPI interface {
+	UploadVmImage(ctx context.Context, name, location, gitrepo, rev,
+		format string, encoded bool) error
+	MyId(ctx context.Context) (string, error)
+	MyNs(ctx context.Context) (string, error)
+	CreatePrincipal(ctx context.Context, name string) error
+	ListPrincipals(ctx context.Context) (map[string]Principal, error)
+	ShowPrincipal(ctx context.Context, target string) (*Principal, error)
+	DeletePrincipal(ctx context.Context, name string) error
+	CreateNs(ctx context.Context, name string) error
+	JoinNs(ctx context.Context, name string) error
+	LeaveNs(ctx context.Context, name string) error
+	DeleteNs(ctx context.Context, name string) error
+	CreateIPAlias(ctx context.Context, name string, ns string, ip net.IP) error
+	DeleteIPAlias(ctx context.Context, name string, ns string, ip net.IP) error
+	CreatePortAlias(ctx context.Context, name string, ns string, ip net.IP,
+		protocol string, portMin, portMax int) error
+	DeletePortAlias(ctx context.Context, name string, ns string, ip net.IP,
+		protocol string, portMin, portMax int) error
+
+	PostProof(ctx context.Context, target string, statements []Statement) error
+	PostProofForChild(ctx context.Context, target string,
+		statements []Statement) error
+	LinkProof(ctx context.Context, target string, dependencies []string) error
+	LinkProofForChild(ctx context.Context, target string,
+		dependencies []string) error
+	RemoveProofForChild(ctx context.Context, target string,
+		statements []Statement) error
+	UnlinkProofForChild(ctx context.Context, target string,
+		dependencies []string) error
+	SelfCertify(ctx context.Context, statements []Statement) error
+	PostNsProof(ctx context.Context, ns string, statements []Statement) error
+	RemoveNsProof(ctx context.Context, ns string, statements []Statement) error
+	ListNsProofs(ctx context.Context, ns string) ([]EndorsedStatement, error)
+
+	/// apply many mutations in one call, with one result per mutation
+	Batch(ctx context.Context, mutations []Mutation) []error
+
+	/// traditional metadata api
+	MyLocalIp(ctx context.Context) (string, error)
+	MyPublicIp(ctx context.Context) (string, error)
+}
+
+// WithContext adapts a MetadataAPI without context support, e.g. the stubs.
+// A call already made is not interrupted, but no call is made once the
+// context is done.
+func WithContext(api MetadataAPI) ContextMetadataAPI {
+	if n, ok := api.(*noContext); ok {
+		return n.api
+	}
+	return &withContext{api}
+}
+
+type withContext struct {
+	api MetadataAPI
+}
+
+func (w *withContext) UploadVmImage(ctx context.Context, name, location,
+	gitrepo, rev, format string, encoded bool) error {
+	if err := ctx.Err(); err != nil {
+		return unavailable(err)
+	}
+	return w.api.UploadVmImage(name, location, gitrepo, rev, format, encoded)
+}
+
+func (w *withContext) MyId(ctx context.Context) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", unavailable(err)
+	}
+	return w.api.MyId()
+}
+
+func (w *withContext) MyNs(ctx context.Context) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", unavailable(err)
+	}
+	return w.api.MyNs()
+}
+
+func (w *withContext) CreatePrincipal(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return unavailable(err)
+	}
+	return w.api.CreatePrincipal(name)
+}
+
+func (w *withContext) ListPrincipals(ctx context.Context) (map[string]Principal,
+	error) {
+	if err := ctx.Err(); err != nil {
+		return nil, unavailable(err)
+	}
+	return w.api.ListPrincipals()
+}
+
+func (w *withContext) ShowPrincipal(ctx context.Context,
+	target string) (*Principal, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, unavailable(err)
+	}
+	return w.api.ShowPrincipal(target)
+}
+
+func (w *withContext) DeletePrincipal(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return unavailable(err)
+	}
+	return w.api.DeletePrincipal(name)
+}
+
+func (w *withContext) CreateNs(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return unavailable(err)
+	}
+	return w.api.CreateNs(name)
+}
+
+func (w *withContext) JoinNs(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return unavailable(err)
+	}
+	return w.api.JoinNs(name)
+}
+
+func (w *withContext) LeaveNs(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return unavailable(err)
+	}
+	return w.api.LeaveNs(name)
+}
+
+func (w *withContext) DeleteNs(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return unavailable(err)
+	}
+	return w.api.DeleteNs(name)
+}
+
+func (w *withContext) CreateIPAlias(ctx context.Context, name string,
+	ns string, ip net.IP) error {
+	if err := ctx.Err(); err != nil {
+		return unavailable(err)
+	}
+	return w.api.CreateIPAlias(name, ns, ip)
+}
+
+func (w *withContext) DeleteIPAlias(ctx context.Context, name string,
+	ns string, ip net.IP) error {
+	if err := ctx.Err(); err != nil {
+		return unavailable(err)
+	}
+	return w.api.DeleteIPAlias(name, ns, ip)
+}
+
+func (w *withContext) CreatePortAlias(ctx context.Context, name string,
+	ns string, ip net.IP,
+	protocol string, portMin, portMax int) error {
+	if err := ctx.Err(); err != nil {
+		return unavailable(err)
+	}
+	return w.api.CreatePortAlias(name, ns, ip, protocol, portMin, portMax)
+}
+
+func (w *withContext) DeletePortAlias(ctx context.Context, name string,
+	ns string, ip net.IP,
+	protocol string, portMin, portMax int) error {
+	if err := ctx.Err(); err != nil {
+		return unavailable(err)
+	}
+	return w.api.DeletePortAlias(name, ns, ip, protocol, portMin, portMax)
+}
+
+func (w *withContext) PostProof(ctx context.Context, target string,
+	statements []Statement) error {
+	if err := ctx.Err(); err != nil {
+		return unavailable(err)
+	}
+	return w.api.PostProof(target, statements)
+}
+
+func (w *withContext) PostProofForChild(ctx context.Context, target string,
+	statements []Statement) error {
+	if err := ctx.Err(); err != nil {
+		return unavailable(err)
+	}
+	return w.api.PostProofForChild(target, statements)
+}
+
+func (w *withContext) LinkProof(ctx context.Context, target string,
+	dependencies []string) error {
+	if err := ctx.Err(); err != nil {
+		return unavailable(err)
+	}
+	return w.api.LinkProof(target, dependencies)
+}
+
+func (w *withContext) LinkProofForChild(ctx context.Context, target string,
+	dependencies []string) error {
+	if err := ctx.Err(); err != nil {
+		return unavailable(err)
+	}
+	return w.api.LinkProofForChild(target, dependencies)
+}
+
+func (w *withContext) RemoveProofForChild(ctx context.Context, target string,
+	statements []Statement) error {
+	if err := ctx.Err(); err != nil {
+		return unavailable(err)
+	}
+	return w.api.RemoveProofForChild(target, statements)
+}
+
+func (w *withContext) UnlinkProofForChild(ctx context.Context, target string,
+	dependencies []string) error {
+	if err := ctx.Err(); err != nil {
+		return unavailable(err)
+	}
+	return w.api.UnlinkProofForChild(target, dependencies)
+}
+
+func (w *withContext) SelfCertify(ctx context.Context,
+	statements []Statement) error {
+	if err := ctx.Err(); err != nil {
+		return unavailable(err)
+	}
+	return w.api.SelfCertify(statements)
+}
+
+func (w *withContext) PostNsProof(ctx context.Context, ns string,
+	statements []Statement) error {
+	if err := ctx.Err(); err != nil {
+		return unavailable(err)
+	}
+	return w.api.PostNsProof(ns, statements)
+}
+
+func (w *withContext) RemoveNsProof(ctx context.Context, ns string,
+	statements []Statement) error {
+	if err := ctx.Err(); err != nil {
+		return unavailable(err)
+	}
+	return w.api.RemoveNsProof(ns, statements)
+}
+
+func (w *withContext) ListNsProofs(ctx context.Context,
+	ns string) ([]EndorsedStatement, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, unavailable(err)
+	}
+	return w.api.ListNsProofs(ns)
+}
+
+func (w *withContext) Batch(ctx context.Context, mutations []Mutation) []error {
+	if err := ctx.Err(); err != nil {
+		return batchFailed(len(mutations), unavailable(err))
+	}
+	return w.api.Batch(mutations)
+}
+
+func (w *withContext) MyLocalIp(ctx context.Context) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", unavailable(err)
+	}
+	return w.api.MyLocalIp()
+}
+
+func (w *withContext) MyPublicIp(ctx context.Context) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", unavailable(err)
+	}
+	return w.api.MyPublicIp()
+}
+
+// NoContext adapts a ContextMetadataAPI to MetadataAPI. Every call is made
+// with a context derived from parent, so cancelling parent cancels all the
+// calls in flight, and with a deadline of timeout unless it is 0.
+func NoContext(api ContextMetadataAPI, parent context.Context,
+	timeout time.Duration) MetadataAPI {
+	if w, ok := api.(*withContext); ok {
+		return w.api
+	}
+	return &noContext{api: api, parent: parent, timeout: timeout}
+}
+
+type noContext struct {
+	api     ContextMetadataAPI
+	parent  context.Context
+	timeout time.Duration
+}
+
+func (n *noContext) callContext() (context.Context, context.CancelFunc) {
+	if n.timeout == 0 {
+		return context.WithCancel(n.parent)
+	}
+	return context.WithTimeout(n.parent, n.timeout)
+}
+
+func (n *noContext) UploadVmImage(name, location, gitrepo, rev, format string,
+	encoded bool) error {
+	ctx, cancel := n.callContext()
+	defer cancel()
+	return n.api.UploadVmImage(ctx, name, location, gitrepo, rev, format,
+		encoded)
+}
+
+func (n *noContext) MyId() (string, error) {
+	ctx, cancel := n.callContext()
+	defer cancel()
+	return n.api.MyId(ctx)
+}
+
+func (n *noContext) MyNs() (string, error) {
+	ctx, cancel := n.callContext()
+	defer cancel()
+	return n.api.MyNs(ctx)
+}
+
+func (n *noContext) CreatePrincipal(name string) error {
+	ctx, cancel := n.callContext()
+	defer cancel()
+	return n.api.CreatePrincipal(ctx, name)
+}
+
+func (n *noContext) ListPrincipals() (map[string]Principal, error) {
+	ctx, cancel := n.callContext()
+	defer cancel()
+	return n.api.ListPrincipals(ctx)
+}
+
+func (n *noContext) ShowPrincipal(target string) (*Principal, error) {
+	ctx, cancel := n.callContext()
+	defer cancel()
+	return n.api.ShowPrincipal(ctx, target)
+}
+
+func (n *noContext) DeletePrincipal(name string) error {
+	ctx, cancel := n.callContext()
+	defer cancel()
+	return n.api.DeletePrincipal(ctx, name)
+}
+
+func (n *noContext) CreateNs(name string) error {
+	ctx, cancel := n.callContext()
+	defer cancel()
+	return n.api.CreateNs(ctx, name)
+}
+
+func (n *noContext) JoinNs(name string) error {
+	ctx, cancel := n.callContext()
+	defer cancel()
+	return n.api.JoinNs(ctx, name)
+}
+
+func (n *noContext) LeaveNs(name string) error {
+	ctx, cancel := n.callContext()
+	defer cancel()
+	return n.api.LeaveNs(ctx, name)
+}
+
+func (n *noContext) DeleteNs(name string) error {
+	ctx, cancel := n.callContext()
+	defer cancel()
+	return n.api.DeleteNs(ctx, name)
+}
+
+func (n *noContext) CreateIPAlias(name string, ns string, ip net.IP) error {
+	ctx, cancel := n.callContext()
+	defer cancel()
+	return n.api.CreateIPAlias(ctx, name, ns, ip)
+}
+
+func (n *noContext) DeleteIPAlias(name string, ns string, ip net.IP) error {
+	ctx, cancel := n.callContext()
+	defer cancel()
+	return n.api.DeleteIPAlias(ctx, name, ns, ip)
+}
+
+func (n *noContext) CreatePortAlias(name string, ns string, ip net.IP,
+	protocol string, portMin, portMax int) error {
+	ctx, cancel := n.callContext()
+	defer cancel()
+	return n.api.CreatePortAlias(ctx, name, ns, ip, protocol, portMin, portMax)
+}
+
+func (n *noContext) DeletePortAlias(name string, ns string, ip net.IP,
+	protocol string, portMin, portMax int) error {
+	ctx, cancel := n.callContext()
+	defer cancel()
+	return n.api.DeletePortAlias(ctx, name, ns, ip, protocol, portMin, portMax)
+}
+
+func (n *noContext) PostProof(target string, statements []Statement) error {
+	ctx, cancel := n.callContext()
+	defer cancel()
+	return n.api.PostProof(ctx, target, statements)
+}
+
+func (n *noContext) PostProofForChild(target string,
+	statements []Statement) error {
+	ctx, cancel := n.callContext()
+	defer cancel()
+	return n.api.PostProofForChild(ctx, target, statements)
+}
+
+func (n *noContext) LinkProof(target string, dependencies []string) error {
+	ctx, cancel := n.callContext()
+	defer cancel()
+	return n.api.LinkProof(ctx, target, dependencies)
+}
+
+func (n *noContext) LinkProofForChild(target string,
+	dependencies []string) error {
+	ctx, cancel := n.callContext()
+	defer cancel()
+	return n.api.LinkProofForChild(ctx, target, dependencies)
+}
+
+func (n *noContext) RemoveProofForChild(target string,
+	statements []Statement) error {
+	ctx, cancel := n.callContext()
+	defer cancel()
+	return n.api.RemoveProofForChild(ctx, target, statements)
+}
+
+func (n *noContext) UnlinkProofForChild(target string,
+	dependencies []string) error {
+	ctx, cancel := n.callContext()
+	defer cancel()
+	return n.api.UnlinkProofForChild(ctx, target, dependencies)
+}
+
+func (n *noContext) SelfCertify(statements []Statement) error {
+	ctx, cancel := n.callContext()
+	defer cancel()
+	return n.api.SelfCertify(ctx, statements)
+}
+
+func (n *noContext) PostNsProof(ns string, statements []Statement) error {
+	ctx, cancel := n.callContext()
+	defer cancel()
+	return n.api.PostNsProof(ctx, ns, statements)
+}
+
+func (n *noContext) RemoveNsProof(ns string, statements []Statement) error {
+	ctx, cancel := n.callContext()
+	defer cancel()
+	return n.api.RemoveNsProof(ctx, ns, statements)
+}
+
+func (n *noContext) ListNsProofs(ns string) ([]EndorsedStatement, error) {
+	ctx, cancel := n.callContext()
+	defer cancel()
+	return n.api.ListNsProofs(ctx, ns)
+}
+
+// Batch leaves the deadlines to the calls the batch is made of, a long one
+// must not fail its last mutations for the time the first ones took.
+func (n *noContext) Batch(mutations []Mutation) []error {
+	ctx, cancel := context.WithCancel(WithCallTimeout(n.parent, n.timeout))
+	defer cancel()
+	return n.api.Batch(ctx, mutations)
+}
+
+func (n *noContext) MyLocalIp() (string, error) {
+	ctx, cancel := n.callContext()
+	defer cancel()
+	return n.api.MyLocalIp(ctx)
+}
+
+func (n *noContext) MyPublicIp() (string, error) {
+	ctx, cancel := n.callContext()
+	defer cancel()
+	return n.api.MyPublicIp(ctx)
+}
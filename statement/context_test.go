@@ -0,0 +1,71 @@
+package statement
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// hungServer never answers until the client gives up
+func hungServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}))
+}
+
+func TestCallDeadline(t *testing.T) {
+	server := hungServer()
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+	hungApi := NoContext(NewOpenstackContextAPI(addr), context.Background(),
+		50*time.Millisecond)
+
+	start := time.Now()
+	_, err := hungApi.ShowPrincipal("p1")
+	assert.True(t, IsUnavailable(err), "deadline exceeded")
+	assert.True(t, time.Since(start) < 5*time.Second, "not blocked")
+}
+
+func TestCallCancelled(t *testing.T) {
+	server := hungServer()
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+	parent, cancel := context.WithCancel(context.Background())
+	hungApi := NoContext(NewOpenstackContextAPI(addr), parent, 0)
+
+	result := make(chan error)
+	go func() {
+		result <- hungApi.CreatePrincipal("p1")
+	}()
+	cancel()
+	select {
+	case err := <-result:
+		assert.True(t, IsUnavailable(err), "cancelled")
+	case <-time.After(5 * time.Second):
+		t.Fatalf("call not cancelled")
+	}
+}
+
+func TestStubWithContext(t *testing.T) {
+	stub := NewStubApi(t)
+	ctxApi := WithContext(stub)
+	p, err := ctxApi.ShowPrincipal(context.Background(), "regular")
+	assert.Nil(t, err, "passed through")
+	assert.NotNil(t, p, "principal shown")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.True(t, IsUnavailable(ctxApi.CreatePrincipal(ctx, "p1")),
+		"no call once cancelled")
+	_, err = stub.ShowPrincipal("p1")
+	assert.True(t, IsNotFound(err), "principal not created")
+
+	assert.Equal(t, stub, NoContext(ctxApi, context.Background(), time.Second),
+		"adapters unwrap")
+}
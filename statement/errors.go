@@ -0,0 +1,159 @@
+package statement
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+/// Typed errors of the metadata service
+
+type ErrorKind int
+
+const (
+	ErrUnknown ErrorKind = iota
+	ErrNotFound
+	ErrAlreadyExists
+	ErrUnauthorized
+	ErrUnavailable
+	ErrBadRequest
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrNotFound:
+		return "not found"
+	case ErrAlreadyExists:
+		return "already exists"
+	case ErrUnauthorized:
+		return "unauthorized"
+	case ErrUnavailable:
+		return "unavailable"
+	case ErrBadRequest:
+		return "bad request"
+	}
+	return "unknown"
+}
+
+// ApiError is returned by the metadata API when the server rejects a call, or
+// can not be reached at all (ErrUnavailable). Status is 0 if there is no
+// HTTP response.
+type ApiError struct {
+	Kind   ErrorKind
+	Status int
+	Msg    string
+}
+
+func (e *ApiError) Error() string {
+	if e.Status != 0 {
+		return fmt.Sprintf("metadata server %s (%d): %s", e.Kind, e.Status, e.Msg)
+	}
+	return fmt.Sprintf("metadata server %s: %s", e.Kind, e.Msg)
+}
+
+func statusKind(status int) ErrorKind {
+	switch status {
+	case http.StatusNotFound, http.StatusGone:
+		return ErrNotFound
+	case http.StatusConflict:
+		return ErrAlreadyExists
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrUnauthorized
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return ErrBadRequest
+	case http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout,
+		http.StatusTooManyRequests:
+		/// a failing server is as good as none, the call may work later
+		return ErrUnavailable
+	}
+	return ErrUnknown
+}
+
+// The server answers "false: <reason>" with status 200 for most failures, so
+// the kind is guessed from the reason.
+func bodyKind(body string) ErrorKind {
+	body = strings.ToLower(body)
+	switch {
+	case strings.Contains(body, "not found"),
+		strings.Contains(body, "not exist"),
+		strings.Contains(body, "no such"):
+		return ErrNotFound
+	case strings.Contains(body, "already"),
+		strings.Contains(body, "existed"),
+		strings.Contains(body, "exists"):
+		return ErrAlreadyExists
+	case strings.Contains(body, "unauthorized"),
+		strings.Contains(body, "permission"),
+		strings.Contains(body, "forbidden"):
+		return ErrUnauthorized
+	case strings.Contains(body, "invalid"),
+		strings.Contains(body, "malformed"),
+		strings.Contains(body, "bad request"):
+		return ErrBadRequest
+	}
+	return ErrUnknown
+}
+
+// NewApiError builds the error of a failed call from its status and body.
+// Old servers answer 500 with the reason of some failures, the reason tells
+// the kind then.
+func NewApiError(status int, body string) *ApiError {
+	kind := ErrUnknown
+	if status != http.StatusOK && status != 0 {
+		kind = statusKind(status)
+	}
+	if status == http.StatusInternalServerError {
+		if reason := bodyKind(body); reason != ErrUnknown {
+			kind = reason
+		}
+	}
+	if kind == ErrUnknown {
+		kind = bodyKind(body)
+	}
+	return &ApiError{Kind: kind, Status: status, Msg: body}
+}
+
+func newError(kind ErrorKind, format string, args ...interface{}) *ApiError {
+	return &ApiError{Kind: kind, Msg: fmt.Sprintf(format, args...)}
+}
+
+func notFound(format string, args ...interface{}) *ApiError {
+	return newError(ErrNotFound, format, args...)
+}
+
+func alreadyExists(format string, args ...interface{}) *ApiError {
+	return newError(ErrAlreadyExists, format, args...)
+}
+
+func unavailable(err error) *ApiError {
+	return &ApiError{Kind: ErrUnavailable, Msg: err.Error()}
+}
+
+// ErrorKindOf returns the kind of an error returned by the metadata API.
+func ErrorKindOf(err error) ErrorKind {
+	if e, ok := err.(*ApiError); ok {
+		return e.Kind
+	}
+	return ErrUnknown
+}
+
+func IsNotFound(err error) bool {
+	return ErrorKindOf(err) == ErrNotFound
+}
+
+func IsAlreadyExists(err error) bool {
+	return ErrorKindOf(err) == ErrAlreadyExists
+}
+
+func IsUnauthorized(err error) bool {
+	return ErrorKindOf(err) == ErrUnauthorized
+}
+
+func IsUnavailable(err error) bool {
+	return ErrorKindOf(err) == ErrUnavailable
+}
+
+func IsBadRequest(err error) bool {
+	return ErrorKindOf(err) == ErrBadRequest
+}
@@ -0,0 +1,69 @@
+package statement
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewApiError(t *testing.T) {
+	cases := []struct {
+		status int
+		body   string
+		kind   ErrorKind
+	}{
+		{http.StatusNotFound, "", ErrNotFound},
+		{http.StatusConflict, "", ErrAlreadyExists},
+		{http.StatusForbidden, "", ErrUnauthorized},
+		{http.StatusServiceUnavailable, "", ErrUnavailable},
+		{http.StatusBadRequest, "", ErrBadRequest},
+		{http.StatusInternalServerError, "principal p1 not found", ErrNotFound},
+		{http.StatusInternalServerError, "", ErrUnavailable},
+		{http.StatusInternalServerError, "database locked", ErrUnavailable},
+		{http.StatusOK, "false: principal p1 already exists", ErrAlreadyExists},
+		{http.StatusOK, "false: invalid ip", ErrBadRequest},
+		{http.StatusOK, "false", ErrUnknown},
+	}
+	for _, c := range cases {
+		err := NewApiError(c.status, c.body)
+		assert.Equal(t, c.kind, err.Kind, "%d %q", c.status, c.body)
+	}
+}
+
+func TestApiErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch getApiName(r.URL.Path) {
+			case kShowPrincipal:
+				w.WriteHeader(http.StatusNotFound)
+			case kCreatePrincipal:
+				fmt.Fprintf(w, "false: principal existed")
+			case kDeletePrincipal:
+				w.WriteHeader(http.StatusServiceUnavailable)
+			case kListPrincipals:
+				// chunked, so no content length
+				w.(http.Flusher).Flush()
+				fmt.Fprintf(w, `{"p1": {}}`)
+			}
+		}))
+	addr := strings.TrimPrefix(server.URL, "http://")
+	errApi := NewOpenstackMetadataAPI(addr)
+
+	_, err := errApi.ShowPrincipal("p1")
+	assert.True(t, IsNotFound(err), "show missing principal")
+	assert.True(t, IsAlreadyExists(errApi.CreatePrincipal("p1")),
+		"create existing principal")
+	assert.True(t, IsUnavailable(errApi.DeletePrincipal("p1")),
+		"server unavailable")
+	principals, err := errApi.ListPrincipals()
+	assert.Nil(t, err, "list without content length")
+	assert.Len(t, principals, 1, "principals listed")
+
+	server.Close()
+	assert.True(t, IsUnavailable(errApi.CreatePrincipal("p1")),
+		"server unreachable")
+}
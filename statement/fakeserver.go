@@ -0,0 +1,1020 @@
+package statement
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+/// In-memory fake of the metadata server for integration tests
+
+// Fault is injected into the calls of an endpoint. Each call waits Latency,
+// then fails with ErrorStatus at ErrorRate, or has its connection closed
+// without an answer at DropRate. Rates are between 0 and 1.
+type Fault struct {
+	Latency     time.Duration
+	ErrorRate   float64
+	ErrorStatus int // http.StatusServiceUnavailable if 0
+	DropRate    float64
+}
+
+// FakeImage is what the fake keeps of an uploaded image.
+type FakeImage struct {
+	GitRepo string
+	GitRev  string
+	Format  string
+	Size    int
+}
+
+// FakeServer speaks the wire protocol of the metadata server, including the
+// base64 encoded statements and the AWS style IP paths, and keeps principals,
+// namespaces, aliases, proofs and links in memory. It is a ContextMetadataAPI
+// too, to set up and check its state directly.
+type FakeServer struct {
+	Id       string
+	Ns       string
+	LocalIp  string
+	PublicIp string
+	// advertised at kCapabilities, nil to answer 404 like old servers. Drop
+	// CapV2 to have clients speak version 1 only.
+	Capabilities []string
+	// requests not passing the verifier are rejected, nil to accept all
+	Verifier *SignatureVerifier
+	// IMDSv2 session tokens of the AWS style paths, ImdsV1 for none at all
+	// or ImdsRequired to reject calls without
+	Imds string
+
+	lock       *sync.Mutex
+	self       *Principal
+	principals map[string]*Principal
+	namespaces map[string]bool // created namespaces, to whether joined
+	nsProofs   map[string][]EndorsedStatement
+	images     map[string]FakeImage
+	faults     map[string]Fault
+	calls      map[string]int
+	tokens     map[string]time.Time // IMDSv2 tokens to when they expire
+}
+
+func NewFakeServer() *FakeServer {
+	return &FakeServer{
+		Id:           "fake-vm",
+		Ns:           "fake-ns",
+		LocalIp:      "192.168.0.1",
+		PublicIp:     "166.111.68.162",
+		Capabilities: []string{CapBatch, CapV2},
+		lock:         &sync.Mutex{},
+		self:         NewPrincipal(),
+		principals:   make(map[string]*Principal),
+		namespaces:   make(map[string]bool),
+		nsProofs:     make(map[string][]EndorsedStatement),
+		images:       make(map[string]FakeImage),
+		faults:       make(map[string]Fault),
+		calls:        make(map[string]int),
+		Imds:         ImdsOptional,
+		tokens:       make(map[string]time.Time),
+	}
+}
+
+// StartFakeServer runs a new fake on a local port, close the returned server
+// when done. The address for the API is server.Listener.Addr().
+func StartFakeServer() (*FakeServer, *httptest.Server) {
+	fake := NewFakeServer()
+	return fake, httptest.NewServer(fake)
+}
+
+// SetFault injects the fault into calls of the endpoint, e.g. kCreatePrincipal
+// or "/local-ipv4", or into all calls if endpoint is "".
+func (f *FakeServer) SetFault(endpoint string, fault Fault) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.faults[endpoint] = fault
+}
+
+func (f *FakeServer) ClearFaults() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.faults = make(map[string]Fault)
+}
+
+// Calls counts the requests made to the endpoint, faulty or not.
+func (f *FakeServer) Calls(endpoint string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.calls[endpoint]
+}
+
+func (f *FakeServer) Image(name string) (FakeImage, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	image, ok := f.images[name]
+	return image, ok
+}
+
+func (f *FakeServer) fault(endpoint string) Fault {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.calls[endpoint]++
+	if fault, ok := f.faults[endpoint]; ok {
+		return fault
+	}
+	return f.faults[""]
+}
+
+/// the HTTP side
+
+func (f *FakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var endpoint string
+	path := "/" + strings.TrimLeft(r.URL.Path, "/")
+	switch {
+	case strings.HasPrefix(path, "/"+APIPath+"/"):
+		endpoint = strings.TrimPrefix(path, "/"+APIPath)
+	case strings.HasPrefix(path, "/"+AwsAPIPath+"/"):
+		endpoint = strings.TrimPrefix(path, "/"+AwsAPIPath)
+	case path == "/"+ImdsTokenPath:
+		endpoint = kImdsToken
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	/// faults and calls of version 2 go by the version 1 endpoint
+	v2, name := strings.HasPrefix(endpoint, kV2+"/"), ""
+	if v2 {
+		if endpoint, name = v2Route(r.Method, endpoint); endpoint == "" {
+			writeV2Result(w, notFound("no such resource %s %s", r.Method,
+				path))
+			return
+		}
+	}
+
+	fault := f.fault(endpoint)
+	if fault.Latency > 0 {
+		select {
+		case <-time.After(fault.Latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if fault.DropRate > 0 && rand.Float64() < fault.DropRate {
+		if hijacker, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hijacker.Hijack(); err == nil {
+				conn.Close()
+				return
+			}
+		}
+		log.Errorf("fake metadata server can not drop %s", endpoint)
+	}
+	if fault.ErrorRate > 0 && rand.Float64() < fault.ErrorRate {
+		status := fault.ErrorStatus
+		if status == 0 {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, fmt.Sprintf("injected fault for %s", endpoint), status)
+		return
+	}
+
+	if f.Verifier != nil {
+		if err := f.Verifier.Verify(r); err != nil {
+			if v2 {
+				writeV2Result(w, err)
+			} else {
+				writeError(w, err)
+			}
+			return
+		}
+	}
+	if v2 {
+		f.serveV2(w, r, endpoint, name)
+	} else {
+		f.serve(w, r, endpoint)
+	}
+}
+
+func (f *FakeServer) serve(w http.ResponseWriter, r *http.Request,
+	endpoint string) {
+	ctx := r.Context()
+	query := r.URL.Query()
+	switch endpoint {
+	case kViewPrincipalName:
+		fmt.Fprint(w, f.Id)
+	case kViewNs:
+		fmt.Fprint(w, f.Ns)
+	case kImdsToken:
+		f.serveImdsToken(w, r)
+	case kViewLocalIP, kViewPublicIP:
+		if err := f.checkImdsToken(r.Header.Get(HeaderImdsToken)); err != nil {
+			writeError(w, err)
+			return
+		}
+		if endpoint == kViewLocalIP {
+			fmt.Fprint(w, f.LocalIp)
+		} else {
+			fmt.Fprint(w, f.PublicIp)
+		}
+	case kCapabilities:
+		if f.Capabilities == nil {
+			http.NotFound(w, r)
+			return
+		}
+		writeJson(w, f.Capabilities)
+	case kListPrincipals:
+		principals, _ := f.ListPrincipals(ctx)
+		writeJson(w, principals)
+	case kShowPrincipal:
+		p, err := f.ShowPrincipal(ctx, query.Get(qTarget))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJson(w, p)
+	case kListNsProofs:
+		statements, err := f.ListNsProofs(ctx, query.Get(qNsName))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJson(w, statements)
+	case kUploadVmImage:
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, badRequest("reading image: %v", err))
+			return
+		}
+		writeResult(w, f.uploadImage(query.Get(qImageName), FakeImage{
+			GitRepo: query.Get(qImageGitRepo),
+			GitRev:  query.Get(qImageGitRev),
+			Format:  query.Get(qImageDiskFormat),
+			Size:    len(data),
+		}))
+	case kSelfCertify:
+		var statements []Statement
+		if err := decodeQuery(query.Get(qStatements), &statements); err != nil {
+			writeError(w, err)
+			return
+		}
+		writeResult(w, f.SelfCertify(ctx, statements))
+	case kBatch:
+		var mutations []Mutation
+		if err := json.NewDecoder(r.Body).Decode(&mutations); err != nil {
+			writeError(w, badRequest("decoding batch: %v", err))
+			return
+		}
+		results := make([]MutationResult, len(mutations))
+		for i, err := range f.Batch(ctx, mutations) {
+			results[i] = mutationResult(err)
+		}
+		writeJson(w, results)
+	default:
+		m, err := mutationFromQuery(endpoint, query)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeResult(w, ApplyMutationContext(ctx, f, m))
+	}
+}
+
+func (f *FakeServer) serveImdsToken(w http.ResponseWriter, r *http.Request) {
+	if f.Imds == ImdsV1 {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPut {
+		http.Error(w, "token only by PUT", http.StatusMethodNotAllowed)
+		return
+	}
+	secs, err := strconv.Atoi(r.Header.Get(HeaderImdsTTL))
+	if err != nil || secs < 1 || secs > int(DefaultImdsTokenTTL/time.Second) {
+		writeError(w, badRequest("invalid %s %q", HeaderImdsTTL,
+			r.Header.Get(HeaderImdsTTL)))
+		return
+	}
+	token := fmt.Sprintf("%016x", rand.Int63())
+	f.lock.Lock()
+	f.tokens[token] = time.Now().Add(time.Duration(secs) * time.Second)
+	f.lock.Unlock()
+	fmt.Fprint(w, token)
+}
+
+// checkImdsToken rejects expired or unknown tokens, and calls without any if
+// tokens are required.
+func (f *FakeServer) checkImdsToken(token string) error {
+	if token == "" {
+		if f.Imds == ImdsRequired {
+			return unauthorized("session token required")
+		}
+		return nil
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if expire, ok := f.tokens[token]; !ok || time.Now().After(expire) {
+		delete(f.tokens, token)
+		return unauthorized("invalid session token")
+	}
+	return nil
+}
+
+// RevokeTokens makes the IMDSv2 tokens handed out so far invalid.
+func (f *FakeServer) RevokeTokens() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.tokens = make(map[string]time.Time)
+}
+
+// mutationFromQuery reads the parameters of a state changing endpoint.
+func mutationFromQuery(endpoint string, query map[string][]string) (Mutation,
+	error) {
+	get := func(name string) string {
+		if v := query[name]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	m := Mutation{
+		Op:        opName(endpoint),
+		Principal: get(qPrincipalName),
+		NsName:    get(qNsName),
+		Ip:        get(qIpAlias),
+		Protocol:  get(qProtocol),
+		Target:    get(qTarget),
+	}
+	switch endpoint {
+	case kCreatePrincipal, kDeletePrincipal, kCreateNs, kDeleteNs, kJoinNs,
+		kLeaveNs, kCreateIPAlias, kDeleteIPAlias:
+	case kCreatePortAlias, kDeletePortAlias:
+		var err error
+		if m.PortMin, err = strconv.Atoi(get(qPortMin)); err != nil {
+			return m, badRequest("invalid %s %q", qPortMin, get(qPortMin))
+		}
+		if m.PortMax, err = strconv.Atoi(get(qPortMax)); err != nil {
+			return m, badRequest("invalid %s %q", qPortMax, get(qPortMax))
+		}
+	case kPostProof, kPostProofForChild, kRemoveProofForChild, kPostNsProof,
+		kRemoveNsProof:
+		if err := decodeQuery(get(qStatements), &m.Statements); err != nil {
+			return m, err
+		}
+	case kLinkProof, kLinkProofForChild, kUnlinkProofForChild:
+		if err := decodeQuery(get(qDependencies), &m.Dependencies); err != nil {
+			return m, err
+		}
+	default:
+		return m, newError(ErrNotFound, "no such endpoint %s", endpoint)
+	}
+	return m, nil
+}
+
+// decodeQuery decodes the base64 encoded JSON of a query parameter.
+func decodeQuery(value string, v interface{}) error {
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return badRequest("invalid base64 parameter: %v", err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return badRequest("invalid json parameter: %v", err)
+	}
+	return nil
+}
+
+func errorStatus(err error) int {
+	switch ErrorKindOf(err) {
+	case ErrNotFound:
+		return http.StatusNotFound
+	case ErrAlreadyExists:
+		return http.StatusConflict
+	case ErrUnauthorized:
+		return http.StatusUnauthorized
+	case ErrBadRequest:
+		return http.StatusBadRequest
+	case ErrUnavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// errors are answered with their status, the body keeps the "false" of the
+// old servers
+func writeError(w http.ResponseWriter, err error) {
+	msg := err.Error()
+	if apiErr, ok := err.(*ApiError); ok {
+		msg = apiErr.Msg
+	}
+	w.WriteHeader(errorStatus(err))
+	fmt.Fprintf(w, "false: %s", msg)
+}
+
+func writeResult(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Fprint(w, "true")
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("fake metadata server encoding result: %v", err)
+	}
+}
+
+func mutationResult(err error) MutationResult {
+	if err == nil {
+		return MutationResult{Ok: true}
+	}
+	msg := err.Error()
+	if apiErr, ok := err.(*ApiError); ok {
+		msg = apiErr.Msg
+	}
+	return MutationResult{Error: msg, Status: errorStatus(err)}
+}
+
+// v2Route finds the version 1 endpoint doing what the version 2 request
+// does, and the principal or namespace it is about.
+func v2Route(method, endpoint string) (string, string) {
+	parts := strings.Split(strings.TrimPrefix(endpoint, kV2+"/"), "/")
+	if len(parts) == 0 || len(parts) > 3 {
+		return "", ""
+	}
+	resource, name, sub := parts[0], "", ""
+	if len(parts) > 1 {
+		name = parts[1]
+	}
+	if len(parts) > 2 {
+		sub = parts[2]
+	}
+	routes := map[string]map[string]string{}
+	switch {
+	case resource == "self" && len(parts) == 1:
+		routes[http.MethodGet] = map[string]string{"": kViewPrincipalName}
+	case resource == "self" && name == v2Proofs && len(parts) == 2:
+		return map[string]string{http.MethodPost: kSelfCertify}[method], ""
+	case resource == "principals" && len(parts) == 1:
+		return map[string]string{http.MethodGet: kListPrincipals}[method], ""
+	case resource == "principals":
+		routes[http.MethodGet] = map[string]string{"": kShowPrincipal}
+		routes[http.MethodPut] = map[string]string{"": kCreatePrincipal,
+			v2IpAliases: kCreateIPAlias, v2PortAliases: kCreatePortAlias}
+		routes[http.MethodDelete] = map[string]string{"": kDeletePrincipal,
+			v2IpAliases: kDeleteIPAlias, v2PortAliases: kDeletePortAlias,
+			v2ChildProofs: kRemoveProofForChild,
+			v2ChildLinks:  kUnlinkProofForChild}
+		routes[http.MethodPost] = map[string]string{v2Proofs: kPostProof,
+			v2ChildProofs: kPostProofForChild, v2Links: kLinkProof,
+			v2ChildLinks: kLinkProofForChild}
+	case resource == "namespaces" && len(parts) > 1:
+		routes[http.MethodPut] = map[string]string{"": kCreateNs,
+			v2Membership: kJoinNs}
+		routes[http.MethodDelete] = map[string]string{"": kDeleteNs,
+			v2Membership: kLeaveNs, v2Proofs: kRemoveNsProof}
+		routes[http.MethodPost] = map[string]string{v2Proofs: kPostNsProof}
+		routes[http.MethodGet] = map[string]string{v2Proofs: kListNsProofs}
+	}
+	if endpoint := routes[method][sub]; endpoint != "" {
+		return endpoint, name
+	}
+	return "", ""
+}
+
+func (f *FakeServer) serveV2(w http.ResponseWriter, r *http.Request,
+	endpoint, name string) {
+	ctx := r.Context()
+	switch endpoint {
+	case kViewPrincipalName:
+		writeJson(w, &v2Self{Principal: f.Id, NsName: f.Ns})
+		return
+	case kListPrincipals:
+		principals, _ := f.ListPrincipals(ctx)
+		writeJson(w, principals)
+		return
+	case kShowPrincipal:
+		p, err := f.ShowPrincipal(ctx, name)
+		if err != nil {
+			writeV2Result(w, err)
+			return
+		}
+		writeJson(w, p)
+		return
+	case kListNsProofs:
+		statements, err := f.ListNsProofs(ctx, name)
+		if err != nil {
+			writeV2Result(w, err)
+			return
+		}
+		writeJson(w, statements)
+		return
+	}
+
+	/// the body of the aliases is a subset of v2PortAlias
+	var alias v2PortAlias
+	var proof v2Proof
+	var body interface{}
+	switch endpoint {
+	case kCreateIPAlias, kDeleteIPAlias, kCreatePortAlias, kDeletePortAlias:
+		body = &alias
+	case kPostProof, kPostProofForChild, kRemoveProofForChild, kLinkProof,
+		kLinkProofForChild, kUnlinkProofForChild, kSelfCertify, kPostNsProof,
+		kRemoveNsProof:
+		body = &proof
+	}
+	if body != nil {
+		if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+			writeV2Result(w, badRequest("decoding body: %v", err))
+			return
+		}
+	}
+	if endpoint == kSelfCertify {
+		writeV2Result(w, f.SelfCertify(ctx, proof.Statements))
+		return
+	}
+	m := Mutation{
+		Op:           opName(endpoint),
+		Principal:    name,
+		Target:       name,
+		NsName:       alias.NsName,
+		Ip:           alias.Ip,
+		Protocol:     alias.Protocol,
+		PortMin:      alias.PortMin,
+		PortMax:      alias.PortMax,
+		Statements:   proof.Statements,
+		Dependencies: proof.Dependencies,
+	}
+	if endpoint == kCreateNs || endpoint == kDeleteNs ||
+		endpoint == kJoinNs || endpoint == kLeaveNs ||
+		endpoint == kPostNsProof || endpoint == kRemoveNsProof {
+		m.NsName = name
+	}
+	writeV2Result(w, ApplyMutationContext(ctx, f, m))
+}
+
+func writeV2Result(w http.ResponseWriter, err error) {
+	if err == nil {
+		writeJson(w, &v2Result{Ok: true})
+		return
+	}
+	msg := err.Error()
+	if apiErr, ok := err.(*ApiError); ok {
+		msg = apiErr.Msg
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(errorStatus(err))
+	json.NewEncoder(w).Encode(&v2Result{Error: msg})
+}
+
+func badRequest(format string, args ...interface{}) *ApiError {
+	return newError(ErrBadRequest, format, args...)
+}
+
+/// the in-memory state, as a ContextMetadataAPI
+
+func (f *FakeServer) uploadImage(name string, image FakeImage) error {
+	if name == "" {
+		return badRequest("missing %s", qImageName)
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.images[name] = image
+	return nil
+}
+
+// UploadVmImage records the image without reading the file.
+func (f *FakeServer) UploadVmImage(ctx context.Context, name, location,
+	gitrepo, rev, format string, encoded bool) error {
+	return f.uploadImage(name, FakeImage{GitRepo: gitrepo, GitRev: rev,
+		Format: format})
+}
+
+func (f *FakeServer) MyId(ctx context.Context) (string, error) {
+	return f.Id, nil
+}
+
+func (f *FakeServer) MyNs(ctx context.Context) (string, error) {
+	return f.Ns, nil
+}
+
+func (f *FakeServer) MyLocalIp(ctx context.Context) (string, error) {
+	return f.LocalIp, nil
+}
+
+func (f *FakeServer) MyPublicIp(ctx context.Context) (string, error) {
+	return f.PublicIp, nil
+}
+
+// copy a principal so that callers can't change the fake's state
+func copyPrincipal(p *Principal) Principal {
+	c := *NewPrincipal()
+	c.Aliases.Ips = append(c.Aliases.Ips, p.Aliases.Ips...)
+	for _, alias := range p.Aliases.Ports {
+		alias.Ports.Tcp = append([][2]int{}, alias.Ports.Tcp...)
+		alias.Ports.Udp = append([][2]int{}, alias.Ports.Udp...)
+		if alias.Ports.Sctp != nil {
+			alias.Ports.Sctp = append([][2]int{}, alias.Ports.Sctp...)
+		}
+		c.Aliases.Ports = append(c.Aliases.Ports, alias)
+	}
+	c.Links = append(c.Links, p.Links...)
+	c.Statements = append(c.Statements, p.Statements...)
+	return c
+}
+
+func (f *FakeServer) CreatePrincipal(ctx context.Context, name string) error {
+	if name == "" {
+		return badRequest("missing %s", qPrincipalName)
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, ok := f.principals[name]; ok || name == f.Id {
+		return alreadyExists("principal %s already exists", name)
+	}
+	f.principals[name] = NewPrincipal()
+	return nil
+}
+
+func (f *FakeServer) ListPrincipals(ctx context.Context) (map[string]Principal,
+	error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	result := make(map[string]Principal, len(f.principals))
+	for name, p := range f.principals {
+		result[name] = copyPrincipal(p)
+	}
+	return result, nil
+}
+
+func (f *FakeServer) ShowPrincipal(ctx context.Context, target string) (
+	*Principal, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	p, err := f.principal(target, true)
+	if err != nil {
+		return nil, err
+	}
+	c := copyPrincipal(p)
+	return &c, nil
+}
+
+func (f *FakeServer) DeletePrincipal(ctx context.Context, name string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, ok := f.principals[name]; !ok {
+		return notFound("principal %s not found", name)
+	}
+	delete(f.principals, name)
+	return nil
+}
+
+// principal finds a child principal, or this VM's own if self is allowed.
+// Call with the lock held.
+func (f *FakeServer) principal(name string, self bool) (*Principal, error) {
+	if self && name == f.Id {
+		return f.self, nil
+	}
+	if p, ok := f.principals[name]; ok {
+		return p, nil
+	}
+	return nil, notFound("principal %s not found", name)
+}
+
+func (f *FakeServer) CreateNs(ctx context.Context, name string) error {
+	if name == "" {
+		return badRequest("missing %s", qNsName)
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, ok := f.namespaces[name]; ok {
+		return alreadyExists("namespace %s already exists", name)
+	}
+	f.namespaces[name] = false
+	return nil
+}
+
+func (f *FakeServer) JoinNs(ctx context.Context, name string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	joined, ok := f.namespaces[name]
+	if !ok {
+		return notFound("namespace %s not found", name)
+	}
+	if joined {
+		return alreadyExists("namespace %s already joined", name)
+	}
+	f.namespaces[name] = true
+	return nil
+}
+
+func (f *FakeServer) LeaveNs(ctx context.Context, name string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if joined, ok := f.namespaces[name]; !ok || !joined {
+		return notFound("namespace %s not joined", name)
+	}
+	f.namespaces[name] = false
+	return nil
+}
+
+func (f *FakeServer) DeleteNs(ctx context.Context, name string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, ok := f.namespaces[name]; !ok {
+		return notFound("namespace %s not found", name)
+	}
+	delete(f.namespaces, name)
+	delete(f.nsProofs, name)
+	return nil
+}
+
+// Namespaces lists the created namespaces, and whether they are joined.
+func (f *FakeServer) Namespaces() map[string]bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	result := make(map[string]bool, len(f.namespaces))
+	for name, joined := range f.namespaces {
+		result[name] = joined
+	}
+	return result
+}
+
+func (f *FakeServer) CreateIPAlias(ctx context.Context, name string, ns string,
+	ip net.IP) error {
+	if ip == nil {
+		return badRequest("invalid ip alias for %s", name)
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	p, err := f.principal(name, false)
+	if err != nil {
+		return err
+	}
+	for _, alias := range p.Aliases.Ips {
+		if alias.NsName == ns && alias.Ip == ip.String() {
+			return alreadyExists("ip alias %s %v already exists for %s", ns, ip,
+				name)
+		}
+	}
+	p.Aliases.Ips = append(p.Aliases.Ips, IpAlias{ns, ip.String()})
+	return nil
+}
+
+func (f *FakeServer) DeleteIPAlias(ctx context.Context, name string, ns string,
+	ip net.IP) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	p, err := f.principal(name, false)
+	if err != nil {
+		return err
+	}
+	for i, alias := range p.Aliases.Ips {
+		if alias.NsName == ns && alias.Ip == ip.String() {
+			p.Aliases.Ips = append(p.Aliases.Ips[:i], p.Aliases.Ips[i+1:]...)
+			return nil
+		}
+	}
+	return notFound("ip alias %s %v not found for %s", ns, ip, name)
+}
+
+func checkPortAlias(ip net.IP, protocol string, portMin, portMax int) error {
+	if ip == nil {
+		return badRequest("invalid ip of port alias")
+	}
+	if (&ProtocolPorts{}).Protocol(protocol) == nil {
+		return badRequest("invalid protocol %q", protocol)
+	}
+	if portMin < 0 || portMax > 65535 || portMin > portMax {
+		return badRequest("invalid port range %d-%d", portMin, portMax)
+	}
+	return nil
+}
+
+func (f *FakeServer) CreatePortAlias(ctx context.Context, name string,
+	ns string, ip net.IP, protocol string, portMin, portMax int) error {
+	if err := checkPortAlias(ip, protocol, portMin, portMax); err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	p, err := f.principal(name, false)
+	if err != nil {
+		return err
+	}
+	return p.AddPortAlias(ns, ip.String(), protocol, portMin, portMax)
+}
+
+func (f *FakeServer) DeletePortAlias(ctx context.Context, name string,
+	ns string, ip net.IP, protocol string, portMin, portMax int) error {
+	if err := checkPortAlias(ip, protocol, portMin, portMax); err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	p, err := f.principal(name, false)
+	if err != nil {
+		return err
+	}
+	return p.DelPortAlias(ns, ip.String(), protocol, portMin, portMax)
+}
+
+// statements are endorsed by this VM
+func (f *FakeServer) endorse(p *Principal, statements []Statement) {
+	for _, s := range statements {
+		p.Statements = append(p.Statements, EndorsedStatement{
+			Endorser: f.Id,
+			Fact:     string(s),
+		})
+	}
+}
+
+func (f *FakeServer) postProof(target string, statements []Statement,
+	self bool) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	p, err := f.principal(target, self)
+	if err != nil {
+		return err
+	}
+	f.endorse(p, statements)
+	return nil
+}
+
+func (f *FakeServer) PostProof(ctx context.Context, target string,
+	statements []Statement) error {
+	return f.postProof(target, statements, true)
+}
+
+func (f *FakeServer) PostProofForChild(ctx context.Context, target string,
+	statements []Statement) error {
+	return f.postProof(target, statements, false)
+}
+
+func (f *FakeServer) SelfCertify(ctx context.Context,
+	statements []Statement) error {
+	return f.postProof(f.Id, statements, true)
+}
+
+// RemoveProofForChild removes all the statements or none of them.
+func (f *FakeServer) RemoveProofForChild(ctx context.Context, target string,
+	statements []Statement) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	p, err := f.principal(target, false)
+	if err != nil {
+		return err
+	}
+	remove := make(map[string]bool, len(statements))
+	for _, s := range statements {
+		remove[string(s)] = true
+	}
+	kept := make([]EndorsedStatement, 0, len(p.Statements))
+	for _, s := range p.Statements {
+		if remove[s.Fact] {
+			delete(remove, s.Fact)
+		} else {
+			kept = append(kept, s)
+		}
+	}
+	if len(remove) > 0 {
+		return notFound("statements %v not found for %s", sortedKeys(remove),
+			target)
+	}
+	p.Statements = kept
+	return nil
+}
+
+func (f *FakeServer) PostNsProof(ctx context.Context, ns string,
+	statements []Statement) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, ok := f.namespaces[ns]; !ok {
+		return notFound("namespace %s not found", ns)
+	}
+	for _, s := range statements {
+		f.nsProofs[ns] = append(f.nsProofs[ns], EndorsedStatement{
+			Endorser: f.Id,
+			Fact:     string(s),
+		})
+	}
+	return nil
+}
+
+// RemoveNsProof removes all the statements or none of them.
+func (f *FakeServer) RemoveNsProof(ctx context.Context, ns string,
+	statements []Statement) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, ok := f.namespaces[ns]; !ok {
+		return notFound("namespace %s not found", ns)
+	}
+	remove := make(map[string]bool, len(statements))
+	for _, s := range statements {
+		remove[string(s)] = true
+	}
+	kept := make([]EndorsedStatement, 0, len(f.nsProofs[ns]))
+	for _, s := range f.nsProofs[ns] {
+		if remove[s.Fact] {
+			delete(remove, s.Fact)
+		} else {
+			kept = append(kept, s)
+		}
+	}
+	if len(remove) > 0 {
+		return notFound("statements %v not found for namespace %s",
+			sortedKeys(remove), ns)
+	}
+	f.nsProofs[ns] = kept
+	return nil
+}
+
+func (f *FakeServer) ListNsProofs(ctx context.Context, ns string) (
+	[]EndorsedStatement, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, ok := f.namespaces[ns]; !ok {
+		return nil, notFound("namespace %s not found", ns)
+	}
+	return append([]EndorsedStatement{}, f.nsProofs[ns]...), nil
+}
+
+// NsFacts lists the facts posted about a namespace, in order.
+func (f *FakeServer) NsFacts(ns string) []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	facts := make([]string, 0, len(f.nsProofs[ns]))
+	for _, s := range f.nsProofs[ns] {
+		facts = append(facts, s.Fact)
+	}
+	return facts
+}
+
+func (f *FakeServer) linkProof(target string, dependencies []string,
+	self bool) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	p, err := f.principal(target, self)
+	if err != nil {
+		return err
+	}
+	p.Links = append(p.Links, dependencies...)
+	return nil
+}
+
+func (f *FakeServer) LinkProof(ctx context.Context, target string,
+	dependencies []string) error {
+	return f.linkProof(target, dependencies, true)
+}
+
+func (f *FakeServer) LinkProofForChild(ctx context.Context, target string,
+	dependencies []string) error {
+	return f.linkProof(target, dependencies, false)
+}
+
+// UnlinkProofForChild removes all the links or none of them.
+func (f *FakeServer) UnlinkProofForChild(ctx context.Context, target string,
+	dependencies []string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	p, err := f.principal(target, false)
+	if err != nil {
+		return err
+	}
+	remove := make(map[string]bool, len(dependencies))
+	for _, l := range dependencies {
+		remove[l] = true
+	}
+	kept := make([]string, 0, len(p.Links))
+	for _, l := range p.Links {
+		if remove[l] {
+			delete(remove, l)
+		} else {
+			kept = append(kept, l)
+		}
+	}
+	if len(remove) > 0 {
+		return notFound("links %v not found for %s", sortedKeys(remove), target)
+	}
+	p.Links = kept
+	return nil
+}
+
+func (f *FakeServer) Batch(ctx context.Context, mutations []Mutation) []error {
+	return ApplyMutationsContext(ctx, f, mutations)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,235 @@
+package statement
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fakeApi(t *testing.T) (*FakeServer, MetadataAPI, func()) {
+	fake, server := StartFakeServer()
+	return fake, serverApi(server), server.Close
+}
+
+func serverApi(server *httptest.Server) MetadataAPI {
+	return NewOpenstackMetadataAPI(strings.TrimPrefix(server.URL, "http://"))
+}
+
+func TestFakeServerPrincipals(t *testing.T) {
+	for _, caps := range [][]string{{CapBatch, CapV2}, {CapBatch}} {
+		fake, api, done := fakeApi(t)
+		fake.Capabilities = caps
+		fakePrincipalsSession(t, api)
+		done()
+	}
+}
+
+func fakePrincipalsSession(t *testing.T, api MetadataAPI) {
+	id, err := api.MyId()
+	assert.Nil(t, err, "my id")
+	assert.Equal(t, "fake-vm", id, "my id")
+	ip, err := api.MyLocalIp()
+	assert.Nil(t, err, "local ip")
+	assert.Equal(t, "192.168.0.1", ip, "local ip")
+
+	require.Nil(t, api.CreatePrincipal("p1"), "create")
+	assert.True(t, IsAlreadyExists(api.CreatePrincipal("p1")), "create twice")
+	addr := net.ParseIP("10.0.0.1")
+	assert.Nil(t, api.CreateIPAlias("p1", "overlay", addr), "ip alias")
+	assert.True(t, IsAlreadyExists(api.CreateIPAlias("p1", "overlay", addr)),
+		"ip alias twice")
+	assert.Nil(t, api.CreatePortAlias("p1", "default", addr, "tcp", 1000, 2000),
+		"port alias")
+	assert.Nil(t, api.CreatePortAlias("p1", "default", addr, "sctp", 3868,
+		3868), "sctp port alias")
+	assert.True(t, IsBadRequest(api.CreatePortAlias("p1", "default", addr,
+		"icmp", 1000, 2000)), "bad protocol")
+	assert.True(t, IsNotFound(api.CreateIPAlias("p2", "overlay", addr)),
+		"alias of missing principal")
+
+	stmts := []Statement{"containerFact(\"p1\", \"image-1\")", "other"}
+	assert.Nil(t, api.PostProofForChild("p1", stmts), "post proofs")
+	assert.Nil(t, api.LinkProofForChild("p1", []string{"image-1"}), "link")
+	p, err := api.ShowPrincipal("p1")
+	require.Nil(t, err, "show")
+	assert.Equal(t, []IpAlias{{"overlay", "10.0.0.1"}}, p.Aliases.Ips)
+	assert.Equal(t, [][2]int{{1000, 2000}}, p.Aliases.Ports[0].Ports.Tcp)
+	assert.Equal(t, []string{"image-1"}, p.Links)
+	require.Len(t, p.Statements, 2, "statements")
+	assert.Equal(t, EndorsedStatement{"fake-vm", string(stmts[0])},
+		p.Statements[0], "statement endorsed by the vm")
+
+	assert.True(t, IsNotFound(api.RemoveProofForChild("p1",
+		[]Statement{"other", "missing"})), "remove missing")
+	assert.Nil(t, api.RemoveProofForChild("p1", stmts[1:]), "remove")
+	assert.Nil(t, api.UnlinkProofForChild("p1", []string{"image-1"}), "unlink")
+	assert.Nil(t, api.DeletePortAlias("p1", "default", addr, "tcp", 1000, 2000),
+		"delete port alias")
+	assert.Nil(t, api.SelfCertify([]Statement{"self"}), "self certify")
+
+	principals, err := api.ListPrincipals()
+	require.Nil(t, err, "list")
+	require.Contains(t, principals, "p1", "list")
+	assert.Len(t, principals["p1"].Statements, 1, "statement removed")
+	assert.Empty(t, principals["p1"].Links, "link removed")
+	self, err := api.ShowPrincipal("fake-vm")
+	require.Nil(t, err, "show self")
+	assert.Len(t, self.Statements, 1, "self certified")
+
+	assert.Nil(t, api.DeletePrincipal("p1"), "delete")
+	_, err = api.ShowPrincipal("p1")
+	assert.True(t, IsNotFound(err), "deleted")
+	assert.True(t, IsNotFound(api.DeletePrincipal("p1")), "delete twice")
+}
+
+func TestFakeServerNamespaces(t *testing.T) {
+	for _, caps := range [][]string{{CapBatch, CapV2}, {CapBatch}} {
+		fake, api, done := fakeApi(t)
+		fake.Capabilities = caps
+		fakeNamespacesSession(t, fake, api)
+		done()
+	}
+}
+
+func fakeNamespacesSession(t *testing.T, fake *FakeServer, api MetadataAPI) {
+	assert.True(t, IsNotFound(api.JoinNs("ns1")), "join missing")
+	assert.Nil(t, api.CreateNs("ns1"), "create")
+	assert.True(t, IsAlreadyExists(api.CreateNs("ns1")), "create twice")
+	assert.Nil(t, api.JoinNs("ns1"), "join")
+	assert.Equal(t, map[string]bool{"ns1": true}, fake.Namespaces())
+
+	stmts := []Statement{"networkFact(\"ns1\", \"driver\", \"overlay\")",
+		"other"}
+	assert.True(t, IsNotFound(api.PostNsProof("ns2", stmts)),
+		"facts of missing ns")
+	assert.Nil(t, api.PostNsProof("ns1", stmts), "post ns facts")
+	assert.Equal(t, []string{string(stmts[0]), "other"}, fake.NsFacts("ns1"))
+	assert.True(t, IsNotFound(api.RemoveNsProof("ns1",
+		[]Statement{"other", "missing"})), "remove missing")
+	assert.Nil(t, api.RemoveNsProof("ns1", stmts[1:]), "remove ns facts")
+	assert.Equal(t, []string{string(stmts[0])}, fake.NsFacts("ns1"))
+	listed, err := api.ListNsProofs("ns1")
+	assert.Nil(t, err, "list ns facts")
+	assert.Equal(t, []EndorsedStatement{{Endorser: fake.Id,
+		Fact: string(stmts[0])}}, listed)
+	_, err = api.ListNsProofs("ns2")
+	assert.True(t, IsNotFound(err), "facts of missing ns")
+
+	assert.Nil(t, api.LeaveNs("ns1"), "leave")
+	assert.True(t, IsNotFound(api.LeaveNs("ns1")), "leave twice")
+	assert.Nil(t, api.DeleteNs("ns1"), "delete")
+	assert.Empty(t, fake.Namespaces(), "deleted")
+	assert.Empty(t, fake.NsFacts("ns1"), "facts gone with the ns")
+}
+
+func TestFakeServerBatch(t *testing.T) {
+	fake, server := StartFakeServer()
+	defer server.Close()
+
+	errs := serverApi(server).Batch([]Mutation{
+		CreatePrincipalMutation("p1"),
+		CreatePrincipalMutation("p1"),
+		PostProofForChildMutation("p1", []Statement{"fact"}),
+		DeletePrincipalMutation("p2"),
+	})
+	require.Len(t, errs, 4, "one result per mutation")
+	assert.Nil(t, errs[0], "created")
+	assert.True(t, IsAlreadyExists(errs[1]), "created twice")
+	assert.Nil(t, errs[2], "proof posted")
+	assert.True(t, IsNotFound(errs[3]), "missing principal")
+	assert.Equal(t, 1, fake.Calls(kBatch), "sent as one batch")
+
+	fake.Capabilities = nil
+	errs = serverApi(server).Batch([]Mutation{CreatePrincipalMutation("p2")})
+	assert.Nil(t, errs[0], "fallback without batch")
+	assert.Equal(t, 1, fake.Calls(kCreatePrincipal), "one call per mutation")
+}
+
+func TestFakeServerFaults(t *testing.T) {
+	fake, api, done := fakeApi(t)
+	defer done()
+
+	fake.SetFault(kCreatePrincipal, Fault{ErrorRate: 1})
+	assert.True(t, IsUnavailable(api.CreatePrincipal("p1")), "injected error")
+	fake.SetFault(kCreatePrincipal, Fault{ErrorRate: 1,
+		ErrorStatus: http.StatusForbidden})
+	assert.True(t, IsUnauthorized(api.CreatePrincipal("p1")), "injected status")
+	_, err := api.MyId()
+	assert.Nil(t, err, "other endpoints not affected")
+
+	fake.SetFault("", Fault{DropRate: 1})
+	_, err = api.MyLocalIp()
+	assert.True(t, IsUnavailable(err), "dropped")
+
+	fake.ClearFaults()
+	fake.SetFault(kShowPrincipal, Fault{Latency: time.Second})
+	ctxApi := NoContext(WithContext(api), context.Background(),
+		50*time.Millisecond)
+	start := time.Now()
+	_, err = ctxApi.ShowPrincipal("p1")
+	assert.True(t, IsUnavailable(err), "timed out")
+	assert.True(t, time.Since(start) < time.Second, "not waiting for the fault")
+	assert.Nil(t, api.CreatePrincipal("p1"), "faults cleared")
+	assert.Equal(t, 3, fake.Calls(kCreatePrincipal), "calls counted")
+}
+
+func TestFakeServerSigned(t *testing.T) {
+	fake, server := StartFakeServer()
+	defer server.Close()
+	fake.Verifier = NewSignatureVerifier(DefaultMaxSkew)
+	fake.Verifier.AddHMACKey("host1", []byte("secret"))
+
+	assert.True(t, IsUnauthorized(signedApi(server, nil).CreatePrincipal("p1")),
+		"unsigned")
+	signed := signedApi(server, NewHMACSigner("host1", []byte("secret")))
+	assert.Nil(t, signed.CreatePrincipal("p1"), "signed")
+}
+
+func TestProtocolNegotiation(t *testing.T) {
+	fake := NewFakeServer()
+	requests := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r.Method+" "+r.URL.RequestURI())
+			fake.ServeHTTP(w, r)
+		}))
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+
+	stmts := []Statement{"fact1", "fact2"}
+	api := NewOpenstackMetadataAPI(addr)
+	require.Nil(t, api.CreatePrincipal("p1"), "create")
+	require.Nil(t, api.PostProofForChild("p1", stmts), "post proofs")
+	assert.Equal(t, []string{
+		"GET /" + APIPath + kCapabilities,
+		"PUT /" + APIPath + "/v2/principals/p1",
+		"POST /" + APIPath + "/v2/principals/p1/child_proofs",
+	}, requests, "version 2 negotiated")
+	assert.True(t, IsAlreadyExists(api.CreatePrincipal("p1")), "v2 error")
+	ns, err := api.MyNs()
+	assert.Nil(t, err, "self")
+	assert.Equal(t, "fake-ns", ns, "self")
+
+	requests = requests[:0]
+	v1 := NewOpenstackContextAPI(addr)
+	v1.SetProtocolVersion(ProtocolV1)
+	require.Nil(t, v1.RemoveProofForChild(context.Background(), "p1", stmts),
+		"remove proofs")
+	require.Len(t, requests, 1, "no negotiation")
+	assert.True(t, strings.HasPrefix(requests[0], "POST /"+APIPath+
+		kRemoveProofForChild+"?"), "version 1 forced")
+
+	requests = requests[:0]
+	fake.Capabilities = []string{CapBatch}
+	old := NewOpenstackMetadataAPI(addr)
+	require.Nil(t, old.DeletePrincipal("p1"), "delete")
+	assert.Equal(t, "POST /"+APIPath+kDeletePrincipal+"?principal=p1",
+		requests[1], "version 1 with older servers")
+}
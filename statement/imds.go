@@ -0,0 +1,183 @@
+package statement
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+/// IMDSv2 session tokens for the AWS style metadata paths
+
+const (
+	// Both sides of the metadata service use these. A client with ImdsV1
+	// never asks for tokens, with ImdsOptional it uses them if the server
+	// hands them out and with ImdsRequired it fails without one. A server
+	// with ImdsV1 has no token endpoint, with ImdsOptional it accepts calls
+	// with or without tokens and with ImdsRequired only with.
+	ImdsV1       = "v1"
+	ImdsOptional = "optional"
+	ImdsRequired = "required"
+
+	ImdsTokenPath   = "latest/api/token"
+	HeaderImdsTTL   = "X-aws-ec2-metadata-token-ttl-seconds"
+	HeaderImdsToken = "X-aws-ec2-metadata-token"
+
+	// the longest AWS allows
+	DefaultImdsTokenTTL = 6 * time.Hour
+
+	// endpoint of the token, relative to "latest" like the AWS paths
+	kImdsToken = "/api/token"
+)
+
+// imdsSession keeps the token of the AWS style metadata calls, and asks for a
+// new one a little before it expires.
+type imdsSession struct {
+	mode        string
+	ttl         time.Duration
+	lock        *sync.Mutex
+	token       string
+	expire      time.Time
+	unsupported bool // the server has no tokens, only with ImdsOptional
+	now         func() time.Time
+}
+
+func newImdsSession(mode string, ttl time.Duration) *imdsSession {
+	if mode == "" {
+		mode = ImdsOptional
+	}
+	if ttl < time.Second {
+		ttl = DefaultImdsTokenTTL
+	}
+	return &imdsSession{mode: mode, ttl: ttl, lock: &sync.Mutex{},
+		now: time.Now}
+}
+
+// SetImds sets how the AWS style calls use session tokens, and how long the
+// tokens asked for last.
+func (api *Api) SetImds(mode string, ttl time.Duration) {
+	api.imds = newImdsSession(mode, ttl)
+}
+
+// invalidate drops a token the server no longer takes.
+func (s *imdsSession) invalidate(token string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.token == token {
+		s.token = ""
+	}
+}
+
+// retryTokens asks for a token again, the server wants one after all.
+func (s *imdsSession) retryTokens() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.unsupported = false
+}
+
+// noImdsTokens tells if the server answered the token request as one without
+// a token endpoint.
+func noImdsTokens(err error) bool {
+	e, ok := err.(*ApiError)
+	return ok && (e.Status == http.StatusNotFound ||
+		e.Status == http.StatusMethodNotAllowed)
+}
+
+// imdsToken gives the token to send, "" to go without.
+func (api *Api) imdsToken(ctx context.Context) (string, error) {
+	s := api.imds
+	if s.mode == ImdsV1 {
+		return "", nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	/// renew when 90% of the lifetime has passed
+	if s.token != "" && s.now().Before(s.expire.Add(-s.ttl/10)) {
+		return s.token, nil
+	}
+	if s.unsupported {
+		return "", nil
+	}
+	token, err := api.fetchImdsToken(ctx, s.ttl)
+	if err == nil {
+		s.token, s.expire = token, s.now().Add(s.ttl)
+		return token, nil
+	}
+	if s.mode == ImdsRequired {
+		return "", err
+	}
+	if noImdsTokens(err) {
+		/// not going to change until the server is reconfigured
+		log.Infof("metadata server gives no session token, using IMDSv1: %v",
+			err)
+		s.unsupported = true
+	} else {
+		log.Warnf("fetching metadata session token, trying IMDSv1: %v", err)
+	}
+	return "", nil
+}
+
+func (api *Api) fetchImdsToken(ctx context.Context,
+	ttl time.Duration) (string, error) {
+	req, err := http.NewRequest(http.MethodPut,
+		fmt.Sprintf("%s://%s/%s", api.scheme, api.serverAddr, ImdsTokenPath),
+		nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set(HeaderImdsTTL, strconv.Itoa(int(ttl/time.Second)))
+	resp, err := api.do(req)
+	if err != nil {
+		return "", err
+	}
+	token, err := strResp(resp)
+	if err != nil {
+		return "", err
+	}
+	if token = strings.TrimSpace(token); token == "" {
+		return "", newError(ErrUnknown, "empty metadata session token")
+	}
+	return token, nil
+}
+
+// doImds sends an AWS style request with the session token. A token the
+// server rejects is renewed once, and a token is asked for once if the
+// server rejects a call without.
+func (api *Api) doImds(ctx context.Context,
+	newReq func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		token, err := api.imdsToken(ctx)
+		if err != nil {
+			log.Errorf("fetching metadata session token: %v", err)
+			return nil, err
+		}
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+		if token != "" {
+			req.Header.Set(HeaderImdsToken, token)
+		}
+		resp, err := api.do(req)
+		if err != nil || attempt > 0 || api.imds.mode == ImdsV1 ||
+			resp.StatusCode != http.StatusUnauthorized {
+			return resp, err
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if token == "" {
+			log.Infof("metadata session token required, fetching one")
+			api.imds.retryTokens()
+		} else {
+			log.Infof("metadata session token rejected, renewing")
+			api.imds.invalidate(token)
+		}
+	}
+}
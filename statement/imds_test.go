@@ -0,0 +1,109 @@
+package statement
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func imdsApi(server *httptest.Server, mode string) *Api {
+	api := NewOpenstackContextAPI(strings.TrimPrefix(server.URL, "http://"))
+	api.SetImds(mode, time.Hour)
+	return api
+}
+
+func TestImdsTokenRequired(t *testing.T) {
+	fake, server := StartFakeServer()
+	defer server.Close()
+	fake.Imds = ImdsRequired
+	ctx := context.Background()
+
+	_, err := imdsApi(server, ImdsV1).MyLocalIp(ctx)
+	assert.True(t, IsUnauthorized(err), "no token")
+
+	api := imdsApi(server, ImdsOptional)
+	ip, err := api.MyLocalIp(ctx)
+	require.Nil(t, err, "with token")
+	assert.Equal(t, "192.168.0.1", ip)
+	_, err = api.MyPublicIp(ctx)
+	assert.Nil(t, err, "token reused")
+	assert.Equal(t, 1, fake.Calls(kImdsToken), "one token")
+
+	fake.RevokeTokens()
+	_, err = api.MyLocalIp(ctx)
+	assert.Nil(t, err, "token renewed once rejected")
+	assert.Equal(t, 2, fake.Calls(kImdsToken), "new token")
+
+	api.imds.now = func() time.Time { return time.Now().Add(55 * time.Minute) }
+	_, err = api.MyLocalIp(ctx)
+	assert.Nil(t, err, "token renewed before expiring")
+	assert.Equal(t, 3, fake.Calls(kImdsToken), "new token")
+}
+
+func TestImdsFallback(t *testing.T) {
+	fake, server := StartFakeServer()
+	defer server.Close()
+	fake.Imds = ImdsV1
+	ctx := context.Background()
+
+	_, err := imdsApi(server, ImdsRequired).MyLocalIp(ctx)
+	assert.NotNil(t, err, "token required")
+
+	api := imdsApi(server, ImdsOptional)
+	_, err = api.MyLocalIp(ctx)
+	assert.Nil(t, err, "falling back to v1")
+	_, err = api.MyPublicIp(ctx)
+	assert.Nil(t, err, "v1")
+	assert.Equal(t, 2, fake.Calls(kImdsToken), "server without tokens known")
+
+	// an unreachable token endpoint is tried again next time
+	fake.Imds = ImdsOptional
+	fake.SetFault(kImdsToken, Fault{ErrorRate: 1})
+	api = imdsApi(server, ImdsOptional)
+	_, err = api.MyLocalIp(ctx)
+	assert.Nil(t, err, "falling back to v1")
+	fake.ClearFaults()
+	_, err = api.MyLocalIp(ctx)
+	assert.Nil(t, err, "with token")
+	assert.Equal(t, 4, fake.Calls(kImdsToken), "token tried again")
+	assert.NotEmpty(t, api.imds.token, "token kept")
+}
+
+func TestImdsTokenErrors(t *testing.T) {
+	fake, server := StartFakeServer()
+	defer server.Close()
+	ctx := context.Background()
+
+	// only a server without the token endpoint goes without tokens for good
+	for _, status := range []int{http.StatusInternalServerError,
+		http.StatusUnauthorized, http.StatusForbidden} {
+		fake.SetFault(kImdsToken, Fault{ErrorRate: 1, ErrorStatus: status})
+		api := imdsApi(server, ImdsOptional)
+		_, err := api.MyLocalIp(ctx)
+		assert.Nil(t, err, "falling back to v1 on %d", status)
+		assert.False(t, api.imds.unsupported, "tokens tried again on %d",
+			status)
+	}
+	fake.SetFault(kImdsToken, Fault{ErrorRate: 1,
+		ErrorStatus: http.StatusMethodNotAllowed})
+	api := imdsApi(server, ImdsOptional)
+	_, err := api.MyLocalIp(ctx)
+	assert.Nil(t, err, "falling back to v1")
+	assert.True(t, api.imds.unsupported, "no token endpoint")
+	fake.ClearFaults()
+
+	// the server now wants tokens
+	fake.Imds = ImdsRequired
+	calls := fake.Calls(kImdsToken)
+	ip, err := api.MyLocalIp(ctx)
+	require.Nil(t, err, "token fetched once rejected without")
+	assert.Equal(t, "192.168.0.1", ip)
+	assert.Equal(t, calls+1, fake.Calls(kImdsToken), "one token")
+	assert.NotEmpty(t, api.imds.token, "token kept")
+}
@@ -0,0 +1,221 @@
+package statement
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+/// Identity of the instance the daemon runs on
+
+const (
+	ProviderAuto      = "auto"
+	ProviderOpenstack = "openstack"
+	ProviderAWS       = "aws"
+	ProviderGCP       = "gcp"
+	ProviderAzure     = "azure"
+	ProviderStatic    = "static"
+)
+
+// InstanceInfo is what the daemon needs to know about its instance. PublicIp
+// is nil if the instance has none. Ipv6 are the global IPv6 addresses, none
+// if the cloud does not tell. Ns is the IaaS namespace: the tenant, the
+// account, the project or the subscription depending on the cloud.
+type InstanceInfo struct {
+	LocalIp  net.IP
+	PublicIp net.IP
+	Ipv6     []net.IP
+	Ns       string
+}
+
+// InstanceInfoProvider asks the instance metadata of a cloud for the
+// InstanceInfo.
+type InstanceInfoProvider interface {
+	Name() string
+	InstanceInfo(ctx context.Context) (*InstanceInfo, error)
+}
+
+func parseIp(what, s string) (net.IP, error) {
+	ip := net.ParseIP(strings.TrimSpace(s))
+	if ip == nil {
+		return nil, badRequest("invalid %s %q", what, s)
+	}
+	return ip, nil
+}
+
+// parseIpv6 parses IPv6 addresses, listed one per line by the clouds.
+func parseIpv6(ips ...string) ([]net.IP, error) {
+	result := make([]net.IP, 0, len(ips))
+	for _, line := range ips {
+		for _, s := range strings.Fields(line) {
+			ip, err := parseIp("ipv6", s)
+			if err != nil {
+				return nil, err
+			}
+			if ip.To4() != nil {
+				return nil, badRequest("invalid ipv6 %q", s)
+			}
+			result = append(result, ip)
+		}
+	}
+	return result, nil
+}
+
+// metadataProvider is the tapcon metadata service, OpenStack's as far as
+// the instance is concerned.
+type metadataProvider struct {
+	api ContextMetadataAPI
+}
+
+func NewMetadataInstanceProvider(api ContextMetadataAPI) InstanceInfoProvider {
+	return &metadataProvider{api}
+}
+
+func (p *metadataProvider) Name() string {
+	return ProviderOpenstack
+}
+
+func (p *metadataProvider) InstanceInfo(ctx context.Context) (*InstanceInfo,
+	error) {
+	local, err := p.api.MyLocalIp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	info := &InstanceInfo{}
+	if info.LocalIp, err = parseIp("local ip", local); err != nil {
+		return nil, err
+	}
+	public, err := p.api.MyPublicIp(ctx)
+	if err != nil && !IsNotFound(err) {
+		return nil, err
+	}
+	if err == nil && public != "" {
+		if info.PublicIp, err = parseIp("public ip", public); err != nil {
+			return nil, err
+		}
+	}
+	if info.Ns, err = p.api.MyNs(ctx); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// staticProvider is for bare metal, with the identity configured.
+type staticProvider struct {
+	info InstanceInfo
+}
+
+func NewStaticInstanceProvider(localIp, publicIp string, ipv6 []string,
+	ns string) (InstanceInfoProvider, error) {
+	p := &staticProvider{InstanceInfo{Ns: ns}}
+	var err error
+	if p.info.LocalIp, err = parseIp("local ip", localIp); err != nil {
+		return nil, err
+	}
+	if p.info.Ipv6, err = parseIpv6(ipv6...); err != nil {
+		return nil, err
+	}
+	if publicIp != "" {
+		if p.info.PublicIp, err = parseIp("public ip", publicIp); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (p *staticProvider) Name() string {
+	return ProviderStatic
+}
+
+func (p *staticProvider) InstanceInfo(ctx context.Context) (*InstanceInfo,
+	error) {
+	info := p.info
+	return &info, nil
+}
+
+// timeoutProvider gives the provider it wraps a time limit on each call.
+type timeoutProvider struct {
+	InstanceInfoProvider
+	timeout time.Duration
+}
+
+// NewTimeoutInstanceProvider has each call to provider finish within timeout,
+// or the deadline of its context if earlier.
+func NewTimeoutInstanceProvider(provider InstanceInfoProvider,
+	timeout time.Duration) InstanceInfoProvider {
+	return &timeoutProvider{provider, timeout}
+}
+
+func (p *timeoutProvider) InstanceInfo(ctx context.Context) (*InstanceInfo,
+	error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	return p.InstanceInfoProvider.InstanceInfo(ctx)
+}
+
+// autoProvider detects the cloud: the first of the providers answering is
+// used from then on. Each probe has its own time limit, so a cloud hanging
+// does not leave the others without time to answer.
+type autoProvider struct {
+	providers []InstanceInfoProvider
+	timeout   time.Duration
+	lock      *sync.Mutex
+	chosen    InstanceInfoProvider
+}
+
+// NewAutoInstanceProvider tries the providers in order, the ones that can
+// tell for sure they are on their cloud should come first. Each is given
+// timeout to answer, and the chosen one as much on the later calls.
+func NewAutoInstanceProvider(timeout time.Duration,
+	providers ...InstanceInfoProvider) InstanceInfoProvider {
+	return &autoProvider{providers: providers, timeout: timeout,
+		lock: &sync.Mutex{}}
+}
+
+func (p *autoProvider) Name() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.chosen != nil {
+		return p.chosen.Name()
+	}
+	return ProviderAuto
+}
+
+func (p *autoProvider) probe(ctx context.Context,
+	provider InstanceInfoProvider) (*InstanceInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	return provider.InstanceInfo(ctx)
+}
+
+func (p *autoProvider) InstanceInfo(ctx context.Context) (*InstanceInfo,
+	error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.chosen != nil {
+		return p.probe(ctx, p.chosen)
+	}
+	failures := make([]string, 0, len(p.providers))
+	for _, provider := range p.providers {
+		info, err := p.probe(ctx, provider)
+		if err == nil {
+			log.Infof("instance metadata provider detected: %s",
+				provider.Name())
+			p.chosen = provider
+			return info, nil
+		}
+		if ctx.Err() != nil {
+			/// the caller gave up, not the provider
+			return nil, err
+		}
+		log.Debugf("instance is not on %s: %v", provider.Name(), err)
+		failures = append(failures, fmt.Sprintf("%s: %v", provider.Name(), err))
+	}
+	return nil, newError(ErrNotFound, "no instance metadata provider: %s",
+		strings.Join(failures, "; "))
+}
@@ -0,0 +1,213 @@
+package statement
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func standIn(handler http.HandlerFunc) (*httptest.Server, string) {
+	server := httptest.NewServer(handler)
+	return server, strings.TrimPrefix(server.URL, "http://")
+}
+
+func gcpStandIn() http.HandlerFunc {
+	values := map[string]string{
+		"/computeMetadata/v1/instance/network-interfaces/0/ip": "10.128.0.2",
+		"/computeMetadata/v1/instance/network-interfaces/0/access-configs/0/" +
+			"external-ip": "35.1.2.3",
+		"/computeMetadata/v1/instance/network-interfaces/0/ipv6s": "2600:1900::2\n",
+		"/computeMetadata/v1/project/project-id":                  "tapcon-project",
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(gcpFlavor) != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set(gcpFlavor, "Google")
+		value, ok := values[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(value))
+	}
+}
+
+const azureDocument = `{
+  "compute": {"subscriptionId": "8d10da13-8125-4ba9-a717-bf7490507b3d"},
+  "network": {"interface": [{"ipv4": {"ipAddress": [
+    {"privateIpAddress": "10.0.0.4", "publicIpAddress": ""}]},
+    "ipv6": {"ipAddress": [{"privateIpAddress": "ace:cab:deca::4"}]}}]}}`
+
+func azureStandIn(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Metadata") != "true" ||
+		r.URL.Query().Get("api-version") == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if r.URL.Path != "/"+azurePath {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Write([]byte(azureDocument))
+}
+
+func awsStandIn(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/"+ImdsTokenPath {
+		w.Write([]byte("token"))
+		return
+	}
+	if r.Header.Get(HeaderImdsToken) != "token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch r.URL.Path {
+	case "/" + awsIdentityPath:
+		w.Write([]byte(`{"accountId": "123456789012", ` +
+			`"privateIp": "172.31.0.5", "region": "us-east-1"}`))
+	case "/" + AwsAPIPath + kViewPublicIP:
+		w.Write([]byte("54.1.2.3"))
+	case "/" + AwsAPIPath + "/ipv6":
+		w.Write([]byte("2600:1f18::5"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestInstanceProviders(t *testing.T) {
+	ctx := context.Background()
+
+	gcp, gcpAddr := standIn(gcpStandIn())
+	defer gcp.Close()
+	info, err := NewGCPInstanceProvider(gcpAddr).InstanceInfo(ctx)
+	require.Nil(t, err, "gcp")
+	assert.Equal(t, "10.128.0.2", info.LocalIp.String())
+	assert.Equal(t, "35.1.2.3", info.PublicIp.String())
+	assert.Equal(t, "2600:1900::2", info.Ipv6[0].String())
+	assert.Equal(t, "tapcon-project", info.Ns)
+
+	azure, azureAddr := standIn(azureStandIn)
+	defer azure.Close()
+	info, err = NewAzureInstanceProvider(azureAddr).InstanceInfo(ctx)
+	require.Nil(t, err, "azure")
+	assert.Equal(t, "10.0.0.4", info.LocalIp.String())
+	assert.Nil(t, info.PublicIp, "no public ip")
+	assert.Equal(t, "ace:cab:deca::4", info.Ipv6[0].String())
+	assert.Equal(t, "8d10da13-8125-4ba9-a717-bf7490507b3d", info.Ns)
+
+	aws, awsAddr := standIn(awsStandIn)
+	defer aws.Close()
+	info, err = NewAWSInstanceProvider(awsAddr, ImdsRequired).InstanceInfo(ctx)
+	require.Nil(t, err, "aws")
+	assert.Equal(t, "172.31.0.5", info.LocalIp.String())
+	assert.Equal(t, "54.1.2.3", info.PublicIp.String())
+	assert.Equal(t, "2600:1f18::5", info.Ipv6[0].String())
+	assert.Equal(t, "123456789012", info.Ns)
+
+	fake, server := StartFakeServer()
+	defer server.Close()
+	info, err = NewMetadataInstanceProvider(WithContext(serverApi(server))).InstanceInfo(ctx)
+	require.Nil(t, err, "openstack")
+	assert.Equal(t, fake.LocalIp, info.LocalIp.String())
+	assert.Equal(t, fake.PublicIp, info.PublicIp.String())
+	assert.Empty(t, info.Ipv6, "not told by the metadata service")
+	assert.Equal(t, fake.Ns, info.Ns)
+
+	static, err := NewStaticInstanceProvider("10.1.1.1", "",
+		[]string{"2001:db8::1"}, "rack-1")
+	require.Nil(t, err, "static")
+	info, err = static.InstanceInfo(ctx)
+	require.Nil(t, err, "static")
+	assert.Equal(t, "10.1.1.1", info.LocalIp.String())
+	assert.Nil(t, info.PublicIp, "no public ip")
+	assert.Equal(t, "2001:db8::1", info.Ipv6[0].String())
+	assert.Equal(t, "rack-1", info.Ns)
+	_, err = NewStaticInstanceProvider("not-an-ip", "", nil, "rack-1")
+	assert.True(t, IsBadRequest(err), "invalid ip")
+	_, err = NewStaticInstanceProvider("10.1.1.1", "", []string{"10.1.1.2"},
+		"rack-1")
+	assert.True(t, IsBadRequest(err), "ipv4 as ipv6")
+}
+
+func TestInstanceProviderDetection(t *testing.T) {
+	ctx := context.Background()
+	azure, azureAddr := standIn(azureStandIn)
+	defer azure.Close()
+	fake, server := StartFakeServer()
+	defer server.Close()
+
+	/// the azure server is neither GCE's nor EC2's, and the metadata service
+	/// not asked
+	auto := NewAutoInstanceProvider(time.Second,
+		NewGCPInstanceProvider(azureAddr),
+		NewAWSInstanceProvider(azureAddr, ImdsOptional),
+		NewAzureInstanceProvider(azureAddr),
+		NewMetadataInstanceProvider(WithContext(serverApi(server))))
+	assert.Equal(t, ProviderAuto, auto.Name())
+	info, err := auto.InstanceInfo(ctx)
+	require.Nil(t, err, "detected")
+	assert.Equal(t, ProviderAzure, auto.Name())
+	assert.Equal(t, "10.0.0.4", info.LocalIp.String())
+	assert.Equal(t, 0, fake.Calls(kViewNs), "metadata service not asked")
+
+	/// the fake server has no identity document, unlike EC2
+	auto = NewAutoInstanceProvider(time.Second,
+		NewAWSInstanceProvider(strings.TrimPrefix(server.URL, "http://"),
+			ImdsOptional),
+		NewMetadataInstanceProvider(WithContext(serverApi(server))))
+	info, err = auto.InstanceInfo(ctx)
+	require.Nil(t, err, "detected")
+	assert.Equal(t, ProviderOpenstack, auto.Name())
+	assert.Equal(t, fake.Ns, info.Ns)
+
+	_, err = NewAutoInstanceProvider(time.Second,
+		NewGCPInstanceProvider(azureAddr)).InstanceInfo(ctx)
+	assert.True(t, IsNotFound(err), "nothing detected")
+}
+
+// hangingProvider answers nothing until the caller gives up.
+type hangingProvider struct{}
+
+func (hangingProvider) Name() string {
+	return "hanging"
+}
+
+func (hangingProvider) InstanceInfo(ctx context.Context) (*InstanceInfo,
+	error) {
+	<-ctx.Done()
+	return nil, unavailable(ctx.Err())
+}
+
+func TestInstanceProviderProbeTimeout(t *testing.T) {
+	static, err := NewStaticInstanceProvider("10.1.1.1", "", nil, "rack-1")
+	require.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	/// the hanging cloud only takes its own share of the caller's second
+	auto := NewAutoInstanceProvider(300*time.Millisecond, hangingProvider{},
+		hangingProvider{}, static)
+	info, err := auto.InstanceInfo(ctx)
+	require.Nil(t, err, "detected after the hanging ones")
+	assert.Equal(t, ProviderStatic, auto.Name())
+	assert.Equal(t, "10.1.1.1", info.LocalIp.String())
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = NewAutoInstanceProvider(time.Second, hangingProvider{},
+		static).InstanceInfo(ctx)
+	assert.NotNil(t, err, "caller gave up")
+
+	start := time.Now()
+	_, err = NewTimeoutInstanceProvider(hangingProvider{},
+		100*time.Millisecond).InstanceInfo(context.Background())
+	assert.True(t, IsUnavailable(err), "timed out")
+	assert.WithinDuration(t, start, time.Now(), time.Second/2)
+}
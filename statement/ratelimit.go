@@ -0,0 +1,335 @@
+package statement
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+/// Client side rate limiting of metadata calls
+
+// TokenBucket lets rate calls per second through on average, and bursts of
+// up to burst calls. A call taking more tokens than available waits for them,
+// so callers are served in order. Unlimited if rate is 0.
+type TokenBucket struct {
+	rate   float64
+	burst  float64
+	lock   *sync.Mutex
+	tokens float64
+	last   time.Time
+	stats  BucketMetrics
+	now    func() time.Time
+	after  func(time.Duration) <-chan time.Time
+}
+
+// BucketMetrics counts the calls through a bucket, how many of them were
+// throttled, and how long they waited in total.
+type BucketMetrics struct {
+	Calls     int64
+	Throttled int64
+	Waited    time.Duration
+}
+
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		lock:   &sync.Mutex{},
+		tokens: float64(burst),
+		last:   time.Now(),
+		now:    time.Now,
+		after:  time.After,
+	}
+}
+
+// Wait blocks until n tokens are taken, or fails if ctx is done first. The
+// tokens of a caller giving up are given back.
+func (b *TokenBucket) Wait(ctx context.Context, n int) error {
+	b.lock.Lock()
+	b.stats.Calls++
+	if b.rate <= 0 {
+		b.lock.Unlock()
+		return nil
+	}
+	now := b.now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	/// tokens go negative if not enough, and the later callers wait for the
+	// debt to be paid as well
+	b.tokens -= float64(n)
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+		b.stats.Throttled++
+		b.stats.Waited += wait
+	}
+	b.lock.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	select {
+	case <-b.after(wait):
+		return nil
+	case <-ctx.Done():
+		b.lock.Lock()
+		b.tokens += float64(n)
+		b.lock.Unlock()
+		return unavailable(ctx.Err())
+	}
+}
+
+func (b *TokenBucket) Metrics() BucketMetrics {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.stats
+}
+
+type RateLimitMetrics struct {
+	Reads     BucketMetrics
+	Mutations BucketMetrics
+}
+
+// RateLimitedApi decorates a MetadataAPI with separate budgets for reads and
+// mutations. A batch takes one mutation token per mutation, since that is
+// what loads the server, batching only saves round trips. Calls waiting for
+// tokens fail once ctx is done.
+type RateLimitedApi struct {
+	ctx       context.Context
+	api       MetadataAPI
+	reads     *TokenBucket
+	mutations *TokenBucket
+}
+
+func NewRateLimitedApi(ctx context.Context, api MetadataAPI, reads,
+	mutations *TokenBucket) *RateLimitedApi {
+	return &RateLimitedApi{ctx: ctx, api: api, reads: reads,
+		mutations: mutations}
+}
+
+func (r *RateLimitedApi) Metrics() RateLimitMetrics {
+	return RateLimitMetrics{
+		Reads:     r.reads.Metrics(),
+		Mutations: r.mutations.Metrics(),
+	}
+}
+
+func (r *RateLimitedApi) read() error {
+	return r.reads.Wait(r.ctx, 1)
+}
+
+func (r *RateLimitedApi) mutate() error {
+	return r.mutations.Wait(r.ctx, 1)
+}
+
+func (r *RateLimitedApi) UploadVmImage(name, location, gitrepo, rev,
+	format string, encoded bool) error {
+	if err := r.mutate(); err != nil {
+		return err
+	}
+	return r.api.UploadVmImage(name, location, gitrepo, rev, format, encoded)
+}
+
+func (r *RateLimitedApi) MyId() (string, error) {
+	if err := r.read(); err != nil {
+		return "", err
+	}
+	return r.api.MyId()
+}
+
+func (r *RateLimitedApi) MyNs() (string, error) {
+	if err := r.read(); err != nil {
+		return "", err
+	}
+	return r.api.MyNs()
+}
+
+func (r *RateLimitedApi) CreatePrincipal(name string) error {
+	if err := r.mutate(); err != nil {
+		return err
+	}
+	return r.api.CreatePrincipal(name)
+}
+
+func (r *RateLimitedApi) ListPrincipals() (map[string]Principal, error) {
+	if err := r.read(); err != nil {
+		return nil, err
+	}
+	return r.api.ListPrincipals()
+}
+
+func (r *RateLimitedApi) ShowPrincipal(target string) (*Principal, error) {
+	if err := r.read(); err != nil {
+		return nil, err
+	}
+	return r.api.ShowPrincipal(target)
+}
+
+func (r *RateLimitedApi) DeletePrincipal(name string) error {
+	if err := r.mutate(); err != nil {
+		return err
+	}
+	return r.api.DeletePrincipal(name)
+}
+
+func (r *RateLimitedApi) CreateNs(name string) error {
+	if err := r.mutate(); err != nil {
+		return err
+	}
+	return r.api.CreateNs(name)
+}
+
+func (r *RateLimitedApi) JoinNs(name string) error {
+	if err := r.mutate(); err != nil {
+		return err
+	}
+	return r.api.JoinNs(name)
+}
+
+func (r *RateLimitedApi) LeaveNs(name string) error {
+	if err := r.mutate(); err != nil {
+		return err
+	}
+	return r.api.LeaveNs(name)
+}
+
+func (r *RateLimitedApi) DeleteNs(name string) error {
+	if err := r.mutate(); err != nil {
+		return err
+	}
+	return r.api.DeleteNs(name)
+}
+
+func (r *RateLimitedApi) CreateIPAlias(name string, ns string, ip net.IP) error {
+	if err := r.mutate(); err != nil {
+		return err
+	}
+	return r.api.CreateIPAlias(name, ns, ip)
+}
+
+func (r *RateLimitedApi) DeleteIPAlias(name string, ns string, ip net.IP) error {
+	if err := r.mutate(); err != nil {
+		return err
+	}
+	return r.api.DeleteIPAlias(name, ns, ip)
+}
+
+func (r *RateLimitedApi) CreatePortAlias(name string, ns string, ip net.IP,
+	protocol string, portMin, portMax int) error {
+	if err := r.mutate(); err != nil {
+		return err
+	}
+	return r.api.CreatePortAlias(name, ns, ip, protocol, portMin, portMax)
+}
+
+func (r *RateLimitedApi) DeletePortAlias(name string, ns string, ip net.IP,
+	protocol string, portMin, portMax int) error {
+	if err := r.mutate(); err != nil {
+		return err
+	}
+	return r.api.DeletePortAlias(name, ns, ip, protocol, portMin, portMax)
+}
+
+func (r *RateLimitedApi) PostProof(target string, statements []Statement) error {
+	if err := r.mutate(); err != nil {
+		return err
+	}
+	return r.api.PostProof(target, statements)
+}
+
+func (r *RateLimitedApi) PostProofForChild(target string,
+	statements []Statement) error {
+	if err := r.mutate(); err != nil {
+		return err
+	}
+	return r.api.PostProofForChild(target, statements)
+}
+
+func (r *RateLimitedApi) LinkProof(target string, dependencies []string) error {
+	if err := r.mutate(); err != nil {
+		return err
+	}
+	return r.api.LinkProof(target, dependencies)
+}
+
+func (r *RateLimitedApi) LinkProofForChild(target string,
+	dependencies []string) error {
+	if err := r.mutate(); err != nil {
+		return err
+	}
+	return r.api.LinkProofForChild(target, dependencies)
+}
+
+func (r *RateLimitedApi) RemoveProofForChild(target string,
+	statements []Statement) error {
+	if err := r.mutate(); err != nil {
+		return err
+	}
+	return r.api.RemoveProofForChild(target, statements)
+}
+
+func (r *RateLimitedApi) UnlinkProofForChild(target string,
+	dependencies []string) error {
+	if err := r.mutate(); err != nil {
+		return err
+	}
+	return r.api.UnlinkProofForChild(target, dependencies)
+}
+
+func (r *RateLimitedApi) SelfCertify(statements []Statement) error {
+	if err := r.mutate(); err != nil {
+		return err
+	}
+	return r.api.SelfCertify(statements)
+}
+
+func (r *RateLimitedApi) PostNsProof(ns string, statements []Statement) error {
+	if err := r.mutate(); err != nil {
+		return err
+	}
+	return r.api.PostNsProof(ns, statements)
+}
+
+func (r *RateLimitedApi) RemoveNsProof(ns string,
+	statements []Statement) error {
+	if err := r.mutate(); err != nil {
+		return err
+	}
+	return r.api.RemoveNsProof(ns, statements)
+}
+
+func (r *RateLimitedApi) ListNsProofs(ns string) ([]EndorsedStatement, error) {
+	if err := r.read(); err != nil {
+		return nil, err
+	}
+	return r.api.ListNsProofs(ns)
+}
+
+func (r *RateLimitedApi) Batch(mutations []Mutation) []error {
+	if len(mutations) > 0 {
+		if err := r.mutations.Wait(r.ctx, len(mutations)); err != nil {
+			return batchFailed(len(mutations), err)
+		}
+	}
+	return r.api.Batch(mutations)
+}
+
+func (r *RateLimitedApi) MyLocalIp() (string, error) {
+	if err := r.read(); err != nil {
+		return "", err
+	}
+	return r.api.MyLocalIp()
+}
+
+func (r *RateLimitedApi) MyPublicIp() (string, error) {
+	if err := r.read(); err != nil {
+		return "", err
+	}
+	return r.api.MyPublicIp()
+}
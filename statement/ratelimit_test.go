@@ -0,0 +1,92 @@
+package statement
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestBucket(rate float64, burst int) (*TokenBucket, *[]time.Duration,
+	*time.Time) {
+	b := NewTokenBucket(rate, burst)
+	slept := []time.Duration{}
+	now := time.Now()
+	b.last = now
+	b.now = func() time.Time { return now }
+	b.after = func(d time.Duration) <-chan time.Time {
+		slept = append(slept, d)
+		return time.After(0)
+	}
+	return b, &slept, &now
+}
+
+func TestTokenBucket(t *testing.T) {
+	ctx := context.Background()
+	b, slept, now := newTestBucket(10, 2)
+	b.Wait(ctx, 1)
+	b.Wait(ctx, 1)
+	assert.Empty(t, *slept, "burst not throttled")
+	b.Wait(ctx, 1)
+	b.Wait(ctx, 1)
+	assert.Equal(t, []time.Duration{100 * time.Millisecond,
+		200 * time.Millisecond}, *slept, "waiting for the debt")
+
+	*now = now.Add(time.Hour)
+	b.Wait(ctx, 5)
+	assert.Equal(t, 300*time.Millisecond, (*slept)[2], "more than the burst")
+	assert.Equal(t, BucketMetrics{Calls: 5, Throttled: 3,
+		Waited: 600 * time.Millisecond}, b.Metrics(), "metrics")
+
+	unlimited, slept, _ := newTestBucket(0, 0)
+	for i := 0; i < 100; i++ {
+		unlimited.Wait(ctx, 1)
+	}
+	assert.Empty(t, *slept, "unlimited")
+	assert.Equal(t, int64(100), unlimited.Metrics().Calls, "calls counted")
+}
+
+func TestTokenBucketCancel(t *testing.T) {
+	b, _, _ := newTestBucket(1, 1)
+	b.after = func(d time.Duration) <-chan time.Time { return nil }
+	ctx, cancel := context.WithCancel(context.Background())
+	require.Nil(t, b.Wait(ctx, 1), "burst")
+
+	done := make(chan error)
+	go func() { done <- b.Wait(ctx, 1) }()
+	cancel()
+	select {
+	case err := <-done:
+		assert.True(t, IsUnavailable(err), "gave up")
+	case <-time.After(time.Second):
+		t.Fatal("still waiting after cancel")
+	}
+	assert.Equal(t, 0.0, b.tokens, "tokens given back")
+
+	r := NewRateLimitedApi(ctx, NewStubApi(t), b, b)
+	_, err := r.ShowPrincipal("regular")
+	assert.True(t, IsUnavailable(err), "read given up")
+	errs := r.Batch([]Mutation{CreateNsMutation("ns1")})
+	assert.True(t, IsUnavailable(errs[0]), "batch given up")
+}
+
+func TestRateLimitedApi(t *testing.T) {
+	reads, _, _ := newTestBucket(1, 1)
+	mutations, _, _ := newTestBucket(1, 1)
+	r := NewRateLimitedApi(context.Background(), NewStubApi(t), reads,
+		mutations)
+
+	r.ShowPrincipal("regular")
+	r.ListPrincipals()
+	r.CreatePrincipal("p1")
+	r.Batch([]Mutation{CreateNsMutation("ns1"), DeleteNsMutation("ns1")})
+
+	metrics := r.Metrics()
+	assert.Equal(t, int64(2), metrics.Reads.Calls, "reads")
+	assert.Equal(t, int64(1), metrics.Reads.Throttled, "reads throttled")
+	assert.Equal(t, int64(2), metrics.Mutations.Calls, "mutation calls")
+	assert.Equal(t, 2*time.Second, metrics.Mutations.Waited,
+		"one token per batched mutation")
+}
@@ -0,0 +1,727 @@
+package statement
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+/// Recording metadata API traffic, and replaying it
+
+// RecordedError is an error returned by a recorded call.
+type RecordedError struct {
+	Kind   string `json:"kind"`
+	Status int    `json:"status,omitempty"`
+	Msg    string `json:"msg"`
+}
+
+func recordError(err error) *RecordedError {
+	if err == nil {
+		return nil
+	}
+	if apiErr, ok := err.(*ApiError); ok {
+		return &RecordedError{Kind: apiErr.Kind.String(), Status: apiErr.Status,
+			Msg: apiErr.Msg}
+	}
+	return &RecordedError{Kind: ErrUnknown.String(), Msg: err.Error()}
+}
+
+// Err gives back the error as an *ApiError, nil for no error.
+func (e *RecordedError) Err() error {
+	if e == nil {
+		return nil
+	}
+	kind := ErrUnknown
+	for k := ErrUnknown; k <= ErrBadRequest; k++ {
+		if k.String() == e.Kind {
+			kind = k
+		}
+	}
+	return &ApiError{Kind: kind, Status: e.Status, Msg: e.Msg}
+}
+
+// RecordedCall is one line of a recording. Args is the JSON array of the
+// arguments of Method, Result its return value besides the error. Errors are
+// the results of a Batch.
+type RecordedCall struct {
+	Seq    int              `json:"seq"`
+	Time   time.Time        `json:"time"`
+	Method string           `json:"method"`
+	Args   json.RawMessage  `json:"args"`
+	Result json.RawMessage  `json:"result,omitempty"`
+	Error  *RecordedError   `json:"error,omitempty"`
+	Errors []*RecordedError `json:"errors,omitempty"`
+}
+
+func encodeArgs(args []interface{}) json.RawMessage {
+	if args == nil {
+		args = []interface{}{}
+	}
+	data, err := json.Marshal(args)
+	if err != nil {
+		log.Errorf("encoding recorded arguments: %v", err)
+	}
+	return data
+}
+
+// decodeArgs decodes the arguments of a call into the pointers.
+func (c *RecordedCall) decodeArgs(ptrs ...interface{}) error {
+	var args []json.RawMessage
+	if err := json.Unmarshal(c.Args, &args); err != nil {
+		return err
+	}
+	if len(args) != len(ptrs) {
+		return fmt.Errorf("%s recorded with %d arguments, expecting %d",
+			c.Method, len(args), len(ptrs))
+	}
+	for i, arg := range args {
+		if err := json.Unmarshal(arg, ptrs[i]); err != nil {
+			return fmt.Errorf("argument %d of %s: %v", i, c.Method, err)
+		}
+	}
+	return nil
+}
+
+// Mutations gives the state changes made by the call, nil for reads and the
+// calls that can not be batched (UploadVmImage, SelfCertify).
+func (c *RecordedCall) Mutations() ([]Mutation, error) {
+	var (
+		name, ns, protocol string
+		ip                 net.IP
+		portMin, portMax   int
+		statements         []Statement
+		dependencies       []string
+		err                error
+		m                  Mutation
+	)
+	switch c.Method {
+	case "Batch":
+		var mutations []Mutation
+		err = c.decodeArgs(&mutations)
+		return mutations, err
+	case "CreatePrincipal", "DeletePrincipal":
+		err = c.decodeArgs(&name)
+		m = Mutation{Principal: name}
+	case "CreateNs", "JoinNs", "LeaveNs", "DeleteNs":
+		err = c.decodeArgs(&ns)
+		m = Mutation{NsName: ns}
+	case "CreateIPAlias", "DeleteIPAlias":
+		err = c.decodeArgs(&name, &ns, &ip)
+		m = Mutation{Principal: name, NsName: ns, Ip: ip.String()}
+	case "CreatePortAlias", "DeletePortAlias":
+		err = c.decodeArgs(&name, &ns, &ip, &protocol, &portMin, &portMax)
+		m = Mutation{Principal: name, NsName: ns, Ip: ip.String(),
+			Protocol: protocol, PortMin: portMin, PortMax: portMax}
+	case "PostProof", "PostProofForChild", "RemoveProofForChild":
+		err = c.decodeArgs(&name, &statements)
+		m = Mutation{Target: name, Statements: statements}
+	case "PostNsProof", "RemoveNsProof":
+		err = c.decodeArgs(&ns, &statements)
+		m = Mutation{NsName: ns, Statements: statements}
+	case "LinkProof", "LinkProofForChild", "UnlinkProofForChild":
+		err = c.decodeArgs(&name, &dependencies)
+		m = Mutation{Target: name, Dependencies: dependencies}
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m.Op = mutationOps[c.Method]
+	return []Mutation{m}, nil
+}
+
+var mutationOps = map[string]string{
+	"CreatePrincipal":     opName(kCreatePrincipal),
+	"DeletePrincipal":     opName(kDeletePrincipal),
+	"CreateNs":            opName(kCreateNs),
+	"JoinNs":              opName(kJoinNs),
+	"LeaveNs":             opName(kLeaveNs),
+	"DeleteNs":            opName(kDeleteNs),
+	"CreateIPAlias":       opName(kCreateIPAlias),
+	"DeleteIPAlias":       opName(kDeleteIPAlias),
+	"CreatePortAlias":     opName(kCreatePortAlias),
+	"DeletePortAlias":     opName(kDeletePortAlias),
+	"PostProof":           opName(kPostProof),
+	"PostProofForChild":   opName(kPostProofForChild),
+	"RemoveProofForChild": opName(kRemoveProofForChild),
+	"PostNsProof":         opName(kPostNsProof),
+	"RemoveNsProof":       opName(kRemoveNsProof),
+	"LinkProof":           opName(kLinkProof),
+	"LinkProofForChild":   opName(kLinkProofForChild),
+	"UnlinkProofForChild": opName(kUnlinkProofForChild),
+}
+
+// isRead tells the calls not changing the server state.
+func isRead(method string) bool {
+	switch method {
+	case "MyId", "MyNs", "ListPrincipals", "ShowPrincipal", "ListNsProofs",
+		"MyLocalIp", "MyPublicIp":
+		return true
+	}
+	return false
+}
+
+// Mutations lists the state changes of a session in order, to compare the
+// mutations made by different builds for the same traffic. Builds may order
+// independent mutations differently, e.g. the aliases of a container.
+func Mutations(calls []RecordedCall) ([]Mutation, error) {
+	result := make([]Mutation, 0, len(calls))
+	for i := range calls {
+		mutations, err := calls[i].Mutations()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, mutations...)
+	}
+	return result, nil
+}
+
+// LoadRecording reads the JSON lines written by a RecordingApi.
+func LoadRecording(r io.Reader) ([]RecordedCall, error) {
+	calls := make([]RecordedCall, 0)
+	scanner := bufio.NewScanner(r)
+	// a principal list may be long
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var c RecordedCall
+		if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			return nil, fmt.Errorf("recording line %d: %v", line, err)
+		}
+		calls = append(calls, c)
+	}
+	return calls, scanner.Err()
+}
+
+// RecordingApi decorates a MetadataAPI to write every call, its arguments
+// and its result to w as a line of JSON. Calls are written in the order they
+// return.
+type RecordingApi struct {
+	api     MetadataAPI
+	lock    *sync.Mutex
+	encoder *json.Encoder
+	seq     int
+	now     func() time.Time
+}
+
+func NewRecordingApi(api MetadataAPI, w io.Writer) *RecordingApi {
+	return &RecordingApi{
+		api:     api,
+		lock:    &sync.Mutex{},
+		encoder: json.NewEncoder(w),
+		now:     time.Now,
+	}
+}
+
+func (r *RecordingApi) record(method string, args []interface{},
+	result interface{}, err error) {
+	c := RecordedCall{
+		Method: method,
+		Args:   encodeArgs(args),
+		Error:  recordError(err),
+	}
+	if result != nil && err == nil {
+		data, err := json.Marshal(result)
+		if err != nil {
+			log.Errorf("encoding recorded result of %s: %v", method, err)
+		}
+		c.Result = data
+	}
+	r.write(&c)
+}
+
+func (r *RecordingApi) write(c *RecordedCall) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.seq++
+	c.Seq = r.seq
+	c.Time = r.now()
+	if err := r.encoder.Encode(c); err != nil {
+		log.Errorf("recording %s: %v", c.Method, err)
+	}
+}
+
+func (r *RecordingApi) UploadVmImage(name, location, gitrepo, rev,
+	format string, encoded bool) error {
+	err := r.api.UploadVmImage(name, location, gitrepo, rev, format, encoded)
+	r.record("UploadVmImage", []interface{}{name, location, gitrepo, rev,
+		format, encoded}, nil, err)
+	return err
+}
+
+func (r *RecordingApi) MyId() (string, error) {
+	id, err := r.api.MyId()
+	r.record("MyId", []interface{}{}, id, err)
+	return id, err
+}
+
+func (r *RecordingApi) MyNs() (string, error) {
+	ns, err := r.api.MyNs()
+	r.record("MyNs", []interface{}{}, ns, err)
+	return ns, err
+}
+
+func (r *RecordingApi) CreatePrincipal(name string) error {
+	err := r.api.CreatePrincipal(name)
+	r.record("CreatePrincipal", []interface{}{name}, nil, err)
+	return err
+}
+
+func (r *RecordingApi) ListPrincipals() (map[string]Principal, error) {
+	principals, err := r.api.ListPrincipals()
+	r.record("ListPrincipals", []interface{}{}, principals, err)
+	return principals, err
+}
+
+func (r *RecordingApi) ShowPrincipal(target string) (*Principal, error) {
+	p, err := r.api.ShowPrincipal(target)
+	r.record("ShowPrincipal", []interface{}{target}, p, err)
+	return p, err
+}
+
+func (r *RecordingApi) DeletePrincipal(name string) error {
+	err := r.api.DeletePrincipal(name)
+	r.record("DeletePrincipal", []interface{}{name}, nil, err)
+	return err
+}
+
+func (r *RecordingApi) CreateNs(name string) error {
+	err := r.api.CreateNs(name)
+	r.record("CreateNs", []interface{}{name}, nil, err)
+	return err
+}
+
+func (r *RecordingApi) JoinNs(name string) error {
+	err := r.api.JoinNs(name)
+	r.record("JoinNs", []interface{}{name}, nil, err)
+	return err
+}
+
+func (r *RecordingApi) LeaveNs(name string) error {
+	err := r.api.LeaveNs(name)
+	r.record("LeaveNs", []interface{}{name}, nil, err)
+	return err
+}
+
+func (r *RecordingApi) DeleteNs(name string) error {
+	err := r.api.DeleteNs(name)
+	r.record("DeleteNs", []interface{}{name}, nil, err)
+	return err
+}
+
+func (r *RecordingApi) CreateIPAlias(name string, ns string, ip net.IP) error {
+	err := r.api.CreateIPAlias(name, ns, ip)
+	r.record("CreateIPAlias", []interface{}{name, ns, ip}, nil, err)
+	return err
+}
+
+func (r *RecordingApi) DeleteIPAlias(name string, ns string, ip net.IP) error {
+	err := r.api.DeleteIPAlias(name, ns, ip)
+	r.record("DeleteIPAlias", []interface{}{name, ns, ip}, nil, err)
+	return err
+}
+
+func (r *RecordingApi) CreatePortAlias(name string, ns string, ip net.IP,
+	protocol string, portMin, portMax int) error {
+	err := r.api.CreatePortAlias(name, ns, ip, protocol, portMin, portMax)
+	r.record("CreatePortAlias", []interface{}{name, ns, ip, protocol, portMin,
+		portMax}, nil, err)
+	return err
+}
+
+func (r *RecordingApi) DeletePortAlias(name string, ns string, ip net.IP,
+	protocol string, portMin, portMax int) error {
+	err := r.api.DeletePortAlias(name, ns, ip, protocol, portMin, portMax)
+	r.record("DeletePortAlias", []interface{}{name, ns, ip, protocol, portMin,
+		portMax}, nil, err)
+	return err
+}
+
+func (r *RecordingApi) PostProof(target string, statements []Statement) error {
+	err := r.api.PostProof(target, statements)
+	r.record("PostProof", []interface{}{target, statements}, nil, err)
+	return err
+}
+
+func (r *RecordingApi) PostProofForChild(target string,
+	statements []Statement) error {
+	err := r.api.PostProofForChild(target, statements)
+	r.record("PostProofForChild", []interface{}{target, statements}, nil, err)
+	return err
+}
+
+func (r *RecordingApi) LinkProof(target string, dependencies []string) error {
+	err := r.api.LinkProof(target, dependencies)
+	r.record("LinkProof", []interface{}{target, dependencies}, nil, err)
+	return err
+}
+
+func (r *RecordingApi) LinkProofForChild(target string,
+	dependencies []string) error {
+	err := r.api.LinkProofForChild(target, dependencies)
+	r.record("LinkProofForChild", []interface{}{target, dependencies}, nil, err)
+	return err
+}
+
+func (r *RecordingApi) RemoveProofForChild(target string,
+	statements []Statement) error {
+	err := r.api.RemoveProofForChild(target, statements)
+	r.record("RemoveProofForChild", []interface{}{target, statements}, nil, err)
+	return err
+}
+
+func (r *RecordingApi) UnlinkProofForChild(target string,
+	dependencies []string) error {
+	err := r.api.UnlinkProofForChild(target, dependencies)
+	r.record("UnlinkProofForChild", []interface{}{target, dependencies}, nil,
+		err)
+	return err
+}
+
+func (r *RecordingApi) SelfCertify(statements []Statement) error {
+	err := r.api.SelfCertify(statements)
+	r.record("SelfCertify", []interface{}{statements}, nil, err)
+	return err
+}
+
+func (r *RecordingApi) PostNsProof(ns string, statements []Statement) error {
+	err := r.api.PostNsProof(ns, statements)
+	r.record("PostNsProof", []interface{}{ns, statements}, nil, err)
+	return err
+}
+
+func (r *RecordingApi) RemoveNsProof(ns string, statements []Statement) error {
+	err := r.api.RemoveNsProof(ns, statements)
+	r.record("RemoveNsProof", []interface{}{ns, statements}, nil, err)
+	return err
+}
+
+func (r *RecordingApi) ListNsProofs(ns string) ([]EndorsedStatement, error) {
+	statements, err := r.api.ListNsProofs(ns)
+	r.record("ListNsProofs", []interface{}{ns}, statements, err)
+	return statements, err
+}
+
+func (r *RecordingApi) Batch(mutations []Mutation) []error {
+	errs := r.api.Batch(mutations)
+	c := RecordedCall{
+		Method: "Batch",
+		Args:   encodeArgs([]interface{}{mutations}),
+		Errors: make([]*RecordedError, len(errs)),
+	}
+	for i, err := range errs {
+		c.Errors[i] = recordError(err)
+	}
+	r.write(&c)
+	return errs
+}
+
+func (r *RecordingApi) MyLocalIp() (string, error) {
+	ip, err := r.api.MyLocalIp()
+	r.record("MyLocalIp", []interface{}{}, ip, err)
+	return ip, err
+}
+
+func (r *RecordingApi) MyPublicIp() (string, error) {
+	ip, err := r.api.MyPublicIp()
+	r.record("MyPublicIp", []interface{}{}, ip, err)
+	return ip, err
+}
+
+// ReplayApi serves a recorded session back. A call is answered with the
+// result recorded for the same method and arguments, in the recorded order,
+// and the last answer is repeated once they run out. Reads that were never
+// recorded fail, mutations never recorded succeed, so a build making other
+// mutations than the recorded one can still be replayed. A batch not
+// recorded as such is answered mutation by mutation.
+type ReplayApi struct {
+	lock      *sync.Mutex
+	answers   map[string][]RecordedCall
+	calls     []RecordedCall
+	unmatched int
+}
+
+func callKey(method string, args json.RawMessage) string {
+	return method + " " + string(args)
+}
+
+func NewReplayApi(recorded []RecordedCall) *ReplayApi {
+	p := &ReplayApi{
+		lock:    &sync.Mutex{},
+		answers: make(map[string][]RecordedCall),
+		calls:   make([]RecordedCall, 0, len(recorded)),
+	}
+	for _, c := range recorded {
+		key := callKey(c.Method, c.Args)
+		p.answers[key] = append(p.answers[key], c)
+		if c.Method != "Batch" {
+			continue
+		}
+		/// the mutations of a batch answer single calls as well, a build may
+		// batch them differently
+		mutations, err := c.Mutations()
+		if err != nil {
+			log.Errorf("replaying batch %d: %v", c.Seq, err)
+			continue
+		}
+		for i, m := range mutations {
+			method, args := mutationCall(m)
+			single := RecordedCall{Seq: c.Seq, Time: c.Time, Method: method,
+				Args: encodeArgs(args)}
+			if i < len(c.Errors) {
+				single.Error = c.Errors[i]
+			}
+			key := callKey(single.Method, single.Args)
+			p.answers[key] = append(p.answers[key], single)
+		}
+	}
+	return p
+}
+
+// mutationCall gives the method and arguments of the single call making the
+// mutation, the reverse of RecordedCall.Mutations.
+func mutationCall(m Mutation) (string, []interface{}) {
+	method := ""
+	for name, op := range mutationOps {
+		if op == m.Op {
+			method = name
+		}
+	}
+	switch method {
+	case "CreatePrincipal", "DeletePrincipal":
+		return method, []interface{}{m.Principal}
+	case "CreateNs", "JoinNs", "LeaveNs", "DeleteNs":
+		return method, []interface{}{m.NsName}
+	case "CreateIPAlias", "DeleteIPAlias":
+		return method, []interface{}{m.Principal, m.NsName, net.ParseIP(m.Ip)}
+	case "CreatePortAlias", "DeletePortAlias":
+		return method, []interface{}{m.Principal, m.NsName, net.ParseIP(m.Ip),
+			m.Protocol, m.PortMin, m.PortMax}
+	case "PostProof", "PostProofForChild", "RemoveProofForChild":
+		return method, []interface{}{m.Target, m.Statements}
+	case "PostNsProof", "RemoveNsProof":
+		return method, []interface{}{m.NsName, m.Statements}
+	}
+	return method, []interface{}{m.Target, m.Dependencies}
+}
+
+// Calls lists the calls made during the replay, with the answers given.
+func (p *ReplayApi) Calls() []RecordedCall {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]RecordedCall{}, p.calls...)
+}
+
+// Unmatched counts the calls made during the replay that were not recorded.
+func (p *ReplayApi) Unmatched() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.unmatched
+}
+
+// answer finds the recorded answer of the call and logs the call.
+func (p *ReplayApi) answer(method string, args []interface{}) (RecordedCall,
+	bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	c := RecordedCall{Method: method, Args: encodeArgs(args)}
+	key := callKey(method, c.Args)
+	queue := p.answers[key]
+	found := len(queue) > 0
+	if found {
+		c.Result, c.Error, c.Errors = queue[0].Result, queue[0].Error,
+			queue[0].Errors
+		if len(queue) > 1 {
+			p.answers[key] = queue[1:]
+		}
+	} else {
+		p.unmatched++
+		if !isRead(method) {
+			log.Debugf("replaying %s not recorded", key)
+		}
+	}
+	c.Seq = len(p.calls) + 1
+	p.calls = append(p.calls, c)
+	return c, found
+}
+
+func (p *ReplayApi) mutate(method string, args ...interface{}) error {
+	c, _ := p.answer(method, args)
+	return c.Error.Err()
+}
+
+// read decodes the recorded result into v.
+func (p *ReplayApi) read(v interface{}, method string,
+	args ...interface{}) error {
+	c, found := p.answer(method, args)
+	if !found {
+		return newError(ErrUnknown, "%s %s not recorded", method, c.Args)
+	}
+	if c.Error != nil {
+		return c.Error.Err()
+	}
+	return json.Unmarshal(c.Result, v)
+}
+
+func (p *ReplayApi) UploadVmImage(name, location, gitrepo, rev,
+	format string, encoded bool) error {
+	return p.mutate("UploadVmImage", name, location, gitrepo, rev, format,
+		encoded)
+}
+
+func (p *ReplayApi) MyId() (string, error) {
+	var id string
+	err := p.read(&id, "MyId")
+	return id, err
+}
+
+func (p *ReplayApi) MyNs() (string, error) {
+	var ns string
+	err := p.read(&ns, "MyNs")
+	return ns, err
+}
+
+func (p *ReplayApi) CreatePrincipal(name string) error {
+	return p.mutate("CreatePrincipal", name)
+}
+
+func (p *ReplayApi) ListPrincipals() (map[string]Principal, error) {
+	var principals map[string]Principal
+	if err := p.read(&principals, "ListPrincipals"); err != nil {
+		return nil, err
+	}
+	return principals, nil
+}
+
+func (p *ReplayApi) ShowPrincipal(target string) (*Principal, error) {
+	var principal *Principal
+	if err := p.read(&principal, "ShowPrincipal", target); err != nil {
+		return nil, err
+	}
+	return principal, nil
+}
+
+func (p *ReplayApi) DeletePrincipal(name string) error {
+	return p.mutate("DeletePrincipal", name)
+}
+
+func (p *ReplayApi) CreateNs(name string) error {
+	return p.mutate("CreateNs", name)
+}
+
+func (p *ReplayApi) JoinNs(name string) error {
+	return p.mutate("JoinNs", name)
+}
+
+func (p *ReplayApi) LeaveNs(name string) error {
+	return p.mutate("LeaveNs", name)
+}
+
+func (p *ReplayApi) DeleteNs(name string) error {
+	return p.mutate("DeleteNs", name)
+}
+
+func (p *ReplayApi) CreateIPAlias(name string, ns string, ip net.IP) error {
+	return p.mutate("CreateIPAlias", name, ns, ip)
+}
+
+func (p *ReplayApi) DeleteIPAlias(name string, ns string, ip net.IP) error {
+	return p.mutate("DeleteIPAlias", name, ns, ip)
+}
+
+func (p *ReplayApi) CreatePortAlias(name string, ns string, ip net.IP,
+	protocol string, portMin, portMax int) error {
+	return p.mutate("CreatePortAlias", name, ns, ip, protocol, portMin, portMax)
+}
+
+func (p *ReplayApi) DeletePortAlias(name string, ns string, ip net.IP,
+	protocol string, portMin, portMax int) error {
+	return p.mutate("DeletePortAlias", name, ns, ip, protocol, portMin, portMax)
+}
+
+func (p *ReplayApi) PostProof(target string, statements []Statement) error {
+	return p.mutate("PostProof", target, statements)
+}
+
+func (p *ReplayApi) PostProofForChild(target string,
+	statements []Statement) error {
+	return p.mutate("PostProofForChild", target, statements)
+}
+
+func (p *ReplayApi) LinkProof(target string, dependencies []string) error {
+	return p.mutate("LinkProof", target, dependencies)
+}
+
+func (p *ReplayApi) LinkProofForChild(target string,
+	dependencies []string) error {
+	return p.mutate("LinkProofForChild", target, dependencies)
+}
+
+func (p *ReplayApi) RemoveProofForChild(target string,
+	statements []Statement) error {
+	return p.mutate("RemoveProofForChild", target, statements)
+}
+
+func (p *ReplayApi) UnlinkProofForChild(target string,
+	dependencies []string) error {
+	return p.mutate("UnlinkProofForChild", target, dependencies)
+}
+
+func (p *ReplayApi) SelfCertify(statements []Statement) error {
+	return p.mutate("SelfCertify", statements)
+}
+
+func (p *ReplayApi) PostNsProof(ns string, statements []Statement) error {
+	return p.mutate("PostNsProof", ns, statements)
+}
+
+func (p *ReplayApi) RemoveNsProof(ns string, statements []Statement) error {
+	return p.mutate("RemoveNsProof", ns, statements)
+}
+
+func (p *ReplayApi) ListNsProofs(ns string) ([]EndorsedStatement, error) {
+	var statements []EndorsedStatement
+	if err := p.read(&statements, "ListNsProofs", ns); err != nil {
+		return nil, err
+	}
+	return statements, nil
+}
+
+func (p *ReplayApi) Batch(mutations []Mutation) []error {
+	p.lock.Lock()
+	key := callKey("Batch", encodeArgs([]interface{}{mutations}))
+	_, recorded := p.answers[key]
+	p.lock.Unlock()
+	if !recorded {
+		return ApplyMutations(p, mutations)
+	}
+	c, _ := p.answer("Batch", []interface{}{mutations})
+	errs := make([]error, len(mutations))
+	for i := range errs {
+		if i < len(c.Errors) {
+			errs[i] = c.Errors[i].Err()
+		}
+	}
+	return errs
+}
+
+func (p *ReplayApi) MyLocalIp() (string, error) {
+	var ip string
+	err := p.read(&ip, "MyLocalIp")
+	return ip, err
+}
+
+func (p *ReplayApi) MyPublicIp() (string, error) {
+	var ip string
+	err := p.read(&ip, "MyPublicIp")
+	return ip, err
+}
@@ -0,0 +1,77 @@
+package statement
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// a session against the fake, with some failing calls
+func recordSession(t *testing.T, api MetadataAPI) {
+	ip := net.ParseIP("10.0.0.1")
+	require.Nil(t, api.CreatePrincipal("p1"))
+	assert.NotNil(t, api.CreatePrincipal("p1"))
+	require.Nil(t, api.CreatePortAlias("p1", "default", ip, "tcp", 1000, 2000))
+	require.Nil(t, api.PostProofForChild("p1", []Statement{"fact"}))
+	_, err := api.ShowPrincipal("p1")
+	require.Nil(t, err)
+	errs := api.Batch([]Mutation{CreateIPAliasMutation("p1", "overlay", ip),
+		DeletePrincipalMutation("p2")})
+	require.Len(t, errs, 2)
+	_, err = api.ShowPrincipal("p2")
+	assert.True(t, IsNotFound(err))
+	require.Nil(t, api.DeletePrincipal("p1"))
+	_, err = api.ShowPrincipal("p1")
+	assert.True(t, IsNotFound(err))
+}
+
+func TestRecordReplay(t *testing.T) {
+	var buf bytes.Buffer
+	fake := NewFakeServer()
+	recorder := NewRecordingApi(NoContext(fake, context.Background(), 0), &buf)
+	recordSession(t, recorder)
+
+	recorded, err := LoadRecording(strings.NewReader(buf.String()))
+	require.Nil(t, err, "loading")
+	require.Len(t, recorded, 9, "one line per call")
+	assert.Equal(t, "CreatePrincipal", recorded[0].Method)
+	assert.Equal(t, ErrAlreadyExists.String(), recorded[1].Error.Kind)
+	assert.Nil(t, recorded[5].Errors[0], "batch result")
+	assert.True(t, IsNotFound(recorded[5].Errors[1].Err()), "batch result")
+
+	// the same session served by the replay alone
+	replay := NewReplayApi(recorded)
+	recordSession(t, replay)
+	assert.Equal(t, 0, replay.Unmatched(), "all calls recorded")
+	p, err := replay.ShowPrincipal("p1")
+	assert.True(t, IsNotFound(err), "last answer repeated")
+	assert.Nil(t, p)
+
+	want, err := Mutations(recorded)
+	require.Nil(t, err, "recorded mutations")
+	got, err := Mutations(replay.Calls())
+	require.Nil(t, err, "replayed mutations")
+	assert.Equal(t, want, got, "same mutations")
+	assert.Equal(t, CreatePortAliasMutation("p1", "default",
+		net.ParseIP("10.0.0.1"), "tcp", 1000, 2000), want[2])
+}
+
+func TestReplayUnrecorded(t *testing.T) {
+	replay := NewReplayApi([]RecordedCall{})
+	_, err := replay.MyId()
+	assert.NotNil(t, err, "read not recorded")
+	assert.Nil(t, replay.CreatePrincipal("p1"), "mutation not recorded")
+	errs := replay.Batch([]Mutation{CreatePrincipalMutation("p2")})
+	assert.Nil(t, errs[0], "batch applied mutation by mutation")
+	assert.Equal(t, 3, replay.Unmatched())
+
+	mutations, err := Mutations(replay.Calls())
+	require.Nil(t, err)
+	assert.Equal(t, []Mutation{CreatePrincipalMutation("p1"),
+		CreatePrincipalMutation("p2")}, mutations)
+}
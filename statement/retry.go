@@ -0,0 +1,402 @@
+package statement
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+/// Retries and circuit breaker around any MetadataAPI
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// RetryConfig tunes RetryApi. Only failures with the server unavailable are
+// retried, and only for idempotent calls. The breaker is disabled if
+// BreakerThreshold is 0.
+type RetryConfig struct {
+	Retries   int           // extra attempts of an idempotent call
+	BaseDelay time.Duration // wait before the first retry, doubled after
+	MaxDelay  time.Duration
+	// consecutive failures opening the breaker, and how long it stays open
+	// before a trial call is let through
+	BreakerThreshold int
+	BreakerTimeout   time.Duration
+}
+
+// RetryApi decorates a MetadataAPI with retries and a circuit breaker. While
+// the breaker is open calls fail right away with an ErrUnavailable error.
+// Once ctx is done calls backing off give up with their last error.
+type RetryApi struct {
+	ctx       context.Context
+	api       MetadataAPI
+	conf      RetryConfig
+	lock      *sync.Mutex
+	state     BreakerState
+	failures  int
+	openedAt  time.Time
+	trial     bool // a half-open trial call is in flight
+	listeners []func(BreakerState)
+	after     func(time.Duration) <-chan time.Time
+	now       func() time.Time
+}
+
+func NewRetryApi(ctx context.Context, api MetadataAPI,
+	conf RetryConfig) *RetryApi {
+	return &RetryApi{
+		ctx:   ctx,
+		api:   api,
+		conf:  conf,
+		lock:  &sync.Mutex{},
+		state: BreakerClosed,
+		after: time.After,
+		now:   time.Now,
+	}
+}
+
+// OnStateChange registers f to be called every time the breaker changes
+// state. f must not call back into the RetryApi.
+func (r *RetryApi) OnStateChange(f func(BreakerState)) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.listeners = append(r.listeners, f)
+}
+
+func (r *RetryApi) State() BreakerState {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.state
+}
+
+// must hold the lock, returns the listeners to notify once it is released
+func (r *RetryApi) setState(state BreakerState) []func(BreakerState) {
+	if r.state == state {
+		return nil
+	}
+	log.Infof("metadata api breaker %s -> %s", r.state, state)
+	r.state = state
+	if state == BreakerOpen {
+		r.openedAt = r.now()
+	}
+	return r.listeners
+}
+
+func notify(listeners []func(BreakerState), state BreakerState) {
+	for _, f := range listeners {
+		f(state)
+	}
+}
+
+// allow tells if a call can be made now.
+func (r *RetryApi) allow() bool {
+	r.lock.Lock()
+	var listeners []func(BreakerState)
+	allowed := true
+	switch r.state {
+	case BreakerOpen:
+		if r.now().Sub(r.openedAt) < r.conf.BreakerTimeout {
+			allowed = false
+			break
+		}
+		listeners = r.setState(BreakerHalfOpen)
+		r.trial = true
+	case BreakerHalfOpen:
+		if r.trial {
+			allowed = false
+		} else {
+			r.trial = true
+		}
+	}
+	state := r.state
+	r.lock.Unlock()
+	notify(listeners, state)
+	return allowed
+}
+
+// record counts the result of a call made.
+func (r *RetryApi) record(err error) {
+	r.lock.Lock()
+	var listeners []func(BreakerState)
+	failed := IsUnavailable(err)
+	switch {
+	case !failed:
+		r.failures = 0
+		listeners = r.setState(BreakerClosed)
+	case r.state == BreakerHalfOpen:
+		listeners = r.setState(BreakerOpen)
+	default:
+		r.failures++
+		if r.conf.BreakerThreshold > 0 &&
+			r.failures >= r.conf.BreakerThreshold {
+			listeners = r.setState(BreakerOpen)
+		}
+	}
+	r.trial = false
+	state := r.state
+	r.lock.Unlock()
+	notify(listeners, state)
+}
+
+// delay before the nth retry, with jitter so that many clients don't retry
+// in lock steps
+func (r *RetryApi) delay(n int) time.Duration {
+	d := r.conf.BaseDelay
+	for i := 1; i < n && d < r.conf.MaxDelay; i++ {
+		d *= 2
+	}
+	if r.conf.MaxDelay > 0 && d > r.conf.MaxDelay {
+		d = r.conf.MaxDelay
+	}
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+func (r *RetryApi) call(idempotent bool, f func() error) error {
+	attempts := 1
+	if idempotent {
+		attempts += r.conf.Retries
+	}
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			select {
+			case <-r.after(r.delay(i)):
+			case <-r.ctx.Done():
+				return err
+			}
+		}
+		if !r.allow() {
+			return &ApiError{Kind: ErrUnavailable, Msg: "circuit breaker open"}
+		}
+		err = f()
+		r.record(err)
+		if !IsUnavailable(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (r *RetryApi) UploadVmImage(name, location, gitrepo, rev, format string,
+	encoded bool) error {
+	return r.call(false, func() error {
+		return r.api.UploadVmImage(name, location, gitrepo, rev, format, encoded)
+	})
+}
+
+func (r *RetryApi) MyId() (result string, err error) {
+	err = r.call(true, func() (err error) {
+		result, err = r.api.MyId()
+		return err
+	})
+	return result, err
+}
+
+func (r *RetryApi) MyNs() (result string, err error) {
+	err = r.call(true, func() (err error) {
+		result, err = r.api.MyNs()
+		return err
+	})
+	return result, err
+}
+
+func (r *RetryApi) CreatePrincipal(name string) error {
+	return r.call(false, func() error {
+		return r.api.CreatePrincipal(name)
+	})
+}
+
+func (r *RetryApi) ListPrincipals() (result map[string]Principal, err error) {
+	err = r.call(true, func() (err error) {
+		result, err = r.api.ListPrincipals()
+		return err
+	})
+	return result, err
+}
+
+func (r *RetryApi) ShowPrincipal(target string) (result *Principal, err error) {
+	err = r.call(true, func() (err error) {
+		result, err = r.api.ShowPrincipal(target)
+		return err
+	})
+	return result, err
+}
+
+func (r *RetryApi) DeletePrincipal(name string) error {
+	return r.call(true, func() error {
+		return r.api.DeletePrincipal(name)
+	})
+}
+
+func (r *RetryApi) CreateNs(name string) error {
+	return r.call(false, func() error {
+		return r.api.CreateNs(name)
+	})
+}
+
+func (r *RetryApi) JoinNs(name string) error {
+	return r.call(false, func() error {
+		return r.api.JoinNs(name)
+	})
+}
+
+func (r *RetryApi) LeaveNs(name string) error {
+	return r.call(false, func() error {
+		return r.api.LeaveNs(name)
+	})
+}
+
+func (r *RetryApi) DeleteNs(name string) error {
+	return r.call(true, func() error {
+		return r.api.DeleteNs(name)
+	})
+}
+
+func (r *RetryApi) CreateIPAlias(name string, ns string, ip net.IP) error {
+	return r.call(false, func() error {
+		return r.api.CreateIPAlias(name, ns, ip)
+	})
+}
+
+func (r *RetryApi) DeleteIPAlias(name string, ns string, ip net.IP) error {
+	return r.call(true, func() error {
+		return r.api.DeleteIPAlias(name, ns, ip)
+	})
+}
+
+func (r *RetryApi) CreatePortAlias(name string, ns string, ip net.IP,
+	protocol string, portMin, portMax int) error {
+	return r.call(false, func() error {
+		return r.api.CreatePortAlias(name, ns, ip, protocol, portMin, portMax)
+	})
+}
+
+func (r *RetryApi) DeletePortAlias(name string, ns string, ip net.IP,
+	protocol string, portMin, portMax int) error {
+	return r.call(true, func() error {
+		return r.api.DeletePortAlias(name, ns, ip, protocol, portMin, portMax)
+	})
+}
+
+func (r *RetryApi) PostProof(target string, statements []Statement) error {
+	return r.call(false, func() error {
+		return r.api.PostProof(target, statements)
+	})
+}
+
+func (r *RetryApi) PostProofForChild(target string, statements []Statement) error {
+	return r.call(false, func() error {
+		return r.api.PostProofForChild(target, statements)
+	})
+}
+
+func (r *RetryApi) LinkProof(target string, dependencies []string) error {
+	return r.call(false, func() error {
+		return r.api.LinkProof(target, dependencies)
+	})
+}
+
+func (r *RetryApi) LinkProofForChild(target string, dependencies []string) error {
+	return r.call(false, func() error {
+		return r.api.LinkProofForChild(target, dependencies)
+	})
+}
+
+func (r *RetryApi) RemoveProofForChild(target string,
+	statements []Statement) error {
+	return r.call(true, func() error {
+		return r.api.RemoveProofForChild(target, statements)
+	})
+}
+
+func (r *RetryApi) UnlinkProofForChild(target string,
+	dependencies []string) error {
+	return r.call(true, func() error {
+		return r.api.UnlinkProofForChild(target, dependencies)
+	})
+}
+
+func (r *RetryApi) SelfCertify(statements []Statement) error {
+	return r.call(false, func() error {
+		return r.api.SelfCertify(statements)
+	})
+}
+
+func (r *RetryApi) PostNsProof(ns string, statements []Statement) error {
+	return r.call(false, func() error {
+		return r.api.PostNsProof(ns, statements)
+	})
+}
+
+func (r *RetryApi) RemoveNsProof(ns string, statements []Statement) error {
+	return r.call(true, func() error {
+		return r.api.RemoveNsProof(ns, statements)
+	})
+}
+
+func (r *RetryApi) ListNsProofs(ns string) (result []EndorsedStatement,
+	err error) {
+	err = r.call(true, func() (err error) {
+		result, err = r.api.ListNsProofs(ns)
+		return err
+	})
+	return result, err
+}
+
+// Batch is never retried as it mixes all kinds of mutations. It fails the
+// breaker if any mutation finds the server unavailable.
+func (r *RetryApi) Batch(mutations []Mutation) []error {
+	var results []error
+	err := r.call(false, func() error {
+		results = r.api.Batch(mutations)
+		for _, err := range results {
+			if IsUnavailable(err) {
+				return err
+			}
+		}
+		return nil
+	})
+	if results == nil {
+		return batchFailed(len(mutations), err)
+	}
+	return results
+}
+
+func (r *RetryApi) MyLocalIp() (result string, err error) {
+	err = r.call(true, func() (err error) {
+		result, err = r.api.MyLocalIp()
+		return err
+	})
+	return result, err
+}
+
+func (r *RetryApi) MyPublicIp() (result string, err error) {
+	err = r.call(true, func() (err error) {
+		result, err = r.api.MyPublicIp()
+		return err
+	})
+	return result, err
+}
@@ -0,0 +1,129 @@
+package statement
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyApi finds the server unavailable for the first fails calls
+type flakyApi struct {
+	*EmptyStubApi
+	fails int
+	calls int
+}
+
+func (f *flakyApi) result() error {
+	f.calls++
+	if f.calls <= f.fails {
+		return &ApiError{Kind: ErrUnavailable, Msg: "flaky"}
+	}
+	return nil
+}
+
+func (f *flakyApi) ShowPrincipal(target string) (*Principal, error) {
+	if err := f.result(); err != nil {
+		return nil, err
+	}
+	return NewPrincipal(), nil
+}
+
+func (f *flakyApi) CreatePrincipal(name string) error {
+	return f.result()
+}
+
+func newTestRetryApi(api MetadataAPI, conf RetryConfig) (*RetryApi,
+	*[]time.Duration, *time.Time) {
+	r := NewRetryApi(context.Background(), api, conf)
+	slept := []time.Duration{}
+	now := time.Now()
+	r.after = func(d time.Duration) <-chan time.Time {
+		slept = append(slept, d)
+		c := make(chan time.Time, 1)
+		c <- now
+		return c
+	}
+	r.now = func() time.Time { return now }
+	return r, &slept, &now
+}
+
+func TestRetryIdempotent(t *testing.T) {
+	flaky := &flakyApi{fails: 2}
+	r, slept, _ := newTestRetryApi(flaky, RetryConfig{Retries: 3,
+		BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second})
+
+	p, err := r.ShowPrincipal("p1")
+	assert.Nil(t, err, "succeeds after retries")
+	assert.NotNil(t, p, "principal shown")
+	assert.Equal(t, 3, flaky.calls, "two retries")
+	if assert.Len(t, *slept, 2, "backing off between attempts") {
+		assert.True(t, (*slept)[0] >= 50*time.Millisecond &&
+			(*slept)[0] < 100*time.Millisecond, "first delay with jitter")
+		assert.True(t, (*slept)[1] >= 100*time.Millisecond &&
+			(*slept)[1] < 200*time.Millisecond, "second delay doubled")
+	}
+
+	flaky = &flakyApi{fails: 2}
+	r, _, _ = newTestRetryApi(flaky, RetryConfig{Retries: 3})
+	assert.True(t, IsUnavailable(r.CreatePrincipal("p1")), "not retried")
+	assert.Equal(t, 1, flaky.calls, "one attempt")
+}
+
+func TestRetryCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	flaky := &flakyApi{fails: 2}
+	r := NewRetryApi(ctx, flaky, RetryConfig{Retries: 3,
+		BaseDelay: time.Hour, MaxDelay: time.Hour})
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.ShowPrincipal("p1")
+		done <- err
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		assert.True(t, IsUnavailable(err), "last error returned")
+	case <-time.After(5 * time.Second):
+		t.Fatal("backoff not interrupted")
+	}
+	assert.Equal(t, 1, flaky.calls, "no retry once cancelled")
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	flaky := &flakyApi{fails: 3}
+	r, _, now := newTestRetryApi(flaky, RetryConfig{BreakerThreshold: 2,
+		BreakerTimeout: time.Minute})
+	states := []BreakerState{}
+	r.OnStateChange(func(s BreakerState) { states = append(states, s) })
+
+	r.CreatePrincipal("p1")
+	assert.Equal(t, BreakerClosed, r.State(), "below threshold")
+	r.CreatePrincipal("p1")
+	assert.Equal(t, BreakerOpen, r.State(), "threshold reached")
+	assert.True(t, IsUnavailable(r.CreatePrincipal("p1")), "failing fast")
+	assert.Equal(t, 2, flaky.calls, "no call while open")
+
+	*now = now.Add(time.Minute)
+	r.CreatePrincipal("p1")
+	assert.Equal(t, BreakerOpen, r.State(), "trial call failed")
+	assert.Equal(t, 3, flaky.calls, "trial call made")
+
+	*now = now.Add(time.Minute)
+	assert.Nil(t, r.CreatePrincipal("p1"), "trial call succeeds")
+	assert.Equal(t, BreakerClosed, r.State(), "closed again")
+	assert.Equal(t, []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerOpen,
+		BreakerHalfOpen, BreakerClosed}, states, "state changes")
+}
+
+func TestRetryComposesWithStub(t *testing.T) {
+	r := NewRetryApi(context.Background(), NewStubApi(t),
+		RetryConfig{Retries: 2, BreakerThreshold: 1})
+	_, err := r.ShowPrincipal("nonexist")
+	assert.True(t, IsNotFound(err), "answers are passed through")
+	assert.Equal(t, BreakerClosed, r.State(), "not a server failure")
+	results := r.Batch([]Mutation{CreatePrincipalMutation("p1")})
+	assert.Equal(t, []error{nil}, results, "batch passed through")
+}
@@ -0,0 +1,268 @@
+package statement
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/// Signed metadata requests
+
+const (
+	SignHMAC    = "hmac-sha256"
+	SignEd25519 = "ed25519"
+
+	HeaderKeyId     = "X-Tapcon-Key-Id"
+	HeaderAlgorithm = "X-Tapcon-Signature-Algorithm"
+	HeaderTimestamp = "X-Tapcon-Timestamp"
+	HeaderNonce     = "X-Tapcon-Nonce"
+	HeaderSignature = "X-Tapcon-Signature"
+	HeaderDigest    = "X-Tapcon-Content-Sha256"
+
+	// how far the timestamp of a request may be from the server's clock
+	DefaultMaxSkew = 5 * time.Minute
+)
+
+// canonicalRequest is what gets signed: method, path, the query sorted by key
+// and value, timestamp, nonce and the digest of the body. The digest is empty
+// for bodies that can't be read twice, like uploaded images, version 1 puts
+// the parameters in the query anyway.
+func canonicalRequest(method, path string, query url.Values, timestamp,
+	nonce, digest string) []byte {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(query))
+	for _, k := range keys {
+		values := append([]string{}, query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, url.QueryEscape(k)+"="+url.QueryEscape(v))
+		}
+	}
+	return []byte(strings.Join([]string{method, path, strings.Join(pairs, "&"),
+		timestamp, nonce, digest}, "\n"))
+}
+
+func bodyDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// RequestSigner signs requests with the key of this host.
+type RequestSigner struct {
+	KeyId     string
+	algorithm string
+	hmacKey   []byte
+	edKey     ed25519.PrivateKey
+	now       func() time.Time
+}
+
+func NewHMACSigner(keyId string, key []byte) *RequestSigner {
+	return &RequestSigner{KeyId: keyId, algorithm: SignHMAC, hmacKey: key,
+		now: time.Now}
+}
+
+func NewEd25519Signer(keyId string, key ed25519.PrivateKey) *RequestSigner {
+	return &RequestSigner{KeyId: keyId, algorithm: SignEd25519, edKey: key,
+		now: time.Now}
+}
+
+// LoadRequestSigner reads the key from a file. A PEM encoded PKCS8 ed25519
+// private key is used for ed25519, anything else is taken as the HMAC secret.
+func LoadRequestSigner(keyId, path string) (*RequestSigner, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing signing key %s: %v", path, err)
+		}
+		edKey, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("signing key %s is not ed25519", path)
+		}
+		return NewEd25519Signer(keyId, edKey), nil
+	}
+	secret := []byte(strings.TrimSpace(string(data)))
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("empty signing key %s", path)
+	}
+	return NewHMACSigner(keyId, secret), nil
+}
+
+func (s *RequestSigner) Algorithm() string {
+	return s.algorithm
+}
+
+func (s *RequestSigner) sign(data []byte) []byte {
+	if s.algorithm == SignEd25519 {
+		return ed25519.Sign(s.edKey, data)
+	}
+	mac := hmac.New(sha256.New, s.hmacKey)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// Sign adds the signature headers to the request. The query must be final.
+func (s *RequestSigner) Sign(req *http.Request) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(s.now().Unix(), 10)
+	nonceStr := hex.EncodeToString(nonce)
+	digest := ""
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(body)
+		body.Close()
+		if err != nil {
+			return err
+		}
+		digest = bodyDigest(data)
+		req.Header.Set(HeaderDigest, digest)
+	}
+	signature := s.sign(canonicalRequest(req.Method, req.URL.Path,
+		req.URL.Query(), timestamp, nonceStr, digest))
+	req.Header.Set(HeaderKeyId, s.KeyId)
+	req.Header.Set(HeaderAlgorithm, s.algorithm)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderNonce, nonceStr)
+	req.Header.Set(HeaderSignature, base64.StdEncoding.EncodeToString(signature))
+	return nil
+}
+
+type verifyKey struct {
+	algorithm string
+	hmacKey   []byte
+	edKey     ed25519.PublicKey
+}
+
+// SignatureVerifier checks signed requests for the metadata server and the
+// test fakes. A request is accepted once: its nonce is remembered for as long
+// as its timestamp is within MaxSkew.
+type SignatureVerifier struct {
+	MaxSkew time.Duration
+	lock    *sync.Mutex
+	keys    map[string]verifyKey
+	seen    map[string]time.Time // nonce to when it can be forgotten
+	now     func() time.Time
+}
+
+func NewSignatureVerifier(maxSkew time.Duration) *SignatureVerifier {
+	return &SignatureVerifier{
+		MaxSkew: maxSkew,
+		lock:    &sync.Mutex{},
+		keys:    make(map[string]verifyKey),
+		seen:    make(map[string]time.Time),
+		now:     time.Now,
+	}
+}
+
+func (v *SignatureVerifier) AddHMACKey(keyId string, key []byte) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.keys[keyId] = verifyKey{algorithm: SignHMAC, hmacKey: key}
+}
+
+func (v *SignatureVerifier) AddEd25519Key(keyId string, key ed25519.PublicKey) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.keys[keyId] = verifyKey{algorithm: SignEd25519, edKey: key}
+}
+
+func unauthorized(format string, args ...interface{}) *ApiError {
+	return newError(ErrUnauthorized, format, args...)
+}
+
+// Verify returns an ErrUnauthorized error if the request is not signed by a
+// known key, is too old or too new, or replays an earlier request. A body
+// with a digest is read to check it, and left for the handler to read again.
+func (v *SignatureVerifier) Verify(req *http.Request) error {
+	keyId := req.Header.Get(HeaderKeyId)
+	timestamp := req.Header.Get(HeaderTimestamp)
+	nonce := req.Header.Get(HeaderNonce)
+	signature, err := base64.StdEncoding.DecodeString(
+		req.Header.Get(HeaderSignature))
+	if keyId == "" || timestamp == "" || nonce == "" || err != nil ||
+		len(signature) == 0 {
+		return unauthorized("request not signed")
+	}
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return unauthorized("bad timestamp %s", timestamp)
+	}
+	digest := req.Header.Get(HeaderDigest)
+	if digest != "" {
+		data, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return unavailable(err)
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(data))
+		if bodyDigest(data) != digest {
+			return unauthorized("body does not match its digest")
+		}
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	key, ok := v.keys[keyId]
+	if !ok {
+		return unauthorized("unknown key %s", keyId)
+	}
+	if alg := req.Header.Get(HeaderAlgorithm); alg != key.algorithm {
+		return unauthorized("key %s is not for %s", keyId, alg)
+	}
+	data := canonicalRequest(req.Method, req.URL.Path, req.URL.Query(),
+		timestamp, nonce, digest)
+	if key.algorithm == SignEd25519 {
+		ok = ed25519.Verify(key.edKey, data, signature)
+	} else {
+		mac := hmac.New(sha256.New, key.hmacKey)
+		mac.Write(data)
+		ok = hmac.Equal(mac.Sum(nil), signature)
+	}
+	if !ok {
+		return unauthorized("bad signature from %s", keyId)
+	}
+
+	now := v.now()
+	signed := time.Unix(secs, 0)
+	if signed.Before(now.Add(-v.MaxSkew)) || signed.After(now.Add(v.MaxSkew)) {
+		return unauthorized("request signed at %v, now %v", signed, now)
+	}
+	for n, expire := range v.seen {
+		if now.After(expire) {
+			delete(v.seen, n)
+		}
+	}
+	if _, replayed := v.seen[keyId+"/"+nonce]; replayed {
+		return unauthorized("replayed request from %s", keyId)
+	}
+	v.seen[keyId+"/"+nonce] = signed.Add(v.MaxSkew)
+	return nil
+}
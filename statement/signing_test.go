@@ -0,0 +1,149 @@
+package statement
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// a server answering 401 to requests failing verification
+func signedServer(v *SignatureVerifier) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if err := v.Verify(r); err != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprintf(w, "%v", err)
+				return
+			}
+			fmt.Fprintf(w, "true")
+		}))
+}
+
+func signedApi(server *httptest.Server, signer *RequestSigner) MetadataAPI {
+	api := NewOpenstackContextAPI(strings.TrimPrefix(server.URL, "http://"))
+	api.SetSigner(signer)
+	return NoContext(api, context.Background(), 0)
+}
+
+func TestSignedRequests(t *testing.T) {
+	v := NewSignatureVerifier(DefaultMaxSkew)
+	v.AddHMACKey("host1", []byte("secret"))
+	server := signedServer(v)
+	defer server.Close()
+
+	good := signedApi(server, NewHMACSigner("host1", []byte("secret")))
+	assert.Nil(t, good.CreatePortAlias("p1", "ns1", nil, "tcp", 1, 2),
+		"signed request")
+	bad := signedApi(server, NewHMACSigner("host1", []byte("guess")))
+	assert.True(t, IsUnauthorized(bad.CreatePrincipal("p1")), "wrong key")
+	unknown := signedApi(server, NewHMACSigner("host2", []byte("secret")))
+	assert.True(t, IsUnauthorized(unknown.CreatePrincipal("p1")), "unknown key")
+	unsigned := signedApi(server, nil)
+	assert.True(t, IsUnauthorized(unsigned.CreatePrincipal("p1")), "unsigned")
+}
+
+func newSignedRequest(t *testing.T, signer *RequestSigner,
+	query string) *http.Request {
+	req, err := http.NewRequest(http.MethodPost,
+		"http://127.0.0.1/openstack/latest/container_api/create_principal?"+
+			query, nil)
+	require.Nil(t, err, "building request")
+	require.Nil(t, signer.Sign(req), "signing request")
+	return req
+}
+
+func TestVerifyRejects(t *testing.T) {
+	v := NewSignatureVerifier(time.Minute)
+	v.AddHMACKey("host1", []byte("secret"))
+	signer := NewHMACSigner("host1", []byte("secret"))
+
+	req := newSignedRequest(t, signer, "principal=p1&ns_name=ns1")
+	assert.Nil(t, v.Verify(req), "first time")
+	assert.True(t, IsUnauthorized(v.Verify(req)), "replayed")
+
+	req = newSignedRequest(t, signer, "principal=p1")
+	req.URL.RawQuery = "principal=p2"
+	assert.True(t, IsUnauthorized(v.Verify(req)), "query changed")
+
+	req = newSignedRequest(t, signer, "ns_name=ns1&principal=p1")
+	req.URL.RawQuery = "principal=p1&ns_name=ns1"
+	assert.Nil(t, v.Verify(req), "query order does not matter")
+
+	signer.now = func() time.Time { return time.Now().Add(-time.Hour) }
+	req = newSignedRequest(t, signer, "principal=p1")
+	assert.True(t, IsUnauthorized(v.Verify(req)), "too old")
+}
+
+func TestSignedBody(t *testing.T) {
+	v := NewSignatureVerifier(DefaultMaxSkew)
+	v.AddHMACKey("host1", []byte("secret"))
+	signer := NewHMACSigner("host1", []byte("secret"))
+	newRequest := func() *http.Request {
+		req, err := http.NewRequest(http.MethodPost,
+			"http://127.0.0.1/openstack/latest/container_api/v2/self/proofs",
+			strings.NewReader(`{"statements":["fact"]}`))
+		require.Nil(t, err, "building request")
+		require.Nil(t, signer.Sign(req), "signing request")
+		return req
+	}
+
+	req := newRequest()
+	assert.Nil(t, v.Verify(req), "body signed")
+	body, err := ioutil.ReadAll(req.Body)
+	assert.Nil(t, err, "body left to read")
+	assert.Equal(t, `{"statements":["fact"]}`, string(body))
+
+	req = newRequest()
+	req.Body = ioutil.NopCloser(strings.NewReader(`{"statements":["lie"]}`))
+	assert.True(t, IsUnauthorized(v.Verify(req)), "body changed")
+	req = newRequest()
+	req.Header.Del(HeaderDigest)
+	assert.True(t, IsUnauthorized(v.Verify(req)), "digest removed")
+}
+
+func TestEd25519SigningKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tapcon-signing")
+	require.Nil(t, err, "temp dir")
+	defer os.RemoveAll(dir)
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err, "generating key")
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	require.Nil(t, err, "marshalling key")
+	keyPath := filepath.Join(dir, "host.pem")
+	require.Nil(t, ioutil.WriteFile(keyPath, pem.EncodeToMemory(
+		&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+	secretPath := filepath.Join(dir, "host.secret")
+	require.Nil(t, ioutil.WriteFile(secretPath, []byte("secret\n"), 0600))
+
+	signer, err := LoadRequestSigner("host1", keyPath)
+	require.Nil(t, err, "loading ed25519 key")
+	assert.Equal(t, SignEd25519, signer.Algorithm(), "ed25519 key")
+	hmacSigner, err := LoadRequestSigner("host2", secretPath)
+	require.Nil(t, err, "loading hmac secret")
+	assert.Equal(t, SignHMAC, hmacSigner.Algorithm(), "hmac secret")
+
+	v := NewSignatureVerifier(DefaultMaxSkew)
+	v.AddEd25519Key("host1", pub)
+	v.AddHMACKey("host2", []byte("secret"))
+	assert.Nil(t, v.Verify(newSignedRequest(t, signer, "principal=p1")),
+		"ed25519 signature")
+	assert.Nil(t, v.Verify(newSignedRequest(t, hmacSigner, "principal=p1")),
+		"hmac signature")
+	v.AddHMACKey("host1", []byte("secret"))
+	assert.True(t, IsUnauthorized(v.Verify(newSignedRequest(t, signer,
+		"principal=p1"))), "algorithm mismatch")
+}
@@ -111,11 +111,36 @@ func (s *EmptyStubApi) LinkProofForChild(cid string, links []string) error {
 	fmt.Printf("LinkProofForChild %s, %v\n", cid, links)
 	return nil
 }
+func (s *EmptyStubApi) RemoveProofForChild(cid string, statements []Statement) error {
+	fmt.Printf("RemoveProofForChild %s, %v\n", cid, statements)
+	return nil
+}
+
+func (s *EmptyStubApi) UnlinkProofForChild(cid string, links []string) error {
+	fmt.Printf("UnlinkProofForChild %s, %v\n", cid, links)
+	return nil
+}
+
 func (s *EmptyStubApi) SelfCertify(statements []Statement) error {
 	fmt.Printf("SelfCertify %v\n", statements)
 	return nil
 }
 
+func (s *EmptyStubApi) PostNsProof(ns string, statements []Statement) error {
+	fmt.Printf("PostNsProof %s %v\n", ns, statements)
+	return nil
+}
+
+func (s *EmptyStubApi) RemoveNsProof(ns string, statements []Statement) error {
+	fmt.Printf("RemoveNsProof %s %v\n", ns, statements)
+	return nil
+}
+
+func (s *EmptyStubApi) ListNsProofs(ns string) ([]EndorsedStatement, error) {
+	fmt.Printf("ListNsProofs %s\n", ns)
+	return []EndorsedStatement{}, nil
+}
+
 func (s *EmptyStubApi) MyLocalIp() (string, error) {
 	fmt.Printf("MyLocalIp\n")
 	return "192.168.0.1", nil
@@ -126,6 +151,11 @@ func (s *EmptyStubApi) MyPublicIp() (string, error) {
 	return "166.111.68.162", nil
 }
 
+func (s *EmptyStubApi) Batch(mutations []Mutation) []error {
+	fmt.Printf("Batch %v\n", mutations)
+	return ApplyMutations(s, mutations)
+}
+
 type CallArgs struct {
 	args []interface{}
 }
@@ -325,7 +355,7 @@ func (api *StubApi) CreatePrincipal(id string) error {
 	}
 
 	if _, ok := api.principals[id]; ok {
-		return fmt.Errorf("Principal %v has existed\n", id)
+		return alreadyExists("Principal %v has existed", id)
 	}
 
 	p := emptyPrincipal()
@@ -354,7 +384,7 @@ func (api *StubApi) ShowPrincipal(id string) (*Principal, error) {
 	} else if id == "regular" {
 		p = regularPrincipal()
 	} else {
-		return nil, fmt.Errorf("principal not found")
+		return nil, notFound("principal %s", id)
 	}
 	api.principals[id] = &p
 	copy := p
@@ -374,7 +404,7 @@ func (api *StubApi) DeletePrincipal(id string) error {
 		delete(api.principals, id)
 		return nil
 	} else {
-		return fmt.Errorf("can not delete: principal not found")
+		return notFound("can not delete: principal not found")
 	}
 
 }
@@ -398,7 +428,7 @@ func (api *StubApi) PostProofForChild(id string, statements []Statement) error {
 	ptr, ok := api.principals[id]
 
 	if !ok {
-		return fmt.Errorf("can not find principal %s\n", id)
+		return notFound("can not find principal %s", id)
 	}
 	for _, s := range statements {
 		ptr.Statements = append(ptr.Statements, EndorsedStatement{
@@ -415,7 +445,7 @@ func (api *StubApi) LinkProofForChild(id string, links []string) error {
 	ptr, ok := api.principals[id]
 
 	if !ok {
-		return fmt.Errorf("can not find principal %s\n", id)
+		return notFound("can not find principal %s", id)
 	}
 	for _, l := range links {
 		ptr.Links = append(ptr.Links, l)
@@ -423,17 +453,65 @@ func (api *StubApi) LinkProofForChild(id string, links []string) error {
 	return nil
 }
 
+func (api *StubApi) RemoveProofForChild(id string, statements []Statement) error {
+	dstarg := api.CopySlice(statements)
+	api.called("RemoveProofForChild", id, dstarg)
+	ptr, ok := api.principals[id]
+
+	if !ok {
+		return notFound("can not find principal %s", id)
+	}
+	for _, s := range statements {
+		found := -1
+		for i, stmt := range ptr.Statements {
+			if stmt.Fact == string(s) {
+				found = i
+				break
+			}
+		}
+		if found == -1 {
+			return notFound("can not find statement %s for %s", s, id)
+		}
+		ptr.Statements = append(ptr.Statements[0:found], ptr.Statements[found+1:]...)
+	}
+	return nil
+}
+
+func (api *StubApi) UnlinkProofForChild(id string, links []string) error {
+	dstarg := api.CopySlice(links)
+	api.called("UnlinkProofForChild", id, dstarg)
+	ptr, ok := api.principals[id]
+
+	if !ok {
+		return notFound("can not find principal %s", id)
+	}
+	for _, l := range links {
+		found := -1
+		for i, link := range ptr.Links {
+			if link == l {
+				found = i
+				break
+			}
+		}
+		if found == -1 {
+			return notFound("can not find link %s for %s", l, id)
+		}
+		ptr.Links = append(ptr.Links[0:found], ptr.Links[found+1:]...)
+	}
+	return nil
+}
+
 func (api *StubApi) CreateIPAlias(id string, ns string, ip net.IP) error {
 
 	api.called("CreateIpAlias", id, ns, ip.String())
 	ptr, ok := api.principals[id]
 
 	if !ok {
-		return fmt.Errorf("can not find principal %s\n", id)
+		return notFound("can not find principal %s", id)
 	}
 	for _, alias := range ptr.Aliases.Ips {
 		if alias.NsName == ns && alias.Ip == ip.String() {
-			return fmt.Errorf("ip alias %s %v existed for %s", ns, ip, id)
+			return alreadyExists("ip alias %s %v existed for %s", ns, ip, id)
 		}
 	}
 	ptr.Aliases.Ips = append(ptr.Aliases.Ips, IpAlias{ns, ip.String()})
@@ -445,7 +523,7 @@ func (api *StubApi) DeleteIPAlias(id string, ns string, ip net.IP) error {
 	ptr, ok := api.principals[id]
 
 	if !ok {
-		return fmt.Errorf("can not find principal %s\n", id)
+		return notFound("can not find principal %s", id)
 	}
 	found := -1
 	for i, alias := range ptr.Aliases.Ips {
@@ -455,7 +533,7 @@ func (api *StubApi) DeleteIPAlias(id string, ns string, ip net.IP) error {
 		}
 	}
 	if found == -1 {
-		return fmt.Errorf("can not find ip alias: %s %v for %s", ns, ip, id)
+		return notFound("can not find ip alias: %s %v for %s", ns, ip, id)
 	}
 	ptr.Aliases.Ips = append(ptr.Aliases.Ips[0:found], ptr.Aliases.Ips[found+1:]...)
 	return nil
@@ -468,7 +546,7 @@ func (api *StubApi) CreatePortAlias(id, ns string, ip net.IP, protocol string,
 	ptr, ok := api.principals[id]
 
 	if !ok {
-		return fmt.Errorf("can not find principal %s\n", id)
+		return notFound("can not find principal %s", id)
 	}
 	return ptr.AddPortAlias(ns, ip.String(), protocol, portMin, portMax)
 }
@@ -479,11 +557,31 @@ func (api *StubApi) DeletePortAlias(id, ns string, ip net.IP, protocol string,
 	ptr, ok := api.principals[id]
 
 	if !ok {
-		return fmt.Errorf("can not find principal %s\n", id)
+		return notFound("can not find principal %s", id)
 	}
 	return ptr.DelPortAlias(ns, ip.String(), protocol, portMin, portMax)
 }
 
+func (api *StubApi) PostNsProof(ns string, statements []Statement) error {
+	api.called("PostNsProof", ns, api.CopySlice(statements))
+	return nil
+}
+
+func (api *StubApi) RemoveNsProof(ns string, statements []Statement) error {
+	api.called("RemoveNsProof", ns, api.CopySlice(statements))
+	return nil
+}
+
+func (api *StubApi) ListNsProofs(ns string) ([]EndorsedStatement, error) {
+	api.called("ListNsProofs", ns)
+	return []EndorsedStatement{}, nil
+}
+
+func (api *StubApi) Batch(mutations []Mutation) []error {
+	api.called("Batch", len(mutations))
+	return ApplyMutations(api, mutations)
+}
+
 /// not a test case
 func NewStubApi(t *testing.T) MetadataAPI {
 	return &StubApi{
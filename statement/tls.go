@@ -0,0 +1,136 @@
+package statement
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+/// TLS and mutual TLS to the metadata service
+
+// TLSConfig locates the PEM files used to talk to the server. The server is
+// only trusted if its certificate is signed by CACert, and ClientCert and
+// ClientKey authenticate us to it, if given. The files are read again when
+// they change, so certificates can be rotated without a restart.
+type TLSConfig struct {
+	CACert     string
+	ClientCert string
+	ClientKey  string
+	// name in the server certificate, if not the host of the address
+	ServerName string
+}
+
+func NewOpenstackTLSContextAPI(addr string, conf TLSConfig) (*Api, error) {
+	certs := &certReloader{conf: conf, lock: &sync.Mutex{}}
+	tlsConfig, _, err := certs.reload()
+	if err != nil {
+		return nil, err
+	}
+	api := newApi(addr, "https", tlsConfig)
+	api.certs = certs
+	return api, nil
+}
+
+// NewOpenstackTLSMetadataAPI gives every call DefaultTimeout to finish.
+func NewOpenstackTLSMetadataAPI(addr string,
+	conf TLSConfig) (MetadataAPI, error) {
+	api, err := NewOpenstackTLSContextAPI(addr, conf)
+	if err != nil {
+		return nil, err
+	}
+	return NoContext(api, context.Background(), DefaultTimeout), nil
+}
+
+type certReloader struct {
+	conf  TLSConfig
+	lock  *sync.Mutex
+	stamp string // modification time and size of the files loaded
+}
+
+// stamp tells if any of the files changed, it is cheap enough to check on
+// every request.
+func (r *certReloader) fileStamp() (string, error) {
+	stamp := ""
+	for _, path := range []string{r.conf.CACert, r.conf.ClientCert,
+		r.conf.ClientKey} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		stamp += fmt.Sprintf("%s:%d:%d;", path, info.ModTime().UnixNano(),
+			info.Size())
+	}
+	return stamp, nil
+}
+
+// reload loads the files if they changed since the last time, and returns
+// the TLS config made out of them.
+func (r *certReloader) reload() (*tls.Config, bool, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	stamp, err := r.fileStamp()
+	if err != nil {
+		return nil, false, err
+	}
+	if stamp == r.stamp {
+		return nil, false, nil
+	}
+	conf := &tls.Config{ServerName: r.conf.ServerName}
+	if r.conf.CACert != "" {
+		data, err := ioutil.ReadFile(r.conf.CACert)
+		if err != nil {
+			return nil, false, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, false, fmt.Errorf("no certificate in %s",
+				r.conf.CACert)
+		}
+		conf.RootCAs = pool
+	}
+	if r.conf.ClientCert != "" || r.conf.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(r.conf.ClientCert, r.conf.ClientKey)
+		if err != nil {
+			return nil, false, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	r.stamp = stamp
+	return conf, true, nil
+}
+
+// httpClient returns the client to make a request with, rebuilt with the new
+// certificates if they are rotated. Connections made with the old ones are
+// closed once idle.
+func (api *Api) httpClient() *http.Client {
+	api.clientLock.Lock()
+	defer api.clientLock.Unlock()
+	if api.certs == nil {
+		return api.client
+	}
+	conf, changed, err := api.certs.reload()
+	if err != nil {
+		/// likely in the middle of a rotation, try again next time
+		log.Errorf("reloading metadata certificates, keep using the loaded: %v",
+			err)
+		return api.client
+	}
+	if changed {
+		log.Infof("metadata certificates changed, reloaded")
+		if old, ok := api.client.Transport.(*http.Transport); ok {
+			old.CloseIdleConnections()
+		}
+		api.client = newHttpClient(conf)
+	}
+	return api.client
+}
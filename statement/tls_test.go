@@ -0,0 +1,156 @@
+package statement
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// signed by parent, or self signed CA if parent is nil
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err, "generating key")
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer,
+		&key.PublicKey, signerKey)
+	require.Nil(t, err, "creating certificate")
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err, "parsing certificate")
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// write the certificate and key into dir, returning their paths
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	certPath := filepath.Join(dir, name+".pem")
+	keyPath := filepath.Join(dir, name+"-key.pem")
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	require.Nil(t, err, "marshalling key")
+	require.Nil(t, ioutil.WriteFile(certPath, pem.EncodeToMemory(
+		&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600))
+	require.Nil(t, ioutil.WriteFile(keyPath, pem.EncodeToMemory(
+		&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certPath, keyPath
+}
+
+// a server trusting client certificates signed by clientCA
+func newTLSServer(server, clientCA *testCert) *httptest.Server {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "true")
+		}))
+	pool := x509.NewCertPool()
+	pool.AddCert(clientCA.cert)
+	s.TLS = &tls.Config{
+		Certificates: []tls.Certificate{server.tlsCert()},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	s.StartTLS()
+	return s
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tapcon-tls")
+	require.Nil(t, err, "temp dir")
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", nil)
+	server := newTLSServer(newTestCert(t, "server", ca), ca)
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "https://")
+	caPath, _ := ca.write(t, dir, "ca")
+	certPath, keyPath := newTestCert(t, "client", ca).write(t, dir, "client")
+
+	tlsApi, err := NewOpenstackTLSMetadataAPI(addr, TLSConfig{CACert: caPath,
+		ClientCert: certPath, ClientKey: keyPath})
+	require.Nil(t, err, "loading certificates")
+	assert.Nil(t, tlsApi.CreatePrincipal("p1"), "mutual TLS")
+
+	noClientCert, err := NewOpenstackTLSMetadataAPI(addr,
+		TLSConfig{CACert: caPath})
+	require.Nil(t, err, "loading certificates")
+	assert.NotNil(t, noClientCert.CreatePrincipal("p1"), "client not trusted")
+
+	otherCA := newTestCert(t, "other", nil)
+	otherPath, _ := otherCA.write(t, dir, "other")
+	wrongCA, err := NewOpenstackTLSMetadataAPI(addr, TLSConfig{
+		CACert: otherPath, ClientCert: certPath, ClientKey: keyPath})
+	require.Nil(t, err, "loading certificates")
+	assert.NotNil(t, wrongCA.CreatePrincipal("p1"), "server not trusted")
+
+	_, err = NewOpenstackTLSMetadataAPI(addr, TLSConfig{
+		CACert: filepath.Join(dir, "missing.pem")})
+	assert.NotNil(t, err, "missing certificate")
+}
+
+func TestCertificateRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tapcon-tls")
+	require.Nil(t, err, "temp dir")
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", nil)
+	server := newTLSServer(newTestCert(t, "server", ca), ca)
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "https://")
+	caPath, _ := ca.write(t, dir, "ca")
+	// a client certificate the server doesn't trust
+	untrusted := newTestCert(t, "untrusted", nil)
+	certPath, keyPath := newTestCert(t, "client", untrusted).write(t, dir,
+		"client")
+
+	tlsApi, err := NewOpenstackTLSMetadataAPI(addr, TLSConfig{CACert: caPath,
+		ClientCert: certPath, ClientKey: keyPath})
+	require.Nil(t, err, "loading certificates")
+	assert.NotNil(t, tlsApi.CreatePrincipal("p1"), "client not trusted")
+
+	newTestCert(t, "client", ca).write(t, dir, "client")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certPath, later, later)
+	os.Chtimes(keyPath, later, later)
+	assert.Nil(t, tlsApi.CreatePrincipal("p1"), "rotated certificate")
+}
@@ -1,7 +1,6 @@
 package statement
 
 import (
-	"fmt"
 	"log"
 )
 
@@ -28,8 +27,22 @@ type IpAlias struct {
 }
 
 type ProtocolPorts struct {
-	Tcp [][2]int `json:"tcp"`
-	Udp [][2]int `json:"udp"`
+	Tcp  [][2]int `json:"tcp"`
+	Udp  [][2]int `json:"udp"`
+	Sctp [][2]int `json:"sctp,omitempty"`
+}
+
+// Protocol gives the ranges of the protocol, nil if it is not supported.
+func (p *ProtocolPorts) Protocol(protocol string) *[][2]int {
+	switch protocol {
+	case "tcp":
+		return &p.Tcp
+	case "udp":
+		return &p.Udp
+	case "sctp":
+		return &p.Sctp
+	}
+	return nil
 }
 
 type PortAlias struct {
@@ -66,74 +79,52 @@ func NewPrincipal() *Principal {
 func (p *Principal) FindPortAlias(ns, ip, protocol string,
 	portMin, portMax int) (int, int) {
 
-	if protocol == "tcp" {
-		for i, alias := range p.Aliases.Ports {
-			if alias.NsName != ns || alias.Ip != ip {
-				continue
-			}
-			for j, tcpPorts := range alias.Ports.Tcp {
-				if tcpPorts[0] == portMin && tcpPorts[1] == portMax {
-					return i, j
-				}
-			}
-			return i, -1
+	if (&ProtocolPorts{}).Protocol(protocol) == nil {
+		log.Printf("unsupported protocol %s\n", protocol)
+		return -1, -1
+	}
+	for i, alias := range p.Aliases.Ports {
+		if alias.NsName != ns || alias.Ip != ip {
+			continue
 		}
-	} else if protocol == "udp" {
-		for i, alias := range p.Aliases.Ports {
-			if alias.NsName != ns || alias.Ip != ip {
-				continue
-			}
-			for j, udpPorts := range alias.Ports.Udp {
-				if udpPorts[0] == portMin && udpPorts[1] == portMax {
-					return i, j
-				}
+		for j, ports := range *alias.Ports.Protocol(protocol) {
+			if ports[0] == portMin && ports[1] == portMax {
+				return i, j
 			}
-			return i, -1
 		}
-	} else {
-		log.Printf("unsupported protocol %s\n", protocol)
+		return i, -1
 	}
 	return -1, -1
 
 }
 
 func NewPortAlias(ns, ip, protocol string, portMin, portMax int) PortAlias {
-	if protocol == "tcp" {
-		return PortAlias{
-			NsName: ns,
-			Ip:     ip,
-			Ports: ProtocolPorts{
-				Tcp: [][2]int{[2]int{portMin, portMax}},
-				Udp: [][2]int{},
-			},
-		}
-	} else {
-		return PortAlias{
-			NsName: ns,
-			Ip:     ip,
-			Ports: ProtocolPorts{
-				Udp: [][2]int{[2]int{portMin, portMax}},
-				Tcp: [][2]int{},
-			},
-		}
+	alias := PortAlias{
+		NsName: ns,
+		Ip:     ip,
+		Ports: ProtocolPorts{
+			Tcp: [][2]int{},
+			Udp: [][2]int{},
+		},
 	}
+	ranges := alias.Ports.Protocol(protocol)
+	if ranges == nil {
+		ranges = &alias.Ports.Udp
+	}
+	*ranges = append(*ranges, [2]int{portMin, portMax})
+	return alias
 }
 
 func (p *Principal) AddPortAlias(ns, ip, protocol string,
 	portMin, portMax int) error {
 	i, j := p.FindPortAlias(ns, ip, protocol, portMin, portMax)
 	if j != -1 {
-		return fmt.Errorf("port alias %s %s %s %d %d existed", ns, ip, protocol,
+		return alreadyExists("port alias %s %s %s %d %d existed", ns, ip, protocol,
 			portMin, portMax)
 	}
 	if i != -1 {
-		if protocol == "tcp" {
-			p.Aliases.Ports[i].Ports.Tcp = append(p.Aliases.Ports[i].Ports.Tcp,
-				[2]int{portMin, portMax})
-		} else if protocol == "udp" {
-			p.Aliases.Ports[i].Ports.Udp = append(p.Aliases.Ports[i].Ports.Udp,
-				[2]int{portMin, portMax})
-		}
+		ranges := p.Aliases.Ports[i].Ports.Protocol(protocol)
+		*ranges = append(*ranges, [2]int{portMin, portMax})
 	} else {
 		p.Aliases.Ports = append(p.Aliases.Ports, NewPortAlias(ns, ip, protocol,
 			portMin, portMax))
@@ -146,16 +137,11 @@ func (p *Principal) DelPortAlias(ns, ip, protocol string,
 	portMin, portMax int) error {
 	i, j := p.FindPortAlias(ns, ip, protocol, portMin, portMax)
 	if j == -1 {
-		return fmt.Errorf("port alias %s %s %s %d %d not found", ns, ip, protocol,
+		return notFound("port alias %s %s %s %d %d not found", ns, ip, protocol,
 			portMin, portMax)
 	}
 
-	if protocol == "tcp" {
-		ptr := &p.Aliases.Ports[i].Ports.Tcp
-		*ptr = append((*ptr)[0:j], (*ptr)[j+1:]...)
-	} else {
-		ptr := &p.Aliases.Ports[i].Ports.Udp
-		*ptr = append((*ptr)[0:j], (*ptr)[j+1:]...)
-	}
+	ptr := p.Aliases.Ports[i].Ports.Protocol(protocol)
+	*ptr = append((*ptr)[0:j], (*ptr)[j+1:]...)
 	return nil
 }
@@ -0,0 +1,232 @@
+package statement
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+/// Version 2 of the wire protocol: resources under kV2 with proper verbs,
+// parameters in JSON bodies and JSON answers. Servers advertise CapV2, the
+// client uses version 1 with the others.
+//
+//   GET          /v2/self                              MyId, MyNs
+//   POST         /v2/self/proofs                       SelfCertify
+//   GET          /v2/principals                        ListPrincipals
+//   GET|PUT|DELETE /v2/principals/<name>               Show, Create, Delete
+//   PUT|DELETE   /v2/principals/<name>/ip_aliases      v2IpAlias
+//   PUT|DELETE   /v2/principals/<name>/port_aliases    v2PortAlias
+//   POST         /v2/principals/<name>/proofs          PostProof
+//   POST|DELETE  /v2/principals/<name>/child_proofs    Post/RemoveProofForChild
+//   POST         /v2/principals/<name>/links           LinkProof
+//   POST|DELETE  /v2/principals/<name>/child_links     Link/UnlinkProofForChild
+//   PUT|DELETE   /v2/namespaces/<ns>                   CreateNs, DeleteNs
+//   PUT|DELETE   /v2/namespaces/<ns>/membership        JoinNs, LeaveNs
+//   GET|POST|DELETE /v2/namespaces/<ns>/proofs         List/Post/RemoveNsProof
+//
+// Images are still uploaded and batches still sent the version 1 way, the
+// former has the image as body and the latter is JSON already.
+
+const (
+	// capability advertised by servers speaking version 2
+	CapV2 = "v2"
+
+	ProtocolAuto = 0 // version 2 if the server advertises it
+	ProtocolV1   = 1
+	ProtocolV2   = 2
+
+	// while the capabilities are unknown the server is asked again after
+	// a delay doubling from the min to the max, version 1 spoken meanwhile
+	CapProbeMinDelay = time.Second
+	CapProbeMaxDelay = time.Minute
+
+	kV2           = "/v2"
+	kV2Self       = kV2 + "/self"
+	kV2Principals = kV2 + "/principals"
+	kV2Namespaces = kV2 + "/namespaces"
+
+	v2IpAliases   = "ip_aliases"
+	v2PortAliases = "port_aliases"
+	v2Proofs      = "proofs"
+	v2ChildProofs = "child_proofs"
+	v2Links       = "links"
+	v2ChildLinks  = "child_links"
+	v2Membership  = "membership"
+)
+
+type v2Self struct {
+	Principal string `json:"principal"`
+	NsName    string `json:"ns_name"`
+}
+
+type v2IpAlias struct {
+	NsName string `json:"ns_name"`
+	Ip     string `json:"ip"`
+}
+
+type v2PortAlias struct {
+	NsName   string `json:"ns_name"`
+	Ip       string `json:"ip"`
+	Protocol string `json:"protocol"`
+	PortMin  int    `json:"port_min"`
+	PortMax  int    `json:"port_max"`
+}
+
+type v2Proof struct {
+	Statements   []Statement `json:"statements,omitempty"`
+	Dependencies []string    `json:"dependencies,omitempty"`
+}
+
+// v2Result answers the mutations, and is the body of all errors.
+type v2Result struct {
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+func principalPath(name string, sub string) string {
+	path := kV2Principals + "/" + url.PathEscape(name)
+	if sub != "" {
+		path += "/" + sub
+	}
+	return path
+}
+
+func namespacePath(ns string, sub string) string {
+	path := kV2Namespaces + "/" + url.PathEscape(ns)
+	if sub != "" {
+		path += "/" + sub
+	}
+	return path
+}
+
+// SetProtocolVersion forces a version of the wire protocol, ProtocolAuto
+// negotiates it with the server.
+func (api *Api) SetProtocolVersion(version int) {
+	api.version = version
+}
+
+// v2 tells whether to speak version 2 with the server.
+func (api *Api) v2(ctx context.Context) bool {
+	switch api.version {
+	case ProtocolV1:
+		return false
+	case ProtocolV2:
+		return true
+	}
+	return api.Supports(ctx, CapV2)
+}
+
+func (api *Api) DoV2(ctx context.Context, method, path string,
+	body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		buf := bytes.NewBuffer(make([]byte, 0))
+		if err := json.NewEncoder(buf).Encode(body); err != nil {
+			log.Errorf("encoding request body: %v", err)
+			return nil, err
+		}
+		reader = buf
+	}
+	req, err := http.NewRequest(method, api.GetAPI(api.scheme, path), reader)
+	if err != nil {
+		log.Errorf("constructing request: %v", err)
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	log.Debugf("meta api: %s %s", method, req.URL.String())
+	return api.do(req)
+}
+
+func successful(resp *http.Response) bool {
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
+
+// v2Error reads the error of a failed response.
+func v2Error(resp *http.Response) error {
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return unavailable(err)
+	}
+	var result v2Result
+	if err := json.Unmarshal(data, &result); err == nil && result.Error != "" {
+		return NewApiError(resp.StatusCode, result.Error)
+	}
+	return NewApiError(resp.StatusCode, string(data))
+}
+
+// v2Ok checks the answer to a mutation.
+func v2Ok(resp *http.Response) error {
+	defer resp.Body.Close()
+	if !successful(resp) {
+		return v2Error(resp)
+	}
+	var result v2Result
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		if err == io.EOF {
+			/// nothing to say but the status
+			return nil
+		}
+		return err
+	}
+	if !result.Ok {
+		return NewApiError(resp.StatusCode, result.Error)
+	}
+	return nil
+}
+
+func v2Decode(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	if !successful(resp) {
+		return v2Error(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (api *Api) mutateV2(ctx context.Context, method, path string,
+	body interface{}) error {
+	resp, err := api.DoV2(ctx, method, path, body)
+	if err != nil {
+		log.Errorf("%s %s: %v", method, path, err)
+		return err
+	}
+	return v2Ok(resp)
+}
+
+func (api *Api) getV2(ctx context.Context, path string, v interface{}) error {
+	resp, err := api.DoV2(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		log.Errorf("GET %s: %v", path, err)
+		return err
+	}
+	return v2Decode(resp, v)
+}
+
+func (api *Api) selfV2(ctx context.Context) (*v2Self, error) {
+	var self v2Self
+	if err := api.getV2(ctx, kV2Self, &self); err != nil {
+		return nil, err
+	}
+	return &self, nil
+}
+
+func ipAliasV2(ns string, ip net.IP) *v2IpAlias {
+	return &v2IpAlias{NsName: ns, Ip: ip.String()}
+}
+
+func portAliasV2(ns string, ip net.IP, protocol string,
+	portMin, portMax int) *v2PortAlias {
+	return &v2PortAlias{NsName: ns, Ip: ip.String(), Protocol: protocol,
+		PortMin: portMin, PortMax: portMax}
+}
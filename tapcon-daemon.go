@@ -40,9 +40,16 @@ func main() {
 	sigchan := make(chan os.Signal)
 	signal.Notify(sigchan, syscall.SIGUSR1, syscall.SIGUSR2)
 
+	stopchan := make(chan os.Signal, 1)
+	signal.Notify(stopchan, syscall.SIGINT, syscall.SIGTERM)
+
 	done := make(chan bool)
 	go func() {
 		monitor.WorkAndWait(sigchan)
+		done <- true
 	}()
+	<-stopchan
+	/// cancel the metadata calls in flight rather than waiting for them
+	monitor.Shutdown()
 	<-done
 }
@@ -0,0 +1,72 @@
+package main
+
+/// Fake metadata server for local development, keeping everything in memory
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	metadata "github.com/jerryz920/tapcon-monitor/statement"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:19851", "address to listen on")
+	id := flag.String("id", "fake-vm", "principal name of the VM")
+	ns := flag.String("ns", "fake-ns", "IaaS namespace of the VM")
+	localIp := flag.String("local-ip", "192.168.0.1", "local IPv4 of the VM")
+	publicIp := flag.String("public-ip", "166.111.68.162", "public IPv4 of the VM")
+	noBatch := flag.Bool("no-batch", false, "answer like servers without batch")
+	v1 := flag.Bool("v1", false, "answer like servers without version 2")
+	imds := flag.String("imds", metadata.ImdsOptional,
+		"IMDSv2 session tokens: v1, optional or required")
+	keyId := flag.String("key-id", "", "require requests signed by this key")
+	secret := flag.String("hmac-secret", "", "file with the HMAC secret of key-id")
+	endpoint := flag.String("fault-endpoint", "",
+		"endpoint to inject faults into, e.g. /create_principal, all if empty")
+	latency := flag.Duration("latency", 0, "delay of every call")
+	errorRate := flag.Float64("error-rate", 0, "fraction of calls failing")
+	errorStatus := flag.Int("error-status", http.StatusServiceUnavailable,
+		"status of failing calls")
+	dropRate := flag.Float64("drop-rate", 0,
+		"fraction of calls closed without an answer")
+	flag.Parse()
+
+	fake := metadata.NewFakeServer()
+	fake.Id = *id
+	fake.Ns = *ns
+	fake.LocalIp = *localIp
+	fake.PublicIp = *publicIp
+	fake.Imds = *imds
+	if *noBatch {
+		fake.Capabilities = nil
+	} else if *v1 {
+		fake.Capabilities = []string{metadata.CapBatch}
+	}
+	if *keyId != "" {
+		data, err := ioutil.ReadFile(*secret)
+		if err != nil {
+			log.Fatalf("reading hmac secret: %v", err)
+		}
+		fake.Verifier = metadata.NewSignatureVerifier(metadata.DefaultMaxSkew)
+		fake.Verifier.AddHMACKey(*keyId,
+			[]byte(strings.TrimSpace(string(data))))
+	}
+	fake.SetFault(*endpoint, metadata.Fault{
+		Latency:     *latency,
+		ErrorRate:   *errorRate,
+		ErrorStatus: *errorStatus,
+		DropRate:    *dropRate,
+	})
+
+	server := &http.Server{
+		Addr:        *addr,
+		Handler:     fake,
+		ReadTimeout: time.Minute,
+	}
+	log.Printf("fake metadata server listening on %s\n", *addr)
+	log.Fatal(server.ListenAndServe())
+}